@@ -33,7 +33,7 @@ type acmeClient struct {
 	caURL      string
 	mgr        *ACMEManager
 	acmeClient *lego.Client
-	challenges []challenge.Type
+	challenges []challenge.Type // if non-nil, only these challenges may be used
 }
 
 // newACMEClientWithRetry is the same as newACMEClient, but with automatic retry capabilities.
@@ -199,6 +199,26 @@ func (client *acmeClient) initialChallenges() []challenge.Type {
 	return chal
 }
 
+// permittedChallenges returns the initial set of challenges,
+// restricted to client.challenges if that has been set (for
+// example, by CAA validationmethods parameters).
+func (client *acmeClient) permittedChallenges() []challenge.Type {
+	initial := client.initialChallenges()
+	if client.challenges == nil {
+		return initial
+	}
+	var chal []challenge.Type
+	for _, c := range initial {
+		for _, permitted := range client.challenges {
+			if c == permitted {
+				chal = append(chal, c)
+				break
+			}
+		}
+	}
+	return chal
+}
+
 // nextChallenge chooses a challenge randomly from the given list of available challenges
 // and configures client.acmeClient to use that challenge according to client.config.
 // It pops the chosen challenge from the list and returns that challenge along with the new list without that challenge.
@@ -229,6 +249,11 @@ func (client *acmeClient) nextChallenge(available []challenge.Type) (challenge.T
 
 	switch randomChallenge {
 	case challenge.HTTP01:
+		if client.mgr.HTTPProvider != nil {
+			client.acmeClient.Challenge.SetHTTP01Provider(client.mgr.HTTPProvider)
+			break
+		}
+
 		useHTTPPort := HTTPChallengePort
 		if HTTPPort > 0 && HTTPPort != HTTPChallengePort {
 			useHTTPPort = HTTPPort
@@ -265,11 +290,7 @@ func (client *acmeClient) nextChallenge(available []challenge.Type) (challenge.T
 		})
 
 	case challenge.DNS01:
-		if client.mgr.DNSChallengeOption != nil {
-			client.acmeClient.Challenge.SetDNS01Provider(client.mgr.DNSProvider, client.mgr.DNSChallengeOption)
-		} else {
-			client.acmeClient.Challenge.SetDNS01Provider(client.mgr.DNSProvider)
-		}
+		client.acmeClient.Challenge.SetDNS01Provider(client.mgr.DNSProvider, client.mgr.dnsChallengeOptions()...)
 	}
 
 	return randomChallenge, available
@@ -0,0 +1,252 @@
+package otomatik
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/miekg/dns"
+)
+
+// ACMEDNSProvider solves the DNS-01 challenge using a server that
+// speaks the acme-dns API (https://github.com/joohoi/acme-dns). Each
+// domain is registered with the server once; the resulting account
+// credentials are kept in Storage, and the domain's _acme-challenge
+// name must then be delegated with a CNAME record to the full domain
+// of its account. This way, only the acme-dns server needs to be able
+// to change DNS records, and only for its own validation zone.
+type ACMEDNSProvider struct {
+	// The base URL of the acme-dns API - REQUIRED.
+	Server string
+
+	// Where to keep account credentials; if nil,
+	// Default.Storage is used.
+	Storage Storage
+
+	// Networks (in CIDR notation) from which updates to newly
+	// registered accounts are allowed; if empty, any network.
+	AllowFrom []string
+
+	// The HTTP client to use; if nil, a client with
+	// HTTPTimeout as its timeout is used.
+	HTTPClient *http.Client
+
+	// The recursive DNS resolvers (host:port) to use when
+	// verifying CNAME delegations; if empty, the system's are used.
+	Resolvers []string
+
+	// How long to wait for records to propagate, and how
+	// often to check; if unset, lego's defaults are used.
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+}
+
+// ACMEDNSAccount holds the credentials for one registration
+// with an acme-dns server.
+type ACMEDNSAccount struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	FullDomain string   `json:"fulldomain"`
+	SubDomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom,omitempty"`
+}
+
+// Present updates the TXT record of the acme-dns account for domain,
+// registering a new account first if there is none. If domain's
+// _acme-challenge name is not delegated to the account's full domain,
+// an error explaining the CNAME record to create is returned.
+func (p *ACMEDNSProvider) Present(domain, token, keyAuth string) error {
+	account, err := p.Account(domain)
+	if err != nil {
+		return err
+	}
+	if err := p.checkDelegation(domain, account); err != nil {
+		return err
+	}
+	_, value := dns01.GetRecord(domain, keyAuth)
+	return p.update(account, value)
+}
+
+// CleanUp is a no-op, since acme-dns keeps only the
+// most recent TXT records of each account anyway.
+func (p *ACMEDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+// ChallengeRecordName returns the full domain of the account
+// for domain, which is where acme-dns publishes the record.
+func (p *ACMEDNSProvider) ChallengeRecordName(domain string) (string, error) {
+	account, err := p.loadAccount(domain)
+	if err != nil {
+		return "", err
+	}
+	return dns.Fqdn(account.FullDomain), nil
+}
+
+// Timeout returns the propagation timeout and polling interval.
+func (p *ACMEDNSProvider) Timeout() (timeout, interval time.Duration) {
+	return propagationTimeout(p.PropagationTimeout, p.PollingInterval)
+}
+
+// Account returns the acme-dns account for domain, registering
+// and storing a new one if it does not exist yet. Registering
+// ahead of time lets the CNAME record be created before the
+// first certificate is requested.
+func (p *ACMEDNSProvider) Account(domain string) (ACMEDNSAccount, error) {
+	account, err := p.loadAccount(domain)
+	if err == nil {
+		return account, nil
+	}
+	if _, ok := err.(ErrNotExist); !ok {
+		return ACMEDNSAccount{}, err
+	}
+
+	account, err = p.register()
+	if err != nil {
+		return ACMEDNSAccount{}, fmt.Errorf("registering %s with acme-dns server: %v", domain, err)
+	}
+	accountBytes, err := json.MarshalIndent(account, "", "\t")
+	if err != nil {
+		return ACMEDNSAccount{}, err
+	}
+	err = p.storage().Store(p.storageKeyAccount(domain), accountBytes)
+	if err != nil {
+		return ACMEDNSAccount{}, fmt.Errorf("storing acme-dns account for %s: %v", domain, err)
+	}
+	log.Printf("[INFO][%s] Registered with acme-dns server %s; create this DNS record: %s CNAME %s",
+		domain, p.Server, challengeRecordName(domain), dns.Fqdn(account.FullDomain))
+
+	return account, nil
+}
+
+func (p *ACMEDNSProvider) loadAccount(domain string) (ACMEDNSAccount, error) {
+	var account ACMEDNSAccount
+	accountBytes, err := p.storage().Load(p.storageKeyAccount(domain))
+	if err != nil {
+		return account, err
+	}
+	err = json.Unmarshal(accountBytes, &account)
+	if err != nil {
+		return account, fmt.Errorf("decoding acme-dns account for %s: %v", domain, err)
+	}
+	return account, nil
+}
+
+// checkDelegation ensures that the _acme-challenge name of
+// domain leads to the full domain of account.
+func (p *ACMEDNSProvider) checkDelegation(domain string, account ACMEDNSAccount) error {
+	target, err := followCNAMEs(challengeRecordName(domain), p.Resolvers)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(target, dns.Fqdn(account.FullDomain)) {
+		return fmt.Errorf("%s is not delegated to acme-dns; create this DNS record: %s CNAME %s",
+			domain, challengeRecordName(domain), dns.Fqdn(account.FullDomain))
+	}
+	return nil
+}
+
+func (p *ACMEDNSProvider) register() (ACMEDNSAccount, error) {
+	var account ACMEDNSAccount
+	var body io.Reader
+	if len(p.AllowFrom) > 0 {
+		reqBody, err := json.Marshal(map[string][]string{"allowfrom": p.AllowFrom})
+		if err != nil {
+			return account, err
+		}
+		body = bytes.NewReader(reqBody)
+	}
+	err := p.do("/register", nil, body, http.StatusCreated, &account)
+	if err != nil {
+		return account, err
+	}
+	if account.Username == "" || account.Password == "" || account.FullDomain == "" || account.SubDomain == "" {
+		return account, fmt.Errorf("incomplete registration returned by server")
+	}
+	return account, nil
+}
+
+func (p *ACMEDNSProvider) update(account ACMEDNSAccount, value string) error {
+	reqBody, err := json.Marshal(map[string]string{
+		"subdomain": account.SubDomain,
+		"txt":       value,
+	})
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{
+		"X-Api-User": account.Username,
+		"X-Api-Key":  account.Password,
+	}
+	err = p.do("/update", headers, bytes.NewReader(reqBody), http.StatusOK, nil)
+	if err != nil {
+		return fmt.Errorf("updating acme-dns TXT record for %s: %v", account.FullDomain, err)
+	}
+	return nil
+}
+
+// do POSTs body to endpoint on the acme-dns server and decodes the
+// JSON response into result, if not nil. Any response status other
+// than expectStatus is an error.
+func (p *ACMEDNSProvider) do(endpoint string, headers map[string]string, body io.Reader, expectStatus int, result interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(p.Server, "/")+endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", buildUAString())
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := p.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: HTTPTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectStatus {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(result)
+}
+
+func (p *ACMEDNSProvider) storage() Storage {
+	if p.Storage != nil {
+		return p.Storage
+	}
+	return Default.Storage
+}
+
+// storageKeyAccount returns the storage key of the
+// account for domain with p's server.
+func (p *ACMEDNSProvider) storageKeyAccount(domain string) string {
+	server := p.Server
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		server = u.Host
+	}
+	return path.Join(prefixACMEDNS, StorageKeys.Safe(server), StorageKeys.Safe(domain)+".json")
+}
+
+// prefixACMEDNS is the storage key prefix for acme-dns accounts.
+const prefixACMEDNS = "acme_dns"
+
+// Interface guard
+var _ DNSChallengeDelegator = (*ACMEDNSProvider)(nil)
@@ -0,0 +1,215 @@
+package otomatik
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/miekg/dns"
+)
+
+// testACMEDNSServer is a local stand-in for an acme-dns server.
+type testACMEDNSServer struct {
+	zone     string
+	mu       sync.Mutex
+	accounts map[string]ACMEDNSAccount // keyed by username
+	txt      map[string]string         // keyed by subdomain
+}
+
+func newTestACMEDNSServer(zone string) *testACMEDNSServer {
+	return &testACMEDNSServer{
+		zone:     zone,
+		accounts: make(map[string]ACMEDNSAccount),
+		txt:      make(map[string]string),
+	}
+}
+
+func (s *testACMEDNSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/register":
+		var req struct {
+			AllowFrom []string `json:"allowfrom"`
+		}
+		if r.ContentLength > 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, `{"error": "malformed_json_payload"}`, http.StatusBadRequest)
+				return
+			}
+		}
+		n := len(s.accounts) + 1
+		sub := fmt.Sprintf("sub%d", n)
+		acct := ACMEDNSAccount{
+			Username:   fmt.Sprintf("user%d", n),
+			Password:   fmt.Sprintf("pass%d", n),
+			SubDomain:  sub,
+			FullDomain: sub + "." + s.zone,
+			AllowFrom:  req.AllowFrom,
+		}
+		s.accounts[acct.Username] = acct
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(acct)
+	case "/update":
+		acct, ok := s.accounts[r.Header.Get("X-Api-User")]
+		if !ok || acct.Password != r.Header.Get("X-Api-Key") {
+			http.Error(w, `{"error": "forbidden"}`, http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			SubDomain string `json:"subdomain"`
+			TXT       string `json:"txt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SubDomain != acct.SubDomain || len(req.TXT) != 43 {
+			http.Error(w, `{"error": "bad_request"}`, http.StatusBadRequest)
+			return
+		}
+		s.txt[req.SubDomain] = req.TXT
+		json.NewEncoder(w).Encode(map[string]string{"txt": req.TXT})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// cnameHandler returns a DNS handler which answers CNAME queries from cnames.
+func cnameHandler(mu *sync.Mutex, cnames map[string]string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		mu.Lock()
+		target, ok := cnames[strings.ToLower(q.Name)]
+		mu.Unlock()
+		if ok && q.Qtype == dns.TypeCNAME {
+			m.Answer = append(m.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: target,
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestACMEDNSProvider(t *testing.T) {
+	storage := &FileStorage{Path: "./_testdata_tmp"}
+	defer os.RemoveAll(storage.Path)
+
+	acmeDNS := newTestACMEDNSServer("auth.example.net.")
+	srv := httptest.NewServer(acmeDNS)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	cnames := make(map[string]string)
+	resolver, stop := startTestDNSServer(t, cnameHandler(&mu, cnames))
+	defer stop()
+
+	provider := &ACMEDNSProvider{
+		Server:    srv.URL,
+		Storage:   storage,
+		AllowFrom: []string{"192.0.2.0/24"},
+		Resolvers: []string{resolver},
+	}
+
+	// first attempt registers, but fails because there is no CNAME yet
+	err := provider.Present("example.com", "token", "keyauth")
+	if err == nil || !strings.Contains(err.Error(), "CNAME sub1.auth.example.net.") {
+		t.Fatalf("Expected error instructing to create CNAME, got: %v", err)
+	}
+	account, err := provider.loadAccount("example.com")
+	if err != nil {
+		t.Fatalf("Expected account to be stored, got error: %v", err)
+	}
+	if account.Username != "user1" || account.FullDomain != "sub1.auth.example.net." {
+		t.Errorf("Unexpected stored account: %+v", account)
+	}
+	if len(account.AllowFrom) != 1 || account.AllowFrom[0] != "192.0.2.0/24" {
+		t.Errorf("Expected AllowFrom to be sent with registration, got: %v", account.AllowFrom)
+	}
+
+	// once delegated, the existing account is used to update the record
+	mu.Lock()
+	cnames["_acme-challenge.example.com."] = "sub1.auth.example.net."
+	mu.Unlock()
+	err = provider.Present("example.com", "token", "keyauth")
+	if err != nil {
+		t.Fatalf("Expected no error presenting, got: %v", err)
+	}
+	_, expectedValue := dns01.GetRecord("example.com", "keyauth")
+	if actual := acmeDNS.txt["sub1"]; actual != expectedValue {
+		t.Errorf("Expected TXT value '%s', got '%s'", expectedValue, actual)
+	}
+	if len(acmeDNS.accounts) != 1 {
+		t.Errorf("Expected exactly one registration, got %d", len(acmeDNS.accounts))
+	}
+
+	name, err := provider.ChallengeRecordName("example.com")
+	if err != nil || name != "sub1.auth.example.net." {
+		t.Errorf("Expected challenge record name 'sub1.auth.example.net.', got '%s' (error: %v)", name, err)
+	}
+}
+
+type testTXTProvider struct {
+	records map[string]string
+}
+
+func (p *testTXTProvider) PresentTXT(fqdn, value string) error {
+	p.records[fqdn] = value
+	return nil
+}
+
+func (p *testTXTProvider) CleanUpTXT(fqdn, value string) error {
+	if p.records[fqdn] != value {
+		return fmt.Errorf("no record with value %s at %s", value, fqdn)
+	}
+	delete(p.records, fqdn)
+	return nil
+}
+
+func TestDelegatedDNSProvider(t *testing.T) {
+	var mu sync.Mutex
+	cnames := map[string]string{
+		"_acme-challenge.example.com.":        "example.com.validation.example.net.",
+		"example.com.validation.example.net.": "final.validation.example.net.",
+		"_acme-challenge.loop.example.":       "a.loop.example.",
+		"a.loop.example.":                     "_acme-challenge.loop.example.",
+	}
+	resolver, stop := startTestDNSServer(t, cnameHandler(&mu, cnames))
+	defer stop()
+
+	txt := &testTXTProvider{records: make(map[string]string)}
+	provider := &DelegatedDNSProvider{Provider: txt, Resolvers: []string{resolver}}
+
+	err := provider.Present("example.com", "token", "keyauth")
+	if err != nil {
+		t.Fatalf("Expected no error presenting, got: %v", err)
+	}
+	_, expectedValue := dns01.GetRecord("example.com", "keyauth")
+	if actual := txt.records["final.validation.example.net."]; actual != expectedValue {
+		t.Errorf("Expected record at end of CNAME chain with value '%s', got: %v", expectedValue, txt.records)
+	}
+	if err := provider.CleanUp("example.com", "token", "keyauth"); err != nil {
+		t.Errorf("Expected no error cleaning up, got: %v", err)
+	}
+
+	// names without delegation use the usual record name
+	if err := provider.Present("*.other.example", "token", "keyauth"); err != nil {
+		t.Fatalf("Expected no error presenting, got: %v", err)
+	}
+	if _, ok := txt.records["_acme-challenge.other.example."]; !ok {
+		t.Errorf("Expected undelegated record at usual name, got: %v", txt.records)
+	}
+
+	if _, err := provider.ChallengeRecordName("loop.example"); err == nil {
+		t.Error("Expected error for CNAME loop, but got none")
+	}
+}
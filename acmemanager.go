@@ -55,12 +55,30 @@ type ACMEManager struct {
 	// the system must forward TLSALPNChallengePort to this port for challenge to succeed
 	AltTLSALPNPort int
 
-	// The DNS provider to use when solving the ACME DNS challenge
+	// The provider to use when solving the ACME HTTP challenge, instead of the
+	// built-in challenge server; useful when challenge responses must be served
+	// by another system, such as a load balancer (see ExecSolver and WebhookSolver)
+	HTTPProvider challenge.Provider
+
+	// The DNS provider to use when solving the ACME DNS challenge;
+	// if it is a DNSChallengeDelegator, propagation is checked at the delegated record name
 	DNSProvider challenge.Provider
 
 	// The ChallengeOption struct to provide custom precheck or name resolution options for DNS challenge validation and execution
 	DNSChallengeOption dns01.ChallengeOption
 
+	// If true, the DNS CAA records of each name are checked before a certificate
+	// is requested, and issuance is refused if they do not authorize the CA and account
+	CheckCAA bool
+
+	// The issuer domain names that identify the CA in CAA records (e.g. "letsencrypt.org");
+	// if empty, the CAA identities advertised in the CA's directory are used
+	CAAIdentities []string
+
+	// The recursive DNS resolvers (host:port) to use for CAA lookups;
+	// if empty, the system's resolvers are used
+	CAAResolvers []string
+
 	// TrustedRoots specifies a pool of root CA certificates to trust when communicating over a network to a peer.
 	TrustedRoots *x509.CertPool
 
@@ -108,12 +126,24 @@ func NewACMEManager(cfg *Config, template ACMEManager) *ACMEManager {
 	if template.AltTLSALPNPort == 0 {
 		template.AltTLSALPNPort = DefaultACME.AltTLSALPNPort
 	}
+	if template.HTTPProvider == nil {
+		template.HTTPProvider = DefaultACME.HTTPProvider
+	}
 	if template.DNSProvider == nil {
 		template.DNSProvider = DefaultACME.DNSProvider
 	}
 	if template.DNSChallengeOption == nil {
 		template.DNSChallengeOption = DefaultACME.DNSChallengeOption
 	}
+	if !template.CheckCAA {
+		template.CheckCAA = DefaultACME.CheckCAA
+	}
+	if len(template.CAAIdentities) == 0 {
+		template.CAAIdentities = DefaultACME.CAAIdentities
+	}
+	if len(template.CAAResolvers) == 0 {
+		template.CAAResolvers = DefaultACME.CAAResolvers
+	}
 	if template.TrustedRoots == nil {
 		template.TrustedRoots = DefaultACME.TrustedRoots
 	}
@@ -241,6 +271,12 @@ func (manager *ACMEManager) doIssue(ctx context.Context, csr *x509.CertificateRe
 
 	nameSet := namesFromCSR(csr)
 
+	if manager.CheckCAA {
+		if err := client.checkCAA(nameSet); err != nil {
+			return nil, usingTestCA, err
+		}
+	}
+
 	if !useTestCA {
 		if err := client.throttle(ctx, nameSet); err != nil {
 			return nil, usingTestCA, err
@@ -261,8 +297,8 @@ func (manager *ACMEManager) doIssue(ctx context.Context, csr *x509.CertificateRe
 }
 
 func (client *acmeClient) tryAllEnabledChallenges(ctx context.Context, csr *x509.CertificateRequest) (*certificate.Resource, error) {
-	// start with all enabled challenges
-	challenges := client.initialChallenges()
+	// start with all enabled (and permitted) challenges
+	challenges := client.permittedChallenges()
 	if len(challenges) == 0 {
 		return nil, fmt.Errorf("no challenge types enabled")
 	}
@@ -0,0 +1,324 @@
+package otomatik
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v3/acme"
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/miekg/dns"
+)
+
+// CAAChecker checks whether the DNS CAA records of a name authorize
+// a CA to issue a certificate for it, following the processing rules
+// of RFC 8659, including the accounturi and validationmethods
+// parameters defined by RFC 8657. An empty CAAChecker is not useful;
+// at least IssuerDomainNames must be set.
+type CAAChecker struct {
+	// The issuer domain names by which the CA identifies itself
+	// in CAA records, for example "letsencrypt.org"
+	IssuerDomainNames []string
+
+	// The URI of the ACME account that will request the certificate;
+	// records with an accounturi parameter only authorize this account
+	AccountURI string
+
+	// The validation methods (ACME challenge types such as "http-01")
+	// that may be used to prove control of the names; if empty, any
+	// restriction by a validationmethods parameter fails the check
+	ValidationMethods []string
+
+	// The recursive DNS servers (host:port) to query;
+	// if empty, the system's resolvers are used
+	Resolvers []string
+
+	// How long to wait for each DNS response
+	Timeout time.Duration
+}
+
+// Check walks the CAA tree for name and returns the validation methods,
+// out of checker.ValidationMethods, that are permitted for name. If the
+// CAA records of name do not authorize issuance at all, a CAAError is
+// returned. Names that are IP addresses are not subject to CAA and are
+// always permitted.
+func (checker CAAChecker) Check(name string) ([]string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if net.ParseIP(name) != nil {
+		return checker.ValidationMethods, nil
+	}
+	wildcard := strings.HasPrefix(name, "*.")
+	domain := strings.TrimPrefix(name, "*.")
+
+	relevantDomain, records, err := checker.relevantRecordSet(domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		// no CAA records means anyone may issue
+		return checker.ValidationMethods, nil
+	}
+
+	caaErr := CAAError{Name: name, Domain: relevantDomain}
+	for _, rr := range records {
+		caaErr.Records = append(caaErr.Records, fmt.Sprintf("%d %s %q", rr.Flag, rr.Tag, rr.Value))
+	}
+
+	// a critical property we do not understand forbids issuance (RFC 8659 §4.1)
+	for _, rr := range records {
+		if rr.Flag&caaCriticalFlag != 0 && !knownCAATags[strings.ToLower(rr.Tag)] {
+			caaErr.Reason = fmt.Sprintf("unknown critical property %q", rr.Tag)
+			return nil, caaErr
+		}
+	}
+
+	// issuewild properties take precedence for wildcard names, if there are any
+	tag := "issue"
+	if wildcard {
+		for _, rr := range records {
+			if strings.EqualFold(rr.Tag, "issuewild") {
+				tag = "issuewild"
+				break
+			}
+		}
+	}
+
+	var relevant []*dns.CAA
+	for _, rr := range records {
+		if strings.EqualFold(rr.Tag, tag) {
+			relevant = append(relevant, rr)
+		}
+	}
+	if len(relevant) == 0 {
+		// there are CAA records, but none restrict issuance
+		return checker.ValidationMethods, nil
+	}
+
+	allowed := make(map[string]bool)
+	for _, rr := range relevant {
+		issuer, params := parseCAAValue(rr.Value)
+		if issuer == "" || !checker.isOwnIssuer(issuer) {
+			continue
+		}
+		if accountURI, ok := params["accounturi"]; ok && accountURI != checker.AccountURI {
+			continue
+		}
+		methods := checker.ValidationMethods
+		if vm, ok := params["validationmethods"]; ok {
+			methods = intersectStrings(checker.ValidationMethods, strings.Split(vm, ","))
+		}
+		for _, m := range methods {
+			allowed[m] = true
+		}
+	}
+	if len(allowed) == 0 {
+		caaErr.Reason = fmt.Sprintf("no %s property authorizes issuer %v with account %q using any of %v",
+			tag, checker.IssuerDomainNames, checker.AccountURI, checker.ValidationMethods)
+		return nil, caaErr
+	}
+
+	// preserve the caller's order of preference
+	var result []string
+	for _, m := range checker.ValidationMethods {
+		if allowed[m] {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+// relevantRecordSet climbs the DNS tree from domain toward the root and
+// returns the first non-empty set of CAA records it finds, along with
+// the name at which they were found (RFC 8659 §3). Aliases are followed
+// by the recursive resolver.
+func (checker CAAChecker) relevantRecordSet(domain string) (string, []*dns.CAA, error) {
+	resolvers := checker.Resolvers
+	if len(resolvers) == 0 {
+		resolvers = systemResolvers()
+	}
+	labels := strings.Split(domain, ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		if candidate == "" {
+			continue
+		}
+		resp, err := dnsExchange(candidate, dns.TypeCAA, resolvers, true, checker.Timeout)
+		if err != nil {
+			// a failed lookup must not be treated as permission (RFC 8659 §3)
+			return "", nil, fmt.Errorf("looking up CAA records for %s: %v", candidate, err)
+		}
+		var records []*dns.CAA
+		for _, rr := range resp.Answer {
+			if caa, ok := rr.(*dns.CAA); ok {
+				records = append(records, caa)
+			}
+		}
+		if len(records) > 0 {
+			return candidate, records, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// isOwnIssuer returns true if issuer is one of the checker's issuer domain names.
+func (checker CAAChecker) isOwnIssuer(issuer string) bool {
+	for _, name := range checker.IssuerDomainNames {
+		if strings.EqualFold(strings.TrimSuffix(name, "."), strings.TrimSuffix(issuer, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCAAValue splits the value of an issue or issuewild property
+// into the issuer domain name and its parameters (RFC 8659 §4.2).
+// An empty issuer domain name means that no CA is authorized.
+func parseCAAValue(value string) (string, map[string]string) {
+	parts := strings.Split(value, ";")
+	issuer := strings.TrimSpace(parts[0])
+	params := make(map[string]string)
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	return issuer, params
+}
+
+// intersectStrings returns the elements of a that are also in b,
+// compared case-insensitively and ignoring surrounding whitespace.
+func intersectStrings(a, b []string) []string {
+	var result []string
+	for _, x := range a {
+		for _, y := range b {
+			if strings.EqualFold(strings.TrimSpace(x), strings.TrimSpace(y)) {
+				result = append(result, x)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// CAAError is returned when the CAA records for a name
+// do not authorize the configured CA to issue for it.
+type CAAError struct {
+	// The name being checked
+	Name string
+
+	// The domain at which the relevant CAA records were found
+	Domain string
+
+	// The relevant CAA records, in presentation format
+	Records []string
+
+	// Why issuance is not authorized
+	Reason string
+}
+
+func (e CAAError) Error() string {
+	return fmt.Sprintf("CAA records at %s do not permit issuance for %s: %s (records: %s)",
+		e.Domain, e.Name, e.Reason, strings.Join(e.Records, "; "))
+}
+
+// checkCAA verifies that the CAA records of all names authorize the CA
+// and account being used by client. Challenges that the records forbid
+// are removed from those the client may use. If issuance is not
+// permitted for any name, the failure is emitted as a
+// "caa_check_failed" event and returned.
+func (client *acmeClient) checkCAA(names []string) error {
+	identities := client.mgr.CAAIdentities
+	if len(identities) == 0 {
+		var err error
+		identities, err = client.mgr.directoryCAAIdentities(client.caURL)
+		if err != nil {
+			return fmt.Errorf("getting CAA identities of CA %s: %v", client.caURL, err)
+		}
+	}
+	if len(identities) == 0 {
+		log.Printf("[WARNING] CA %s does not advertise CAA identities and none are configured; skipping CAA check", client.caURL)
+		return nil
+	}
+
+	var accountURI string
+	if u, err := client.mgr.getUser(client.caURL, client.mgr.Email); err == nil && u.Registration != nil {
+		accountURI = u.Registration.URI
+	}
+
+	available := client.initialChallenges()
+	methods := make([]string, len(available))
+	for i, chal := range available {
+		methods[i] = string(chal)
+	}
+
+	checker := CAAChecker{
+		IssuerDomainNames: identities,
+		AccountURI:        accountURI,
+		ValidationMethods: methods,
+		Resolvers:         client.mgr.CAAResolvers,
+	}
+	for _, name := range names {
+		allowed, err := checker.Check(name)
+		if err != nil {
+			client.mgr.config.emit("caa_check_failed", err)
+			return fmt.Errorf("[%s] CAA check: %w", name, err)
+		}
+		checker.ValidationMethods = allowed
+	}
+
+	client.challenges = nil
+	for _, m := range checker.ValidationMethods {
+		client.challenges = append(client.challenges, challenge.Type(m))
+	}
+	log.Printf("[INFO]%v CAA records permit issuance (challenges=%v)", names, client.challenges)
+	return nil
+}
+
+// directoryCAAIdentities returns the CAA identities advertised in the
+// metadata of the ACME directory at caURL.
+func (manager *ACMEManager) directoryCAAIdentities(caURL string) ([]string, error) {
+	httpClient := &http.Client{Timeout: HTTPTimeout}
+	if manager.TrustedRoots != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: manager.TrustedRoots}
+		httpClient.Transport = transport
+	}
+	resp, err := httpClient.Get(caURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	var dir acme.Directory
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&dir)
+	if err != nil {
+		return nil, fmt.Errorf("decoding directory: %v", err)
+	}
+	return dir.Meta.CaaIdentities, nil
+}
+
+// caaCriticalFlag is the issuer critical flag of a CAA record.
+const caaCriticalFlag = 128
+
+// knownCAATags are the property tags that this implementation understands.
+var knownCAATags = map[string]bool{
+	"issue":        true,
+	"issuewild":    true,
+	"iodef":        true,
+	"contactemail": true,
+	"contactphone": true,
+}
@@ -0,0 +1,120 @@
+package otomatik
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startTestDNSServer starts a DNS server on a random loopback
+// port which answers queries using handler. It returns the
+// server's address and a function to shut it down.
+func startTestDNSServer(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening for test DNS server: %v", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestCAAChecker(t *testing.T) {
+	zone := map[string][]string{
+		"example.com.":           {`example.com. 300 IN CAA 0 issue "ca.test"`},
+		"wild.example.com.":      {`wild.example.com. 300 IN CAA 0 issue "ca.test"`, `wild.example.com. 300 IN CAA 0 issuewild ";"`},
+		"other.example.com.":     {`other.example.com. 300 IN CAA 0 issue "otherca.test"`},
+		"account.example.com.":   {`account.example.com. 300 IN CAA 0 issue "ca.test; accounturi=https://ca.test/acct/1"`},
+		"methods.example.com.":   {`methods.example.com. 300 IN CAA 0 issue "ca.test; validationmethods=dns-01"`},
+		"critical.example.com.":  {`critical.example.com. 300 IN CAA 128 tbs "unknown"`, `critical.example.com. 300 IN CAA 0 issue "ca.test"`},
+		"iodefonly.example.com.": {`iodefonly.example.com. 300 IN CAA 0 iodef "mailto:security@example.com"`},
+		"alias.example.com.":     {`alias.example.com. 300 IN CNAME other.example.com.`, `other.example.com. 300 IN CAA 0 issue "otherca.test"`},
+	}
+	addr, stop := startTestDNSServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeCAA {
+			for _, s := range zone[r.Question[0].Name] {
+				rr, err := dns.NewRR(s)
+				if err != nil {
+					t.Errorf("Bad test record %q: %v", s, err)
+					continue
+				}
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	allMethods := []string{"http-01", "tls-alpn-01", "dns-01"}
+	checker := CAAChecker{
+		IssuerDomainNames: []string{"ca.test"},
+		AccountURI:        "https://ca.test/acct/1",
+		ValidationMethods: allMethods,
+		Resolvers:         []string{addr},
+	}
+
+	for i, test := range []struct {
+		name      string
+		account   string
+		expect    []string
+		expectErr bool
+	}{
+		{name: "example.com", expect: allMethods},
+		{name: "www.example.com", expect: allMethods}, // inherited from parent
+		{name: "*.example.com", expect: allMethods},   // no issuewild, so issue applies
+		{name: "nocaa.test", expect: allMethods},
+		{name: "wild.example.com", expect: allMethods},
+		{name: "*.wild.example.com", expectErr: true},
+		{name: "other.example.com", expectErr: true},
+		{name: "alias.example.com", expectErr: true},
+		{name: "account.example.com", expect: allMethods},
+		{name: "account.example.com", account: "https://ca.test/acct/2", expectErr: true},
+		{name: "methods.example.com", expect: []string{"dns-01"}},
+		{name: "sub.methods.example.com", expect: []string{"dns-01"}},
+		{name: "critical.example.com", expectErr: true},
+		{name: "iodefonly.example.com", expect: allMethods},
+		{name: "127.0.0.1", expect: allMethods},
+	} {
+		c := checker
+		if test.account != "" {
+			c.AccountURI = test.account
+		}
+		actual, err := c.Check(test.name)
+		if test.expectErr {
+			if _, ok := err.(CAAError); !ok {
+				t.Errorf("Test %d (%s): Expected CAAError, got: %v (methods=%v)", i, test.name, err, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d (%s): Expected no error, got: %v", i, test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expect) {
+			t.Errorf("Test %d (%s): Expected methods %v, got %v", i, test.name, test.expect, actual)
+		}
+	}
+}
+
+func TestParseCAAValue(t *testing.T) {
+	issuer, params := parseCAAValue(" ca.test ;  accounturi=https://ca.test/acct/1 ; validationmethods=http-01,dns-01")
+	if issuer != "ca.test" {
+		t.Errorf("Expected issuer 'ca.test', got '%s'", issuer)
+	}
+	expected := map[string]string{
+		"accounturi":        "https://ca.test/acct/1",
+		"validationmethods": "http-01,dns-01",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("Expected params %v, got %v", expected, params)
+	}
+	if issuer, _ := parseCAAValue(";"); issuer != "" {
+		t.Errorf("Expected empty issuer, got '%s'", issuer)
+	}
+}
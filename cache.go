@@ -43,6 +43,17 @@ type Cache struct {
 
 	// Used to signal when stopping is completed
 	doneChan chan struct{}
+	stopOnce sync.Once
+
+	// The storages being watched for changes to
+	// managed certificates, and its mutex
+	watching map[WatchableStorage]struct{}
+	watchMu  sync.Mutex
+
+	// The files of unmanaged certificates being
+	// checked for changes, and its mutex
+	certFiles   []*watchedCertFiles
+	certFilesMu sync.Mutex
 }
 
 // NewCache returns a new, valid Cache for efficiently accessing certificates in memory.
@@ -67,6 +78,9 @@ func NewCache(opts CacheOptions) *Cache {
 	if opts.RenewCheckInterval <= 0 {
 		opts.RenewCheckInterval = DefaultRenewCheckInterval
 	}
+	if opts.FileCheckInterval <= 0 {
+		opts.FileCheckInterval = DefaultFileCheckInterval
+	}
 
 	// this must be set, because we cannot not safely assume that the Default Config is always the correct one to use
 	if opts.GetConfigForCert == nil {
@@ -88,10 +102,13 @@ func NewCache(opts CacheOptions) *Cache {
 
 // Stop stops the maintenance goroutine for certificates in certCache.
 // It blocks until stopping is complete.
-// Once a cache is stopped, it cannot be reused.
+// Once a cache is stopped, it cannot be reused;
+// calling Stop again has no effect.
 func (certCache *Cache) Stop() {
-	close(certCache.stopChan) // signal to stop
-	<-certCache.doneChan      // wait for stop to complete
+	certCache.stopOnce.Do(func() {
+		close(certCache.stopChan) // signal to stop
+	})
+	<-certCache.doneChan // wait for stop to complete
 }
 
 // CacheOptions is used to configure certificate caches.
@@ -115,6 +132,19 @@ type CacheOptions struct {
 	// How often to check certificates for renewal;
 	// if unset, DefaultRenewCheckInterval will be used.
 	RenewCheckInterval time.Duration
+
+	// How often to check the files of unmanaged certificates
+	// loaded from PEM files for changes; if unset,
+	// DefaultFileCheckInterval will be used.
+	FileCheckInterval time.Duration
+
+	// Whether to watch the storage of managed certificates for
+	// changes, if it is a WatchableStorage, so that certificates
+	// renewed by other instances sharing the storage are reloaded
+	// within seconds instead of at the next renewal check. This is
+	// only useful if the storage is shared; some storages, such as
+	// FileStorage, are watched by polling them.
+	WatchStorage bool
 }
 
 // ConfigGetter is a function that returns a prepared, valid config that should
@@ -170,6 +200,15 @@ func (certCache *Cache) removeCertificate(cert Certificate) {
 	delete(certCache.cache, cert.hash)
 }
 
+// hasCertificate returns true if cert is in the cache.
+// This method is safe for concurrent use.
+func (certCache *Cache) hasCertificate(cert Certificate) bool {
+	certCache.mu.RLock()
+	defer certCache.mu.RUnlock()
+	_, ok := certCache.cache[cert.hash]
+	return ok
+}
+
 // replaceCertificate atomically replaces oldCert with newCert in the cache.
 // This method is safe for concurrent use.
 func (certCache *Cache) replaceCertificate(oldCert, newCert Certificate) {
@@ -218,11 +257,14 @@ func (certCache *Cache) getConfig(cert Certificate) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cfg == nil {
+		return nil, nil
+	}
 	if cfg.certCache != nil && cfg.certCache != certCache {
 		return nil, fmt.Errorf("config returned for certificate %v is not nil and points to different cache; got %p, expected %p (this one)",
 			cert.Names, cfg.certCache, certCache)
 	}
-	return cfg, nil
+	return cfg.forCertificate(cert), nil
 }
 
 // AllMatchingCertificates returns a list of all certificates that could be used to serve the given SNI name,
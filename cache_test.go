@@ -1,6 +1,12 @@
 package otomatik
 
-import "testing"
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
 
 func TestNewCache(t *testing.T) {
 	noop := func(Certificate) (*Config, error) { return new(Config), nil }
@@ -22,4 +28,85 @@ func TestNewCache(t *testing.T) {
 	if c.stopChan == nil {
 		t.Error("Expected stopChan to be set, but it was nil")
 	}
-}
\ No newline at end of file
+}
+
+func TestCacheReloadsCertificatesChangedInStorage(t *testing.T) {
+	oldDelay := storageWatchDelay
+	storageWatchDelay = 10 * time.Millisecond
+	defer func() { storageWatchDelay = oldDelay }()
+
+	// two instances sharing the same storage
+	storage := new(MemoryStorage)
+	issuer := &testIssuer{key: "watch"}
+	newInstance := func() *Config {
+		var cfg *Config
+		cache := NewCache(CacheOptions{
+			GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+			WatchStorage:     true,
+		})
+		cfg = New(cache, Config{
+			Issuer:             issuer,
+			Storage:            storage,
+			RenewalWindowRatio: 1, // always due for renewal
+		})
+		return cfg
+	}
+	cfg1, cfg2 := newInstance(), newInstance()
+	defer cfg1.certCache.Stop()
+	defer cfg2.certCache.Stop()
+
+	ctx := context.Background()
+	if err := cfg1.ObtainCert(ctx, "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cfg2.CacheManagedCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// renewed by the first instance; the second picks it up
+	if err := cfg1.RenewCert(ctx, "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cached := cfg2.certCache.getAllMatchingCerts("example.com")
+		if len(cached) == 1 && cached[0].hash != cert.hash {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected renewed certificate to be reloaded into cache, got %d certificates", len(cached))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheDoesNotWatchStorageByDefault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otomatik-nowatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuer:  &testIssuer{key: "nowatch"},
+		Storage: &FileStorage{Path: dir},
+	})
+
+	if err := cfg.ObtainCert(context.Background(), "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.CacheManagedCertificate("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cache.watchMu.Lock()
+	defer cache.watchMu.Unlock()
+	if len(cache.watching) != 0 {
+		t.Errorf("Expected storage not to be watched unless enabled, got %d watched", len(cache.watching))
+	}
+}
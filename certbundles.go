@@ -0,0 +1,265 @@
+package otomatik
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// CacheUnmanagedCertificatePEMBundle loads a certificate from bundle,
+// which contains a PEM-encoded private key and the certificate chain
+// in any order, and adds it to the cache with tags. The certificate
+// whose public key matches the key is the leaf, and the others are
+// served after it in the order they appear in the bundle.
+// This method is safe for concurrent use.
+func (cfg *Config) CacheUnmanagedCertificatePEMBundle(bundle []byte, tags []string) error {
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	tlsCert, err := tlsCertificateFromPEMBlocks(blocks)
+	if err != nil {
+		return err
+	}
+	return cfg.CacheUnmanagedTLSCertificate(tlsCert, tags)
+}
+
+// CacheUnmanagedCertificatePKCS12File loads a certificate and its
+// private key from a PKCS#12 (PFX) file, such as those exported by
+// Windows, decrypting it with password, and adds it to the cache
+// with tags. Files encrypted with AES (PBES2), as exported by
+// current versions of OpenSSL and Windows, and with the legacy
+// algorithms (3DES and RC2) are supported.
+// This method is safe for concurrent use.
+func (cfg *Config) CacheUnmanagedCertificatePKCS12File(pfxFile, password string, tags []string) error {
+	pfxData, err := ioutil.ReadFile(pfxFile)
+	if err != nil {
+		return err
+	}
+	key, cert, caCerts, err := pkcs12.DecodeChain(pfxData, password)
+	if err != nil {
+		return fmt.Errorf("decoding PKCS#12 file %s: %v", pfxFile, err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("%s: %v", pfxFile, err)
+	}
+	blocks := []*pem.Block{
+		{Type: "PRIVATE KEY", Bytes: keyDER},
+		{Type: "CERTIFICATE", Bytes: cert.Raw},
+	}
+	for _, caCert := range caCerts {
+		blocks = append(blocks, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	}
+	tlsCert, err := tlsCertificateFromPEMBlocks(blocks)
+	if err != nil {
+		return fmt.Errorf("%s: %v", pfxFile, err)
+	}
+	return cfg.CacheUnmanagedTLSCertificate(tlsCert, tags)
+}
+
+// CacheUnmanagedCertificatePEMDirectory loads the certificates in the
+// PEM files in dir (not its subdirectories) and adds them to the cache
+// with tags. Private keys are paired with the certificates that have
+// their public keys, regardless of which files they are in, and the
+// chain of each certificate is made from the other certificates in
+// the directory that issued it, leaving out self-signed roots. Keys
+// and certificates that cannot be paired are skipped with a warning.
+// It returns the number of certificates loaded, which is an error
+// if zero.
+// This method is safe for concurrent use.
+func (cfg *Config) CacheUnmanagedCertificatePEMDirectory(dir string, tags []string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var keys []crypto.PrivateKey
+	var keyPubs [][]byte
+	var certs []*x509.Certificate
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		filename := filepath.Join(dir, file.Name())
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return 0, err
+		}
+		for {
+			var block *pem.Block
+			block, contents = pem.Decode(contents)
+			if block == nil {
+				break
+			}
+			switch {
+			case block.Type == "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					log.Printf("[WARNING] Skipping invalid certificate in %s: %v", filename, err)
+					continue
+				}
+				certs = append(certs, cert)
+			case isPrivateKeyPEMType(block.Type):
+				key, err := decodePrivateKey(pem.EncodeToMemory(block))
+				if err != nil {
+					log.Printf("[WARNING] Skipping invalid private key in %s: %v", filename, err)
+					continue
+				}
+				pub, err := publicKeyDER(key)
+				if err != nil {
+					log.Printf("[WARNING] Skipping private key in %s: %v", filename, err)
+					continue
+				}
+				keys = append(keys, key)
+				keyPubs = append(keyPubs, pub)
+			}
+		}
+	}
+
+	var loaded int
+	paired := make(map[*x509.Certificate]bool)
+	for i, key := range keys {
+		var found bool
+		for _, cert := range certs {
+			certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+			if err != nil || !bytes.Equal(certPub, keyPubs[i]) {
+				continue
+			}
+			found, paired[cert] = true, true
+			tlsCert := tls.Certificate{PrivateKey: key}
+			for _, c := range buildChain(cert, certs) {
+				tlsCert.Certificate = append(tlsCert.Certificate, c.Raw)
+			}
+			if err := cfg.CacheUnmanagedTLSCertificate(tlsCert, tags); err != nil {
+				return loaded, fmt.Errorf("caching certificate for %v: %v", namesFromLeaf(cert), err)
+			}
+			loaded++
+		}
+		if !found {
+			log.Printf("[WARNING] No certificate in %s for private key %d", dir, i+1)
+		}
+	}
+	for _, cert := range certs {
+		if !paired[cert] && !cert.IsCA {
+			log.Printf("[WARNING] No private key in %s for certificate for %v", dir, namesFromLeaf(cert))
+		}
+	}
+
+	if loaded == 0 {
+		return 0, fmt.Errorf("no certificates with private keys found in %s", dir)
+	}
+	return loaded, nil
+}
+
+// tlsCertificateFromPEMBlocks makes a certificate from blocks,
+// which must contain one private key and its certificate. The
+// certificate with the key is put first in the chain, followed
+// by the others in order.
+func tlsCertificateFromPEMBlocks(blocks []*pem.Block) (tls.Certificate, error) {
+	var tlsCert tls.Certificate
+	var certs []*x509.Certificate
+	for _, block := range blocks {
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return tls.Certificate{}, err
+			}
+			certs = append(certs, cert)
+		case isPrivateKeyPEMType(block.Type):
+			if tlsCert.PrivateKey != nil {
+				return tls.Certificate{}, fmt.Errorf("more than one private key found")
+			}
+			key, err := decodePrivateKey(pem.EncodeToMemory(block))
+			if err != nil {
+				return tls.Certificate{}, err
+			}
+			tlsCert.PrivateKey = key
+		}
+	}
+	if tlsCert.PrivateKey == nil {
+		return tls.Certificate{}, fmt.Errorf("no private key found")
+	}
+	keyPub, err := publicKeyDER(tlsCert.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	leaf := -1
+	for i, cert := range certs {
+		certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+		if err == nil && bytes.Equal(certPub, keyPub) {
+			leaf = i
+			break
+		}
+	}
+	if leaf < 0 {
+		return tls.Certificate{}, fmt.Errorf("no certificate found for private key")
+	}
+	tlsCert.Certificate = append(tlsCert.Certificate, certs[leaf].Raw)
+	for i, cert := range certs {
+		if i != leaf {
+			tlsCert.Certificate = append(tlsCert.Certificate, cert.Raw)
+		}
+	}
+	return tlsCert, nil
+}
+
+// buildChain returns the chain of leaf, made of leaf and
+// its issuers among pool, without a self-signed root.
+func buildChain(leaf *x509.Certificate, pool []*x509.Certificate) []*x509.Certificate {
+	chain := []*x509.Certificate{leaf}
+	for cert := leaf; len(chain) < maxChainLength; {
+		var issuer *x509.Certificate
+		for _, candidate := range pool {
+			if candidate != cert &&
+				bytes.Equal(candidate.RawSubject, cert.RawIssuer) &&
+				cert.CheckSignatureFrom(candidate) == nil {
+				issuer = candidate
+				break
+			}
+		}
+		if issuer == nil || bytes.Equal(issuer.RawSubject, issuer.RawIssuer) {
+			break
+		}
+		chain = append(chain, issuer)
+		cert = issuer
+	}
+	return chain
+}
+
+// publicKeyDER returns the PKIX encoding of
+// the public key of the private key.
+func publicKeyDER(key crypto.PrivateKey) ([]byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+	return x509.MarshalPKIXPublicKey(signer.Public())
+}
+
+// isPrivateKeyPEMType returns true if blockType is
+// the type of a PEM block of an unencrypted private key.
+func isPrivateKeyPEMType(blockType string) bool {
+	return blockType == "PRIVATE KEY" ||
+		(strings.HasSuffix(blockType, " PRIVATE KEY") && blockType != "ENCRYPTED PRIVATE KEY")
+}
+
+// maxChainLength is the maximum number of
+// certificates in chains made by buildChain.
+const maxChainLength = 10
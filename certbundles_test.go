@@ -0,0 +1,265 @@
+package otomatik
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCacheUnmanagedCertificatePEMBundle(t *testing.T) {
+	cfg := newUnmanagedTestConfig()
+	defer cfg.certCache.Stop()
+
+	root, rootKey := signTestCertificate(t, "Root", true, nil, nil)
+	inter, interKey := signTestCertificate(t, "Intermediate", true, root, rootKey)
+	leaf, leafKey := signTestCertificate(t, "bundle.example.com", false, inter, interKey)
+
+	// the key and chain may be in any order
+	bundle := append(encodeTestCertificate(inter), encodeTestKey(t, leafKey)...)
+	bundle = append(bundle, encodeTestCertificate(leaf)...)
+	if err := cfg.CacheUnmanagedCertificatePEMBundle(bundle, []string{"bundle"}); err != nil {
+		t.Fatal(err)
+	}
+	certs := cfg.certCache.getAllMatchingCerts("bundle.example.com")
+	if len(certs) != 1 {
+		t.Fatalf("Expected certificate to be cached, got %d", len(certs))
+	}
+	if expect := [][]byte{leaf.Raw, inter.Raw}; !reflect.DeepEqual(certs[0].Certificate.Certificate, expect) {
+		t.Errorf("Expected chain to start with leaf")
+	}
+	if !reflect.DeepEqual(certs[0].Tags, []string{"bundle"}) {
+		t.Errorf("Expected tags, got %v", certs[0].Tags)
+	}
+
+	for i, bundle := range [][]byte{
+		encodeTestCertificate(leaf),
+		append(encodeTestCertificate(inter), encodeTestKey(t, leafKey)...),
+		append(append(encodeTestCertificate(leaf), encodeTestKey(t, leafKey)...), encodeTestKey(t, interKey)...),
+	} {
+		if err := cfg.CacheUnmanagedCertificatePEMBundle(bundle, nil); err == nil {
+			t.Errorf("Test %d: Expected error for invalid bundle", i)
+		}
+	}
+}
+
+func TestCacheUnmanagedCertificatePKCS12File(t *testing.T) {
+	cfg := newUnmanagedTestConfig()
+	defer cfg.certCache.Stop()
+
+	dir, err := ioutil.TempDir("", "otomatik-pfx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, test := range []struct {
+		pfx        string
+		name       string
+		chainCerts int
+	}{
+		{pfx: testPFX, name: "pfx.example.com", chainCerts: 1},
+		{pfx: testAESPFX, name: "pfx-aes.example.com", chainCerts: 2},
+	} {
+		pfx, err := base64.StdEncoding.DecodeString(test.pfx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pfxFile := filepath.Join(dir, test.name+".pfx")
+		if err := ioutil.WriteFile(pfxFile, pfx, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cfg.CacheUnmanagedCertificatePKCS12File(pfxFile, "wrong", nil); err == nil {
+			t.Errorf("Test %d: Expected error for wrong password", i)
+		}
+		if err := cfg.CacheUnmanagedCertificatePKCS12File(pfxFile, "secret", []string{"pfx"}); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		certs := cfg.certCache.getAllMatchingCerts(test.name)
+		if len(certs) != 1 || certs[0].Tags[0] != "pfx" {
+			t.Errorf("Test %d: Expected certificate from PKCS#12 file to be cached, got %d", i, len(certs))
+			continue
+		}
+		if len(certs[0].Certificate.Certificate) != test.chainCerts {
+			t.Errorf("Test %d: Expected chain of %d certificates, got %d",
+				i, test.chainCerts, len(certs[0].Certificate.Certificate))
+		}
+	}
+}
+
+func TestCacheUnmanagedCertificatePEMDirectory(t *testing.T) {
+	cfg := newUnmanagedTestConfig()
+	defer cfg.certCache.Stop()
+
+	dir, err := ioutil.TempDir("", "otomatik-pemdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root, rootKey := signTestCertificate(t, "Root", true, nil, nil)
+	inter, interKey := signTestCertificate(t, "Intermediate", true, root, rootKey)
+	leafA, leafAKey := signTestCertificate(t, "a.example.com", false, inter, interKey)
+	leafB, leafBKey := signTestCertificate(t, "b.example.com", false, root, rootKey)
+	_, orphanKey := signTestCertificate(t, "orphan.example.com", false, root, rootKey)
+
+	files := map[string][]byte{
+		"ca.pem":     append(encodeTestCertificate(root), encodeTestCertificate(inter)...),
+		"a.crt":      encodeTestCertificate(leafA),
+		"a.key":      encodeTestKey(t, leafAKey),
+		"b.pem":      append(encodeTestKey(t, leafBKey), encodeTestCertificate(leafB)...),
+		"orphan.key": encodeTestKey(t, orphanKey),
+		"README":     []byte("not PEM"),
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := cfg.CacheUnmanagedCertificatePEMDirectory(dir, []string{"dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 certificates to be loaded, got %d", n)
+	}
+	for name, expect := range map[string][][]byte{
+		"a.example.com": {leafA.Raw, inter.Raw}, // without the root
+		"b.example.com": {leafB.Raw},
+	} {
+		certs := cfg.certCache.getAllMatchingCerts(name)
+		if len(certs) != 1 {
+			t.Errorf("%s: Expected certificate to be cached, got %d", name, len(certs))
+			continue
+		}
+		if !reflect.DeepEqual(certs[0].Certificate.Certificate, expect) {
+			t.Errorf("%s: Expected chain of %d certificates, got %d", name, len(expect), len(certs[0].Certificate.Certificate))
+		}
+	}
+
+	emptyDir := filepath.Join(dir, "empty")
+	if err := os.Mkdir(emptyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.CacheUnmanagedCertificatePEMDirectory(emptyDir, nil); err == nil {
+		t.Errorf("Expected error for directory without certificates")
+	}
+}
+
+func newUnmanagedTestConfig() *Config {
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+	})
+	return New(cache, Config{Storage: new(MemoryStorage)})
+}
+
+// signTestCertificate creates a certificate for name signed by
+// parent, or a self-signed one if parent is nil, and its key.
+func signTestCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func encodeTestCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func encodeTestKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPEM
+}
+
+// testPFX is a PKCS#12 file, encrypted with 3DES and the password
+// "secret", that holds a self-signed certificate for pfx.example.com.
+const testPFX = `MIIDqgIBAzCCA3AGCSqGSIb3DQEHAaCCA2EEggNdMIIDWTCCAk8GCSqGSIb3DQEHBqCCAkAwggI8
+AgEAMIICNQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQMwDgQI8vczKCrhVUYCAggAgIICCKGokvs4
+QiOejKRp/cG1TeAV0VQIQ5YKfupFZfRHHv4/CP/kWpabD5eCbWYVX1uhaSgWG86fAyNKw83zXRdc
+75C7RbD9uoyTXynfp8ULL6BizCQMylIBCxd4eyC1GCmo9ktJqApoFaU2ZM4fLnEn4Ru03BGtd/l+
+eZI4Xii58oYMSeslo01NCA3vDriLnPhICk+90R4H/kJSEunBZiDGiEjAFPj/9ZxlotNOgFhSzHNc
+VOKotjrTPInwKFcJTLcVxTOqcUjYW0jHSAtyl9j0Pnon5jwLGUAxmGpPldzOGbq9sa2PjLjaHy76
+hLBbP3QoIhAp18FiCNrUrBANVnAepO286QbPDPDd8wmALx4z8fstnm9trQIGVEZddJ6VKoo4VrsR
+v1RpxO+kDxmguf69lNZEXSpOZ1+af7dVwv7MdgMUjGiGFG67scQpJ82/RJ+D4bmF/ta9G/RBJbY2
+cSAafaB1qfLtzhzk2Y4Bt53lOc7l+jR66DpnVSO6jcHLkgzhZ4VJm3vyBljD7ggpRx5WTdKLCj7e
+RJ+7uho+4SLlzpqAeuAHiTbOwC2y/QZFDfyduBh/DL46B5Fyj6UIxiwLK/Lwjz6ovfsXL6+rT2Gh
+d/Ga/XRpsTolJA1p4U6dGuBESzaKGCBIocRoEJh74/CN31oWeYJYBp3OMvttmJqeNpQGoCp03xy5
+s/QwggECBgkqhkiG9w0BBwGggfQEgfEwge4wgesGCyqGSIb3DQEMCgECoIG0MIGxMBwGCiqGSIb3
+DQEMAQMwDgQIUIZzDtAGHFACAggABIGQrdX5NjhwegeBVsDMdifHKRet/gp4xSesvONuGnLlYAXn
+oG2BWJfeKJKgydNDM27H2mziAjh20UDUmp06Gwga7x42cUt5EfKA90WLgwmMyM65kSvH/GbTm55l
+5kohkic3AR5diEPCZB1zaeVRg8RaFwSIDGUlZaKNdKe8sRCt8qu5M59XkqB2igIp8e/NmVuYMSUw
+IwYJKoZIhvcNAQkVMRYEFM17K3XqHev2D4thej4E6sIDa17jMDEwITAJBgUrDgMCGgUABBQvuQIy
+gc4CG3sR84tY5SoCdAXffQQI7Gh44uI1lnsCAggA`
+
+// testAESPFX is a PKCS#12 file, encrypted with AES-256 (PBES2) and
+// the password "secret", as exported by OpenSSL 3 by default, that
+// holds a certificate for pfx-aes.example.com and its issuer.
+const testAESPFX = `MIIFzAIBAzCCBYIGCSqGSIb3DQEHAaCCBXMEggVvMIIFazCCBCIGCSqGSIb3DQEHBqCCBBMwggQP
+AgEAMIIECAYJKoZIhvcNAQcBMFcGCSqGSIb3DQEFDTBKMCkGCSqGSIb3DQEFDDAcBAjs8MRFYdNC
+OAICCAAwDAYIKoZIhvcNAgkFADAdBglghkgBZQMEASoEEKtCa6KPT3phaKfBFwrqjjSAggOgXe9R
+Ii3vHg2jUYXjkzIbL3wtS4Mt2yqywwae8D609tPCl1bGCrAmrLjE0I7RRKvjzyroHKua5SEkMt3w
+t2kBjwts1RD/fOkoQzxDnSjFBLgrB+/HZNlrN7eAPjyQ662BQY++W4sDKFaFcZdsgKTl22lO18ba
+aZaB3FacxS6vset4WekAY2BrcURREnVCXJJBdYuxIrvMTZ+abg9EG7UroIXN32l2aFm4d+/Vy776
+2myMRaLFge/z5b2gxdZQ3+u/MHofdDfTfbsabGraFlJEwWC9+lPg8eQ94Fv44wPQSWpmCnHj3RYd
+87LPHqe2jD4qZTYyhMxvsgAs5l1DwG8rZd2CRUXLaF9HmtU/aXzgfpUHE3z0yFiQH09pZhG136/C
+4HfmjTVsZWnxrB8br2E8VtVFZYUsgOqv7y/bcSZDW3OLqI2AvTwPLkvo6Yt4TnZS95CoBo5OxQAY
+fAR3DzYFeEkbIeSThRwg7iMMJ7+3qiXn/Rdt7BRiENRVhj8WIHE31TTBr1ZscTk5dfTidMIaKrS+
+HCvi1PSDVsxUOT6bFtCAK00YrQ+UiEUdlETgTtQvH65dmdMNCZpqKL9mdkkIZxQ7AxaRMGLpwa3c
+YUsQYUyr1ZVrUjx5KWTODD5YYHHz61+0hi8TXY6rRuXSSZgvdZrIYW13+W5eqA57pAf5lgtZJLyO
+KiK1q/1YnauLG81rlfp7ai6Zl6n//1PhjCHuXsTVnufBDl+kGlubKMMZCGhpB31i19JkRQ77lgIQ
+N6XxTjkWC06dgMWpzkLqXhOXxZRhIPq3nc9hSeSTAbnG+TwZXSfR1iKmZAEH4tlpBPq7ZFJzZaRW
+GLdvxCKqcYQIwu+zZz9NLNdrnRDDPEJrsMSkMVtSEJLMwZDEvbr3vItf20e4mqaldmUPn1DXXx7U
+XRtKa1W+aF6IxYIXfLSBmpoujJhRR5pX/k6V2q7lm2a292z3CG97k9QCFQM3t5EjKkupOEyLGxKg
+pDpv+by+HCpBqQSN/JzDeaEdySJGktJ1o2tku9sBBnb2l1D1gp1YeIoFjJ4PJrkg+8OxDNDJGz6B
+ZQo/ACVcbz4PnT340i5TE7nfOlJ/U8JZROVA+Bd5qz2almuJ2+yTjIR1iAbqujZB4qatuTYwolNl
+ucV+Gx3eMwuSWr33L/dLcPnv6U2yc6TGmJdTADstQqBUIpg8d1k2JMqm/8V58QfzB2vFYICLQFCS
+e9e7U/AGOoSSMhRnpjCCAUEGCSqGSIb3DQEHAaCCATIEggEuMIIBKjCCASYGCyqGSIb3DQEMCgEC
+oIHvMIHsMFcGCSqGSIb3DQEFDTBKMCkGCSqGSIb3DQEFDDAcBAjH6j+FyLIm+AICCAAwDAYIKoZI
+hvcNAgkFADAdBglghkgBZQMEASoEEAwDg1FvM54DoDthgqR0jJ0EgZDqCYIMZv+sZ5rm+jv3Ysak
+Sds3+adZzc4gHSOCLirFxSAFm2vSqhSo0PpB+xmFyRSXiTkhFUOUGsgnF4FOj1wWe0gxjj2/6cDb
+/SogOxrdeENy/hdV25SghG2XSTd4zX3ej28pORKmi3cORq57YoJUsYi0VgzRFd9AnaVedz4npxw1
+4056Hozl1kutAuwXMiQxJTAjBgkqhkiG9w0BCRUxFgQUFQUYKrCJl3ZN+AjpJLTHh8uIeCMwQTAx
+MA0GCWCGSAFlAwQCAQUABCC9N1+rqIcoC8hVrSmM2MqdX6pUS07gfQDNXGSke1oaCQQI5Yazh7bm
+83ACAggA`
@@ -1,6 +1,7 @@
 package otomatik
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -36,6 +37,9 @@ type Certificate struct {
 
 // NeedsRenewal returns true if the certificate is expiring soon (according to cfg) or has expired.
 func (cert Certificate) NeedsRenewal(cfg *Config) bool {
+	if len(cert.Names) > 0 {
+		cfg = cfg.forName(cert.Names[0])
+	}
 	return currentlyInRenewalWindow(cert.Leaf.NotBefore, cert.Leaf.NotAfter, cfg.RenewalWindowRatio)
 }
 
@@ -75,6 +79,7 @@ func (cfg *Config) CacheManagedCertificate(domain string) (Certificate, error) {
 		return cert, err
 	}
 	cfg.certCache.cacheCertificate(cert)
+	cfg.certCache.watchStorage(cfg.Storage)
 	cfg.emit("cached_managed_cert", cert.Names)
 	return cert, nil
 }
@@ -82,7 +87,7 @@ func (cfg *Config) CacheManagedCertificate(domain string) (Certificate, error) {
 // loadManagedCertificate loads the managed certificate for domain, but it does not add it to the cache.
 // It just loads from storage.
 func (cfg *Config) loadManagedCertificate(domain string) (Certificate, error) {
-	certRes, err := cfg.loadCertResource(domain)
+	certRes, err := cfg.forName(domain).loadCertResource(domain)
 	if err != nil {
 		return Certificate{}, err
 	}
@@ -95,15 +100,17 @@ func (cfg *Config) loadManagedCertificate(domain string) (Certificate, error) {
 }
 
 // CacheUnmanagedCertificatePEMFile loads a certificate for host using certFile and keyFile, which must be in PEM format.
-// It stores the certificate in the in-memory cache.
+// It stores the certificate in the in-memory cache. The files are checked for changes regularly, and if they are
+// rewritten with a valid certificate and key, the cached certificate is replaced with the new one.
 // This method is safe for concurrent use.
 func (cfg *Config) CacheUnmanagedCertificatePEMFile(certFile, keyFile string, tags []string) error {
-	cert, err := makeCertificateFromDiskWithOCSP(cfg.Storage, certFile, keyFile)
+	cert, filesHash, err := makeCertificateFromDiskWithOCSP(cfg.Storage, certFile, keyFile)
 	if err != nil {
 		return err
 	}
 	cert.Tags = tags
 	cfg.certCache.cacheCertificate(cert)
+	cfg.certCache.watchCertificateFiles(cfg, cert, certFile, keyFile, filesHash)
 	cfg.emit("cached_unmanaged_cert", cert.Names)
 	return nil
 }
@@ -143,17 +150,32 @@ func (cfg *Config) CacheUnmanagedCertificatePEMBytes(certBytes, keyBytes []byte,
 
 // makeCertificateFromDiskWithOCSP makes a Certificate by loading the certificate and key files.
 // It fills out all the fields in the certificate except for the Managed and OnDemand flags.
-// (It is up to the caller to set those.) It staples OCSP.
-func makeCertificateFromDiskWithOCSP(storage Storage, certFile, keyFile string) (Certificate, error) {
-	certPEMBlock, err := ioutil.ReadFile(certFile)
+// (It is up to the caller to set those.) It staples OCSP. It also returns a hash of the
+// contents of the files, with which changes to them can be detected.
+func makeCertificateFromDiskWithOCSP(storage Storage, certFile, keyFile string) (Certificate, string, error) {
+	certPEMBlock, keyPEMBlock, filesHash, err := readCertificateFiles(certFile, keyFile)
 	if err != nil {
-		return Certificate{}, err
+		return Certificate{}, "", err
 	}
-	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	cert, err := makeCertificateWithOCSP(storage, certPEMBlock, keyPEMBlock)
+	return cert, filesHash, err
+}
+
+// readCertificateFiles reads the certificate and key files,
+// and returns their contents and a hash of them.
+func readCertificateFiles(certFile, keyFile string) (certPEMBlock, keyPEMBlock []byte, filesHash string, err error) {
+	certPEMBlock, err = ioutil.ReadFile(certFile)
 	if err != nil {
-		return Certificate{}, err
+		return nil, nil, "", err
+	}
+	keyPEMBlock, err = ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, "", err
 	}
-	return makeCertificateWithOCSP(storage, certPEMBlock, keyPEMBlock)
+	h := sha256.New()
+	h.Write(certPEMBlock)
+	h.Write(keyPEMBlock)
+	return certPEMBlock, keyPEMBlock, fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
 // makeCertificateWithOCSP is the same as makeCertificate except that it also staples OCSP to the certificate.
@@ -177,10 +199,13 @@ func makeCertificate(certPEMBlock, keyPEMBlock []byte) (Certificate, error) {
 	var cert Certificate
 
 	// Convert to a tls.Certificate
-	tlsCert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	tlsCert, err := x509KeyPair(certPEMBlock, keyPEMBlock)
 	if err != nil {
 		return cert, err
 	}
+	if key, ok := tlsCert.PrivateKey.(*RemoteKey); ok && key.Signer == nil {
+		return cert, fmt.Errorf("remote signer %q is not registered", key.signerName)
+	}
 
 	// Extract necessary metadata
 	err = fillCertFromLeaf(&cert, tlsCert)
@@ -208,37 +233,45 @@ func fillCertFromLeaf(cert *Certificate, tlsCert tls.Certificate) error {
 	cert.Certificate.Leaf = leaf
 
 	// for convenience, we do want to assemble all the subjects on the certificate into one list
+	cert.Names = namesFromLeaf(leaf)
+	if len(cert.Names) == 0 {
+		return fmt.Errorf("certificate has no names")
+	}
+
+	// save the hash of this certificate (chain) and expiration date, for necessity and efficiency
+	cert.hash = hashCertificateChain(cert.Certificate.Certificate)
+
+	return nil
+}
+
+// namesFromLeaf returns all the subject names of leaf,
+// lower-cased except for URIs.
+func namesFromLeaf(leaf *x509.Certificate) []string {
+	var names []string
 	if leaf.Subject.CommonName != "" { // TODO: CommonName is deprecated
-		cert.Names = []string{strings.ToLower(leaf.Subject.CommonName)}
+		names = []string{strings.ToLower(leaf.Subject.CommonName)}
 	}
 	for _, name := range leaf.DNSNames {
 		if name != leaf.Subject.CommonName { // TODO: CommonName is deprecated
-			cert.Names = append(cert.Names, strings.ToLower(name))
+			names = append(names, strings.ToLower(name))
 		}
 	}
 	for _, ip := range leaf.IPAddresses {
 		if ipStr := ip.String(); ipStr != leaf.Subject.CommonName { // TODO: CommonName is deprecated
-			cert.Names = append(cert.Names, strings.ToLower(ipStr))
+			names = append(names, strings.ToLower(ipStr))
 		}
 	}
 	for _, email := range leaf.EmailAddresses {
 		if email != leaf.Subject.CommonName { // TODO: CommonName is deprecated
-			cert.Names = append(cert.Names, strings.ToLower(email))
+			names = append(names, strings.ToLower(email))
 		}
 	}
 	for _, u := range leaf.URIs {
 		if u.String() != leaf.Subject.CommonName { // TODO: CommonName is deprecated
-			cert.Names = append(cert.Names, u.String())
+			names = append(names, u.String())
 		}
 	}
-	if len(cert.Names) == 0 {
-		return fmt.Errorf("certificate has no names")
-	}
-
-	// save the hash of this certificate (chain) and expiration date, for necessity and efficiency
-	cert.hash = hashCertificateChain(cert.Certificate.Certificate)
-
-	return nil
+	return names
 }
 
 // managedCertInStorageExpiresSoon returns true if cert (being a managed certificate) is expiring within RenewDurationBefore.
@@ -248,11 +281,12 @@ func fillCertFromLeaf(cert *Certificate, tlsCert tls.Certificate) error {
 // that another instance renewed the certificate in the meantime, and it would be a good idea to simply
 // load the cert into our cache rather than repeating the renewal process again.
 func (cfg *Config) managedCertInStorageExpiresSoon(cert Certificate) (bool, error) {
+	cfg = cfg.forName(cert.Names[0])
 	certRes, err := cfg.loadCertResource(cert.Names[0])
 	if err != nil {
 		return false, err
 	}
-	tlsCert, err := tls.X509KeyPair(certRes.CertificatePEM, certRes.PrivateKeyPEM)
+	tlsCert, err := x509KeyPair(certRes.CertificatePEM, certRes.PrivateKeyPEM)
 	if err != nil {
 		return false, err
 	}
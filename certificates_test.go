@@ -1,9 +1,15 @@
 package otomatik
 
 import (
+	"context"
 	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestUnexportedGetCertificate(t *testing.T) {
@@ -191,4 +197,152 @@ func TestMatchWildcard(t *testing.T) {
 				i, test.subject, test.wildcard, test.expect, actual)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestReloadUnmanagedCertificateFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otomatik-certfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	iss := &testIssuer{key: "pki"}
+	writeFiles := func(certPEM, keyPEM []byte) {
+		if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	issue := func() (certPEM, keyPEM []byte) {
+		key, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyPEM, err = encodePrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := new(Config).generateCSR(key, []string{"example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		issued, err := iss.Issue(context.Background(), csr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return issued.Certificate, keyPEM
+	}
+
+	cache := NewCache(CacheOptions{
+		GetConfigForCert:  func(Certificate) (*Config, error) { return nil, nil },
+		FileCheckInterval: 10 * time.Millisecond,
+	})
+	defer cache.Stop()
+	var mu sync.Mutex
+	var events []string
+	cfg := New(cache, Config{
+		Storage: new(MemoryStorage),
+		OnEvent: func(event string, data interface{}) {
+			mu.Lock()
+			events = append(events, event)
+			mu.Unlock()
+		},
+	})
+
+	certPEM, keyPEM := issue()
+	writeFiles(certPEM, keyPEM)
+	if err := cfg.CacheUnmanagedCertificatePEMFile(certFile, keyFile, []string{"corp"}); err != nil {
+		t.Fatal(err)
+	}
+	original := cache.getAllMatchingCerts("example.com")[0]
+
+	// a key that does not match is not swapped in
+	_, otherKeyPEM := issue()
+	writeFiles(certPEM, otherKeyPEM)
+	time.Sleep(100 * time.Millisecond)
+	if certs := cache.getAllMatchingCerts("example.com"); len(certs) != 1 || certs[0].hash != original.hash {
+		t.Fatalf("Expected current certificate to be kept for invalid files, got %d certificates", len(certs))
+	}
+
+	// a new certificate replaces the current one
+	newCertPEM, newKeyPEM := issue()
+	writeFiles(newCertPEM, newKeyPEM)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		certs := cache.getAllMatchingCerts("example.com")
+		if len(certs) == 1 && certs[0].hash != original.hash {
+			if !reflect.DeepEqual(certs[0].Tags, []string{"corp"}) {
+				t.Errorf("Expected tags to be kept, got %v", certs[0].Tags)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for certificate to be reloaded; have %d certificates", len(certs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[1] != "reloaded_unmanaged_cert" {
+		t.Errorf("Expected cached and reloaded events, got %v", events)
+	}
+}
+
+func TestStopReloadingUncachedCertificateFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otomatik-certfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	key, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := new(Config).generateCSR(key, []string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := (&testIssuer{key: "pki"}).Issue(context.Background(), csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, issued.Certificate, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+	})
+	defer cache.Stop()
+	cfg := New(cache, Config{Storage: new(MemoryStorage)})
+	if err := cfg.CacheUnmanagedCertificatePEMFile(certFile, keyFile, nil); err != nil {
+		t.Fatal(err)
+	}
+	cache.reloadCertificateFiles()
+	if len(cache.certFiles) != 1 {
+		t.Fatalf("Expected files of cached certificate to be checked, got %d", len(cache.certFiles))
+	}
+
+	// once the certificate is removed from the cache,
+	// its files are no longer checked for changes
+	cert := cache.getAllMatchingCerts("example.com")[0]
+	cache.mu.Lock()
+	cache.removeCertificate(cert)
+	cache.mu.Unlock()
+	cache.reloadCertificateFiles()
+	if len(cache.certFiles) != 0 {
+		t.Errorf("Expected files of removed certificate not to be checked, got %d", len(cache.certFiles))
+	}
+}
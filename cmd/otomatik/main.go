@@ -0,0 +1,131 @@
+// Command otomatik inspects and rolls back the prior versions of
+// certificates managed by otomatik, which are kept in storage when
+// Config.CertHistory is set.
+//
+// Usage:
+//
+//	otomatik [flags] versions <name>
+//	otomatik [flags] rollback <name> <version>
+//
+// The versions command lists the prior versions of the certificate
+// for name, oldest first; the rollback command makes one of them the
+// active certificate again. Processes serving the certificate pick up
+// the change when they next load it from storage, or right away if
+// they watch the storage for changes. The certificate replaced by a
+// rollback is kept as a prior version; older versions are pruned
+// only if -keep is set.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wondenge/otomatik"
+)
+
+func main() {
+	storagePath := flag.String("storage", "", "path of the certificate storage (default: otomatik's default storage)")
+	ca := flag.String("ca", otomatik.LetsEncryptProductionCA, "directory URL of the ACME CA that issued the certificates")
+	tenant := flag.String("tenant", "", "tenant whose certificates to manage, if any")
+	keep := flag.Int("keep", 0, "number of prior versions to keep when rolling back; if 0, none are pruned")
+	timeout := flag.Duration("timeout", time.Minute, "how long to wait for the certificate's lock")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [flags] versions <name>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [flags] rollback <name> <version>\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *keep < 0 {
+		fatal(fmt.Errorf("-keep must not be negative"))
+	}
+	if *tenant != "" {
+		if err := otomatik.ValidateTenantID(*tenant); err != nil {
+			fatal(err)
+		}
+	}
+
+	var cfg *otomatik.Config
+	cache := otomatik.NewCache(otomatik.CacheOptions{
+		GetConfigForCert: func(otomatik.Certificate) (*otomatik.Config, error) {
+			return cfg, nil
+		},
+	})
+	defer cache.Stop()
+
+	// the certificate replaced by a rollback is always kept, but
+	// prior versions are only pruned if asked to, since the program
+	// that manages the certificates may keep more of them
+	certHistory := *keep
+	if certHistory == 0 {
+		certHistory = math.MaxInt32
+	}
+	template := otomatik.Config{
+		Tenant:      *tenant,
+		CertHistory: certHistory,
+	}
+	if *storagePath != "" {
+		template.Storage = &otomatik.FileStorage{Path: *storagePath}
+	}
+	cfg = otomatik.New(cache, template)
+	cfg.Issuer = otomatik.NewACMEManager(cfg, otomatik.ACMEManager{CA: *ca})
+
+	var err error
+	switch cmd := args[0]; {
+	case cmd == "versions" && len(args) == 2:
+		err = listVersions(cfg, args[1])
+	case cmd == "rollback" && len(args) == 3:
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		err = cfg.RollbackCertificate(ctx, args[1], args[2])
+		cancel()
+		if err == nil {
+			fmt.Printf("Rolled back certificate for %s to version %s\n", args[1], args[2])
+		}
+	default:
+		flag.Usage()
+		cache.Stop()
+		os.Exit(2)
+	}
+	if err != nil {
+		cache.Stop()
+		fatal(err)
+	}
+}
+
+// listVersions prints the prior versions
+// of the certificate for name.
+func listVersions(cfg *otomatik.Config, name string) error {
+	versions, err := cfg.CertificateVersions(name)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		fmt.Printf("No prior versions of the certificate for %s\n", name)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSERIAL\tISSUER\tNOT AFTER\tVALID\tNAMES")
+	for _, v := range versions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\n",
+			v.ID, v.Serial, v.Issuer, v.NotAfter.Format(time.RFC3339), v.Valid(), strings.Join(v.Names, ","))
+	}
+	return w.Flush()
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "otomatik: %v\n", err)
+	os.Exit(1)
+}
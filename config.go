@@ -56,6 +56,15 @@ type Config struct {
 	// the default KeySource is StandardKeyGenerator
 	KeySource KeyGenerator
 
+	// Key types of additional certificates to manage for each
+	// name, alongside the one with a key from KeySource; for
+	// example, RSA2048 for clients that do not support ECDSA.
+	// Each is obtained, renewed and stored separately, and
+	// DefaultCertificateSelector serves the most efficient one
+	// the client supports. Certificates obtained on demand only
+	// have a key from KeySource.
+	AdditionalKeyTypes []KeyType
+
 	// CertSelection chooses one of the certificates with which the ClientHello will be completed;
 	// if not set, DefaultCertificateSelector will be used
 	CertSelection CertificateSelector
@@ -63,6 +72,40 @@ type Config struct {
 	// The storage to access when storing or loading TLS assets
 	Storage Storage
 
+	// Storage keys of PEM-encoded CA certificates to trust for
+	// mutual TLS, such as LocalIssuer.RootCertificateKey(): with
+	// them, servers verify client certificates (see ClientAuth)
+	// and clients verify servers (see ClientTLSConfig). If empty,
+	// the system's roots are trusted.
+	TrustedCAKeys []string
+
+	// If set, servers using TLSConfig or HTTP3TLSConfig
+	// authenticate clients with certificates according
+	// to this policy.
+	ClientAuth *ClientAuthPolicy
+
+	// If set, the tenant whose assets this config manages; all
+	// of its assets, and its locks, are kept in a namespace of
+	// Storage private to the tenant, so that independent tenants
+	// can share a storage (see NamespacedStorage). Tenant IDs may
+	// only contain lowercase letters, digits, '-' and '_'; see
+	// ValidateTenantID.
+	Tenant string
+
+	// How many prior versions of each managed certificate to keep
+	// in storage when it is renewed, so that the certificate can be
+	// rolled back with RollbackCertificate; 0 keeps none
+	CertHistory int
+
+	// Policies override the issuer, key type, challenges, DNS provider
+	// and renewal window ratio for the names they match; the first
+	// matching policy applies
+	Policies []DomainPolicy
+
+	// if set, this config manages the additional
+	// certificates with keys of this type
+	keyType KeyType
+
 	// required pointer to the in-memory cert cache
 	certCache *Cache
 }
@@ -139,6 +182,9 @@ func newWithCache(certCache *Cache, cfg Config) *Config {
 	if cfg.KeySource == nil {
 		cfg.KeySource = Default.KeySource
 	}
+	if cfg.AdditionalKeyTypes == nil {
+		cfg.AdditionalKeyTypes = Default.AdditionalKeyTypes
+	}
 	if cfg.DefaultServerName == "" {
 		cfg.DefaultServerName = Default.DefaultServerName
 	}
@@ -151,6 +197,18 @@ func newWithCache(certCache *Cache, cfg Config) *Config {
 	if cfg.Storage == nil {
 		cfg.Storage = Default.Storage
 	}
+	if cfg.TrustedCAKeys == nil {
+		cfg.TrustedCAKeys = Default.TrustedCAKeys
+	}
+	if cfg.ClientAuth == nil {
+		cfg.ClientAuth = Default.ClientAuth
+	}
+	if cfg.Policies == nil {
+		cfg.Policies = Default.Policies
+	}
+	if cfg.CertHistory == 0 {
+		cfg.CertHistory = Default.CertHistory
+	}
 	if cfg.Issuer == nil {
 		cfg.Issuer = Default.Issuer
 		if cfg.Issuer == nil {
@@ -178,6 +236,14 @@ func newWithCache(certCache *Cache, cfg Config) *Config {
 		cfg.Storage = defaultFileStorage
 	}
 
+	// keep the tenant's assets to itself; if the tenant ID is
+	// invalid (see ValidateTenantID), storage operations fail
+	if cfg.Tenant != "" {
+		if ns, ok := cfg.Storage.(NamespacedStorage); !ok || ns.Namespace != cfg.Tenant {
+			cfg.Storage = NamespacedStorage{Storage: cfg.Storage, Namespace: cfg.Tenant}
+		}
+	}
+
 	// ensure the unexported fields are valid
 	cfg.certCache = certCache
 
@@ -240,6 +306,12 @@ func (cfg *Config) manageAll(ctx context.Context, domainNames []string, async bo
 		if err != nil {
 			return err
 		}
+		for _, keyType := range cfg.additionalKeyTypes(domainName) {
+			err := cfg.forKeyType(keyType).manageOne(ctx, domainName, async)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -295,7 +367,7 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 	}
 	if cert.NeedsRenewal(cfg) {
 		if async {
-			jobmanager.Submit("renew_"+domainName, renew)
+			jobmanager.Submit(cfg.renewJobName(domainName), renew)
 			return nil
 		}
 		return renew()
@@ -311,6 +383,7 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 // If interactive is true, the user may be shown a prompt.
 // TODO: consider moving interactive param into the Config struct, and maybe retry settings into the Config struct as well? (same for RenewCert)
 func (cfg *Config) ObtainCert(ctx context.Context, name string, interactive bool) error {
+	cfg = cfg.forName(name)
 	if cfg.storageHasCertResources(name) {
 		return nil
 	}
@@ -329,18 +402,22 @@ func (cfg *Config) obtainWithIssuer(ctx context.Context, issuer Issuer, name str
 
 	// ensure idempotency of the obtain operation for this name
 	lockKey := cfg.lockKey("cert_acme", name)
-	err := obtainLock(cfg.Storage, lockKey)
+	lease, err := obtainLock(ctx, cfg.Storage, lockKey)
 	if err != nil {
 		return err
 	}
 	defer func() {
 		log.Printf("[INFO][%s] Obtain: Releasing lock", name)
-		if err := releaseLock(cfg.Storage, lockKey); err != nil {
+		if err := releaseLock(lease); err != nil {
 			log.Printf("[ERROR][%s] Obtain: Unable to unlock '%s': %v", name, lockKey, err)
 		}
 	}()
 	log.Printf("[INFO][%s] Obtain: Lock acquired; proceeding...", name)
 
+	// abandon the operation if the lease on the lock is lost
+	ctx, cancel := leaseContext(ctx, lease)
+	defer cancel()
+
 	f := func(ctx context.Context) error {
 		// check if obtain is still needed -- might have been obtained during lock
 		if cfg.storageHasCertResources(name) {
@@ -357,6 +434,15 @@ func (cfg *Config) obtainWithIssuer(ctx context.Context, issuer Issuer, name str
 			return err
 		}
 
+		// a remote key that ends up unused would be left in
+		// its signer, since each retry creates a new key
+		saved := false
+		defer func() {
+			if !saved {
+				deleteRemoteKey(privKeyPEM)
+			}
+		}()
+
 		csr, err := cfg.generateCSR(privateKey, []string{name})
 		if err != nil {
 			return err
@@ -374,10 +460,11 @@ func (cfg *Config) obtainWithIssuer(ctx context.Context, issuer Issuer, name str
 			PrivateKeyPEM:  privKeyPEM,
 			IssuerData:     issuedCert.Metadata,
 		}
-		err = cfg.saveCertResource(certRes)
+		err = cfg.saveCertResourceWithLease(lease, certRes)
 		if err != nil {
 			return fmt.Errorf("[%s] Obtain: saving assets: %v", name, err)
 		}
+		saved = true
 		return nil
 	}
 	if interactive {
@@ -400,6 +487,7 @@ func (cfg *Config) obtainWithIssuer(ctx context.Context, issuer Issuer, name str
 // It stows the renewed certificate and its assets in storage if successful.
 // It DOES NOT update the in-memory cache with the new certificate.
 func (cfg *Config) RenewCert(ctx context.Context, name string, interactive bool) error {
+	cfg = cfg.forName(name)
 	issuer, err := cfg.getPrecheckedIssuer([]string{name}, interactive)
 	if err != nil {
 		return err
@@ -415,18 +503,22 @@ func (cfg *Config) renewWithIssuer(ctx context.Context, issuer Issuer, name stri
 
 	// ensure idempotency of the renew operation for this name
 	lockKey := cfg.lockKey("cert_acme", name)
-	err := obtainLock(cfg.Storage, lockKey)
+	lease, err := obtainLock(ctx, cfg.Storage, lockKey)
 	if err != nil {
 		return err
 	}
 	defer func() {
 		log.Printf("[INFO][%s] Renew: Releasing lock", name)
-		if err := releaseLock(cfg.Storage, lockKey); err != nil {
+		if err := releaseLock(lease); err != nil {
 			log.Printf("[ERROR][%s] Renew: Unable to unlock '%s': %v", name, lockKey, err)
 		}
 	}()
 	log.Printf("[INFO][%s] Renew: Lock acquired; proceeding...", name)
 
+	// abandon the operation if the lease on the lock is lost
+	ctx, cancel := leaseContext(ctx, lease)
+	defer cancel()
+
 	f := func(ctx context.Context) error {
 		// prepare for renewal (load PEM cert, key, and meta)
 		certRes, err := cfg.loadCertResource(name)
@@ -456,6 +548,16 @@ func (cfg *Config) renewWithIssuer(ctx context.Context, issuer Issuer, name stri
 			return fmt.Errorf("[%s] Renew: %w", name, err)
 		}
 
+		// keep the certificate being replaced, in case
+		// the renewed one needs to be rolled back
+		if cfg.CertHistory > 0 {
+			err = cfg.archiveCertResource(lease, name, certRes)
+			if err != nil {
+				log.Printf("[ERROR][%s] Renew: Keeping prior certificate version: %v", name, err)
+			}
+			cfg.pruneCertHistory(name)
+		}
+
 		// success - immediately save the renewed certificate resource
 		newCertRes := CertificateResource{
 			SANs:           namesFromCSR(csr),
@@ -463,7 +565,7 @@ func (cfg *Config) renewWithIssuer(ctx context.Context, issuer Issuer, name stri
 			PrivateKeyPEM:  certRes.PrivateKeyPEM,
 			IssuerData:     issuedCert.Metadata,
 		}
-		err = cfg.saveCertResource(newCertRes)
+		err = cfg.saveCertResourceWithLease(lease, newCertRes)
 		if err != nil {
 			return fmt.Errorf("[%s] Renew: saving assets: %v", name, err)
 		}
@@ -515,6 +617,7 @@ func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string) (*x5
 // RevokeCert revokes the certificate for domain via ACME protocol.
 // It requires that cfg.Issuer is properly configured with the same issuer that issued the certificate being revoked.
 func (cfg *Config) RevokeCert(ctx context.Context, domain string, interactive bool) error {
+	cfg = cfg.forName(domain)
 	rev := cfg.Revoker
 	if rev == nil {
 		rev = Default.Revoker
@@ -525,7 +628,7 @@ func (cfg *Config) RevokeCert(ctx context.Context, domain string, interactive bo
 		return err
 	}
 
-	issuerKey := cfg.Issuer.IssuerKey()
+	issuerKey := cfg.issuerKey()
 
 	if !cfg.Storage.Exists(StorageKeys.SitePrivateKey(issuerKey, domain)) {
 		return fmt.Errorf("private key not found for %s", certRes.SANs)
@@ -538,6 +641,18 @@ func (cfg *Config) RevokeCert(ctx context.Context, domain string, interactive bo
 
 	cfg.emit("cert_revoked", domain)
 
+	if txs, ok := cfg.Storage.(TransactionalStorage); ok {
+		err = txs.Commit(nil, []StorageOp{
+			{Key: StorageKeys.SiteCert(issuerKey, domain), Delete: true},
+			{Key: StorageKeys.SitePrivateKey(issuerKey, domain), Delete: true},
+			{Key: StorageKeys.SiteMeta(issuerKey, domain), Delete: true},
+		})
+		if err != nil {
+			return fmt.Errorf("certificate revoked, but unable to delete certificate resources: %v", err)
+		}
+		return nil
+	}
+
 	err = cfg.Storage.Delete(StorageKeys.SiteCert(issuerKey, domain))
 	if err != nil {
 		return fmt.Errorf("certificate revoked, but unable to delete certificate file: %v", err)
@@ -560,7 +675,7 @@ func (cfg *Config) RevokeCert(ctx context.Context, domain string, interactive bo
 // Feel free to further customize the returned tls.Config, but do not mess with the GetCertificate
 // or NextProtos fields unless you know what you're doing, as they're necessary to solve the TLS-ALPN challenge.
 func (cfg *Config) TLSConfig() *tls.Config {
-	return &tls.Config{
+	tlsConfig := &tls.Config{
 		// these two fields necessary for TLS-ALPN challenge
 		GetCertificate: cfg.GetCertificate,
 		NextProtos:     []string{"h2", "http/1.1", tlsalpn01.ACMETLS1Protocol},
@@ -574,6 +689,30 @@ func (cfg *Config) TLSConfig() *tls.Config {
 		CipherSuites:             preferredDefaultCipherSuites(),
 		PreferServerCipherSuites: true,
 	}
+	if cfg.ClientAuth != nil {
+		cfg.ClientAuth.applyTo(tlsConfig, cfg)
+	}
+	return tlsConfig
+}
+
+// HTTP3TLSConfig returns a TLS configuration for serving HTTP/3 over QUIC with the
+// certificates managed by cfg, for use with an HTTP/3 server implementation. QUIC
+// requires TLS 1.3, and the TLS-ALPN challenge cannot be solved over QUIC, so the
+// TLS-ALPN or HTTP challenge must be solved by a TLS or HTTP server on TCP.
+func (cfg *Config) HTTP3TLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		GetCertificate: cfg.GetCertificate,
+		NextProtos:     []string{"h3"},
+		MinVersion:     tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{
+			tls.X25519,
+			tls.CurveP256,
+		},
+	}
+	if cfg.ClientAuth != nil {
+		cfg.ClientAuth.applyTo(tlsConfig, cfg)
+	}
+	return tlsConfig
 }
 
 // getPrecheckedIssuer returns an Issuer with pre-checks completed, if it is also a PreChecker.
@@ -634,7 +773,7 @@ func (cfg *Config) checkStorage() error {
 // certificate cache has all the resources related to the certificate for domain:
 // the certificate, the private key, and the metadata.
 func (cfg *Config) storageHasCertResources(domain string) bool {
-	issuerKey := cfg.Issuer.IssuerKey()
+	issuerKey := cfg.issuerKey()
 	certKey := StorageKeys.SiteCert(issuerKey, domain)
 	keyKey := StorageKeys.SitePrivateKey(issuerKey, domain)
 	metaKey := StorageKeys.SiteMeta(issuerKey, domain)
@@ -646,7 +785,76 @@ func (cfg *Config) storageHasCertResources(domain string) bool {
 // lockKey returns a key for a lock that is specific to the operation named op
 // being performed related to domainName and this config's CA.
 func (cfg *Config) lockKey(op, domainName string) string {
-	return fmt.Sprintf("%s_%s_%s", op, domainName, cfg.Issuer.IssuerKey())
+	return fmt.Sprintf("%s_%s_%s", op, domainName, cfg.issuerKey())
+}
+
+// issuerKey returns the key of cfg's issuer as it is used in
+// storage keys and lock names. The additional certificates of
+// each key type are kept apart from the primary certificates
+// as if they were from another issuer.
+func (cfg *Config) issuerKey() string {
+	if cfg.keyType == "" {
+		return cfg.Issuer.IssuerKey()
+	}
+	return cfg.Issuer.IssuerKey() + "-" + string(cfg.keyType)
+}
+
+// renewJobName returns the name of the job
+// that renews the certificate for name.
+func (cfg *Config) renewJobName(name string) string {
+	if cfg.keyType == "" {
+		return "renew_" + name
+	}
+	return "renew_" + name + "_" + string(cfg.keyType)
+}
+
+// additionalKeyTypes returns the key types of the certificates
+// that cfg manages for name in addition to the primary one; the
+// type of the primary certificate's key is left out.
+func (cfg *Config) additionalKeyTypes(name string) []KeyType {
+	var primary KeyType
+	switch kg := cfg.forName(name).KeySource.(type) {
+	case StandardKeyGenerator:
+		primary = kg.KeyType
+	case RemoteKeyGenerator:
+		primary = kg.KeyType
+	}
+	if primary == "" {
+		primary = P256
+	}
+	var keyTypes []KeyType
+	for _, keyType := range cfg.AdditionalKeyTypes {
+		if keyType != primary {
+			keyTypes = append(keyTypes, keyType)
+		}
+	}
+	return keyTypes
+}
+
+// forKeyType returns a copy of cfg that manages the
+// additional certificates with keys of keyType.
+func (cfg *Config) forKeyType(keyType KeyType) *Config {
+	cfgCopy := *cfg
+	cfgCopy.KeySource = keyGeneratorOfType(cfg.KeySource, keyType)
+	cfgCopy.AdditionalKeyTypes = nil
+	cfgCopy.keyType = keyType
+	return &cfgCopy
+}
+
+// forCertificate returns the config that manages cert: the
+// config for its key type if it is one of the additional
+// certificates of cfg, otherwise cfg itself.
+func (cfg *Config) forCertificate(cert Certificate) *Config {
+	if cfg.keyType != "" || len(cert.Names) == 0 || cert.Leaf == nil {
+		return cfg
+	}
+	keyType := keyTypeOf(cert.Leaf.PublicKey)
+	for _, additional := range cfg.additionalKeyTypes(cert.Names[0]) {
+		if additional == keyType {
+			return cfg.forKeyType(keyType)
+		}
+	}
+	return cfg
 }
 
 // managedCertNeedsRenewal returns true if certRes is expiring soon or already expired,
@@ -59,4 +59,71 @@ func TestSaveCertResource(t *testing.T) {
 	if !reflect.DeepEqual(cert, siteData) {
 		t.Errorf("Expected '%+v' to match '%+v'", cert, siteData)
 	}
-}
\ No newline at end of file
+}
+
+func TestManageAdditionalKeyTypes(t *testing.T) {
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+	})
+	defer cache.Stop()
+	storage := new(MemoryStorage)
+	iss := &testIssuer{key: "dual"}
+	cfg = New(cache, Config{
+		Issuer:             iss,
+		Storage:            storage,
+		AdditionalKeyTypes: []KeyType{RSA2048, P256}, // P256 is already the primary key type
+	})
+
+	certsByKeyType := func() map[KeyType]Certificate {
+		certs := make(map[KeyType]Certificate)
+		for _, cert := range cache.getAllMatchingCerts("example.com") {
+			certs[keyTypeOf(cert.Leaf.PublicKey)] = cert
+		}
+		return certs
+	}
+
+	if err := cfg.ManageSync([]string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	certs := certsByKeyType()
+	if len(certs) != 2 || certs[P256].hash == "" || certs[RSA2048].hash == "" {
+		t.Fatalf("Expected P256 and RSA2048 certificates in cache, got %v", certs)
+	}
+	if len(cache.cacheIndex["example.com"]) != 2 {
+		t.Errorf("Expected exactly 2 certificates for name, got %d", len(cache.cacheIndex["example.com"]))
+	}
+	if !storage.Exists(StorageKeys.SiteCert("dual", "example.com")) ||
+		!storage.Exists(StorageKeys.SiteCert("dual-rsa2048", "example.com")) {
+		t.Errorf("Expected certificates to be stored under distinct keys")
+	}
+
+	// each certificate is managed with the config for its key type
+	if certCfg, _ := cache.getConfig(certs[RSA2048]); certCfg.keyType != RSA2048 {
+		t.Errorf("Expected RSA certificate to be managed with its key type, got '%s'", certCfg.keyType)
+	}
+	if certCfg, _ := cache.getConfig(certs[P256]); certCfg != cfg {
+		t.Errorf("Expected primary certificate to be managed with the config itself")
+	}
+
+	// renewing keeps each certificate's key and key type
+	cfg.RenewalWindowRatio = 1
+	if err := cfg.ManageSync([]string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(iss.issued) != 4 {
+		t.Errorf("Expected both certificates to be renewed, got %d issuances", len(iss.issued))
+	}
+	renewed := certsByKeyType()
+	if len(renewed) != 2 || len(cache.cacheIndex["example.com"]) != 2 {
+		t.Fatalf("Expected renewed certificates to replace those in cache, got %v", renewed)
+	}
+	for keyType, cert := range renewed {
+		if cert.hash == certs[keyType].hash {
+			t.Errorf("Expected %s certificate to be renewed", keyType)
+		}
+		if !privateKeysSame(cert.PrivateKey, certs[keyType].PrivateKey) {
+			t.Errorf("Expected %s certificate to keep its key", keyType)
+		}
+	}
+}
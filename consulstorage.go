@@ -0,0 +1,538 @@
+package otomatik
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConsulStorage is a Storage that keeps assets in the key-value
+// store of a Consul cluster, and implements locks with Consul
+// sessions, so that all the instances sharing the cluster can
+// share certificates.
+//
+// Changes are committed atomically with Consul transactions, and
+// writes made under a lease are rejected by Consul itself if the
+// session holding the lock is gone. Fencing tokens are the lock
+// index of the lock's key.
+type ConsulStorage struct {
+	// The address of the Consul agent's HTTP API,
+	// for example "http://127.0.0.1:8500". Required.
+	Address string
+
+	// The ACL token with which to authenticate, if any.
+	Token string
+
+	// The datacenter to use; if empty,
+	// the agent's datacenter is used.
+	Datacenter string
+
+	// The prefix under which keys are stored;
+	// defaults to "otomatik".
+	Prefix string
+
+	// The HTTP client to use; if nil,
+	// a default client is used.
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	leases map[string]Lease // held via Lock, by key
+}
+
+// Store saves value at key.
+func (cs *ConsulStorage) Store(key string, value []byte) error {
+	return cs.Commit(nil, []StorageOp{{Key: key, Value: value}})
+}
+
+// Load retrieves the value at key.
+func (cs *ConsulStorage) Load(key string) ([]byte, error) {
+	pair, err := cs.getPair(context.Background(), cs.consulKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return pair.Value, nil
+}
+
+// Delete deletes key. If key is non-terminal,
+// all the keys it contains are deleted.
+func (cs *ConsulStorage) Delete(key string) error {
+	if !cs.Exists(key) {
+		return consulNotExist(key)
+	}
+	ctx := context.Background()
+	consulKey := cs.consulKey(key)
+	err := cs.request(ctx, http.MethodDelete, "/v1/kv/"+consulKey, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return cs.request(ctx, http.MethodDelete, "/v1/kv/"+consulKey+"/", url.Values{"recurse": {""}}, nil, nil)
+}
+
+// Exists returns true if key exists.
+func (cs *ConsulStorage) Exists(key string) bool {
+	_, err := cs.Stat(key)
+	return err == nil
+}
+
+// List returns all keys that match prefix.
+func (cs *ConsulStorage) List(prefix string, recursive bool) ([]string, error) {
+	prefix = cleanKey(prefix)
+	all, err := cs.keysWithin(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := listKeys(all, prefix, recursive)
+	if prefix != "" && len(keys) == 0 && !cs.Exists(prefix) {
+		return nil, consulNotExist(prefix)
+	}
+	return keys, nil
+}
+
+// Stat returns information about key.
+func (cs *ConsulStorage) Stat(key string) (KeyInfo, error) {
+	key = cleanKey(key)
+	ctx := context.Background()
+
+	pair, err := cs.getPair(ctx, cs.consulKey(key))
+	if err == nil {
+		return KeyInfo{
+			Key:        key,
+			Modified:   pair.modified(),
+			Size:       int64(len(pair.Value)),
+			IsTerminal: true,
+		}, nil
+	}
+	if _, ok := err.(consulNotFoundError); !ok {
+		return KeyInfo{}, err
+	}
+
+	// non-terminal keys were last modified
+	// when the keys they contain were
+	var pairs []consulKVPair
+	err = cs.request(ctx, http.MethodGet, "/v1/kv/"+cs.consulKey(key)+"/", url.Values{"recurse": {""}}, nil, &pairs)
+	if _, ok := err.(consulNotFoundError); ok || (err == nil && len(pairs) == 0) {
+		return KeyInfo{}, consulNotExist(key)
+	}
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	info := KeyInfo{Key: key}
+	for _, p := range pairs {
+		if modified := p.modified(); modified.After(info.Modified) {
+			info.Modified = modified
+		}
+	}
+	return info, nil
+}
+
+// Commit applies ops atomically in a Consul transaction. If
+// lease is a lease from cs, the transaction only succeeds if
+// lease's session still holds the lock.
+func (cs *ConsulStorage) Commit(lease Lease, ops []StorageOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if lease != nil && leaseIsLost(lease) {
+		return ErrLeaseLost
+	}
+
+	var txn []consulTxnOp
+	cl, fenced := lease.(*consulLease)
+	if fenced {
+		txn = append(txn, consulTxnOp{KV: consulTxnKV{
+			Verb:    "check-session",
+			Key:     cl.lockKey,
+			Session: cl.session,
+		}})
+	}
+	modified := uint64(time.Now().UnixNano())
+	for _, op := range ops {
+		if op.Delete {
+			txn = append(txn, consulTxnOp{KV: consulTxnKV{Verb: "delete", Key: cs.consulKey(op.Key)}})
+		} else {
+			txn = append(txn, consulTxnOp{KV: consulTxnKV{
+				Verb:  "set",
+				Key:   cs.consulKey(op.Key),
+				Value: op.Value,
+				Flags: modified,
+			}})
+		}
+	}
+
+	err := cs.request(context.Background(), http.MethodPut, "/v1/txn", nil, txn, nil)
+	if fenced && err == errConsulTxnRollback {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// StoreFenced saves value at key, unless lease's
+// session no longer holds the lock.
+func (cs *ConsulStorage) StoreFenced(lease Lease, key string, value []byte) error {
+	return cs.Commit(lease, []StorageOp{{Key: key, Value: value}})
+}
+
+// Lock obtains the lock for key, blocking until it can be
+// obtained. The lock is held with a lease of DefaultLockTTL,
+// which is renewed until Unlock is called.
+func (cs *ConsulStorage) Lock(key string) error {
+	lease, err := cs.LockLease(context.Background(), key, DefaultLockTTL)
+	if err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	if cs.leases == nil {
+		cs.leases = make(map[string]Lease)
+	}
+	cs.leases[key] = lease
+	cs.mu.Unlock()
+	return nil
+}
+
+// Unlock releases the lock for key, which
+// must have been obtained with Lock.
+func (cs *ConsulStorage) Unlock(key string) error {
+	cs.mu.Lock()
+	lease, ok := cs.leases[key]
+	delete(cs.leases, key)
+	cs.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("lock for %s is not held", key)
+	}
+	return lease.Release()
+}
+
+// LockLease obtains a lease on the lock for key by acquiring
+// the lock's key with a new session. It blocks until the lock
+// can be obtained, ctx is done, or an error occurs. The session
+// is renewed every third of ttl until the lease is released; if
+// the session expires or is destroyed in the meantime, the lease
+// is lost. Consul does not allow session TTLs under 10 seconds.
+func (cs *ConsulStorage) LockLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	if ttl < consulMinSessionTTL {
+		ttl = consulMinSessionTTL
+	}
+
+	var created struct{ ID string }
+	err := cs.request(ctx, http.MethodPut, "/v1/session/create", nil, map[string]string{
+		"Name":      "otomatik lock: " + key,
+		"TTL":       ttl.String(),
+		"Behavior":  "release",
+		"LockDelay": "0s",
+	}, &created)
+	if err != nil {
+		return nil, fmt.Errorf("creating session: %v", err)
+	}
+	lease := &consulLease{
+		storage:  cs,
+		key:      key,
+		lockKey:  cs.consulKey(path.Join(consulLocksPrefix, StorageKeys.Safe(key))),
+		session:  created.ID,
+		ttl:      ttl,
+		lost:     closeOnce{ch: make(chan struct{})},
+		released: closeOnce{ch: make(chan struct{})},
+	}
+
+	for {
+		var acquired bool
+		err := cs.request(ctx, http.MethodPut, "/v1/kv/"+lease.lockKey, url.Values{"acquire": {lease.session}}, nil, &acquired)
+		if err != nil {
+			lease.destroySession()
+			return nil, fmt.Errorf("acquiring lock: %v", err)
+		}
+		if acquired {
+			break
+		}
+		// lock is held; wait a moment and try again, keeping
+		// our session alive in case we wait a while
+		select {
+		case <-time.After(consulLockPollInterval):
+		case <-ctx.Done():
+			lease.destroySession()
+			return nil, ctx.Err()
+		}
+		if err := cs.request(ctx, http.MethodPut, "/v1/session/renew/"+lease.session, nil, nil, nil); err != nil {
+			lease.destroySession()
+			return nil, fmt.Errorf("renewing session: %v", err)
+		}
+	}
+
+	pair, err := cs.getPair(ctx, lease.lockKey)
+	if err != nil || pair.Session != lease.session {
+		lease.destroySession()
+		return nil, fmt.Errorf("reading acquired lock: %v", err)
+	}
+	lease.token = pair.LockIndex
+
+	go lease.keepFresh()
+	return lease, nil
+}
+
+func (cs *ConsulStorage) String() string {
+	return "ConsulStorage:" + cs.Address + "/" + cs.prefix()
+}
+
+// keysWithin returns all the terminal keys within prefix.
+func (cs *ConsulStorage) keysWithin(ctx context.Context, prefix string) ([]string, error) {
+	root := cs.prefix() + "/"
+	consulPrefix := root
+	if prefix != "" {
+		consulPrefix = cs.consulKey(prefix) + "/"
+	}
+	var consulKeys []string
+	err := cs.request(ctx, http.MethodGet, "/v1/kv/"+consulPrefix, url.Values{"keys": {""}}, nil, &consulKeys)
+	if _, ok := err.(consulNotFoundError); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var all []string
+	for _, k := range consulKeys {
+		k = strings.TrimPrefix(k, root)
+		if strings.HasPrefix(k, consulLocksPrefix+"/") {
+			continue
+		}
+		all = append(all, k)
+	}
+	return all, nil
+}
+
+func (cs *ConsulStorage) getPair(ctx context.Context, consulKey string) (consulKVPair, error) {
+	var pairs []consulKVPair
+	err := cs.request(ctx, http.MethodGet, "/v1/kv/"+consulKey, nil, nil, &pairs)
+	if _, ok := err.(consulNotFoundError); ok || (err == nil && len(pairs) == 0) {
+		return consulKVPair{}, consulNotExist(consulKey)
+	}
+	if err != nil {
+		return consulKVPair{}, err
+	}
+	return pairs[0], nil
+}
+
+// request performs an API request, encoding body as JSON if not
+// nil, and decoding the response into result if not nil.
+func (cs *ConsulStorage) request(ctx context.Context, method, apiPath string, query url.Values, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	if query == nil {
+		query = make(url.Values)
+	}
+	if cs.Datacenter != "" {
+		query.Set("dc", cs.Datacenter)
+	}
+	reqURL := strings.TrimSuffix(cs.Address, "/") + apiPath
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, reqURL, reqBody)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", buildUAString())
+	if cs.Token != "" {
+		req.Header.Set("X-Consul-Token", cs.Token)
+	}
+
+	client := cs.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: HTTPTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return consulNotFoundError{apiPath}
+	case resp.StatusCode == http.StatusConflict && apiPath == "/v1/txn":
+		return errConsulTxnRollback
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 64*1024*1024)).Decode(result)
+}
+
+// consulKey returns the key in Consul for key.
+func (cs *ConsulStorage) consulKey(key string) string {
+	if key = cleanKey(key); key == "" {
+		return cs.prefix()
+	}
+	return cs.prefix() + "/" + key
+}
+
+func (cs *ConsulStorage) prefix() string {
+	if prefix := cleanKey(cs.Prefix); prefix != "" {
+		return prefix
+	}
+	return "otomatik"
+}
+
+// consulLease is a lease on a lock held
+// with a Consul session.
+type consulLease struct {
+	storage  *ConsulStorage
+	key      string
+	lockKey  string
+	session  string
+	token    uint64
+	ttl      time.Duration
+	lost     closeOnce
+	released closeOnce
+}
+
+func (l *consulLease) Key() string           { return l.key }
+func (l *consulLease) Token() uint64         { return l.token }
+func (l *consulLease) Lost() <-chan struct{} { return l.lost.ch }
+
+// Release releases the lock and destroys the session.
+func (l *consulLease) Release() error {
+	l.released.close()
+	defer l.destroySession()
+
+	var released bool
+	err := l.storage.request(context.Background(), http.MethodPut, "/v1/kv/"+l.lockKey,
+		url.Values{"release": {l.session}}, nil, &released)
+	if err != nil {
+		return err
+	}
+	if !released {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// keepFresh renews the session every third of its TTL until
+// the lease is released. If the session is gone, or if it
+// cannot be renewed before it expires, the lease is lost.
+func (l *consulLease) keepFresh() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	expires := time.Now().Add(l.ttl)
+	for {
+		select {
+		case <-l.released.ch:
+			return
+		case <-ticker.C:
+		}
+		renewedAt := time.Now()
+		err := l.storage.request(context.Background(), http.MethodPut, "/v1/session/renew/"+l.session, nil, nil, nil)
+		switch err.(type) {
+		case nil:
+			expires = renewedAt.Add(l.ttl)
+		case consulNotFoundError:
+			l.lost.close()
+			return
+		default:
+			if time.Now().After(expires) {
+				log.Printf("[ERROR][%s] Renewing lock %s: %v - lease expired", l.storage, l.key, err)
+				l.lost.close()
+				return
+			}
+			log.Printf("[ERROR][%s] Renewing lock %s: %v - will retry", l.storage, l.key, err)
+		}
+	}
+}
+
+func (l *consulLease) destroySession() {
+	err := l.storage.request(context.Background(), http.MethodPut, "/v1/session/destroy/"+l.session, nil, nil, nil)
+	if err != nil {
+		log.Printf("[ERROR][%s] Destroying session %s: %v", l.storage, l.session, err)
+	}
+}
+
+// consulKVPair is an entry in the Consul KV store.
+type consulKVPair struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	Session     string
+	LockIndex   uint64
+	ModifyIndex uint64
+}
+
+// modified returns the modification time of the pair,
+// which is stored in its flags.
+func (p consulKVPair) modified() time.Time {
+	if p.Flags == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(p.Flags))
+}
+
+type consulTxnOp struct {
+	KV consulTxnKV
+}
+
+type consulTxnKV struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Flags   uint64 `json:",omitempty"`
+	Session string `json:",omitempty"`
+}
+
+// consulNotFoundError is returned when Consul
+// responds that something does not exist.
+type consulNotFoundError struct {
+	path string
+}
+
+func (e consulNotFoundError) Error() string {
+	return e.path + ": " + os.ErrNotExist.Error()
+}
+
+func (e consulNotFoundError) Unwrap() error { return os.ErrNotExist }
+
+// errConsulTxnRollback is returned when a
+// transaction was rolled back.
+var errConsulTxnRollback = errors.New("transaction rolled back")
+
+// consulNotExist returns an ErrNotExist for key.
+func consulNotExist(key string) error {
+	return ErrNotExist(consulNotFoundError{key})
+}
+
+const (
+	// consulLocksPrefix is the key prefix, relative to
+	// a ConsulStorage's prefix, of lock keys.
+	consulLocksPrefix = ".locks"
+
+	consulMinSessionTTL    = 10 * time.Second
+	consulLockPollInterval = 1 * time.Second
+)
+
+// Interface guards
+var (
+	_ Storage              = (*ConsulStorage)(nil)
+	_ TransactionalStorage = (*ConsulStorage)(nil)
+	_ LeaseLocker          = (*ConsulStorage)(nil)
+	_ FencedStorage        = (*ConsulStorage)(nil)
+)
@@ -0,0 +1,286 @@
+package otomatik
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul is a minimal Consul agent that implements
+// the KV store, sessions and transactions.
+type fakeConsul struct {
+	token string
+
+	mu       sync.Mutex
+	kv       map[string]consulKVPair
+	sessions map[string]bool
+	nextID   int
+}
+
+func newFakeConsul() (*fakeConsul, *httptest.Server) {
+	fc := &fakeConsul{
+		token:    "sekrit",
+		kv:       make(map[string]consulKVPair),
+		sessions: make(map[string]bool),
+	}
+	return fc, httptest.NewServer(fc)
+}
+
+func (fc *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if r.Header.Get("X-Consul-Token") != fc.token {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		fc.nextID++
+		id := "session-" + strconv.Itoa(fc.nextID)
+		fc.sessions[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		if !fc.sessions[strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")] {
+			http.NotFound(w, r)
+		}
+
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		fc.destroySession(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+
+	case r.URL.Path == "/v1/txn":
+		var txn []consulTxnOp
+		if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, op := range txn {
+			if op.KV.Verb == "check-session" && fc.kv[op.KV.Key].Session != op.KV.Session {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		}
+		for _, op := range txn {
+			switch op.KV.Verb {
+			case "set":
+				pair := fc.kv[op.KV.Key]
+				pair.Key, pair.Value, pair.Flags = op.KV.Key, op.KV.Value, op.KV.Flags
+				fc.kv[op.KV.Key] = pair
+			case "delete":
+				delete(fc.kv, op.KV.Key)
+			}
+		}
+
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		_, recurse := query["recurse"]
+		_, keysOnly := query["keys"]
+
+		switch r.Method {
+		case http.MethodGet:
+			var pairs []consulKVPair
+			var keys []string
+			for k, pair := range fc.kv {
+				if k == key || ((recurse || keysOnly) && strings.HasPrefix(k, key)) {
+					pairs = append(pairs, pair)
+					keys = append(keys, k)
+				}
+			}
+			if len(pairs) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			if keysOnly {
+				json.NewEncoder(w).Encode(keys)
+				return
+			}
+			json.NewEncoder(w).Encode(pairs)
+
+		case http.MethodDelete:
+			for k := range fc.kv {
+				if k == key || (recurse && strings.HasPrefix(k, key)) {
+					delete(fc.kv, k)
+				}
+			}
+			w.Write([]byte("true"))
+
+		case http.MethodPut:
+			pair := fc.kv[key]
+			pair.Key = key
+			var ok bool
+			if session := query.Get("acquire"); session != "" {
+				if !fc.sessions[session] {
+					http.Error(w, "invalid session", http.StatusInternalServerError)
+					return
+				}
+				if ok = pair.Session == "" || pair.Session == session; ok && pair.Session == "" {
+					pair.Session = session
+					pair.LockIndex++
+				}
+			} else if session := query.Get("release"); session != "" {
+				if ok = pair.Session == session; ok {
+					pair.Session = ""
+				}
+			}
+			fc.kv[key] = pair
+			json.NewEncoder(w).Encode(ok)
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// destroySession destroys session, releasing the
+// locks it holds. fc.mu must be locked.
+func (fc *fakeConsul) destroySession(session string) {
+	delete(fc.sessions, session)
+	for k, pair := range fc.kv {
+		if pair.Session == session {
+			pair.Session = ""
+			fc.kv[k] = pair
+		}
+	}
+}
+
+func TestConsulStorage(t *testing.T) {
+	_, server := newFakeConsul()
+	defer server.Close()
+	cs := &ConsulStorage{Address: server.URL, Token: "sekrit"}
+
+	if err := cs.Store("acme/example.com/sites/example.com/example.com.crt", []byte("cert")); err != nil {
+		t.Fatalf("Expected no error storing, got: %v", err)
+	}
+	if err := cs.Store("acme/example.com/sites/example.com/example.com.key", []byte("key")); err != nil {
+		t.Fatalf("Expected no error storing, got: %v", err)
+	}
+	if value, err := cs.Load("acme/example.com/sites/example.com/example.com.crt"); err != nil || string(value) != "cert" {
+		t.Errorf("Expected to load stored value, got %q (error: %v)", value, err)
+	}
+	if _, err := cs.Load("nonexistent"); err == nil {
+		t.Errorf("Expected error loading nonexistent key")
+	}
+
+	keys, err := cs.List("acme/example.com/sites", false)
+	if err != nil {
+		t.Fatalf("Expected no error listing, got: %v", err)
+	}
+	if expected := []string{"acme/example.com/sites/example.com"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, keys)
+	}
+	keys, err = cs.List("acme", true)
+	if err != nil {
+		t.Fatalf("Expected no error listing, got: %v", err)
+	}
+	if len(keys) != 5 {
+		t.Errorf("Expected 5 keys listed recursively, got %v", keys)
+	}
+	if _, err := cs.List("nonexistent", true); err == nil {
+		t.Errorf("Expected error listing nonexistent prefix")
+	}
+
+	info, err := cs.Stat("acme/example.com/sites/example.com/example.com.key")
+	if err != nil || !info.IsTerminal || info.Size != 3 || time.Since(info.Modified) > time.Minute {
+		t.Errorf("Expected terminal key info, got %+v (error: %v)", info, err)
+	}
+	info, err = cs.Stat("acme/example.com/sites")
+	if err != nil || info.IsTerminal || info.Modified.IsZero() {
+		t.Errorf("Expected non-terminal key info, got %+v (error: %v)", info, err)
+	}
+
+	err = cs.Commit(nil, []StorageOp{
+		{Key: "acme/example.com/sites/example.com/example.com.json", Value: []byte("{}")},
+		{Key: "acme/example.com/sites/example.com/example.com.key", Delete: true},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error committing, got: %v", err)
+	}
+	if cs.Exists("acme/example.com/sites/example.com/example.com.key") || !cs.Exists("acme/example.com/sites/example.com/example.com.json") {
+		t.Errorf("Expected commit to apply all operations")
+	}
+
+	if err := cs.Delete("acme/example.com"); err != nil {
+		t.Fatalf("Expected no error deleting, got: %v", err)
+	}
+	if cs.Exists("acme/example.com/sites/example.com/example.com.crt") || cs.Exists("acme") {
+		t.Errorf("Expected deleting non-terminal key to delete the keys it contains")
+	}
+	if err := cs.Delete("acme"); err == nil {
+		t.Errorf("Expected error deleting nonexistent key")
+	}
+
+	cs.Token = "wrong"
+	if err := cs.Store("foo", []byte("bar")); err == nil {
+		t.Errorf("Expected error with wrong token")
+	}
+}
+
+func TestConsulStorageLocks(t *testing.T) {
+	fc, server := newFakeConsul()
+	defer server.Close()
+	cs := &ConsulStorage{Address: server.URL, Token: "sekrit", Prefix: "tls"}
+
+	ctx := context.Background()
+	lease1, err := cs.LockLease(ctx, "example.com", time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error obtaining lease, got: %v", err)
+	}
+	if err := cs.StoreFenced(lease1, "foo", []byte("1")); err != nil {
+		t.Errorf("Expected no error storing with held lease, got: %v", err)
+	}
+
+	// the lock is held, so obtaining it again must wait
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := cs.LockLease(timeoutCtx, "example.com", time.Minute); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded waiting for held lock, got: %v", err)
+	}
+
+	// lock keys are not listed as stored keys
+	if keys, err := cs.List("", true); err != nil || !reflect.DeepEqual(keys, []string{"foo"}) {
+		t.Errorf("Expected only stored keys to be listed, got %v (error: %v)", keys, err)
+	}
+
+	// as if the session expired
+	fc.mu.Lock()
+	fc.destroySession(lease1.(*consulLease).session)
+	fc.mu.Unlock()
+
+	lease2, err := cs.LockLease(ctx, "example.com", time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error obtaining lease after session expired, got: %v", err)
+	}
+	defer lease2.Release()
+	if lease2.Token() <= lease1.Token() {
+		t.Errorf("Expected fencing token to increase, got %d then %d", lease1.Token(), lease2.Token())
+	}
+	if err := cs.StoreFenced(lease1, "foo", []byte("stale")); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost storing with stale lease, got: %v", err)
+	}
+	if value, _ := cs.Load("foo"); string(value) != "1" {
+		t.Errorf("Expected stale write to be rejected, got %q", value)
+	}
+	if err := cs.StoreFenced(lease2, "foo", []byte("2")); err != nil {
+		t.Errorf("Expected no error storing with current lease, got: %v", err)
+	}
+
+	if err := cs.Lock("other"); err != nil {
+		t.Fatalf("Expected no error locking, got: %v", err)
+	}
+	if err := cs.Unlock("other"); err != nil {
+		t.Errorf("Expected no error unlocking, got: %v", err)
+	}
+	if err := cs.Unlock("other"); err == nil {
+		t.Errorf("Expected error unlocking lock that is not held")
+	}
+}
@@ -40,6 +40,8 @@ func encodePrivateKey(key crypto.PrivateKey) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case *RemoteKey:
+		return encodeRemoteKeyReference(key)
 	default:
 		return nil, fmt.Errorf("unsupported key type: %T", key)
 	}
@@ -53,6 +55,13 @@ func encodePrivateKey(key crypto.PrivateKey) ([]byte, error) {
 // https://github.com/golang/go/blob/693748e9fa385f1e2c3b91ca9acbb6c0ad2d133d/src/crypto/tls/tls.go#L238)
 func decodePrivateKey(keyPEMBytes []byte) (crypto.PrivateKey, error) {
 	keyBlockDER, _ := pem.Decode(keyPEMBytes)
+	if keyBlockDER == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	if keyBlockDER.Type == remoteKeyPEMType {
+		return decodeRemoteKeyReference(keyBlockDER)
+	}
 
 	if keyBlockDER.Type != "PRIVATE KEY" && !strings.HasSuffix(keyBlockDER.Type, " PRIVATE KEY") {
 		return nil, fmt.Errorf("unknown PEM header %q", keyBlockDER.Type)
@@ -116,12 +125,19 @@ func fastHash(input []byte) string {
 // includes the certificate file itself, the private key, and the
 // metadata file.
 func (cfg *Config) saveCertResource(cert CertificateResource) error {
+	return cfg.saveCertResourceWithLease(nil, cert)
+}
+
+// saveCertResourceWithLease is like saveCertResource, but the
+// certificate resource is only saved while lease is current,
+// if the storage supports fencing.
+func (cfg *Config) saveCertResourceWithLease(lease Lease, cert CertificateResource) error {
 	metaBytes, err := json.MarshalIndent(cert, "", "\t")
 	if err != nil {
 		return fmt.Errorf("encoding certificate metadata: %v", err)
 	}
 
-	issuerKey := cfg.Issuer.IssuerKey()
+	issuerKey := cfg.issuerKey()
 	certKey := cert.NamesKey()
 
 	all := []keyValue{
@@ -139,12 +155,12 @@ func (cfg *Config) saveCertResource(cert CertificateResource) error {
 		},
 	}
 
-	return storeTx(cfg.Storage, all)
+	return storeTx(cfg.Storage, lease, all)
 }
 
 func (cfg *Config) loadCertResource(certNamesKey string) (CertificateResource, error) {
 	var certRes CertificateResource
-	issuerKey := cfg.Issuer.IssuerKey()
+	issuerKey := cfg.issuerKey()
 	certBytes, err := cfg.Storage.Load(StorageKeys.SiteCert(issuerKey, certNamesKey))
 	if err != nil {
 		return CertificateResource{}, err
@@ -263,3 +279,29 @@ const (
 	RSA4096 = KeyType("rsa4096")
 	RSA8192 = KeyType("rsa8192")
 )
+
+// keyTypeOf returns the type of the key pub, or
+// an empty KeyType if it is not a known type.
+func keyTypeOf(pub crypto.PublicKey) KeyType {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return P256
+		case elliptic.P384():
+			return P384
+		}
+	case *rsa.PublicKey:
+		switch pub.N.BitLen() {
+		case 2048:
+			return RSA2048
+		case 4096:
+			return RSA4096
+		case 8192:
+			return RSA8192
+		}
+	case ed25519.PublicKey:
+		return ED25519
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package otomatik
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/miekg/dns"
+)
+
+// DNSChallengeDelegator is a DNS provider that publishes DNS-01
+// challenge records somewhere other than _acme-challenge.<domain>,
+// usually because that name is delegated via CNAME to a dedicated
+// validation zone. When ACMEManager.DNSProvider implements this
+// interface, DNS propagation is checked at the delegated name.
+type DNSChallengeDelegator interface {
+	challenge.Provider
+
+	// ChallengeRecordName returns the fully-qualified name
+	// at which the challenge TXT record for domain is placed.
+	ChallengeRecordName(domain string) (string, error)
+}
+
+// TXTRecordProvider can publish and remove TXT records
+// in zones it controls, given their fully-qualified names.
+type TXTRecordProvider interface {
+	// PresentTXT adds a TXT record with value at fqdn.
+	PresentTXT(fqdn, value string) error
+
+	// CleanUpTXT removes the TXT record with value at fqdn.
+	CleanUpTXT(fqdn, value string) error
+}
+
+// DelegatedDNSProvider solves the DNS-01 challenge for names that
+// delegate their _acme-challenge label to a validation zone with a
+// CNAME record, such that only the validation zone needs to be
+// controlled by Provider. If a name has no such delegation, the
+// record is placed at the usual _acme-challenge name, which must
+// then be in a zone controlled by Provider.
+type DelegatedDNSProvider struct {
+	// The provider which controls the validation zone - REQUIRED.
+	Provider TXTRecordProvider
+
+	// The recursive DNS resolvers (host:port) to use when
+	// following CNAMEs; if empty, the system's are used.
+	Resolvers []string
+
+	// How long to wait for records to propagate, and how
+	// often to check; if unset, lego's defaults are used.
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+}
+
+// Present publishes the challenge record for domain at the end of
+// its _acme-challenge CNAME chain.
+func (p *DelegatedDNSProvider) Present(domain, token, keyAuth string) error {
+	fqdn, err := p.ChallengeRecordName(domain)
+	if err != nil {
+		return err
+	}
+	_, value := dns01.GetRecord(domain, keyAuth)
+	return p.Provider.PresentTXT(fqdn, value)
+}
+
+// CleanUp removes the challenge record for domain.
+func (p *DelegatedDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	fqdn, err := p.ChallengeRecordName(domain)
+	if err != nil {
+		return err
+	}
+	_, value := dns01.GetRecord(domain, keyAuth)
+	return p.Provider.CleanUpTXT(fqdn, value)
+}
+
+// ChallengeRecordName follows the CNAME chain starting at
+// _acme-challenge.<domain> and returns the name at its end.
+func (p *DelegatedDNSProvider) ChallengeRecordName(domain string) (string, error) {
+	return followCNAMEs(challengeRecordName(domain), p.Resolvers)
+}
+
+// Timeout returns the propagation timeout and polling interval.
+func (p *DelegatedDNSProvider) Timeout() (timeout, interval time.Duration) {
+	return propagationTimeout(p.PropagationTimeout, p.PollingInterval)
+}
+
+// propagationTimeout returns timeout and interval, or the
+// defaults of lego's DNS-01 solver for those that are zero.
+func propagationTimeout(timeout, interval time.Duration) (time.Duration, time.Duration) {
+	if timeout == 0 {
+		timeout = dns01.DefaultPropagationTimeout
+	}
+	if interval == 0 {
+		interval = dns01.DefaultPollingInterval
+	}
+	return timeout, interval
+}
+
+// challengeRecordName returns the conventional, undelegated
+// name of the DNS-01 challenge record for domain.
+func challengeRecordName(domain string) string {
+	return dns.Fqdn("_acme-challenge." + strings.TrimPrefix(domain, "*."))
+}
+
+// followCNAMEs resolves the chain of CNAME records starting
+// at name and returns the fully-qualified name at the end of
+// the chain, which is name itself if it is not an alias.
+func followCNAMEs(name string, resolvers []string) (string, error) {
+	if len(resolvers) == 0 {
+		resolvers = systemResolvers()
+	}
+	name = dns.Fqdn(name)
+	seen := make(map[string]bool)
+	for i := 0; i < maxCNAMEHops; i++ {
+		seen[strings.ToLower(name)] = true
+		resp, err := dnsExchange(name, dns.TypeCNAME, resolvers, true, 0)
+		if err != nil {
+			return "", fmt.Errorf("following CNAME records from %s: %v", name, err)
+		}
+		var target string
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = dns.Fqdn(cname.Target)
+				break
+			}
+		}
+		if target == "" {
+			return name, nil
+		}
+		if seen[strings.ToLower(target)] {
+			return "", fmt.Errorf("CNAME loop at %s", target)
+		}
+		name = target
+	}
+	return "", fmt.Errorf("too many CNAME hops from %s", name)
+}
+
+// dnsChallengeOptions returns the options to use with
+// manager's DNS provider when solving the DNS challenge.
+func (manager *ACMEManager) dnsChallengeOptions() []dns01.ChallengeOption {
+	var opts []dns01.ChallengeOption
+	if delegator, ok := manager.DNSProvider.(DNSChallengeDelegator); ok {
+		// check propagation at the delegated name, since the
+		// authoritative servers of the original name will
+		// only ever answer with the CNAME
+		opts = append(opts, dns01.WrapPreCheck(func(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+			target, err := delegator.ChallengeRecordName(domain)
+			if err != nil {
+				return false, err
+			}
+			return check(target, value)
+		}))
+	}
+	if manager.DNSChallengeOption != nil {
+		opts = append(opts, manager.DNSChallengeOption)
+	}
+	return opts
+}
+
+// maxCNAMEHops is how many aliases to follow before giving up.
+const maxCNAMEHops = 8
+
+// Interface guard
+var _ DNSChallengeDelegator = (*DelegatedDNSProvider)(nil)
@@ -0,0 +1,87 @@
+package otomatik
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// systemResolvers returns the recursive DNS servers configured
+// for this system as host:port pairs. If none can be found, some
+// well-known public resolvers are returned instead.
+func systemResolvers() []string {
+	conf, err := dns.ClientConfigFromFile(resolvConfPath)
+	if err != nil || len(conf.Servers) == 0 {
+		return fallbackResolvers
+	}
+	servers := make([]string, 0, len(conf.Servers))
+	for _, s := range conf.Servers {
+		servers = append(servers, normalizeResolver(s, conf.Port))
+	}
+	return servers
+}
+
+// normalizeResolver ensures that server has a port; if it
+// does not, port (or 53, if port is empty) is appended.
+func normalizeResolver(server, port string) string {
+	if port == "" {
+		port = "53"
+	}
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server // already host:port
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), port)
+}
+
+// dnsExchange sends a query for name of type qtype to each of
+// servers in turn until one of them answers without error. If
+// the UDP response is truncated, the query is retried over TCP.
+// The name is made fully-qualified if it is not already.
+func dnsExchange(name string, qtype uint16, servers []string, recursive bool, timeout time.Duration) (*dns.Msg, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no DNS servers to query")
+	}
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(4096, false)
+	m.RecursionDesired = recursive
+
+	var lastErr error
+	for _, server := range servers {
+		udp := &dns.Client{Net: "udp", Timeout: timeout}
+		in, _, err := udp.Exchange(m, server)
+		if in != nil && in.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: timeout}
+			in, _, err = tcp.Exchange(m, server)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("querying %s for %s %s: %v", server, dns.TypeToString[qtype], name, err)
+			continue
+		}
+		if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("querying %s for %s %s: %s", server, dns.TypeToString[qtype], name, dns.RcodeToString[in.Rcode])
+			continue
+		}
+		return in, nil
+	}
+	return nil, lastErr
+}
+
+// resolvConfPath is the path to the system's resolver configuration.
+const resolvConfPath = "/etc/resolv.conf"
+
+// defaultDNSTimeout is how long to wait for a response to a DNS query.
+const defaultDNSTimeout = 10 * time.Second
+
+// fallbackResolvers are used if the system's resolvers cannot be determined.
+var fallbackResolvers = []string{
+	"8.8.8.8:53",
+	"1.1.1.1:53",
+}
@@ -1,7 +1,9 @@
 package otomatik
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +12,9 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,16 +23,23 @@ import (
 // cross-platform way or persisting ACME assets on the file system.
 type FileStorage struct {
 	Path string
+
+	// How often to check for changes to the keys
+	// being watched (see Watch); if unset,
+	// DefaultFileStorageWatchInterval is used.
+	WatchInterval time.Duration
 }
 
 // Exists returns true if key exists in fs.
 func (fs *FileStorage) Exists(key string) bool {
+	fs.recoverTransactions()
 	_, err := os.Stat(fs.Filename(key))
 	return !os.IsNotExist(err)
 }
 
 // Store saves value at key.
 func (fs *FileStorage) Store(key string, value []byte) error {
+	fs.recoverTransactions()
 	filename := fs.Filename(key)
 	err := os.MkdirAll(filepath.Dir(filename), 0700)
 	if err != nil {
@@ -38,6 +50,7 @@ func (fs *FileStorage) Store(key string, value []byte) error {
 
 // Load retrieves the value at key.
 func (fs *FileStorage) Load(key string) ([]byte, error) {
+	fs.recoverTransactions()
 	contents, err := ioutil.ReadFile(fs.Filename(key))
 	if os.IsNotExist(err) {
 		return nil, ErrNotExist(err)
@@ -47,6 +60,7 @@ func (fs *FileStorage) Load(key string) ([]byte, error) {
 
 // Delete deletes the value at key.
 func (fs *FileStorage) Delete(key string) error {
+	fs.recoverTransactions()
 	err := os.Remove(fs.Filename(key))
 	if os.IsNotExist(err) {
 		return ErrNotExist(err)
@@ -56,6 +70,7 @@ func (fs *FileStorage) Delete(key string) error {
 
 // List returns all keys that match prefix.
 func (fs *FileStorage) List(prefix string, recursive bool) ([]string, error) {
+	fs.recoverTransactions()
 	var keys []string
 	walkPrefix := fs.Filename(prefix)
 
@@ -69,6 +84,9 @@ func (fs *FileStorage) List(prefix string, recursive bool) ([]string, error) {
 		if fpath == walkPrefix {
 			return nil
 		}
+		if fpath == fs.txDir() {
+			return filepath.SkipDir // staged transactions are not keys
+		}
 
 		suffix, err := filepath.Rel(walkPrefix, fpath)
 		if err != nil {
@@ -87,6 +105,7 @@ func (fs *FileStorage) List(prefix string, recursive bool) ([]string, error) {
 
 // Stat returns information about key.
 func (fs *FileStorage) Stat(key string) (KeyInfo, error) {
+	fs.recoverTransactions()
 	fi, err := os.Stat(fs.Filename(key))
 	if os.IsNotExist(err) {
 		return KeyInfo{}, ErrNotExist(err)
@@ -110,31 +129,62 @@ func (fs *FileStorage) Filename(key string) string {
 
 // Lock obtains a lock named by the given key. It blocks
 // until the lock can be obtained or an error is returned.
+// The lock is held with a lease of DefaultLockTTL, which
+// is renewed until Unlock is called.
 func (fs *FileStorage) Lock(key string) error {
+	_, err := fs.LockLease(context.Background(), key, DefaultLockTTL)
+	return err
+}
+
+// LockLease obtains a lease on the lock named by the given key.
+// It blocks until the lock can be obtained, ctx is done, or an
+// error is returned. The lease is renewed every third of ttl
+// until it is released; if the lock file is removed or taken
+// over by another process in the meantime, the lease is lost.
+func (fs *FileStorage) LockLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
 	filename := fs.lockFilename(key)
 
+	// the newest token seen in stale lock files, which
+	// may be newer than the last one issued if their
+	// holders did not get to record it
+	var staleToken uint64
+
 	for {
-		err := createLockfile(filename)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// the lock file is created with its fencing token, so
+		// that it is never without one for other processes to see
+		token, err := fs.fencingToken(key)
+		if err != nil {
+			return nil, fmt.Errorf("reading fencing token: %v", err)
+		}
+		if staleToken > token {
+			token = staleToken
+		}
+		token++
+
+		err = createLockfile(filename, token, ttl)
 		if err == nil {
 			// got the lock, yay
-			return nil
+			lease, err := fs.startLease(key, filename, token, ttl)
+			if err == errStaleFencingToken {
+				continue
+			}
+			return lease, err
 		}
 		if !os.IsExist(err) {
 			// unexpected error
-			return fmt.Errorf("creating lock file: %v", err)
+			return nil, fmt.Errorf("creating lock file: %v", err)
 		}
 
 		// lock file already exists
 
-		var meta lockMeta
-		f, err := os.Open(filename)
-		if err == nil {
-			err2 := json.NewDecoder(f).Decode(&meta)
-			f.Close()
-			if err2 != nil {
-				return err2
-			}
-		}
+		meta, err := readLockfile(filename)
 
 		switch {
 		case os.IsNotExist(err):
@@ -143,19 +193,26 @@ func (fs *FileStorage) Lock(key string) error {
 
 		case err != nil:
 			// unexpected error
-			return fmt.Errorf("accessing lock file: %v", err)
+			return nil, fmt.Errorf("accessing lock file: %v", err)
 
 		case fileLockIsStale(meta):
 			// lock file is stale - delete it and try again to create one
 			log.Printf("[INFO][%s] Lock for '%s' is stale (created: %s, last update: %s); removing then retrying: %s",
 				fs, key, meta.Created, meta.Updated, filename)
+			if meta.Token > staleToken {
+				staleToken = meta.Token
+			}
 			removeLockfile(filename)
 			continue
 
 		default:
 			// lockfile exists and is not stale;
 			// just wait a moment and try again
-			time.Sleep(fileLockPollInterval)
+			select {
+			case <-time.After(fileLockPollInterval):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		}
 	}
 }
@@ -165,6 +222,341 @@ func (fs *FileStorage) Unlock(key string) error {
 	return removeLockfile(fs.lockFilename(key))
 }
 
+// StoreFenced saves value at key, unless lease has been
+// lost or a newer lease has been granted for its lock.
+// Note that the check and the write are not atomic.
+func (fs *FileStorage) StoreFenced(lease Lease, key string, value []byte) error {
+	if err := fs.checkFence(lease); err != nil {
+		return err
+	}
+	return fs.Store(key, value)
+}
+
+// checkFence returns ErrLeaseLost if lease has been lost
+// or a newer lease has been granted for its lock.
+func (fs *FileStorage) checkFence(lease Lease) error {
+	if leaseIsLost(lease) {
+		return ErrLeaseLost
+	}
+	if _, ok := lease.(*fileLease); ok {
+		current, err := fs.fencingToken(lease.Key())
+		if err != nil {
+			return err
+		}
+		if current > lease.Token() {
+			return ErrLeaseLost
+		}
+	}
+	return nil
+}
+
+// Commit applies ops atomically. The new values are first
+// written to a staging directory, followed by a journal of
+// the changes; once the journal is in place, the transaction
+// is committed, and the changes are applied by renaming the
+// staged files into place. If the process dies while the
+// changes are being applied, they are applied the next time
+// the storage is used.
+func (fs *FileStorage) Commit(lease Lease, ops []StorageOp) error {
+	fs.recoverTransactions()
+
+	if lease != nil {
+		if err := fs.checkFence(lease); err != nil {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(fs.txDir(), 0700)
+	if err != nil {
+		return err
+	}
+	stageDir, err := ioutil.TempDir(fs.txDir(), "tx-")
+	if err != nil {
+		return fmt.Errorf("creating staging directory: %v", err)
+	}
+
+	journal := make([]txJournalEntry, len(ops))
+	for i, op := range ops {
+		journal[i] = txJournalEntry{Key: op.Key, Delete: op.Delete}
+		if op.Delete {
+			continue
+		}
+		err := writeFileSync(filepath.Join(stageDir, strconv.Itoa(i)), op.Value, 0600)
+		if err != nil {
+			os.RemoveAll(stageDir)
+			return fmt.Errorf("staging %s: %v", op.Key, err)
+		}
+	}
+
+	err = writeTxJournal(stageDir, journal)
+	if err != nil {
+		os.RemoveAll(stageDir)
+		return fmt.Errorf("writing transaction journal: %v", err)
+	}
+
+	// the transaction is now committed; if applying it fails,
+	// it will be completed when the storage is next opened
+	err = fs.applyTransaction(stageDir, journal)
+	if err != nil {
+		txRecovered.Delete(fs.Path) // try again on next use
+		return fmt.Errorf("applying committed transaction %s: %v", stageDir, err)
+	}
+	return os.RemoveAll(stageDir)
+}
+
+// applyTransaction applies the changes in journal, whose
+// staged values are in stageDir. It is idempotent, so that
+// an interrupted transaction can be applied again.
+func (fs *FileStorage) applyTransaction(stageDir string, journal []txJournalEntry) error {
+	for i, entry := range journal {
+		filename := fs.Filename(entry.Key)
+		if entry.Delete {
+			err := os.Remove(filename)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(filename), 0700)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(stageDir, strconv.Itoa(i)), filename)
+		if os.IsNotExist(err) {
+			continue // already applied
+		}
+		if err != nil {
+			return err
+		}
+		syncDir(filepath.Dir(filename))
+	}
+	return nil
+}
+
+// recoverTransactions completes transactions that were
+// committed but not fully applied, and discards staged
+// transactions that were never committed, for example
+// because the process crashed or the machine lost power.
+// Once every transaction has been recovered, it is not
+// done again for the storage path in this process.
+//
+// Note that it cannot tell transactions interrupted by a
+// crash apart from those being committed by another process
+// at the same moment; re-applying such a transaction is
+// harmless unless it deletes keys that are being written
+// again concurrently, which certificate maintenance avoids
+// by holding locks.
+func (fs *FileStorage) recoverTransactions() {
+	if _, ok := txRecovered.Load(fs.Path); ok {
+		return
+	}
+	txRecoveryMu.Lock()
+	defer txRecoveryMu.Unlock()
+	if _, ok := txRecovered.Load(fs.Path); ok {
+		return
+	}
+
+	dirs, err := ioutil.ReadDir(fs.txDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR][%s] Reading transactions: %v", fs, err)
+			return
+		}
+		txRecovered.Store(fs.Path, true)
+		return
+	}
+	failed := false
+	for _, fi := range dirs {
+		stageDir := filepath.Join(fs.txDir(), fi.Name())
+		journal, err := readTxJournal(stageDir)
+		switch {
+		case os.IsNotExist(err):
+			if time.Since(fi.ModTime()) < staleTxAge {
+				continue // probably still being staged by another process
+			}
+		case err != nil:
+			log.Printf("[ERROR][%s] Reading journal of transaction %s: %v", fs, stageDir, err)
+			failed = true
+			continue
+		default:
+			err = fs.applyTransaction(stageDir, journal)
+			if err != nil {
+				log.Printf("[ERROR][%s] Completing interrupted transaction %s: %v", fs, stageDir, err)
+				failed = true
+				continue
+			}
+			log.Printf("[INFO][%s] Completed interrupted transaction: %s", fs, stageDir)
+		}
+		os.RemoveAll(stageDir)
+	}
+	if !failed {
+		txRecovered.Store(fs.Path, true)
+	}
+}
+
+func (fs *FileStorage) txDir() string {
+	return filepath.Join(fs.Path, "transactions")
+}
+
+// startLease starts maintaining the lease on the lock at
+// filename, which must have just been created by us with
+// token, and records token as the last one issued. If a token
+// at least as new was issued in the meantime, it removes the
+// lock file and returns errStaleFencingToken, and obtaining
+// the lock should be retried with a new token.
+func (fs *FileStorage) startLease(key, filename string, token uint64, ttl time.Duration) (Lease, error) {
+	current, err := fs.fencingToken(key)
+	if err != nil {
+		removeOwnLockfile(filename, token)
+		return nil, fmt.Errorf("reading fencing token: %v", err)
+	}
+	if current >= token {
+		removeOwnLockfile(filename, token)
+		return nil, errStaleFencingToken
+	}
+	if err := fs.storeFencingToken(key, token); err != nil {
+		removeOwnLockfile(filename, token)
+		return nil, fmt.Errorf("issuing fencing token: %v", err)
+	}
+
+	// make sure the lock was not taken over before the token
+	// was recorded, for example because we were paused
+	gone, err := updateLockfileFreshness(filename, token, ttl)
+	if err != nil {
+		removeOwnLockfile(filename, token)
+		return nil, fmt.Errorf("writing lock file: %v", err)
+	}
+	if gone {
+		return nil, ErrLeaseLost
+	}
+
+	lease := &fileLease{
+		key:      key,
+		filename: filename,
+		token:    token,
+		ttl:      ttl,
+		lost:     closeOnce{ch: make(chan struct{})},
+		released: closeOnce{ch: make(chan struct{})},
+	}
+	go lease.keepFresh()
+	return lease, nil
+}
+
+// fencingToken returns the most recent fencing
+// token issued for the lock named by key.
+func (fs *FileStorage) fencingToken(key string) (uint64, error) {
+	contents, err := ioutil.ReadFile(fs.lockFilename(key) + ".fence")
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+}
+
+// storeFencingToken records token as the last fencing token
+// issued for the lock named by key. It must only be called
+// while holding the lock.
+func (fs *FileStorage) storeFencingToken(key string, token uint64) error {
+	filename := fs.lockFilename(key) + ".fence"
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(token, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Watch sends the keys within prefix that change until ctx is
+// done. Changes are found by polling the file system every
+// fs.WatchInterval, which works on any file system, including
+// network file systems shared by several machines. Every poll
+// walks the files within prefix, so it is best done only when
+// the storage is shared.
+func (fs *FileStorage) Watch(ctx context.Context, prefix string) (<-chan string, error) {
+	last, err := fs.watchSnapshot(prefix)
+	if err != nil {
+		return nil, err
+	}
+	changes := make(chan string)
+	go func() {
+		defer close(changes)
+		interval := fs.WatchInterval
+		if interval <= 0 {
+			interval = DefaultFileStorageWatchInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, err := fs.watchSnapshot(prefix)
+			if err != nil {
+				log.Printf("[ERROR][%s] Watching %s: %v", fs, prefix, err)
+				continue
+			}
+			var changed []string
+			for key, info := range current {
+				if prev, ok := last[key]; !ok || prev != info {
+					changed = append(changed, key)
+				}
+			}
+			for key := range last {
+				if _, ok := current[key]; !ok {
+					changed = append(changed, key)
+				}
+			}
+			last = current
+			for _, key := range changed {
+				select {
+				case changes <- key:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// watchSnapshot returns the modification time and size of
+// every file within prefix, keyed by storage key. Lock and
+// transaction files are not keys, so they are skipped.
+func (fs *FileStorage) watchSnapshot(prefix string) (map[string]fileWatchInfo, error) {
+	snapshot := make(map[string]fileWatchInfo)
+	err := filepath.Walk(fs.Filename(prefix), func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if fpath == fs.lockDir() || fpath == fs.txDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		key, err := filepath.Rel(fs.Path, fpath)
+		if err != nil {
+			return err
+		}
+		snapshot[filepath.ToSlash(key)] = fileWatchInfo{modified: info.ModTime(), size: info.Size()}
+		return nil
+	})
+	return snapshot, err
+}
+
+// fileWatchInfo is what is compared to tell
+// whether a file has changed while watching.
+type fileWatchInfo struct {
+	modified time.Time
+	size     int64
+}
+
 func (fs *FileStorage) String() string {
 	return "FileStorage:" + fs.Path
 }
@@ -178,27 +570,36 @@ func (fs *FileStorage) lockDir() string {
 }
 
 func fileLockIsStale(meta lockMeta) bool {
+	if !meta.Expires.IsZero() {
+		return time.Now().After(meta.Expires)
+	}
+	// lock files written by older versions have no
+	// expiration, so assume they were held with the
+	// default TTL
 	ref := meta.Updated
 	if ref.IsZero() {
 		ref = meta.Created
 	}
-	// since updates are exactly every lockFreshnessInterval,
-	// add a grace period for the actual file read+write to
-	// take place
-	return time.Since(ref) > lockFreshnessInterval*2
+	return time.Since(ref) > DefaultLockTTL
 }
 
 // createLockfile atomically creates the lockfile
-// identified by filename. A successfully created
-// lockfile should be removed with removeLockfile.
-func createLockfile(filename string) error {
-	err := atomicallyCreateFile(filename, true)
+// identified by filename, with the fencing token
+// and an expiration ttl from now. A successfully
+// created lockfile should be removed with
+// removeLockfile.
+func createLockfile(filename string, token uint64, ttl time.Duration) error {
+	now := time.Now()
+	err := atomicallyCreateFile(filename, &lockMeta{
+		Created: now,
+		Updated: now,
+		Expires: now.Add(ttl),
+		Token:   token,
+	})
 	if err != nil {
 		return err
 	}
 
-	go keepLockfileFresh(filename)
-
 	// if the app crashes in removeLockfile(), there is a
 	// small chance the .unlock file is left behind; it's
 	// safe to simply remove it as it's a guard against
@@ -207,13 +608,34 @@ func createLockfile(filename string) error {
 	return nil
 }
 
+// readLockfile reads the metadata of the lockfile at filename.
+// If the metadata cannot be decoded, for example because it is
+// being rewritten, the file's modification time is used as the
+// time it was last updated.
+func readLockfile(filename string) (lockMeta, error) {
+	var meta lockMeta
+	f, err := os.Open(filename)
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&meta); err != nil {
+		fi, err := f.Stat()
+		if err != nil {
+			return meta, err
+		}
+		return lockMeta{Updated: fi.ModTime()}, nil
+	}
+	return meta, nil
+}
+
 // removeLockfile atomically removes filename,
 // which must be a lockfile created by createLockfile.
 // See discussion in PR #7 for more background:
 // https://github.com/caddyserver/otomatik/pull/7
 func removeLockfile(filename string) error {
 	unlockFilename := filename + ".unlock"
-	if err := atomicallyCreateFile(unlockFilename, false); err != nil {
+	if err := atomicallyCreateFile(unlockFilename, nil); err != nil {
 		if os.IsExist(err) {
 			// another process is handling the unlocking
 			return nil
@@ -224,66 +646,124 @@ func removeLockfile(filename string) error {
 	return os.Remove(filename)
 }
 
-// keepLockfileFresh continuously updates the lock file
-// at filename with the current timestamp. It stops
-// when the file disappears (happy path = lock released),
-// or when there is an error at any point. Since it polls
-// every lockFreshnessInterval, this function might
-// not terminate until up to lockFreshnessInterval after
-// the lock is released.
-func keepLockfileFresh(filename string) {
+// removeOwnLockfile removes filename if it still
+// has token, that is, if it was not taken over.
+func removeOwnLockfile(filename string, token uint64) {
+	meta, err := readLockfile(filename)
+	if err == nil && meta.Token == token {
+		removeLockfile(filename)
+	}
+}
+
+// fileLease is a lease on a lock file.
+type fileLease struct {
+	key      string
+	filename string
+	token    uint64
+	ttl      time.Duration
+	lost     closeOnce
+	released closeOnce
+}
+
+func (l *fileLease) Key() string           { return l.key }
+func (l *fileLease) Token() uint64         { return l.token }
+func (l *fileLease) Lost() <-chan struct{} { return l.lost.ch }
+
+// Release removes the lock file, unless the
+// lock has been taken over by another process.
+func (l *fileLease) Release() error {
+	l.released.close()
+	meta, err := readLockfile(l.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if meta.Token != l.token {
+		return ErrLeaseLost
+	}
+	return removeLockfile(l.filename)
+}
+
+// keepFresh renews the lease every third of its TTL until
+// it is released. If the lock file disappears or is taken
+// over, or if it cannot be renewed before it expires, the
+// lease is lost.
+func (l *fileLease) keepFresh() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	expires := time.Now().Add(l.ttl)
 	for {
-		time.Sleep(lockFreshnessInterval)
-		done, err := updateLockfileFreshness(filename)
-		if err != nil {
-			log.Printf("[ERROR] Keeping lock file fresh: %v - terminating lock maintenance (lockfile: %s)", err, filename)
+		select {
+		case <-l.released.ch:
 			return
+		case <-ticker.C:
 		}
-		if done {
+		renewedAt := time.Now()
+		gone, err := updateLockfileFreshness(l.filename, l.token, l.ttl)
+		switch {
+		case gone:
+			l.lost.close()
 			return
+		case err != nil:
+			if time.Now().After(expires) {
+				log.Printf("[ERROR] Keeping lock file fresh: %v - lease expired (lockfile: %s)", err, l.filename)
+				l.lost.close()
+				return
+			}
+			log.Printf("[ERROR] Keeping lock file fresh: %v - will retry (lockfile: %s)", err, l.filename)
+		default:
+			expires = renewedAt.Add(l.ttl)
 		}
 	}
 }
 
 // updateLockfileFreshness updates the lock file at filename
-// with the current timestamp. It returns true if the parent
-// loop can terminate (i.e. no more need to update the lock).
-func updateLockfileFreshness(filename string) (bool, error) {
+// with the current timestamp and an expiration ttl from now.
+// If the lock file is gone or has another token, it returns
+// true, meaning the lock is no longer held.
+func updateLockfileFreshness(filename string, token uint64, ttl time.Duration) (bool, error) {
 	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
 	if os.IsNotExist(err) {
 		return true, nil // lock released
 	}
 	if err != nil {
-		return true, err
+		return false, err
 	}
 	defer f.Close()
 
 	// read contents
 	metaBytes, err := ioutil.ReadAll(io.LimitReader(f, 2048))
 	if err != nil {
-		return true, err
+		return false, err
 	}
 	var meta lockMeta
 	if err := json.Unmarshal(metaBytes, &meta); err != nil {
-		return true, err
+		return false, err
+	}
+	if meta.Token != token {
+		return true, nil // lock taken over
 	}
 
 	// truncate file and reset I/O offset to beginning
 	if err := f.Truncate(0); err != nil {
-		return true, err
+		return false, err
 	}
 	if _, err := f.Seek(0, 0); err != nil {
-		return true, err
+		return false, err
 	}
 
 	// write updated timestamp
 	meta.Updated = time.Now()
+	meta.Expires = meta.Updated.Add(ttl)
 	return false, json.NewEncoder(f).Encode(meta)
 }
 
 // atomicallyCreateFile atomically creates the file
 // identified by filename if it doesn't already exist.
-func atomicallyCreateFile(filename string, writeLockInfo bool) error {
+// If meta is not nil, it is written into the file.
+func atomicallyCreateFile(filename string, meta *lockMeta) error {
 	// no need to check this error, we only really care about the file creation error
 	_ = os.MkdirAll(filepath.Dir(filename), 0700)
 	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
@@ -291,12 +771,7 @@ func atomicallyCreateFile(filename string, writeLockInfo bool) error {
 		return err
 	}
 	defer f.Close()
-	if writeLockInfo {
-		now := time.Now()
-		meta := lockMeta{
-			Created: now,
-			Updated: now,
-		}
+	if meta != nil {
 		err := json.NewEncoder(f).Encode(meta)
 		if err != nil {
 			return err
@@ -336,18 +811,111 @@ func dataDir() string {
 type lockMeta struct {
 	Created time.Time `json:"created,omitempty"`
 	Updated time.Time `json:"updated,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+	Token   uint64    `json:"token,omitempty"`
 }
 
-// lockFreshnessInterval is how often to update
-// a lock's timestamp. Locks with a timestamp
-// more than this duration in the past (plus a
-// grace period for latency) can be considered
-// stale.
-const lockFreshnessInterval = 5 * time.Second
+// errStaleFencingToken is returned by startLease if
+// the token of a newly created lock file is stale.
+var errStaleFencingToken = errors.New("stale fencing token")
 
 // fileLockPollInterval is how frequently
 // to check the existence of a lock file
 const fileLockPollInterval = 1 * time.Second
 
-// Interface guard
-var _ Storage = (*FileStorage)(nil)
+// txJournalEntry is a change recorded in the journal of a
+// FileStorage transaction. The value of the i-th entry, if
+// it is not a deletion, is staged in a file named i.
+type txJournalEntry struct {
+	Key    string `json:"key"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// writeTxJournal atomically writes journal to stageDir,
+// which commits the transaction staged there.
+func writeTxJournal(stageDir string, journal []txJournalEntry) error {
+	journalBytes, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(stageDir, txJournalFilename)
+	err = writeFileSync(filename+".tmp", journalBytes, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(filename+".tmp", filename)
+	if err != nil {
+		return err
+	}
+	syncDir(stageDir)
+	return nil
+}
+
+// readTxJournal reads the journal of the transaction
+// staged in stageDir. It returns an error satisfying
+// os.IsNotExist if the transaction was not committed.
+func readTxJournal(stageDir string) ([]txJournalEntry, error) {
+	journalBytes, err := ioutil.ReadFile(filepath.Join(stageDir, txJournalFilename))
+	if err != nil {
+		return nil, err
+	}
+	var journal []txJournalEntry
+	err = json.Unmarshal(journalBytes, &journal)
+	return journal, err
+}
+
+// writeFileSync is like ioutil.WriteFile, except it
+// flushes the file to disk before returning.
+func writeFileSync(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir flushes the directory entries of dir to disk,
+// so that renames into it survive a loss of power. Not
+// all platforms support this, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	d.Close()
+}
+
+// txRecovered records the storage paths for which
+// interrupted transactions have been recovered; it is
+// read without txRecoveryMu, which serializes recovery.
+var (
+	txRecovered  sync.Map
+	txRecoveryMu sync.Mutex
+)
+
+const txJournalFilename = "journal.json"
+
+// staleTxAge is how old an uncommitted transaction must
+// be before it is assumed to have been abandoned.
+const staleTxAge = time.Minute
+
+// DefaultFileStorageWatchInterval is how often a FileStorage
+// being watched is checked for changes by default.
+const DefaultFileStorageWatchInterval = 2 * time.Second
+
+// Interface guards
+var (
+	_ Storage              = (*FileStorage)(nil)
+	_ TransactionalStorage = (*FileStorage)(nil)
+	_ LeaseLocker          = (*FileStorage)(nil)
+	_ FencedStorage        = (*FileStorage)(nil)
+	_ WatchableStorage     = (*FileStorage)(nil)
+)
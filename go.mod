@@ -3,7 +3,10 @@ module github.com/wondenge/otomatik
 go 1.14
 
 require (
+	github.com/ThalesIgnite/crypto11 v1.2.5
 	github.com/go-acme/lego/v3 v3.5.0
 	github.com/klauspost/cpuid v1.2.3
-	golang.org/x/crypto v0.0.0-20200420201142-3c4aac89819a
+	github.com/miekg/dns v1.1.27
+	golang.org/x/crypto v0.11.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
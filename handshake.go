@@ -2,6 +2,7 @@ package otomatik
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -172,26 +173,37 @@ func (cfg *Config) selectCert(hello *tls.ClientHelloInfo, name string) (Certific
 
 // DefaultCertificateSelector is the default certificate selection logic
 // given a choice of certificates. If there is at least one certificate in
-// choices, it always returns a certificate without error. It chooses the
-// first non-expired certificate that the client supports if possible,
-// otherwise it returns an expired certificate that the client supports,
-// otherwise it just returns the first certificate in the list of choices.
+// choices, it always returns a certificate without error. It chooses a
+// non-expired certificate that the client supports if possible, preferring
+// one with an ECDSA key, so that clients that support ECDSA get an ECDSA
+// certificate and legacy clients get an RSA certificate when both are
+// managed (see Config.AdditionalKeyTypes); otherwise it returns an expired
+// certificate that the client supports, otherwise it just returns the
+// first certificate in the list of choices.
 func DefaultCertificateSelector(hello *tls.ClientHelloInfo, choices []Certificate) (Certificate, error) {
 	if len(choices) == 0 {
 		return Certificate{}, fmt.Errorf("no certificates available")
 	}
 	now := time.Now()
 	best := choices[0]
+	var bestUnexpired bool
 	for _, choice := range choices {
 		if err := hello.SupportsCertificate(&choice.Certificate); err != nil {
 			continue
 		}
-		best = choice // at least the client supports it...
-		if now.After(choice.Leaf.NotBefore) && now.Before(choice.Leaf.NotAfter) {
-			return choice, nil // ...and unexpired, great! "Certificate, I choose you!"
+		unexpired := now.After(choice.Leaf.NotBefore) && now.Before(choice.Leaf.NotAfter)
+		if unexpired {
+			if _, ok := choice.Leaf.PublicKey.(*ecdsa.PublicKey); ok {
+				return choice, nil // supported, unexpired, and ECDSA, great! "Certificate, I choose you!"
+			}
+		}
+		if unexpired && !bestUnexpired {
+			best, bestUnexpired = choice, true // supported and unexpired, but maybe there is an ECDSA one...
+		} else if !bestUnexpired {
+			best = choice // at least the client supports it...
 		}
 	}
-	return best, nil // all matching certs are expired or incompatible, oh well
+	return best, nil // no ECDSA, or all matching certs are expired or incompatible, oh well
 }
 
 // getCertDuringHandshake will get a certificate for hello. It first tries
@@ -324,7 +336,7 @@ func (cfg *Config) obtainOnDemandCertificate(hello *tls.ClientHelloInfo) (Certif
 func (cfg *Config) handshakeMaintenance(hello *tls.ClientHelloInfo, cert Certificate) (Certificate, error) {
 	// Check cert expiration
 	timeLeft := cert.Leaf.NotAfter.Sub(time.Now().UTC())
-	if currentlyInRenewalWindow(cert.Leaf.NotBefore, cert.Leaf.NotAfter, cfg.RenewalWindowRatio) {
+	if cert.NeedsRenewal(cfg) {
 		log.Printf("[INFO] Certificate for %v expires in %s; attempting renewal", cert.Names, timeLeft)
 		return cfg.renewDynamicCertificate(hello, cert)
 	}
@@ -420,10 +432,10 @@ func (cfg *Config) renewDynamicCertificate(hello *tls.ClientHelloInfo, currentCe
 // a TLS-ALPN challenge and a certificate is required to solve it. This method
 // checks the distributed store of challenge info files and, if a matching ServerName
 // is present, it makes a certificate to solve this challenge and returns it. For
-// this to succeed, it requires that cfg.Issuer is of type *ACMEManager.
-// A boolean true is returned if a valid certificate is returned.
+// this to succeed, it requires that the issuer for the ServerName is of type
+// *ACMEManager. A boolean true is returned if a valid certificate is returned.
 func (cfg *Config) tryDistributedChallengeSolver(clientHello *tls.ClientHelloInfo) (Certificate, bool, error) {
-	am, ok := cfg.Issuer.(*ACMEManager)
+	am, ok := cfg.forName(clientHello.ServerName).Issuer.(*ACMEManager)
 	if !ok {
 		return Certificate{}, false, nil
 	}
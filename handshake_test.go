@@ -1,6 +1,7 @@
 package otomatik
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"net"
@@ -91,4 +92,76 @@ func TestGetCertificate(t *testing.T) {
 	} else if cert == nil || len(cert.Leaf.IPAddresses) == 0 {
 		t.Errorf("Expected IP cert, got: %v", cert)
 	}
-}
\ No newline at end of file
+}
+
+func TestDefaultCertificateSelector(t *testing.T) {
+	iss := &testIssuer{key: "selector"}
+	rsaCert := issueTestCertificate(t, iss, RSA2048, "example.com")
+	ecdsaCert := issueTestCertificate(t, iss, P256, "example.com")
+
+	modern := &tls.ClientHelloInfo{
+		ServerName:        "example.com",
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256, tls.PKCS1WithSHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+	}
+	legacy := &tls.ClientHelloInfo{
+		ServerName:        "example.com",
+		SupportedVersions: []uint16{tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.PKCS1WithSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+	}
+
+	for i, test := range []struct {
+		hello   *tls.ClientHelloInfo
+		choices []Certificate
+		expect  Certificate
+	}{
+		{hello: modern, choices: []Certificate{rsaCert, ecdsaCert}, expect: ecdsaCert},
+		{hello: modern, choices: []Certificate{ecdsaCert, rsaCert}, expect: ecdsaCert},
+		{hello: legacy, choices: []Certificate{ecdsaCert, rsaCert}, expect: rsaCert},
+		{hello: legacy, choices: []Certificate{rsaCert, ecdsaCert}, expect: rsaCert},
+		{hello: modern, choices: []Certificate{rsaCert}, expect: rsaCert},
+		{hello: legacy, choices: []Certificate{ecdsaCert}, expect: ecdsaCert}, // nothing better
+	} {
+		cert, err := DefaultCertificateSelector(test.hello, test.choices)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if cert.hash != test.expect.hash {
+			t.Errorf("Test %d: Expected %s certificate, got %s",
+				i, keyTypeOf(test.expect.Leaf.PublicKey), keyTypeOf(cert.Leaf.PublicKey))
+		}
+	}
+}
+
+// issueTestCertificate returns a certificate for name
+// with a key of keyType, issued by iss.
+func issueTestCertificate(t *testing.T, iss *testIssuer, keyType KeyType, name string) Certificate {
+	key, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := new(Config).generateCSR(key, []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := iss.Issue(context.Background(), csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := makeCertificate(issued.Certificate, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
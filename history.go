@@ -0,0 +1,297 @@
+package otomatik
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"time"
+)
+
+// CertificateVersion describes a prior version of a managed
+// certificate, kept in storage when the certificate was
+// replaced (see Config.CertHistory).
+type CertificateVersion struct {
+	// The identifier of the version; versions
+	// sort chronologically by their IDs.
+	ID string
+
+	// The names on the certificate.
+	Names []string
+
+	// The common name of the certificate's issuer.
+	Issuer string
+
+	// The hex-encoded serial number of the certificate.
+	Serial string
+
+	// The certificate's validity period.
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Valid returns true if the certificate
+// version is currently within its validity
+// period.
+func (v CertificateVersion) Valid() bool {
+	now := time.Now()
+	return now.After(v.NotBefore) && now.Before(v.NotAfter)
+}
+
+// CertificateVersions returns the prior versions of the
+// managed certificate for name that are kept in storage,
+// oldest first. The active certificate is not included.
+func (cfg *Config) CertificateVersions(name string) ([]CertificateVersion, error) {
+	cfg = cfg.forName(name)
+	issuerKey := cfg.issuerKey()
+
+	prefix := StorageKeys.CertHistoryPrefix(issuerKey, name)
+	versionKeys, err := cfg.Storage.List(prefix, false)
+	if err != nil && !cfg.Storage.Exists(prefix) {
+		return nil, nil // no history kept yet
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing certificate versions: %v", err)
+	}
+
+	var versions []CertificateVersion
+	for _, versionKey := range versionKeys {
+		id := path.Base(versionKey)
+		certPEM, err := cfg.Storage.Load(StorageKeys.CertHistoryCert(issuerKey, name, id))
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate version %s: %v", id, err)
+		}
+		leaf, err := parseLeafPEM(certPEM)
+		if err != nil {
+			return nil, fmt.Errorf("certificate version %s: %v", id, err)
+		}
+		versions = append(versions, CertificateVersion{
+			ID:        id,
+			Names:     namesFromLeaf(leaf),
+			Issuer:    leaf.Issuer.CommonName,
+			Serial:    fmt.Sprintf("%x", leaf.SerialNumber),
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID < versions[j].ID })
+
+	return versions, nil
+}
+
+// RollbackCertificate makes the prior version of the certificate
+// for name with the given ID the active certificate, in storage
+// and in the cache. The version must still be valid. If history
+// is enabled (see Config.CertHistory), the certificate it replaces
+// is kept as a prior version, so the rollback can be undone.
+//
+// Note that if the restored certificate is due for renewal, it will
+// be renewed at the next maintenance check.
+func (cfg *Config) RollbackCertificate(ctx context.Context, name, versionID string) error {
+	cfg = cfg.forName(name)
+
+	lockKey := cfg.lockKey("cert_acme", name)
+	lease, err := obtainLock(ctx, cfg.Storage, lockKey)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := releaseLock(lease); err != nil {
+			log.Printf("[ERROR][%s] Rollback: Unable to unlock '%s': %v", name, lockKey, err)
+		}
+	}()
+
+	prior, err := cfg.loadCertVersion(name, versionID)
+	if err != nil {
+		return fmt.Errorf("loading certificate version %s: %v", versionID, err)
+	}
+	leaf, err := parseLeafPEM(prior.CertificatePEM)
+	if err != nil {
+		return fmt.Errorf("certificate version %s: %v", versionID, err)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate version %s is not valid now (valid from %s until %s)",
+			versionID, leaf.NotBefore, leaf.NotAfter)
+	}
+
+	current, err := cfg.loadCertResource(name)
+	if err != nil {
+		return fmt.Errorf("loading active certificate: %v", err)
+	}
+	if cfg.CertHistory > 0 {
+		if err := cfg.archiveCertResource(lease, name, current); err != nil {
+			return fmt.Errorf("archiving active certificate: %v", err)
+		}
+	}
+
+	err = cfg.saveCertResourceWithLease(lease, prior)
+	if err != nil {
+		return fmt.Errorf("restoring certificate version %s: %v", versionID, err)
+	}
+	cfg.deleteCertVersion(name, versionID)
+	if cfg.CertHistory > 0 {
+		cfg.pruneCertHistory(name)
+	}
+	cfg.deleteUnusedRemoteKey(name, current.PrivateKeyPEM)
+
+	log.Printf("[INFO][%s] Rolled back certificate to version %s (serial: %x, expires: %s)",
+		name, versionID, leaf.SerialNumber, leaf.NotAfter)
+	cfg.emit("cert_rolled_back", name)
+
+	// serve the restored certificate right away
+	for _, cert := range cfg.certCache.getAllMatchingCerts(name) {
+		if cert.managed {
+			if err := cfg.reloadManagedCertificate(cert); err != nil {
+				return fmt.Errorf("certificate rolled back, but %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// archiveCertResource stores cert as a prior version
+// of the certificate for name.
+func (cfg *Config) archiveCertResource(lease Lease, name string, cert CertificateResource) error {
+	metaBytes, err := json.MarshalIndent(cert, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encoding certificate metadata: %v", err)
+	}
+
+	issuerKey := cfg.issuerKey()
+	versionID := time.Now().UTC().Format(certVersionIDFormat)
+
+	return storeTx(cfg.Storage, lease, []keyValue{
+		{
+			key:   StorageKeys.CertHistoryCert(issuerKey, name, versionID),
+			value: cert.CertificatePEM,
+		},
+		{
+			key:   StorageKeys.CertHistoryPrivateKey(issuerKey, name, versionID),
+			value: cert.PrivateKeyPEM,
+		},
+		{
+			key:   StorageKeys.CertHistoryMeta(issuerKey, name, versionID),
+			value: metaBytes,
+		},
+	})
+}
+
+// pruneCertHistory removes the oldest prior versions of the
+// certificate for name beyond the number to keep. Errors
+// are logged, not returned.
+func (cfg *Config) pruneCertHistory(name string) {
+	versions, err := cfg.CertificateVersions(name)
+	if err != nil {
+		log.Printf("[ERROR][%s] Pruning certificate history: %v", name, err)
+		return
+	}
+	var keyPEMs [][]byte
+	issuerKey := cfg.issuerKey()
+	for i := 0; i < len(versions)-cfg.CertHistory; i++ {
+		keyPEM, err := cfg.Storage.Load(StorageKeys.CertHistoryPrivateKey(issuerKey, name, versions[i].ID))
+		if err == nil {
+			keyPEMs = append(keyPEMs, keyPEM)
+		}
+		cfg.deleteCertVersion(name, versions[i].ID)
+	}
+	for _, keyPEM := range keyPEMs {
+		cfg.deleteUnusedRemoteKey(name, keyPEM)
+	}
+}
+
+// deleteUnusedRemoteKey deletes the remote key that keyPEM refers
+// to from its signer, unless the active certificate for name or one
+// of its prior versions still uses it. If that cannot be determined,
+// the key is kept.
+func (cfg *Config) deleteUnusedRemoteKey(name string, keyPEM []byte) {
+	key := remoteKeyFromPEM(keyPEM)
+	if key == nil {
+		return
+	}
+	usesKey := func(otherPEM []byte) bool {
+		other := remoteKeyFromPEM(otherPEM)
+		return other != nil && other.signerName == key.signerName && other.ID == key.ID
+	}
+
+	issuerKey := cfg.issuerKey()
+	activeKey := StorageKeys.SitePrivateKey(issuerKey, name)
+	activePEM, err := cfg.Storage.Load(activeKey)
+	if err != nil && cfg.Storage.Exists(activeKey) {
+		return
+	}
+	if usesKey(activePEM) {
+		return
+	}
+
+	versions, err := cfg.CertificateVersions(name)
+	if err != nil {
+		return
+	}
+	for _, v := range versions {
+		versionPEM, err := cfg.Storage.Load(StorageKeys.CertHistoryPrivateKey(issuerKey, name, v.ID))
+		if err != nil || usesKey(versionPEM) {
+			return
+		}
+	}
+
+	deleteRemoteKey(keyPEM)
+}
+
+// loadCertVersion loads the prior version of the
+// certificate for name with the given ID.
+func (cfg *Config) loadCertVersion(name, versionID string) (CertificateResource, error) {
+	var certRes CertificateResource
+	issuerKey := cfg.issuerKey()
+	certBytes, err := cfg.Storage.Load(StorageKeys.CertHistoryCert(issuerKey, name, versionID))
+	if err != nil {
+		return CertificateResource{}, err
+	}
+	certRes.CertificatePEM = certBytes
+	keyBytes, err := cfg.Storage.Load(StorageKeys.CertHistoryPrivateKey(issuerKey, name, versionID))
+	if err != nil {
+		return CertificateResource{}, err
+	}
+	certRes.PrivateKeyPEM = keyBytes
+	metaBytes, err := cfg.Storage.Load(StorageKeys.CertHistoryMeta(issuerKey, name, versionID))
+	if err != nil {
+		return CertificateResource{}, err
+	}
+	err = json.Unmarshal(metaBytes, &certRes)
+	if err != nil {
+		return CertificateResource{}, fmt.Errorf("decoding certificate metadata: %v", err)
+	}
+	return certRes, nil
+}
+
+// deleteCertVersion deletes the prior version of the certificate
+// for name with the given ID. Errors are logged, not returned.
+func (cfg *Config) deleteCertVersion(name, versionID string) {
+	issuerKey := cfg.issuerKey()
+	for _, key := range []string{
+		StorageKeys.CertHistoryCert(issuerKey, name, versionID),
+		StorageKeys.CertHistoryPrivateKey(issuerKey, name, versionID),
+		StorageKeys.CertHistoryMeta(issuerKey, name, versionID),
+		StorageKeys.CertHistoryVersion(issuerKey, name, versionID),
+	} {
+		if err := cfg.Storage.Delete(key); err != nil && cfg.Storage.Exists(key) {
+			log.Printf("[ERROR][%s] Deleting certificate version %s: %s: %v", name, versionID, key, err)
+		}
+	}
+}
+
+// parseLeafPEM parses the first certificate in certPEM.
+func parseLeafPEM(certPEM []byte) (*x509.Certificate, error) {
+	certs, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+// certVersionIDFormat is the time format of certificate version
+// IDs, which makes them sort chronologically and safe as keys.
+const certVersionIDFormat = "20060102150405.000000000"
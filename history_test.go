@@ -0,0 +1,83 @@
+package otomatik
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCertificateHistoryAndRollback(t *testing.T) {
+	storage := new(MemoryStorage)
+
+	issuer := &testIssuer{key: "history"}
+	cfg := &Config{
+		Issuer:             issuer,
+		KeySource:          DefaultKeyGenerator,
+		Storage:            storage,
+		RenewalWindowRatio: 1, // always due for renewal
+		CertHistory:        2,
+		certCache:          &Cache{cache: make(map[string]Certificate), cacheIndex: make(map[string][]string)},
+	}
+
+	ctx := context.Background()
+	if err := cfg.ObtainCert(ctx, "example.com", true); err != nil {
+		t.Fatalf("Expected no error obtaining certificate, got: %v", err)
+	}
+	if versions, err := cfg.CertificateVersions("example.com"); err != nil || len(versions) != 0 {
+		t.Fatalf("Expected no prior versions before renewal, got %v (error: %v)", versions, err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := cfg.RenewCert(ctx, "example.com", true); err != nil {
+			t.Fatalf("Expected no error renewing certificate, got: %v", err)
+		}
+	}
+
+	// serials 2, 3 and 4 were replaced; only the last two are kept
+	versions, err := cfg.CertificateVersions("example.com")
+	if err != nil {
+		t.Fatalf("Expected no error listing versions, got: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("Expected 2 prior versions, got %d: %+v", len(versions), versions)
+	}
+	if versions[0].Serial != "3" || versions[1].Serial != "4" {
+		t.Errorf("Expected prior serials 3 and 4 oldest first, got %s and %s", versions[0].Serial, versions[1].Serial)
+	}
+	if versions[1].Issuer != "history" || !versions[1].Valid() || len(versions[1].Names) != 1 || versions[1].Names[0] != "example.com" {
+		t.Errorf("Expected version details from certificate, got %+v", versions[1])
+	}
+
+	cert, err := cfg.CacheManagedCertificate("example.com")
+	if err != nil {
+		t.Fatalf("Expected no error caching certificate, got: %v", err)
+	}
+	if cert.Leaf.SerialNumber.Int64() != 5 {
+		t.Fatalf("Expected active certificate to have serial 5, got %d", cert.Leaf.SerialNumber)
+	}
+
+	if err := cfg.RollbackCertificate(ctx, "example.com", versions[1].ID); err != nil {
+		t.Fatalf("Expected no error rolling back, got: %v", err)
+	}
+	certRes, err := cfg.loadCertResource("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf, _ := parseLeafPEM(certRes.CertificatePEM); leaf.SerialNumber.Int64() != 4 {
+		t.Errorf("Expected serial 4 to be active in storage after rollback, got %d", leaf.SerialNumber)
+	}
+	if cached := cfg.certCache.getAllMatchingCerts("example.com"); len(cached) != 1 || cached[0].Leaf.SerialNumber.Int64() != 4 {
+		t.Errorf("Expected cache to serve rolled back certificate, got %d certificates", len(cached))
+	}
+
+	// the replaced certificate is kept, so the rollback can be undone
+	versions, err = cfg.CertificateVersions("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Serial != "3" || versions[1].Serial != "5" {
+		t.Errorf("Expected prior serials 3 and 5 after rollback, got %+v", versions)
+	}
+
+	if err := cfg.RollbackCertificate(ctx, "example.com", "nonexistent"); err == nil {
+		t.Errorf("Expected error rolling back to nonexistent version")
+	}
+}
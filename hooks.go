@@ -0,0 +1,270 @@
+package otomatik
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/go-acme/lego/v3/challenge/http01"
+)
+
+// ExecSolver solves ACME challenges by running an external command,
+// so that records or responses can be published by systems which
+// otomatik does not support natively (proprietary DNS servers, load
+// balancer APIs, etc). It can be used as ACMEManager.DNSProvider or
+// ACMEManager.HTTPProvider.
+//
+// The command is run with Args followed by the action, either
+// "present" or "cleanup". The challenge is described to the command
+// both in environment variables (OTOMATIK_ACTION, OTOMATIK_DOMAIN,
+// OTOMATIK_TOKEN, OTOMATIK_KEY_AUTH, OTOMATIK_DNS_NAME,
+// OTOMATIK_DNS_VALUE and OTOMATIK_HTTP_PATH) and as a JSON object
+// on standard input, with the same fields as HookRequest. A non-zero
+// exit status is an error.
+type ExecSolver struct {
+	// The command to run - REQUIRED.
+	Command string
+
+	// Arguments to pass to the command, before the action.
+	Args []string
+
+	// Additional environment variables, in "KEY=value"
+	// form; the process's own environment is inherited.
+	Env []string
+
+	// How long each run of the command may take;
+	// the default is DefaultHookTimeout.
+	HookTimeout time.Duration
+
+	// How many times to retry a failed run, and
+	// how long to wait between attempts.
+	Retries       int
+	RetryInterval time.Duration
+
+	// How long to wait for DNS records to propagate, and how
+	// often to check; if unset, lego's defaults are used.
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+}
+
+// Present runs the command with the "present" action.
+func (s *ExecSolver) Present(domain, token, keyAuth string) error {
+	return s.run(newHookRequest(hookActionPresent, domain, token, keyAuth))
+}
+
+// CleanUp runs the command with the "cleanup" action.
+func (s *ExecSolver) CleanUp(domain, token, keyAuth string) error {
+	return s.run(newHookRequest(hookActionCleanUp, domain, token, keyAuth))
+}
+
+// Timeout returns the propagation timeout and polling interval.
+func (s *ExecSolver) Timeout() (timeout, interval time.Duration) {
+	return propagationTimeout(s.PropagationTimeout, s.PollingInterval)
+}
+
+func (s *ExecSolver) run(req HookRequest) error {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return retryHook(req, s.Retries, s.RetryInterval, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout(s.HookTimeout))
+		defer cancel()
+
+		args := append(append([]string{}, s.Args...), req.Action)
+		cmd := exec.CommandContext(ctx, s.Command, args...)
+		cmd.Env = append(append(os.Environ(), s.Env...), req.environ()...)
+		cmd.Stdin = bytes.NewReader(input)
+		output, err := cmd.CombinedOutput()
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s: timed out", s.Command)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v: %s", s.Command, err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	})
+}
+
+// WebhookSolver solves ACME challenges by sending HTTP requests to
+// a webhook, which is expected to publish or remove the challenge
+// record or response. It can be used as ACMEManager.DNSProvider or
+// ACMEManager.HTTPProvider.
+//
+// For each action, a HookRequest is POSTed to URL as JSON. Any
+// response status other than 2xx is an error.
+type WebhookSolver struct {
+	// The URL of the webhook - REQUIRED.
+	URL string
+
+	// Headers to add to each request, for
+	// example to authenticate to the webhook.
+	Headers http.Header
+
+	// The HTTP client to use; if nil, the default client is used.
+	HTTPClient *http.Client
+
+	// How long each request may take;
+	// the default is DefaultHookTimeout.
+	HookTimeout time.Duration
+
+	// How many times to retry a failed request, and
+	// how long to wait between attempts.
+	Retries       int
+	RetryInterval time.Duration
+
+	// How long to wait for DNS records to propagate, and how
+	// often to check; if unset, lego's defaults are used.
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+}
+
+// Present sends a request with the "present" action.
+func (s *WebhookSolver) Present(domain, token, keyAuth string) error {
+	return s.send(newHookRequest(hookActionPresent, domain, token, keyAuth))
+}
+
+// CleanUp sends a request with the "cleanup" action.
+func (s *WebhookSolver) CleanUp(domain, token, keyAuth string) error {
+	return s.send(newHookRequest(hookActionCleanUp, domain, token, keyAuth))
+}
+
+// Timeout returns the propagation timeout and polling interval.
+func (s *WebhookSolver) Timeout() (timeout, interval time.Duration) {
+	return propagationTimeout(s.PropagationTimeout, s.PollingInterval)
+}
+
+func (s *WebhookSolver) send(req HookRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return retryHook(req, s.Retries, s.RetryInterval, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout(s.HookTimeout))
+		defer cancel()
+
+		httpReq, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		httpReq = httpReq.WithContext(ctx)
+		for field, values := range s.Headers {
+			httpReq.Header[field] = values
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		httpReq.Header.Set("User-Agent", buildUAString())
+
+		resp, err := client.Do(httpReq)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			return fmt.Errorf("webhook responded HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+		}
+		return nil
+	})
+}
+
+// HookRequest describes a challenge to an ExecSolver or WebhookSolver.
+type HookRequest struct {
+	// "present" or "cleanup".
+	Action string `json:"action"`
+
+	// The domain being validated, and the challenge
+	// token and key authorization from the CA.
+	Domain  string `json:"domain"`
+	Token   string `json:"token"`
+	KeyAuth string `json:"key_auth"`
+
+	// The fully-qualified name and value of
+	// the TXT record for the DNS challenge.
+	DNSName  string `json:"dns_name"`
+	DNSValue string `json:"dns_value"`
+
+	// The path at which the key authorization must
+	// be served for the HTTP challenge.
+	HTTPPath string `json:"http_path"`
+}
+
+func newHookRequest(action, domain, token, keyAuth string) HookRequest {
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+	return HookRequest{
+		Action:   action,
+		Domain:   domain,
+		Token:    token,
+		KeyAuth:  keyAuth,
+		DNSName:  fqdn,
+		DNSValue: value,
+		HTTPPath: http01.ChallengePath(token),
+	}
+}
+
+// environ returns req as environment variables.
+func (req HookRequest) environ() []string {
+	return []string{
+		"OTOMATIK_ACTION=" + req.Action,
+		"OTOMATIK_DOMAIN=" + req.Domain,
+		"OTOMATIK_TOKEN=" + req.Token,
+		"OTOMATIK_KEY_AUTH=" + req.KeyAuth,
+		"OTOMATIK_DNS_NAME=" + req.DNSName,
+		"OTOMATIK_DNS_VALUE=" + req.DNSValue,
+		"OTOMATIK_HTTP_PATH=" + req.HTTPPath,
+	}
+}
+
+// retryHook calls f until it succeeds or has been retried retries times.
+func retryHook(req HookRequest, retries int, interval time.Duration, f func() error) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("[WARNING][%s] Challenge hook (%s, attempt %d/%d): %v - retrying in %s",
+				req.Domain, req.Action, attempt, retries+1, err, interval)
+			time.Sleep(interval)
+		}
+		err = f()
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("[%s] challenge hook (%s): %v", req.Domain, req.Action, err)
+}
+
+func hookTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultHookTimeout
+	}
+	return timeout
+}
+
+// Actions of a HookRequest.
+const (
+	hookActionPresent = "present"
+	hookActionCleanUp = "cleanup"
+)
+
+// DefaultHookTimeout is how long a challenge hook
+// may take if the solver does not specify a timeout.
+const DefaultHookTimeout = 1 * time.Minute
+
+// Interface guards
+var (
+	_ challenge.ProviderTimeout = (*ExecSolver)(nil)
+	_ challenge.ProviderTimeout = (*WebhookSolver)(nil)
+)
@@ -0,0 +1,143 @@
+package otomatik
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge/dns01"
+)
+
+func TestExecSolver(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a POSIX shell")
+	}
+	dir, err := ioutil.TempDir("", "otomatik-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the script records its action and environment, and fails
+	// the first time it is run with a "present" action
+	script := filepath.Join(dir, "hook.sh")
+	out := filepath.Join(dir, "out")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+if [ "$2" = present ] && [ ! -e "$1.failed" ]; then
+	touch "$1.failed"
+	echo "transient failure" >&2
+	exit 1
+fi
+echo "$2 $OTOMATIK_DOMAIN $OTOMATIK_DNS_NAME $OTOMATIK_DNS_VALUE $OTOMATIK_HTTP_PATH $EXTRA" >> "$1"
+cat > "$1.json"
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	solver := &ExecSolver{
+		Command: script,
+		Args:    []string{out},
+		Env:     []string{"EXTRA=extra"},
+		Retries: 1,
+	}
+	if err := solver.Present("example.com", "tok", "tok.thumbprint"); err != nil {
+		t.Fatalf("Expected no error presenting after retry, got: %v", err)
+	}
+	if err := solver.CleanUp("example.com", "tok", "tok.thumbprint"); err != nil {
+		t.Fatalf("Expected no error cleaning up, got: %v", err)
+	}
+
+	fqdn, value := dns01.GetRecord("example.com", "tok.thumbprint")
+	expected := "present example.com " + fqdn + " " + value + " /.well-known/acme-challenge/tok extra\n" +
+		"cleanup example.com " + fqdn + " " + value + " /.well-known/acme-challenge/tok extra\n"
+	actual, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != expected {
+		t.Errorf("Expected hook output:\n%s\ngot:\n%s", expected, actual)
+	}
+
+	var req HookRequest
+	input, err := ioutil.ReadFile(out + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(input, &req); err != nil {
+		t.Fatalf("Expected JSON on standard input, got error: %v", err)
+	}
+	if req.Action != "cleanup" || req.KeyAuth != "tok.thumbprint" || req.Token != "tok" {
+		t.Errorf("Unexpected hook request: %+v", req)
+	}
+
+	// a command that takes too long is killed
+	slow := &ExecSolver{Command: "sh", Args: []string{"-c", "exec sleep 10"}, HookTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	err = slow.Present("example.com", "tok", "tok.thumbprint")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected timeout error, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected command to be killed at timeout, took %s", time.Since(start))
+	}
+}
+
+func TestWebhookSolver(t *testing.T) {
+	var mu sync.Mutex
+	var requests []HookRequest
+	var failures int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if failures < 2 {
+			failures++
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var req HookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, req)
+	}))
+	defer srv.Close()
+
+	solver := &WebhookSolver{
+		URL:     srv.URL,
+		Headers: http.Header{"Authorization": {"Bearer secret"}},
+		Retries: 2,
+	}
+	if err := solver.Present("example.com", "tok", "tok.thumbprint"); err != nil {
+		t.Fatalf("Expected no error presenting after retries, got: %v", err)
+	}
+	if err := solver.CleanUp("example.com", "tok", "tok.thumbprint"); err != nil {
+		t.Fatalf("Expected no error cleaning up, got: %v", err)
+	}
+	if len(requests) != 2 || requests[0].Action != "present" || requests[1].Action != "cleanup" {
+		t.Fatalf("Expected present and cleanup requests, got: %+v", requests)
+	}
+	_, value := dns01.GetRecord("example.com", "tok.thumbprint")
+	if requests[0].DNSValue != value || requests[0].HTTPPath != "/.well-known/acme-challenge/tok" {
+		t.Errorf("Unexpected webhook request: %+v", requests[0])
+	}
+
+	unauthorized := &WebhookSolver{URL: srv.URL, Retries: 1}
+	err := unauthorized.Present("example.com", "tok", "tok.thumbprint")
+	if err == nil || !strings.Contains(err.Error(), "HTTP 401") {
+		t.Errorf("Expected HTTP 401 error, got: %v", err)
+	}
+}
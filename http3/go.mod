@@ -0,0 +1,26 @@
+module github.com/wondenge/otomatik/http3
+
+go 1.26.0
+
+require (
+	github.com/quic-go/quic-go v0.63.0
+	github.com/wondenge/otomatik v0.0.0-20261018201254-2549eb0202d7
+)
+
+require (
+	github.com/ThalesIgnite/crypto11 v1.2.5 // indirect
+	github.com/cenkalti/backoff/v4 v4.0.0 // indirect
+	github.com/go-acme/lego/v3 v3.5.0 // indirect
+	github.com/klauspost/cpuid v1.2.3 // indirect
+	github.com/miekg/dns v1.1.27 // indirect
+	github.com/miekg/pkcs11 v1.0.3-0.20190429190417-a667d056470f // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	github.com/thales-e-security/pool v0.0.2 // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	gopkg.in/square/go-jose.v2 v2.3.1 // indirect
+	software.sslmate.com/src/go-pkcs12 v0.7.3 // indirect
+)
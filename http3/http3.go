@@ -0,0 +1,61 @@
+// Package http3 serves HTTP/3 over QUIC with the certificates
+// managed by otomatik, using quic-go. It is a module of its own,
+// so that programs that do not serve HTTP/3 do not depend on
+// quic-go or the Go version it requires.
+//
+// The simplest way to serve HTTP/1.1, HTTP/2 and HTTP/3 is:
+//
+//	http3.HTTPS([]string{"example.com"}, mux)
+//
+// To serve HTTP/3 from an otomatik.Server, set its HTTP3 field:
+//
+//	srv := &otomatik.Server{Config: cfg, Domains: names, Handler: mux, HTTP3: http3.NewServer}
+//
+// Either way, HTTP/3 is served on the UDP port of the same number
+// as the HTTPS port, and responses over HTTPS advertise it with an
+// Alt-Svc header, so clients switch to HTTP/3 on later requests.
+package http3
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/wondenge/otomatik"
+)
+
+// NewServer returns an HTTP/3 server that serves handler
+// over QUIC with tlsConfig, which should come from
+// otomatik.Config.HTTP3TLSConfig. It is meant to be used
+// as the HTTP3 field of an otomatik.Server.
+func NewServer(tlsConfig *tls.Config, handler http.Handler) otomatik.HTTP3Server {
+	return &http3.Server{
+		TLSConfig: tlsConfig,
+		Handler:   handler,
+	}
+}
+
+// HTTPS serves mux for all domainNames using the HTTP and HTTPS
+// ports, like otomatik.HTTPS, and also serves HTTP/3 on the UDP
+// port of the HTTPS port's number. It blocks until a server
+// stops with an error.
+//
+// Like otomatik.HTTPS, it uses the default config and agrees to
+// the CA's terms of service, and is meant for simple programs;
+// use an otomatik.Server for more control.
+func HTTPS(domainNames []string, mux http.Handler) error {
+	otomatik.DefaultACME.Agreed = true
+	srv := &otomatik.Server{
+		Config:  otomatik.NewDefault(),
+		Domains: domainNames,
+		Handler: mux,
+		HTTP3:   NewServer,
+	}
+	if err := srv.Start(); err != nil {
+		return err
+	}
+	return srv.Wait()
+}
+
+// Interface guard
+var _ otomatik.HTTP3Server = (*http3.Server)(nil)
@@ -0,0 +1,85 @@
+package http3
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/wondenge/otomatik"
+)
+
+func TestServeHTTP3(t *testing.T) {
+	var cfg *otomatik.Config
+	cache := otomatik.NewCache(otomatik.CacheOptions{
+		GetConfigForCert: func(otomatik.Certificate) (*otomatik.Config, error) { return cfg, nil },
+	})
+	storage := new(otomatik.MemoryStorage)
+	issuer := &otomatik.LocalIssuer{Storage: storage}
+	cfg = otomatik.New(cache, otomatik.Config{Issuer: issuer, Storage: storage})
+
+	srv := &otomatik.Server{
+		Config:  cfg,
+		Domains: []string{"example.com"},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "hello over %s", r.Proto)
+		}),
+		HTTPAddr:  "127.0.0.1:0",
+		HTTPSAddr: "127.0.0.1:0",
+		HTTP3:     NewServer,
+		StopCache: true,
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Expected no error starting server, got: %v", err)
+	}
+	_, httpsAddr := srv.Addrs()
+
+	root, err := issuer.RootCertificate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	tlsConfig := &tls.Config{ServerName: "example.com", RootCAs: roots}
+
+	// HTTPS responses advertise HTTP/3
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Get("https://" + httpsAddr.String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	port := httpsAddr.(*net.TCPAddr).Port
+	if altSvc := resp.Header.Get("Alt-Svc"); altSvc != fmt.Sprintf(`h3=":%d"; ma=86400`, port) {
+		t.Errorf("Expected Alt-Svc header for port %d, got '%s'", port, altSvc)
+	}
+
+	// and the managed certificate is served over QUIC
+	h3Transport := &http3.Transport{TLSClientConfig: tlsConfig}
+	defer h3Transport.Close()
+	h3Client := &http.Client{Transport: h3Transport}
+	resp, err = h3Client.Get(fmt.Sprintf("https://127.0.0.1:%d/", port))
+	if err != nil {
+		t.Fatalf("Expected no error over HTTP/3, got: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 3 || string(body) != "hello over HTTP/3.0" {
+		t.Errorf("Expected response over HTTP/3, got %s: '%s'", resp.Proto, body)
+	}
+	if len(resp.TLS.PeerCertificates) == 0 || resp.TLS.PeerCertificates[0].DNSNames[0] != "example.com" {
+		t.Errorf("Expected managed certificate over HTTP/3")
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected no error shutting down, got: %v", err)
+	}
+	if err := srv.Wait(); err != nil {
+		t.Errorf("Expected no error from stopped servers, got: %v", err)
+	}
+}
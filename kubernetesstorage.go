@@ -0,0 +1,1160 @@
+package otomatik
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KubernetesStorage is a Storage that keeps assets in Secrets
+// in a Kubernetes namespace, and implements locks with Lease
+// objects, so that all replicas of a deployment can share
+// certificates.
+//
+// A site's certificate, private key and metadata are stored
+// together in a Secret of type kubernetes.io/tls, with the
+// certificate and key in the tls.crt and tls.key fields, so other
+// consumers in the cluster can use it like any other TLS Secret.
+// Every other key is stored in an Opaque Secret of its own, which
+// keeps each Secret well below the API server's size limit. The
+// Secrets are labeled with hashes of their key prefixes, so keys
+// can be listed without fetching the data of every Secret.
+//
+// Changes to keys in different Secrets are committed atomically
+// by first writing them to a journal Secret; if the process dies
+// before all of them are applied, they are applied the next time
+// the storage is used, by this or another process.
+//
+// The service account used must be allowed to get, list, create,
+// update and delete Secrets and Leases in the namespace.
+type KubernetesStorage struct {
+	// The URL of the API server, for example
+	// "https://kubernetes.default.svc". Required.
+	APIServer string
+
+	// The namespace in which to store assets. Required.
+	Namespace string
+
+	// The bearer token with which to authenticate
+	// to the API server, if any.
+	BearerToken string
+
+	// The HTTP client to use; if nil, a default client
+	// that trusts the system's roots is used.
+	HTTPClient *http.Client
+
+	// The prefix of the names of the objects this
+	// storage manages; defaults to "otomatik". Use
+	// different prefixes to keep separate storages
+	// in the same namespace.
+	Prefix string
+
+	// The identity with which to hold locks;
+	// defaults to the host name and process ID.
+	Identity string
+
+	mu     sync.Mutex
+	leases map[string]Lease // held via Lock, by key
+}
+
+// InClusterKubernetesStorage returns a KubernetesStorage for the
+// namespace of the pod it runs in, authenticating with the pod's
+// service account.
+func InClusterKubernetesStorage(prefix string) (*KubernetesStorage, error) {
+	const saDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT not set")
+	}
+	token, err := ioutil.ReadFile(path.Join(saDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account token: %v", err)
+	}
+	namespace, err := ioutil.ReadFile(path.Join(saDir, "namespace"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account namespace: %v", err)
+	}
+	caPEM, err := ioutil.ReadFile(path.Join(saDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in service account CA certificate file")
+	}
+
+	return &KubernetesStorage{
+		APIServer:   "https://" + net.JoinHostPort(host, port),
+		Namespace:   strings.TrimSpace(string(namespace)),
+		BearerToken: strings.TrimSpace(string(token)),
+		HTTPClient: &http.Client{
+			Timeout:   HTTPTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		},
+		Prefix: prefix,
+	}, nil
+}
+
+// Store saves value at key.
+func (ks *KubernetesStorage) Store(key string, value []byte) error {
+	return ks.Commit(nil, []StorageOp{{Key: key, Value: value}})
+}
+
+// Load retrieves the value at key.
+func (ks *KubernetesStorage) Load(key string) ([]byte, error) {
+	ctx := context.Background()
+	ks.recoverTransactions(ctx)
+	key = cleanKey(key)
+	name, _ := ks.secretFor(key)
+	secret, err := ks.getSecret(ctx, name)
+	if isK8sNotFound(err) {
+		return nil, k8sNotExist(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !secretHoldsDir(secret, path.Dir(key)) {
+		return nil, k8sNotExist(key)
+	}
+	value := ks.decodeFiles(secret)[path.Base(key)]
+	if value == nil {
+		return nil, k8sNotExist(key)
+	}
+	return value, nil
+}
+
+// Delete deletes key. If key is non-terminal, all the
+// keys it contains are deleted, though not atomically.
+func (ks *KubernetesStorage) Delete(key string) error {
+	key = cleanKey(key)
+	if _, err := ks.Load(key); err == nil {
+		return ks.Commit(nil, []StorageOp{{Key: key, Delete: true}})
+	}
+
+	within, err := ks.keysWithin(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	if len(within) == 0 {
+		return k8sNotExist(key)
+	}
+	for k := range within {
+		if err := ks.Commit(nil, []StorageOp{{Key: k, Delete: true}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exists returns true if key exists.
+func (ks *KubernetesStorage) Exists(key string) bool {
+	if _, err := ks.Load(key); err == nil {
+		return true
+	}
+	_, err := ks.Stat(key)
+	return err == nil
+}
+
+// List returns all keys that match prefix.
+func (ks *KubernetesStorage) List(prefix string, recursive bool) ([]string, error) {
+	prefix = cleanKey(prefix)
+	within, err := ks.keysWithin(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]string, 0, len(within))
+	for k := range within {
+		all = append(all, k)
+	}
+	keys := listKeys(all, prefix, recursive)
+	if prefix != "" && len(keys) == 0 {
+		if _, err := ks.Load(prefix); err == nil {
+			return keys, nil
+		}
+		return nil, k8sNotExist(prefix)
+	}
+	return keys, nil
+}
+
+// Stat returns information about key. The modification
+// time is that of the Secret in which key is stored.
+func (ks *KubernetesStorage) Stat(key string) (KeyInfo, error) {
+	ctx := context.Background()
+	ks.recoverTransactions(ctx)
+	key = cleanKey(key)
+
+	name, _ := ks.secretFor(key)
+	secret, err := ks.getSecret(ctx, name)
+	if err != nil && !isK8sNotFound(err) {
+		return KeyInfo{}, err
+	}
+	if value, ok := ks.decodeFiles(secret)[path.Base(key)]; err == nil && ok && secretHoldsDir(secret, path.Dir(key)) {
+		modified, _ := time.Parse(time.RFC3339Nano, secret.Metadata.Annotations[k8sAnnotationModified])
+		return KeyInfo{
+			Key:        key,
+			Modified:   modified,
+			Size:       int64(len(value)),
+			IsTerminal: true,
+		}, nil
+	}
+
+	within, err := ks.keysWithin(ctx, key)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	if len(within) == 0 {
+		return KeyInfo{}, k8sNotExist(key)
+	}
+	info := KeyInfo{Key: key}
+	for _, modified := range within {
+		if modified.After(info.Modified) {
+			info.Modified = modified
+		}
+	}
+	return info, nil
+}
+
+// Commit applies ops atomically. Changes to keys stored in the
+// same Secret are applied with a single update; otherwise, they
+// are written to a journal Secret first, so that they can be
+// completed if the process dies while applying them. If lease is
+// not nil, nothing is applied if a newer lease has been granted
+// for its lock.
+func (ks *KubernetesStorage) Commit(lease Lease, ops []StorageOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	ks.recoverTransactions(ctx)
+
+	if lease != nil {
+		if err := ks.checkFence(ctx, lease); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, op := range ops {
+		name, _ := ks.secretFor(cleanKey(op.Key))
+		names[name] = true
+	}
+	if len(names) == 1 {
+		return ks.applyOps(ctx, ops)
+	}
+
+	journalName, err := ks.createTxJournal(ctx, ops)
+	if err != nil {
+		return fmt.Errorf("writing transaction journal: %v", err)
+	}
+
+	// the transaction is now committed; if applying it fails,
+	// it will be completed when the storage is next used
+	err = ks.applyOps(ctx, ops)
+	if err != nil {
+		k8sTxRecovered.Delete(ks.txRecoveryKey()) // try again on next use
+		return fmt.Errorf("applying committed transaction %s: %v", journalName, err)
+	}
+	return ks.deleteSecret(ctx, journalName, "")
+}
+
+// StoreFenced saves value at key, unless a newer
+// lease has been granted for the lock of lease.
+func (ks *KubernetesStorage) StoreFenced(lease Lease, key string, value []byte) error {
+	return ks.Commit(lease, []StorageOp{{Key: key, Value: value}})
+}
+
+// Lock obtains the lock for key, blocking until it can be
+// obtained. The lock is held with a lease of DefaultLockTTL,
+// which is renewed until Unlock is called.
+func (ks *KubernetesStorage) Lock(key string) error {
+	lease, err := ks.LockLease(context.Background(), key, DefaultLockTTL)
+	if err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	if ks.leases == nil {
+		ks.leases = make(map[string]Lease)
+	}
+	ks.leases[key] = lease
+	ks.mu.Unlock()
+	return nil
+}
+
+// Unlock releases the lock for key, which
+// must have been obtained with Lock.
+func (ks *KubernetesStorage) Unlock(key string) error {
+	ks.mu.Lock()
+	lease, ok := ks.leases[key]
+	delete(ks.leases, key)
+	ks.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("lock for %s is not held", key)
+	}
+	return lease.Release()
+}
+
+// LockLease obtains a lease on the lock for key, which is
+// a Lease object in the namespace. It blocks until the lock
+// can be obtained, ctx is done, or an error occurs. The lease
+// is renewed every third of ttl until it is released; if the
+// Lease object is taken over in the meantime, the lease is
+// lost. Fencing tokens are the Lease object's number of
+// transitions.
+func (ks *KubernetesStorage) LockLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+	name := ks.leaseName(key)
+	holder := fmt.Sprintf("%s-%d", ks.identity(), atomic.AddUint64(&k8sLeaseHolderCounter, 1))
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		obj, err := ks.getLease(ctx, name)
+		switch {
+		case isK8sNotFound(err):
+			obj = k8sLease{Metadata: k8sObjectMeta{Name: name}}
+		case err != nil:
+			return nil, fmt.Errorf("getting lock: %v", err)
+		case !obj.expired():
+			// lock is held; wait a moment and try again
+			select {
+			case <-time.After(k8sLockPollInterval):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		now := k8sMicroTime(time.Now())
+		obj.Spec.HolderIdentity = holder
+		obj.Spec.LeaseDurationSeconds = int32((ttl + time.Second - 1) / time.Second)
+		obj.Spec.AcquireTime = now
+		obj.Spec.RenewTime = now
+		obj.Spec.LeaseTransitions++
+		err = ks.putLease(ctx, obj)
+		if isK8sConflict(err) {
+			continue // someone else got there first
+		}
+		if err != nil {
+			return nil, fmt.Errorf("acquiring lock: %v", err)
+		}
+
+		lease := &k8sLeaseLock{
+			storage:  ks,
+			key:      key,
+			name:     name,
+			holder:   holder,
+			token:    uint64(obj.Spec.LeaseTransitions),
+			ttl:      ttl,
+			lost:     closeOnce{ch: make(chan struct{})},
+			released: closeOnce{ch: make(chan struct{})},
+		}
+		go lease.keepFresh()
+		return lease, nil
+	}
+}
+
+func (ks *KubernetesStorage) String() string {
+	return fmt.Sprintf("KubernetesStorage:%s/%s", ks.Namespace, ks.prefix())
+}
+
+// checkFence returns ErrLeaseLost if lease has been lost
+// or a newer lease has been granted for its lock.
+func (ks *KubernetesStorage) checkFence(ctx context.Context, lease Lease) error {
+	if leaseIsLost(lease) {
+		return ErrLeaseLost
+	}
+	if _, ok := lease.(*k8sLeaseLock); !ok {
+		return nil
+	}
+	obj, err := ks.getLease(ctx, ks.leaseName(lease.Key()))
+	if err != nil {
+		return fmt.Errorf("checking lock: %v", err)
+	}
+	if uint64(obj.Spec.LeaseTransitions) > lease.Token() {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// applyOps applies ops to the Secrets that hold their keys,
+// one Secret at a time.
+func (ks *KubernetesStorage) applyOps(ctx context.Context, ops []StorageOp) error {
+	var names []string
+	byName := make(map[string][]StorageOp)
+	dirs := make(map[string]string)
+	for _, op := range ops {
+		op.Key = cleanKey(op.Key)
+		name, dir := ks.secretFor(op.Key)
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+			dirs[name] = dir
+		}
+		byName[name] = append(byName[name], op)
+	}
+
+	for _, name := range names {
+		err := ks.updateSecret(ctx, name, dirs[name], func(files map[string][]byte) {
+			for _, op := range byName[name] {
+				file := path.Base(op.Key)
+				if op.Delete {
+					delete(files, file)
+				} else {
+					files[file] = op.Value
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateSecret applies change to the files in the Secret named
+// name, which holds keys directly within dir, creating the Secret
+// if it does not exist and deleting it if no files are left. It
+// retries if the Secret is modified concurrently.
+func (ks *KubernetesStorage) updateSecret(ctx context.Context, name, dir string, change func(files map[string][]byte)) error {
+	for attempt := 0; ; attempt++ {
+		secret, err := ks.getSecret(ctx, name)
+		exists := err == nil
+		if err != nil && !isK8sNotFound(err) {
+			return err
+		}
+		if exists && !secretHoldsDir(secret, dir) {
+			return fmt.Errorf("secret %s holds keys within %q, not %q",
+				name, secret.Metadata.Annotations[k8sAnnotationDir], dir)
+		}
+
+		files := make(map[string][]byte)
+		if exists {
+			files = ks.decodeFiles(secret)
+		}
+		change(files)
+
+		switch {
+		case len(files) == 0 && !exists:
+			return nil
+		case len(files) == 0:
+			err = ks.deleteSecret(ctx, name, secret.Metadata.ResourceVersion)
+		case !exists:
+			err = ks.request(ctx, http.MethodPost, ks.secretsPath(), ks.encodeSecret(name, dir, "", files), nil)
+			if isK8sAlreadyExists(err) {
+				err = k8sConflict // created concurrently; try again
+			}
+		default:
+			err = ks.request(ctx, http.MethodPut, ks.secretsPath()+"/"+name,
+				ks.encodeSecret(name, dir, secret.Metadata.ResourceVersion, files), nil)
+		}
+		if isK8sConflict(err) && attempt < k8sMaxConflictRetries {
+			continue
+		}
+		return err
+	}
+}
+
+// encodeSecret makes the Secret named name that holds files,
+// which are the contents of the keys directly within dir.
+func (ks *KubernetesStorage) encodeSecret(name, dir, resourceVersion string, files map[string][]byte) k8sSecret {
+	secret := k8sSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: k8sObjectMeta{
+			Name:            name,
+			ResourceVersion: resourceVersion,
+			Labels:          k8sDirLabels(dir),
+			Annotations: map[string]string{
+				k8sAnnotationDir:      dir,
+				k8sAnnotationModified: time.Now().UTC().Format(time.RFC3339Nano),
+			},
+		},
+		Type: "Opaque",
+		Data: make(map[string][]byte),
+	}
+	secret.Metadata.Labels["app.kubernetes.io/managed-by"] = "otomatik"
+	secret.Metadata.Labels[k8sLabelStorage] = ks.prefix()
+
+	// site certificates are native TLS secrets; both fields
+	// must be present, even if one of them is not set yet
+	certFile, keyFile, isSite := siteFiles(dir)
+	if isSite {
+		secret.Type = "kubernetes.io/tls"
+		secret.Data["tls.crt"] = []byte{}
+		secret.Data["tls.key"] = []byte{}
+	}
+
+	fieldNames := make(map[string]string)
+	for file, value := range files {
+		field := k8sFieldName(file)
+		switch {
+		case isSite && file == certFile:
+			field = "tls.crt"
+		case isSite && file == keyFile:
+			field = "tls.key"
+		default:
+			// field names are more restricted than key names,
+			// so disambiguate names that sanitize the same
+			for i := 2; secret.Data[field] != nil || field == "tls.crt" || field == "tls.key"; i++ {
+				field = fmt.Sprintf("%s-%d", k8sFieldName(file), i)
+			}
+		}
+		secret.Data[field] = value
+		fieldNames[file] = field
+	}
+	fieldNamesJSON, _ := json.Marshal(fieldNames)
+	secret.Metadata.Annotations[k8sAnnotationFiles] = string(fieldNamesJSON)
+
+	return secret
+}
+
+// secretHoldsDir returns true if secret holds the keys directly
+// within dir. Secret names are made from hashes, so the Secret
+// with the name for dir could, rarely, be that of another dir.
+func secretHoldsDir(secret k8sSecret, dir string) bool {
+	return secret.Metadata.Annotations[k8sAnnotationDir] == dir
+}
+
+// decodeFiles returns the files stored in secret, by name.
+func (ks *KubernetesStorage) decodeFiles(secret k8sSecret) map[string][]byte {
+	var fieldNames map[string]string
+	_ = json.Unmarshal([]byte(secret.Metadata.Annotations[k8sAnnotationFiles]), &fieldNames)
+	files := make(map[string][]byte)
+	for file, field := range fieldNames {
+		if value, ok := secret.Data[field]; ok {
+			files[file] = value
+		}
+	}
+	return files
+}
+
+// keysWithin returns the terminal keys within prefix, or all the
+// keys if prefix is empty, with the modification times of the
+// Secrets that hold them. Only the metadata of the Secrets whose
+// labels match prefix is fetched.
+func (ks *KubernetesStorage) keysWithin(ctx context.Context, prefix string) (map[string]time.Time, error) {
+	ks.recoverTransactions(ctx)
+
+	selector := k8sLabelStorage + "=" + ks.prefix()
+	if prefix != "" {
+		// the labels only go so deep; keys within
+		// the prefix are filtered below either way
+		parts := strings.Split(prefix, "/")
+		if len(parts) > k8sMaxDirLabels {
+			parts = parts[:k8sMaxDirLabels]
+		}
+		selector += "," + k8sDirLabel(len(parts)-1) + "=" + fastHash([]byte(strings.Join(parts, "/")))
+	}
+	metas, err := ks.listSecretMeta(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]time.Time)
+	for _, meta := range metas {
+		modified, _ := time.Parse(time.RFC3339Nano, meta.Annotations[k8sAnnotationModified])
+		var fieldNames map[string]string
+		_ = json.Unmarshal([]byte(meta.Annotations[k8sAnnotationFiles]), &fieldNames)
+		for file := range fieldNames {
+			k := cleanKey(path.Join(meta.Annotations[k8sAnnotationDir], file))
+			if _, within := keyWithin(prefix, k); within {
+				keys[k] = modified
+			}
+		}
+	}
+	return keys, nil
+}
+
+// createTxJournal creates a journal Secret that holds ops,
+// and returns its name.
+func (ks *KubernetesStorage) createTxJournal(ctx context.Context, ops []StorageOp) (string, error) {
+	journal := make([]txJournalEntry, len(ops))
+	data := make(map[string][]byte)
+	for i, op := range ops {
+		journal[i] = txJournalEntry{Key: cleanKey(op.Key), Delete: op.Delete}
+		if !op.Delete {
+			data[strconv.Itoa(i)] = op.Value
+		}
+	}
+	journalJSON, err := json.Marshal(journal)
+	if err != nil {
+		return "", err
+	}
+	data[txJournalFilename] = journalJSON
+
+	for {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		name := ks.prefix() + "-tx-" + hex.EncodeToString(id)
+		err := ks.request(ctx, http.MethodPost, ks.secretsPath(), k8sSecret{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Metadata: k8sObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "otomatik",
+					k8sLabelTx:                     ks.prefix(),
+				},
+			},
+			Type: "Opaque",
+			Data: data,
+		}, nil)
+		if isK8sAlreadyExists(err) {
+			continue
+		}
+		return name, err
+	}
+}
+
+// recoverTransactions completes transactions that were
+// committed but not fully applied, for example because
+// the process crashed. Once every transaction has been
+// recovered, it is not done again for the storage in
+// this process.
+//
+// Like FileStorage, it cannot tell transactions interrupted
+// by a crash apart from those being applied by another
+// process at the same moment; re-applying those is harmless
+// unless they delete keys that are being written again
+// concurrently, which certificate maintenance avoids by
+// holding locks.
+func (ks *KubernetesStorage) recoverTransactions(ctx context.Context) {
+	recoveryKey := ks.txRecoveryKey()
+	if _, ok := k8sTxRecovered.Load(recoveryKey); ok {
+		return
+	}
+	k8sTxRecoveryMu.Lock()
+	defer k8sTxRecoveryMu.Unlock()
+	if _, ok := k8sTxRecovered.Load(recoveryKey); ok {
+		return
+	}
+
+	metas, err := ks.listSecretMeta(ctx, k8sLabelTx+"="+ks.prefix())
+	if err != nil {
+		log.Printf("[ERROR][%s] Reading transactions: %v", ks, err)
+		return
+	}
+	failed := false
+	for _, meta := range metas {
+		err := ks.recoverTransaction(ctx, meta.Name)
+		if err != nil {
+			log.Printf("[ERROR][%s] Completing interrupted transaction %s: %v", ks, meta.Name, err)
+			failed = true
+			continue
+		}
+		log.Printf("[INFO][%s] Completed interrupted transaction: %s", ks, meta.Name)
+	}
+	if !failed {
+		k8sTxRecovered.Store(recoveryKey, true)
+	}
+}
+
+// recoverTransaction applies the transaction in the
+// journal Secret named name, then deletes the journal.
+func (ks *KubernetesStorage) recoverTransaction(ctx context.Context, name string) error {
+	secret, err := ks.getSecret(ctx, name)
+	if isK8sNotFound(err) {
+		return nil // completed in the meantime
+	}
+	if err != nil {
+		return err
+	}
+	var journal []txJournalEntry
+	if err := json.Unmarshal(secret.Data[txJournalFilename], &journal); err != nil {
+		return fmt.Errorf("decoding journal: %v", err)
+	}
+	ops := make([]StorageOp, len(journal))
+	for i, entry := range journal {
+		ops[i] = StorageOp{Key: entry.Key, Value: secret.Data[strconv.Itoa(i)], Delete: entry.Delete}
+	}
+	if err := ks.applyOps(ctx, ops); err != nil {
+		return err
+	}
+	return ks.deleteSecret(ctx, name, secret.Metadata.ResourceVersion)
+}
+
+// txRecoveryKey identifies ks among the storages
+// whose transactions have been recovered.
+func (ks *KubernetesStorage) txRecoveryKey() string {
+	return ks.APIServer + "/" + ks.Namespace + "/" + ks.prefix()
+}
+
+func (ks *KubernetesStorage) getSecret(ctx context.Context, name string) (k8sSecret, error) {
+	var secret k8sSecret
+	err := ks.request(ctx, http.MethodGet, ks.secretsPath()+"/"+name, nil, &secret)
+	return secret, err
+}
+
+// deleteSecret deletes the Secret named name, if it has the
+// given resource version or resourceVersion is empty. It is
+// not an error if the Secret does not exist.
+func (ks *KubernetesStorage) deleteSecret(ctx context.Context, name, resourceVersion string) error {
+	err := ks.request(ctx, http.MethodDelete, ks.secretsPath()+"/"+name, k8sDeleteOptions{
+		Preconditions: k8sPreconditions{ResourceVersion: resourceVersion},
+	}, nil)
+	if isK8sNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// listSecretMeta returns the metadata of the Secrets
+// that match selector, without fetching their data.
+func (ks *KubernetesStorage) listSecretMeta(ctx context.Context, selector string) ([]k8sObjectMeta, error) {
+	var list struct {
+		Items []struct {
+			Metadata k8sObjectMeta `json:"metadata"`
+		} `json:"items"`
+	}
+	query := url.Values{"labelSelector": {selector}}
+	err := ks.do(ctx, http.MethodGet, ks.secretsPath()+"?"+query.Encode(), k8sAcceptMetadataList, nil, &list)
+	if err != nil {
+		return nil, fmt.Errorf("listing secrets: %v", err)
+	}
+	metas := make([]k8sObjectMeta, len(list.Items))
+	for i, item := range list.Items {
+		metas[i] = item.Metadata
+	}
+	return metas, nil
+}
+
+func (ks *KubernetesStorage) getLease(ctx context.Context, name string) (k8sLease, error) {
+	var obj k8sLease
+	err := ks.request(ctx, http.MethodGet, ks.leasesPath()+"/"+name, nil, &obj)
+	return obj, err
+}
+
+// putLease creates obj if it has no resource
+// version, and updates it otherwise.
+func (ks *KubernetesStorage) putLease(ctx context.Context, obj k8sLease) error {
+	obj.APIVersion = "coordination.k8s.io/v1"
+	obj.Kind = "Lease"
+	obj.Metadata.Labels = map[string]string{
+		"app.kubernetes.io/managed-by": "otomatik",
+		k8sLabelStorage:                ks.prefix(),
+	}
+	if obj.Metadata.ResourceVersion == "" {
+		err := ks.request(ctx, http.MethodPost, ks.leasesPath(), obj, nil)
+		if isK8sAlreadyExists(err) {
+			return k8sConflict
+		}
+		return err
+	}
+	return ks.request(ctx, http.MethodPut, ks.leasesPath()+"/"+obj.Metadata.Name, obj, nil)
+}
+
+// request performs an API request, encoding body as JSON if not
+// nil, and decoding the response into result if not nil.
+func (ks *KubernetesStorage) request(ctx context.Context, method, apiPath string, body, result interface{}) error {
+	return ks.do(ctx, method, apiPath, "application/json", body, result)
+}
+
+// do performs an API request like request, asking
+// for the response in the media type accept.
+func (ks *KubernetesStorage) do(ctx context.Context, method, apiPath, accept string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(ks.APIServer, "/")+apiPath, reqBody)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", buildUAString())
+	if ks.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ks.BearerToken)
+	}
+
+	client := ks.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: HTTPTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		statusErr := k8sStatusError{Code: resp.StatusCode}
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(respBody, &statusErr) != nil || statusErr.Message == "" {
+			statusErr.Message = strings.TrimSpace(string(respBody))
+		}
+		statusErr.Code = resp.StatusCode
+		return statusErr
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 64*1024*1024)).Decode(result)
+}
+
+func (ks *KubernetesStorage) secretsPath() string {
+	return "/api/v1/namespaces/" + url.PathEscape(ks.Namespace) + "/secrets"
+}
+
+func (ks *KubernetesStorage) leasesPath() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(ks.Namespace) + "/leases"
+}
+
+// secretFor returns the name of the Secret that holds key,
+// and the key prefix of the keys in that Secret: the keys of
+// a site's certificate share a Secret, and every other key
+// has a Secret of its own.
+func (ks *KubernetesStorage) secretFor(key string) (string, string) {
+	dir := path.Dir(key)
+	if _, _, isSite := siteFiles(dir); isSite {
+		return ks.secretName(dir), dir
+	}
+	return k8sObjectName(ks.prefix(), path.Base(key), key), dir
+}
+
+// secretName returns the name of the Secret that holds
+// the keys directly within dir.
+func (ks *KubernetesStorage) secretName(dir string) string {
+	return k8sObjectName(ks.prefix(), path.Base(dir), dir)
+}
+
+// leaseName returns the name of the Lease object
+// for the lock named by key.
+func (ks *KubernetesStorage) leaseName(key string) string {
+	return k8sObjectName(ks.prefix()+"-lock", key, key)
+}
+
+func (ks *KubernetesStorage) prefix() string {
+	if ks.Prefix == "" {
+		return "otomatik"
+	}
+	return k8sSanitize(ks.Prefix, 40)
+}
+
+func (ks *KubernetesStorage) identity() string {
+	if ks.Identity != "" {
+		return ks.Identity
+	}
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// k8sLeaseLock is a lease on a lock held
+// with a Lease object.
+type k8sLeaseLock struct {
+	storage  *KubernetesStorage
+	key      string
+	name     string
+	holder   string
+	token    uint64
+	ttl      time.Duration
+	lost     closeOnce
+	released closeOnce
+}
+
+func (l *k8sLeaseLock) Key() string           { return l.key }
+func (l *k8sLeaseLock) Token() uint64         { return l.token }
+func (l *k8sLeaseLock) Lost() <-chan struct{} { return l.lost.ch }
+
+// Release gives up the Lease object, unless it has been
+// taken over by another holder. The object itself is kept,
+// so that its number of transitions keeps increasing.
+func (l *k8sLeaseLock) Release() error {
+	l.released.close()
+	ctx := context.Background()
+	for {
+		obj, err := l.storage.getLease(ctx, l.name)
+		if isK8sNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if obj.Spec.HolderIdentity != l.holder {
+			return ErrLeaseLost
+		}
+		obj.Spec.HolderIdentity = ""
+		err = l.storage.putLease(ctx, obj)
+		if isK8sConflict(err) {
+			continue
+		}
+		return err
+	}
+}
+
+// keepFresh renews the lease every third of its TTL until it
+// is released. If the Lease object is taken over, or if it
+// cannot be renewed before it expires, the lease is lost.
+func (l *k8sLeaseLock) keepFresh() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	expires := time.Now().Add(l.ttl)
+	for {
+		select {
+		case <-l.released.ch:
+			return
+		case <-ticker.C:
+		}
+		renewedAt := time.Now()
+		taken, err := l.renew()
+		switch {
+		case taken:
+			l.lost.close()
+			return
+		case err != nil:
+			if time.Now().After(expires) {
+				log.Printf("[ERROR][%s] Renewing lock %s: %v - lease expired", l.storage, l.key, err)
+				l.lost.close()
+				return
+			}
+			log.Printf("[ERROR][%s] Renewing lock %s: %v - will retry", l.storage, l.key, err)
+		default:
+			expires = renewedAt.Add(l.ttl)
+		}
+	}
+}
+
+// renew updates the renew time of the Lease object. It
+// returns true if the object has been taken over.
+func (l *k8sLeaseLock) renew() (bool, error) {
+	ctx := context.Background()
+	obj, err := l.storage.getLease(ctx, l.name)
+	if isK8sNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if obj.Spec.HolderIdentity != l.holder || uint64(obj.Spec.LeaseTransitions) != l.token {
+		return true, nil
+	}
+	obj.Spec.RenewTime = k8sMicroTime(time.Now())
+	return false, l.storage.putLease(ctx, obj)
+}
+
+// k8sObjectMeta is the metadata of a Kubernetes object.
+type k8sObjectMeta struct {
+	Name            string            `json:"name"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// k8sSecret is a core/v1 Secret.
+type k8sSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   k8sObjectMeta     `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string][]byte `json:"data,omitempty"`
+}
+
+// k8sLease is a coordination.k8s.io/v1 Lease.
+type k8sLease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   k8sObjectMeta `json:"metadata"`
+	Spec       struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int32  `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int32  `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// expired returns true if the lease is not held.
+func (obj k8sLease) expired() bool {
+	if obj.Spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(k8sMicroTimeFormat, obj.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return time.Since(renewed) > time.Duration(obj.Spec.LeaseDurationSeconds)*time.Second
+}
+
+type k8sDeleteOptions struct {
+	Preconditions k8sPreconditions `json:"preconditions"`
+}
+
+type k8sPreconditions struct {
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// k8sStatusError is an error response from the API server.
+type k8sStatusError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e k8sStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.Code, e.Message)
+}
+
+func isK8sNotFound(err error) bool {
+	statusErr, ok := err.(k8sStatusError)
+	return ok && statusErr.Code == http.StatusNotFound
+}
+
+func isK8sConflict(err error) bool {
+	statusErr, ok := err.(k8sStatusError)
+	return ok && statusErr.Code == http.StatusConflict && statusErr.Reason != "AlreadyExists"
+}
+
+func isK8sAlreadyExists(err error) bool {
+	statusErr, ok := err.(k8sStatusError)
+	return ok && statusErr.Code == http.StatusConflict && statusErr.Reason == "AlreadyExists"
+}
+
+// k8sConflict is returned when an object
+// was modified concurrently.
+var k8sConflict = k8sStatusError{Code: http.StatusConflict, Reason: "Conflict", Message: "object was modified"}
+
+// k8sNotExist returns an ErrNotExist for key.
+func k8sNotExist(key string) error {
+	return ErrNotExist(fmt.Errorf("%s: %w", key, os.ErrNotExist))
+}
+
+// siteFiles returns the names of the certificate and
+// private key files within dir, and true if dir is the
+// key prefix of a site's certificate.
+func siteFiles(dir string) (string, string, bool) {
+	parts := strings.Split(dir, "/")
+	if len(parts) != 3 || parts[0] != prefixCerts {
+		return "", "", false
+	}
+	return parts[2] + ".crt", parts[2] + ".key", true
+}
+
+// k8sDirLabels returns the labels of a Secret that holds keys
+// directly within dir: one for each of the first k8sMaxDirLabels
+// levels of dir, whose value is a hash of dir up to that level.
+func k8sDirLabels(dir string) map[string]string {
+	labels := make(map[string]string)
+	if dir == "" || dir == "." {
+		return labels
+	}
+	parts := strings.Split(dir, "/")
+	for i := 0; i < len(parts) && i < k8sMaxDirLabels; i++ {
+		labels[k8sDirLabel(i)] = fastHash([]byte(strings.Join(parts[:i+1], "/")))
+	}
+	return labels
+}
+
+// k8sDirLabel returns the name of the label for
+// level i of the key prefix of a Secret's keys.
+func k8sDirLabel(i int) string {
+	return fmt.Sprintf("%s-%d", k8sLabelDir, i)
+}
+
+// k8sObjectName returns a valid object name made of prefix and
+// a readable form of name, disambiguated by a hash of id.
+func k8sObjectName(prefix, name, id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return prefix + "-" + k8sSanitize(name, 170) + "-" + hex.EncodeToString(hash[:16])
+}
+
+// k8sSanitize makes s valid as part of an object name:
+// lowercase alphanumerics separated by single hyphens,
+// at most maxLen characters long.
+func k8sSanitize(s string, maxLen int) string {
+	s = k8sInvalidNameChars.ReplaceAllString(strings.ToLower(s), "-")
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	s = strings.Trim(s, "-")
+	if s == "" {
+		return "x"
+	}
+	return s
+}
+
+// k8sFieldName makes file valid as the name of a data field.
+func k8sFieldName(file string) string {
+	field := k8sInvalidFieldChars.ReplaceAllString(file, "_")
+	if len(field) > 253 {
+		field = field[:253]
+	}
+	return field
+}
+
+func k8sMicroTime(t time.Time) string {
+	return t.UTC().Format(k8sMicroTimeFormat)
+}
+
+var (
+	k8sInvalidNameChars  = regexp.MustCompile(`[^a-z0-9]+`)
+	k8sInvalidFieldChars = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+)
+
+// k8sLeaseHolderCounter disambiguates the holder
+// identities of leases held by this process.
+var k8sLeaseHolderCounter uint64
+
+// k8sTxRecovered records the storages for which
+// interrupted transactions have been recovered; it is
+// read without k8sTxRecoveryMu, which serializes recovery.
+var (
+	k8sTxRecovered  sync.Map
+	k8sTxRecoveryMu sync.Mutex
+)
+
+const (
+	k8sAnnotationDir      = "otomatik.wondenge.github.io/dir"
+	k8sAnnotationFiles    = "otomatik.wondenge.github.io/files"
+	k8sAnnotationModified = "otomatik.wondenge.github.io/modified"
+	k8sLabelDir           = "otomatik.wondenge.github.io/dir"
+	k8sLabelStorage       = "otomatik.wondenge.github.io/storage"
+	k8sLabelTx            = "otomatik.wondenge.github.io/transaction"
+
+	// k8sAcceptMetadataList asks the API server
+	// for lists of objects without their data.
+	k8sAcceptMetadataList = "application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1"
+
+	k8sMicroTimeFormat    = "2006-01-02T15:04:05.000000Z07:00"
+	k8sLockPollInterval   = 1 * time.Second
+	k8sMaxConflictRetries = 10
+	k8sMaxDirLabels       = 8
+)
+
+// Interface guards
+var (
+	_ Storage              = (*KubernetesStorage)(nil)
+	_ TransactionalStorage = (*KubernetesStorage)(nil)
+	_ LeaseLocker          = (*KubernetesStorage)(nil)
+	_ FencedStorage        = (*KubernetesStorage)(nil)
+)
@@ -0,0 +1,434 @@
+package otomatik
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKubernetes is a minimal Kubernetes API server that
+// stores Secrets and Leases in a single namespace.
+type fakeKubernetes struct {
+	t         *testing.T
+	namespace string
+	token     string
+
+	mu      sync.Mutex
+	objects map[string]map[string]map[string]interface{} // by resource, by name
+	version int
+}
+
+func newFakeKubernetes(t *testing.T) (*fakeKubernetes, *httptest.Server) {
+	fk := &fakeKubernetes{
+		t:         t,
+		namespace: "default",
+		token:     "sekrit",
+		objects: map[string]map[string]map[string]interface{}{
+			"secrets": make(map[string]map[string]interface{}),
+			"leases":  make(map[string]map[string]interface{}),
+		},
+	}
+	return fk, httptest.NewServer(fk)
+}
+
+func (fk *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+fk.token {
+		fk.status(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var resource, name string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/"+fk.namespace+"/secrets"):
+		resource = "secrets"
+		name = strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"+fk.namespace+"/secrets"), "/")
+	case strings.HasPrefix(r.URL.Path, "/apis/coordination.k8s.io/v1/namespaces/"+fk.namespace+"/leases"):
+		resource = "leases"
+		name = strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/apis/coordination.k8s.io/v1/namespaces/"+fk.namespace+"/leases"), "/")
+	default:
+		fk.status(w, http.StatusNotFound, "NotFound")
+		return
+	}
+	objects := fk.objects[resource]
+
+	var body map[string]interface{}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && r.Method != http.MethodDelete {
+			fk.status(w, http.StatusBadRequest, "BadRequest")
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		// the storage must not fetch the data of every Secret
+		metadataOnly := strings.Contains(r.Header.Get("Accept"), "as=PartialObjectMetadataList")
+		if resource == "secrets" && !metadataOnly {
+			fk.status(w, http.StatusBadRequest, "BadRequest")
+			return
+		}
+		var items []interface{}
+	objects:
+		for _, obj := range objects {
+			meta := obj["metadata"].(map[string]interface{})
+			labels, _ := meta["labels"].(map[string]interface{})
+			for _, requirement := range strings.Split(r.URL.Query().Get("labelSelector"), ",") {
+				if label := strings.SplitN(requirement, "=", 2); len(label) == 2 && labels[label[0]] != label[1] {
+					continue objects
+				}
+			}
+			if metadataOnly {
+				obj = map[string]interface{}{"metadata": meta}
+			}
+			items = append(items, obj)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+
+	case r.Method == http.MethodGet:
+		obj, ok := objects[name]
+		if !ok {
+			fk.status(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		json.NewEncoder(w).Encode(obj)
+
+	case r.Method == http.MethodPost:
+		meta := body["metadata"].(map[string]interface{})
+		name = meta["name"].(string)
+		if _, ok := objects[name]; ok {
+			fk.status(w, http.StatusConflict, "AlreadyExists")
+			return
+		}
+		if !fk.valid(resource, body) {
+			fk.status(w, http.StatusUnprocessableEntity, "Invalid")
+			return
+		}
+		fk.version++
+		meta["resourceVersion"] = strconv.Itoa(fk.version)
+		objects[name] = body
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(body)
+
+	case r.Method == http.MethodPut:
+		existing, ok := objects[name]
+		if !ok {
+			fk.status(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		meta := body["metadata"].(map[string]interface{})
+		if meta["resourceVersion"] != existing["metadata"].(map[string]interface{})["resourceVersion"] {
+			fk.status(w, http.StatusConflict, "Conflict")
+			return
+		}
+		if !fk.valid(resource, body) {
+			fk.status(w, http.StatusUnprocessableEntity, "Invalid")
+			return
+		}
+		fk.version++
+		meta["resourceVersion"] = strconv.Itoa(fk.version)
+		objects[name] = body
+		json.NewEncoder(w).Encode(body)
+
+	case r.Method == http.MethodDelete:
+		existing, ok := objects[name]
+		if !ok {
+			fk.status(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		if pre, ok := body["preconditions"].(map[string]interface{}); ok && pre["resourceVersion"] != nil &&
+			pre["resourceVersion"] != existing["metadata"].(map[string]interface{})["resourceVersion"] {
+			fk.status(w, http.StatusConflict, "Conflict")
+			return
+		}
+		delete(objects, name)
+		fk.status(w, http.StatusOK, "Success")
+
+	default:
+		fk.status(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// valid applies the API server's validation of TLS secrets.
+func (fk *fakeKubernetes) valid(resource string, obj map[string]interface{}) bool {
+	if resource != "secrets" || obj["type"] != "kubernetes.io/tls" {
+		return true
+	}
+	data, _ := obj["data"].(map[string]interface{})
+	_, hasCert := data["tls.crt"]
+	_, hasKey := data["tls.key"]
+	return hasCert && hasKey
+}
+
+func (fk *fakeKubernetes) status(w http.ResponseWriter, code int, reason string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "code": code, "reason": reason, "message": reason})
+}
+
+// secret returns the stored Secret named name, if any.
+func (fk *fakeKubernetes) secret(name string) (k8sSecret, bool) {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	obj, ok := fk.objects["secrets"][name]
+	if !ok {
+		return k8sSecret{}, false
+	}
+	objJSON, _ := json.Marshal(obj)
+	var secret k8sSecret
+	if err := json.Unmarshal(objJSON, &secret); err != nil {
+		fk.t.Fatal(err)
+	}
+	return secret, true
+}
+
+func TestKubernetesStorage(t *testing.T) {
+	fk, srv := newFakeKubernetes(t)
+	defer srv.Close()
+	ks := &KubernetesStorage{APIServer: srv.URL, Namespace: fk.namespace, BearerToken: fk.token}
+
+	for _, key := range []string{"a/b/c", "a/b/user@example.com", "a/e", "f"} {
+		if err := ks.Store(key, []byte(key)); err != nil {
+			t.Fatalf("Expected no error storing %s, got: %v", key, err)
+		}
+	}
+	if value, err := ks.Load("a/b/user@example.com"); err != nil || string(value) != "a/b/user@example.com" {
+		t.Errorf("Expected to load stored value, got '%s' (error: %v)", value, err)
+	}
+	if _, err := ks.Load("a/b/nope"); err == nil {
+		t.Errorf("Expected error loading missing key")
+	}
+	if !ks.Exists("a/b") || !ks.Exists("f") || ks.Exists("a/bc") {
+		t.Errorf("Expected non-terminal and terminal keys to exist and others not")
+	}
+
+	keys, err := ks.List("a", true)
+	if expect := []string{"a/b", "a/b/c", "a/b/user@example.com", "a/e"}; err != nil || !reflect.DeepEqual(keys, expect) {
+		t.Errorf("Expected %v, got %v (error: %v)", expect, keys, err)
+	}
+	if info, err := ks.Stat("a/b/c"); err != nil || !info.IsTerminal || info.Size != 5 || info.Modified.IsZero() {
+		t.Errorf("Expected terminal key info, got %+v (error: %v)", info, err)
+	}
+	if info, err := ks.Stat("a/b"); err != nil || info.IsTerminal {
+		t.Errorf("Expected non-terminal key info, got %+v (error: %v)", info, err)
+	}
+
+	if err := ks.Delete("a/b/c"); err != nil {
+		t.Errorf("Expected no error deleting key, got: %v", err)
+	}
+	if ks.Exists("a/b/c") || !ks.Exists("a/b/user@example.com") {
+		t.Errorf("Expected only deleted key to be gone")
+	}
+	if err := ks.Delete("a"); err != nil {
+		t.Errorf("Expected no error deleting non-terminal key, got: %v", err)
+	}
+	if keys, _ := ks.List("", true); !reflect.DeepEqual(keys, []string{"f"}) {
+		t.Errorf("Expected only 'f' to remain, got %v", keys)
+	}
+	name, _ := ks.secretFor("a/b/user@example.com")
+	if _, ok := fk.secret(name); ok {
+		t.Errorf("Expected secret of deleted key to be deleted")
+	}
+
+	// keys in different secrets are committed through a journal
+	err = ks.Commit(nil, []StorageOp{
+		{Key: "x/1", Value: []byte("1")},
+		{Key: "y/2", Value: []byte("2")},
+		{Key: "f", Delete: true},
+	})
+	if err != nil {
+		t.Errorf("Expected no error committing changes to different secrets, got: %v", err)
+	}
+	if keys, _ := ks.List("", true); !reflect.DeepEqual(keys, []string{"x", "x/1", "y", "y/2"}) {
+		t.Errorf("Expected committed changes, got %v", keys)
+	}
+	fk.mu.Lock()
+	if len(fk.objects["secrets"]) != 2 {
+		t.Errorf("Expected journal to be deleted, got %d secrets", len(fk.objects["secrets"]))
+	}
+	fk.mu.Unlock()
+}
+
+func TestKubernetesStorageRecoverTransactions(t *testing.T) {
+	fk, srv := newFakeKubernetes(t)
+	defer srv.Close()
+	ks := &KubernetesStorage{APIServer: srv.URL, Namespace: fk.namespace, BearerToken: fk.token}
+
+	if err := ks.Store("site/meta", []byte("old meta")); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash after committing a transaction
+	// but before any of its changes were applied
+	_, err := ks.createTxJournal(context.Background(), []StorageOp{
+		{Key: "site/cert", Value: []byte("new cert")},
+		{Key: "other/key", Value: []byte("new key")},
+		{Key: "site/meta", Delete: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k8sTxRecovered.Delete(ks.txRecoveryKey())
+
+	if value, err := ks.Load("other/key"); err != nil || string(value) != "new key" {
+		t.Errorf("Expected interrupted transaction to be completed, got '%s' (error: %v)", value, err)
+	}
+	if value, _ := ks.Load("site/cert"); string(value) != "new cert" {
+		t.Errorf("Expected all changes to be applied, got '%s'", value)
+	}
+	if ks.Exists("site/meta") {
+		t.Errorf("Expected deletion in interrupted transaction to be completed")
+	}
+	if keys, _ := ks.List("", true); !reflect.DeepEqual(keys, []string{"other", "other/key", "site", "site/cert"}) {
+		t.Errorf("Expected journal not to be listed, got %v", keys)
+	}
+	fk.mu.Lock()
+	if len(fk.objects["secrets"]) != 2 {
+		t.Errorf("Expected recovered journal to be deleted, got %d secrets", len(fk.objects["secrets"]))
+	}
+	fk.mu.Unlock()
+}
+
+func TestKubernetesStorageNameCollision(t *testing.T) {
+	fk, srv := newFakeKubernetes(t)
+	defer srv.Close()
+	ks := &KubernetesStorage{APIServer: srv.URL, Namespace: fk.namespace, BearerToken: fk.token}
+
+	certKey := StorageKeys.SiteCert("issuer-a", "example.com")
+	if err := ks.Store(certKey, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// pretend that the secret of another issuer's
+	// site has the same name as the one stored
+	otherKey := StorageKeys.SiteCert("issuer-b", "example.com")
+	name, _ := ks.secretFor(certKey)
+	otherName, _ := ks.secretFor(otherKey)
+	fk.mu.Lock()
+	obj := fk.objects["secrets"][name]
+	obj["metadata"].(map[string]interface{})["name"] = otherName
+	fk.objects["secrets"][otherName] = obj
+	delete(fk.objects["secrets"], name)
+	fk.mu.Unlock()
+
+	if _, err := ks.Load(otherKey); err == nil {
+		t.Errorf("Expected key of another directory not to be loaded")
+	}
+	if _, err := ks.Stat(otherKey); err == nil {
+		t.Errorf("Expected key of another directory not to exist")
+	}
+	if err := ks.Store(otherKey, []byte("b")); err == nil {
+		t.Errorf("Expected error overwriting secret of another directory")
+	}
+	if err := ks.Delete(otherKey); err == nil {
+		t.Errorf("Expected error deleting key of another directory")
+	}
+	if secret, ok := fk.secret(otherName); !ok || string(secret.Data["tls.crt"]) != "a" {
+		t.Errorf("Expected secret of another directory to be left alone")
+	}
+}
+
+func TestKubernetesStorageTLSSecrets(t *testing.T) {
+	fk, srv := newFakeKubernetes(t)
+	defer srv.Close()
+	ks := &KubernetesStorage{APIServer: srv.URL, Namespace: fk.namespace, BearerToken: fk.token}
+
+	cfg := &Config{
+		Issuer:    &testIssuer{key: "k8s"},
+		KeySource: DefaultKeyGenerator,
+		Storage:   ks,
+		certCache: &Cache{cache: make(map[string]Certificate), cacheIndex: make(map[string][]string)},
+	}
+	if err := cfg.ObtainCert(context.Background(), "*.example.com", true); err != nil {
+		t.Fatalf("Expected no error obtaining certificate, got: %v", err)
+	}
+
+	certRes, err := cfg.loadCertResource("*.example.com")
+	if err != nil {
+		t.Fatalf("Expected no error loading certificate resource, got: %v", err)
+	}
+	secret, ok := fk.secret(ks.secretName(StorageKeys.CertsSitePrefix("k8s", "*.example.com")))
+	if !ok {
+		t.Fatal("Expected secret for site")
+	}
+	if secret.Type != "kubernetes.io/tls" {
+		t.Errorf("Expected TLS secret, got type '%s'", secret.Type)
+	}
+	if !bytes.Equal(secret.Data["tls.crt"], certRes.CertificatePEM) || !bytes.Equal(secret.Data["tls.key"], certRes.PrivateKeyPEM) {
+		t.Errorf("Expected certificate and key in tls.crt and tls.key")
+	}
+	if len(secret.Data) != 3 {
+		t.Errorf("Expected certificate, key and metadata in one secret, got fields %v", secret.Data)
+	}
+
+	if problems, err := VerifyStorage(context.Background(), ks, VerifyStorageOptions{}); err != nil || len(problems) != 0 {
+		t.Errorf("Expected stored certificate to verify, got %v (error: %v)", problems, err)
+	}
+}
+
+func TestKubernetesStorageLocking(t *testing.T) {
+	fk, srv := newFakeKubernetes(t)
+	defer srv.Close()
+	ks := &KubernetesStorage{APIServer: srv.URL, Namespace: fk.namespace, BearerToken: fk.token}
+
+	ctx := context.Background()
+	lease1, err := ks.LockLease(ctx, "foo", time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error locking, got: %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := ks.LockLease(waitCtx, "foo", time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded while lock is held, got: %v", err)
+	}
+	if err := ks.StoreFenced(lease1, "fenced/key", []byte("one")); err != nil {
+		t.Errorf("Expected no error storing with current lease, got: %v", err)
+	}
+	if err := lease1.Release(); err != nil {
+		t.Fatalf("Expected no error releasing, got: %v", err)
+	}
+
+	lease2, err := ks.LockLease(ctx, "foo", time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error locking again, got: %v", err)
+	}
+	if lease2.Token() <= lease1.Token() {
+		t.Errorf("Expected fencing token to increase, got %d then %d", lease1.Token(), lease2.Token())
+	}
+	if err := ks.StoreFenced(lease1, "fenced/key", []byte("stale")); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost storing with old lease, got: %v", err)
+	}
+
+	// simulate another replica taking over the lock
+	fk.mu.Lock()
+	spec := fk.objects["leases"][ks.leaseName("foo")]["spec"].(map[string]interface{})
+	spec["holderIdentity"] = "other-replica"
+	spec["leaseTransitions"] = spec["leaseTransitions"].(float64) + 1
+	fk.mu.Unlock()
+	select {
+	case <-lease2.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected lease to be lost after lock was taken over")
+	}
+	if err := lease2.Release(); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost releasing lost lease, got: %v", err)
+	}
+
+	// Locker methods work too
+	ks2 := &KubernetesStorage{APIServer: srv.URL, Namespace: fk.namespace, BearerToken: fk.token}
+	if err := ks2.Lock("bar"); err != nil {
+		t.Fatalf("Expected no error locking, got: %v", err)
+	}
+	if err := ks2.Unlock("bar"); err != nil {
+		t.Errorf("Expected no error unlocking, got: %v", err)
+	}
+}
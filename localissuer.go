@@ -0,0 +1,277 @@
+package otomatik
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// LocalIssuer is an Issuer that signs certificates with a local
+// certificate authority, whose root certificate and key are
+// created in Storage the first time they are needed. Instances
+// sharing a storage share the CA. It is intended for certificates
+// used within an organization, such as the client certificates
+// with which services authenticate to each other (mutual TLS);
+// names may be SPIFFE IDs like "spiffe://example.org/api", which
+// become URI SANs. It does not validate that the requester
+// controls the names.
+//
+// Clients and servers must trust the root certificate to accept
+// the certificates it issues; see Config.TrustedCAKeys.
+//
+// A LocalIssuer must not be copied after first use.
+type LocalIssuer struct {
+	// The name of the CA; CAs with different names
+	// have different roots. Default: "local".
+	Name string
+
+	// The storage in which the root certificate and
+	// key are kept; if nil, Default.Storage is used.
+	Storage Storage
+
+	// How long issued certificates are valid for;
+	// default 7 days.
+	Lifetime time.Duration
+
+	// How long the root certificate is valid for
+	// when it is created; default 10 years.
+	RootLifetime time.Duration
+
+	// The extended key usages of issued certificates;
+	// by default, server and client authentication.
+	ExtKeyUsage []x509.ExtKeyUsage
+
+	mu      sync.Mutex
+	root    *x509.Certificate
+	rootKey crypto.Signer
+}
+
+// Issue signs a certificate for the names in csr.
+func (li *LocalIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request: %v", err)
+	}
+	root, rootKey, err := li.loadOrCreateRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	lifetime := li.Lifetime
+	if lifetime <= 0 {
+		lifetime = defaultLocalCertLifetime
+	}
+	notAfter := time.Now().Add(lifetime)
+	if notAfter.After(root.NotAfter) {
+		notAfter = root.NotAfter
+	}
+	extKeyUsage := li.ExtKeyUsage
+	if extKeyUsage == nil {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      time.Now().Add(-time.Minute), // allow for clock skew
+		NotAfter:       notAfter,
+		KeyUsage:       keyUsage,
+		ExtKeyUsage:    extKeyUsage,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, root, csr.PublicKey, rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing certificate: %v", err)
+	}
+
+	return &IssuedCertificate{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, nil
+}
+
+// IssuerKey returns a key unique to the CA's name.
+func (li *LocalIssuer) IssuerKey() string {
+	return "local-" + li.name()
+}
+
+// RootCertificate returns the root certificate of the CA,
+// creating the CA if it does not exist yet.
+func (li *LocalIssuer) RootCertificate(ctx context.Context) (*x509.Certificate, error) {
+	root, _, err := li.loadOrCreateRoot(ctx)
+	return root, err
+}
+
+// RootCertificateKey returns the storage key of the PEM-encoded
+// root certificate of the CA, for use in Config.TrustedCAKeys.
+func (li *LocalIssuer) RootCertificateKey() string {
+	return StorageKeys.CARootCert(li.name())
+}
+
+// loadOrCreateRoot returns the root certificate and key of the
+// CA, loading them from storage, or creating and storing them if
+// they do not exist yet. Creation is done under a lock so that
+// instances sharing the storage agree on one root.
+func (li *LocalIssuer) loadOrCreateRoot(ctx context.Context) (*x509.Certificate, crypto.Signer, error) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	if li.root != nil {
+		return li.root, li.rootKey, nil
+	}
+
+	root, rootKey, err := li.loadRoot()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("loading root of local CA %s: %v", li.name(), err)
+	}
+	if err != nil {
+		lease, err := obtainLock(ctx, li.storage(), "local_ca_"+li.name())
+		if err != nil {
+			return nil, nil, err
+		}
+		defer func() {
+			if err := releaseLock(lease); err != nil {
+				log.Printf("[ERROR][%s] Unable to unlock local CA: %v", li.name(), err)
+			}
+		}()
+
+		// another instance may have created it while we waited
+		root, rootKey, err = li.loadRoot()
+		if errors.Is(err, os.ErrNotExist) {
+			root, rootKey, err = li.createRoot(lease)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating root of local CA %s: %v", li.name(), err)
+		}
+	}
+
+	li.root, li.rootKey = root, rootKey
+	return root, rootKey, nil
+}
+
+func (li *LocalIssuer) loadRoot() (*x509.Certificate, crypto.Signer, error) {
+	storage := li.storage()
+	certPEM, err := storage.Load(StorageKeys.CARootCert(li.name()))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := storage.Load(StorageKeys.CARootPrivateKey(li.name()))
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := decodePrivateKey(keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("root key of type %T cannot sign", key)
+	}
+	return certs[0], signer, nil
+}
+
+func (li *LocalIssuer) createRoot(lease Lease) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	lifetime := li.RootLifetime
+	if lifetime <= 0 {
+		lifetime = defaultLocalRootLifetime
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("%s Root CA", li.name())},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = storeTx(li.storage(), lease, []keyValue{
+		{
+			key:   StorageKeys.CARootCert(li.name()),
+			value: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		},
+		{
+			key:   StorageKeys.CARootPrivateKey(li.name()),
+			value: keyPEM,
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("[INFO][%s] Created root certificate of local CA, valid until %s",
+		li.name(), root.NotAfter.Format("2006-01-02"))
+
+	return root, key, nil
+}
+
+func (li *LocalIssuer) name() string {
+	if li.Name == "" {
+		return "local"
+	}
+	return li.Name
+}
+
+func (li *LocalIssuer) storage() Storage {
+	if li.Storage == nil {
+		return Default.Storage
+	}
+	return li.Storage
+}
+
+// randomSerialNumber returns a random 128-bit serial number.
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+const (
+	defaultLocalCertLifetime = 7 * 24 * time.Hour
+	defaultLocalRootLifetime = 10 * 365 * 24 * time.Hour
+)
+
+// Interface guard
+var _ Issuer = (*LocalIssuer)(nil)
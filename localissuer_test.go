@@ -0,0 +1,83 @@
+package otomatik
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestLocalIssuer(t *testing.T) {
+	storage := new(MemoryStorage)
+	issuer := &LocalIssuer{Name: "internal", Storage: storage, Lifetime: time.Hour}
+	ctx := context.Background()
+
+	if issuer.IssuerKey() != "local-internal" {
+		t.Errorf("Expected issuer key to be unique to the CA's name, got %s", issuer.IssuerKey())
+	}
+
+	for i, keyType := range []KeyType{P256, RSA2048} {
+		key, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := new(Config).generateCSR(key, []string{"spiffe://example.org/api", "api.internal"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		issued, err := issuer.Issue(ctx, csr)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error issuing certificate, got: %v", i, err)
+		}
+		certs, err := parseCertsFromPEMBundle(issued.Certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf := certs[0]
+		if len(leaf.URIs) != 1 || leaf.URIs[0].String() != "spiffe://example.org/api" || leaf.DNSNames[0] != "api.internal" {
+			t.Errorf("Test %d: Expected names from request, got %v %v", i, leaf.URIs, leaf.DNSNames)
+		}
+		if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime > time.Hour+time.Minute {
+			t.Errorf("Test %d: Expected configured lifetime, got %s", i, lifetime)
+		}
+		if encipherment := leaf.KeyUsage&x509.KeyUsageKeyEncipherment != 0; encipherment != (keyType == RSA2048) {
+			t.Errorf("Test %d: Expected key encipherment usage only for RSA keys", i)
+		}
+
+		// issued by the root in storage, for clients and servers
+		root, err := issuer.RootCertificate(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(root)
+		for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth} {
+			if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}}); err != nil {
+				t.Errorf("Test %d: Expected certificate to verify for usage %v, got: %v", i, usage, err)
+			}
+		}
+	}
+
+	// other instances with the same storage share the CA
+	rootPEM, err := storage.Load(issuer.RootCertificateKey())
+	if err != nil {
+		t.Fatalf("Expected root certificate in storage, got: %v", err)
+	}
+	other := &LocalIssuer{Name: "internal", Storage: storage}
+	otherRoot, err := other.RootCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roots, _ := parseCertsFromPEMBundle(rootPEM); !otherRoot.Equal(roots[0]) {
+		t.Errorf("Expected instances sharing storage to share the root")
+	}
+
+	// but CAs with other names do not
+	differentRoot, err := (&LocalIssuer{Name: "other", Storage: storage}).RootCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if differentRoot.Equal(otherRoot) {
+		t.Errorf("Expected CAs with different names to have different roots")
+	}
+}
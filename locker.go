@@ -0,0 +1,159 @@
+package otomatik
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LeaseLocker is the context-aware successor of Locker. Instead of
+// holding a lock indefinitely, callers hold a lease on it which
+// expires unless it is renewed; implementations renew leases in
+// the background for as long as the lock is held, so a crashed
+// process blocks others for at most one TTL. Storage
+// implementations should implement LeaseLocker in addition to
+// Locker; other Lockers can be adapted with NewLeaseLocker.
+type LeaseLocker interface {
+	// LockLease acquires the lock for key with a lease that
+	// lasts for ttl unless renewed. It blocks until the lock
+	// is acquired, ctx is done, or an error occurs.
+	//
+	// As with Locker, an idempotent operation may already have
+	// been performed by a previous holder of the lock, so check
+	// whether it is still needed after acquiring the lock.
+	LockLease(ctx context.Context, key string, ttl time.Duration) (Lease, error)
+}
+
+// Lease is a held lock obtained from a LeaseLocker.
+type Lease interface {
+	// Key returns the key of the lock.
+	Key() string
+
+	// Token returns the fencing token of the lease. Tokens
+	// increase monotonically with each lease granted for the
+	// same key, so writes made with an older token can be
+	// rejected after the lock has changed hands (see
+	// FencedStorage).
+	Token() uint64
+
+	// Lost returns a channel that is closed if the lease is
+	// lost before it is released, for example because it
+	// could not be renewed in time. Once the lease is lost,
+	// the critical section must be abandoned.
+	Lost() <-chan struct{}
+
+	// Release releases the lock. It must be called exactly
+	// once, after the critical section is finished, even
+	// if the lease was lost.
+	Release() error
+}
+
+// FencedStorage is a Storage which can reject writes
+// made under a lease that is no longer current.
+type FencedStorage interface {
+	// StoreFenced is like Store, except it returns
+	// ErrLeaseLost without storing anything if lease
+	// has been lost or superseded by a newer lease.
+	StoreFenced(lease Lease, key string, value []byte) error
+}
+
+// NewLeaseLocker adapts locker, which does not support leases, to
+// the LeaseLocker interface. Lease TTLs are ignored, since expiring
+// locks is up to locker; fencing tokens are only monotonic within
+// this process, and leases are never reported lost.
+// If the context is done before locker.Lock returns, the lock is
+// released in the background as soon as it is acquired.
+func NewLeaseLocker(locker Locker) LeaseLocker {
+	if ll, ok := locker.(LeaseLocker); ok {
+		return ll
+	}
+	return legacyLeaseLocker{locker}
+}
+
+type legacyLeaseLocker struct {
+	Locker
+}
+
+func (l legacyLeaseLocker) LockLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	result := make(chan error, 1)
+	go func() {
+		result <- l.Lock(key)
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return nil, err
+		}
+		return &legacyLease{
+			locker: l.Locker,
+			key:    key,
+			token:  atomic.AddUint64(&legacyLeaseToken, 1),
+			lost:   make(chan struct{}),
+		}, nil
+	case <-ctx.Done():
+		go func() {
+			if err := <-result; err == nil {
+				l.Unlock(key)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+type legacyLease struct {
+	locker Locker
+	key    string
+	token  uint64
+	lost   chan struct{}
+}
+
+func (l *legacyLease) Key() string           { return l.key }
+func (l *legacyLease) Token() uint64         { return l.token }
+func (l *legacyLease) Lost() <-chan struct{} { return l.lost }
+func (l *legacyLease) Release() error        { return l.locker.Unlock(l.key) }
+
+// legacyLeaseToken is the last fencing token
+// issued to a lease from a legacyLeaseLocker.
+var legacyLeaseToken uint64
+
+// leaseContext returns a copy of ctx that is
+// canceled when lease is lost.
+func leaseContext(ctx context.Context, lease Lease) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-lease.Lost():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// leaseIsLost returns true if lease has been lost.
+func leaseIsLost(lease Lease) bool {
+	select {
+	case <-lease.Lost():
+		return true
+	default:
+		return false
+	}
+}
+
+// closeOnce closes a channel at most once.
+type closeOnce struct {
+	ch   chan struct{}
+	once sync.Once
+}
+
+func (c *closeOnce) close() { c.once.Do(func() { close(c.ch) }) }
+
+// ErrLeaseLost is returned when an operation cannot
+// proceed because its lease on a lock was lost.
+var ErrLeaseLost = errors.New("lock lease lost")
+
+// DefaultLockTTL is the TTL of the leases on locks
+// held while obtaining or renewing certificates.
+const DefaultLockTTL = 10 * time.Second
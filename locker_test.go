@@ -0,0 +1,266 @@
+package otomatik
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStorageLockLease(t *testing.T) {
+	fs := &FileStorage{Path: "./_testdata_tmp"}
+	defer os.RemoveAll(fs.Path)
+
+	ctx := context.Background()
+	lease1, err := fs.LockLease(ctx, "foo", time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error locking, got: %v", err)
+	}
+
+	// while held, other callers wait until their context is done
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := fs.LockLease(waitCtx, "foo", time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded while lock is held, got: %v", err)
+	}
+
+	if err := fs.StoreFenced(lease1, "fenced", []byte("one")); err != nil {
+		t.Errorf("Expected no error storing with current lease, got: %v", err)
+	}
+	if err := lease1.Release(); err != nil {
+		t.Fatalf("Expected no error releasing, got: %v", err)
+	}
+
+	lease2, err := fs.LockLease(ctx, "foo", time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error locking again, got: %v", err)
+	}
+	defer lease2.Release()
+	if lease2.Token() <= lease1.Token() {
+		t.Errorf("Expected fencing token to increase, got %d then %d", lease1.Token(), lease2.Token())
+	}
+
+	// writes with the superseded lease are rejected
+	if err := fs.StoreFenced(lease1, "fenced", []byte("stale")); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost storing with old lease, got: %v", err)
+	}
+	if value, _ := fs.Load("fenced"); string(value) != "one" {
+		t.Errorf("Expected stale write to be rejected, but value is '%s'", value)
+	}
+}
+
+func TestFileStorageLeaseLost(t *testing.T) {
+	fs := &FileStorage{Path: "./_testdata_tmp"}
+	defer os.RemoveAll(fs.Path)
+
+	lease, err := fs.LockLease(context.Background(), "foo", 150*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected no error locking, got: %v", err)
+	}
+
+	// the lease is renewed in the background, so it outlives its TTL
+	time.Sleep(300 * time.Millisecond)
+	if leaseIsLost(lease) {
+		t.Fatal("Expected lease to be kept fresh")
+	}
+	// the lock file may be read while it is being rewritten
+	var meta lockMeta
+	for i := 0; i < 10; i++ {
+		var metaBytes []byte
+		metaBytes, err = ioutil.ReadFile(fs.lockFilename("foo"))
+		if err == nil {
+			err = json.Unmarshal(metaBytes, &meta)
+		}
+		if err == nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err != nil || meta.Token != lease.Token() || !meta.Expires.After(time.Now()) {
+		t.Fatalf("Expected fresh lock file with lease's token, got %+v (error: %v)", meta, err)
+	}
+
+	// simulate another process taking over the lock
+	meta.Token++
+	metaBytes, _ := json.Marshal(meta)
+	if err := ioutil.WriteFile(fs.lockFilename("foo"), metaBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lease.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("Expected lease to be lost after lock was taken over")
+	}
+
+	// releasing a lost lease does not remove the other process's lock
+	if err := lease.Release(); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost releasing lost lease, got: %v", err)
+	}
+	if _, err := os.Stat(fs.lockFilename("foo")); err != nil {
+		t.Errorf("Expected other process's lock file to remain, got: %v", err)
+	}
+}
+
+func TestFileStorageStaleLock(t *testing.T) {
+	fs := &FileStorage{Path: "./_testdata_tmp"}
+	defer os.RemoveAll(fs.Path)
+
+	// a lock file left behind by a crashed process
+	// is taken over as soon as its lease expires
+	crashed := lockMeta{
+		Created: time.Now().Add(-time.Minute),
+		Updated: time.Now().Add(-time.Minute),
+		Expires: time.Now().Add(-time.Second),
+		Token:   1,
+	}
+	if err := atomicallyCreateFile(fs.lockFilename("foo"), &crashed); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	lease, err := fs.LockLease(ctx, "foo", time.Second)
+	if err != nil {
+		t.Fatalf("Expected stale lock to be taken over, got: %v", err)
+	}
+	lease.Release()
+}
+
+func TestFileStorageStaleKeepFreshAfterTakeover(t *testing.T) {
+	fs := &FileStorage{Path: "./_testdata_tmp"}
+	defer os.RemoveAll(fs.Path)
+	filename := fs.lockFilename("foo")
+
+	leaseA, err := fs.LockLease(context.Background(), "foo", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leaseA.Release()
+
+	// A's lock goes stale and B takes it over, but A's
+	// keepFresh runs between B creating the lock file
+	// and B starting its lease
+	removeLockfile(filename)
+	tokenB := leaseA.Token() + 1
+	if err := createLockfile(filename, tokenB, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	gone, err := updateLockfileFreshness(filename, leaseA.Token(), time.Hour)
+	if err != nil || !gone {
+		t.Fatalf("Expected A to find its lock gone, got gone=%v (error: %v)", gone, err)
+	}
+	leaseB, err := fs.startLease("foo", filename, tokenB, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected B to hold the lock, got: %v", err)
+	}
+	defer leaseB.Release()
+	if meta, _ := readLockfile(filename); meta.Token != tokenB {
+		t.Errorf("Expected lock file to keep B's token %d, got %d", tokenB, meta.Token)
+	}
+	if err := fs.StoreFenced(leaseA, "fenced", []byte("A")); err != ErrLeaseLost {
+		t.Errorf("Expected A's writes to be fenced off, got: %v", err)
+	}
+
+	// a lease is not started on a lock file taken over
+	// before its token was recorded
+	tokenC := tokenB + 1
+	if err := ioutil.WriteFile(filename, []byte(`{"token":99}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.startLease("foo", filename, tokenC, time.Hour); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost starting lease on lock taken over, got: %v", err)
+	}
+	if meta, _ := readLockfile(filename); meta.Token != 99 {
+		t.Errorf("Expected other holder's lock file to remain, got token %d", meta.Token)
+	}
+
+	// a token that was issued meanwhile is not reused
+	removeLockfile(filename)
+	if err := createLockfile(filename, tokenC, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.startLease("foo", filename, tokenC, time.Hour); err != errStaleFencingToken {
+		t.Errorf("Expected stale token to be rejected, got: %v", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Expected lock file with stale token to be removed, got: %v", err)
+	}
+}
+
+// blockingLocker is a Locker whose locks are
+// held until released by the test.
+type blockingLocker struct {
+	mu       sync.Mutex
+	held     map[string]chan struct{}
+	unlocked chan string
+}
+
+func (l *blockingLocker) Lock(key string) error {
+	for {
+		l.mu.Lock()
+		ch, ok := l.held[key]
+		if !ok {
+			l.held[key] = make(chan struct{})
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+		<-ch
+	}
+}
+
+func (l *blockingLocker) Unlock(key string) error {
+	l.mu.Lock()
+	close(l.held[key])
+	delete(l.held, key)
+	l.mu.Unlock()
+	l.unlocked <- key
+	return nil
+}
+
+func TestNewLeaseLocker(t *testing.T) {
+	locker := &blockingLocker{held: make(map[string]chan struct{}), unlocked: make(chan string, 10)}
+	ll := NewLeaseLocker(locker)
+
+	lease1, err := ll.LockLease(context.Background(), "foo", time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error locking, got: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ll.LockLease(ctx, "foo", time.Minute); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded while lock is held, got: %v", err)
+	}
+
+	// releasing the first lease lets the abandoned attempt acquire
+	// the lock, which must then be released in the background
+	if err := lease1.Release(); err != nil {
+		t.Fatalf("Expected no error releasing, got: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-locker.unlocked:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected abandoned lock to be released")
+		}
+	}
+
+	lease2, err := ll.LockLease(context.Background(), "foo", time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error locking again, got: %v", err)
+	}
+	if lease2.Token() <= lease1.Token() {
+		t.Errorf("Expected fencing token to increase, got %d then %d", lease1.Token(), lease2.Token())
+	}
+	lease2.Release()
+
+	// storages which support leases are used as-is
+	fs := &FileStorage{Path: "./_testdata_tmp"}
+	if _, ok := NewLeaseLocker(fs).(*FileStorage); !ok {
+		t.Errorf("Expected FileStorage to be used as its own LeaseLocker")
+	}
+}
@@ -20,6 +20,7 @@ import (
 func (certCache *Cache) maintainAssets() {
 	renewalTicker := time.NewTicker(certCache.options.RenewCheckInterval)
 	ocspTicker := time.NewTicker(certCache.options.OCSPCheckInterval)
+	fileTicker := time.NewTicker(certCache.options.FileCheckInterval)
 
 	log.Printf("[INFO][cache:%p] Started certificate maintenance routine", certCache)
 
@@ -35,9 +36,12 @@ func (certCache *Cache) maintainAssets() {
 			}
 		case <-ocspTicker.C:
 			certCache.updateOCSPStaples(ctx)
+		case <-fileTicker.C:
+			certCache.reloadCertificateFiles()
 		case <-certCache.stopChan:
 			renewalTicker.Stop()
 			ocspTicker.Stop()
+			fileTicker.Stop()
 			// TODO: stop any in-progress maintenance operations and clear locks we made (this might be done now with our use of context)
 			log.Printf("[INFO][cache:%p] Stopped certificate maintenance routine", certCache)
 			close(certCache.doneChan)
@@ -52,8 +56,9 @@ func (certCache *Cache) maintainAssets() {
 // need to call this. This method assumes non-interactive
 // mode (i.e. operating in the background).
 func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
-	// configs will hold a map of certificate name to the config
-	// to use when managing that certificate
+	// configs will hold a map of certificate hash to the config
+	// to use when managing that certificate, since there may be
+	// certificates with different key types for the same name
 	configs := make(map[string]*Config)
 
 	// we use the queues for a very important reason: to do any and all
@@ -91,7 +96,7 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 
 		// if time is up or expires soon, we need to try to renew it
 		if cert.NeedsRenewal(cfg) {
-			configs[cert.Names[0]] = cfg
+			configs[cert.hash] = cfg
 
 			// see if the certificate in storage has already been renewed, possibly by another
 			// instance that didn't coordinate with this one; if so, just load it (this
@@ -125,7 +130,7 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 		log.Printf("[INFO] %v Maintenance routine: certificate expires in %s, but is already renewed in storage; reloading stored certificate",
 			oldCert.Names, timeLeft)
 
-		cfg := configs[oldCert.Names[0]]
+		cfg := configs[oldCert.hash]
 
 		// crucially, this happens OUTSIDE a lock on the certCache
 		err := cfg.reloadManagedCertificate(oldCert)
@@ -137,7 +142,7 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 
 	// Renewal queue
 	for _, oldCert := range renewQueue {
-		cfg := configs[oldCert.Names[0]]
+		cfg := configs[oldCert.hash]
 		err := certCache.queueRenewalTask(ctx, oldCert, cfg)
 		if err != nil {
 			log.Printf("[ERROR] %v", err)
@@ -165,7 +170,7 @@ func (certCache *Cache) queueRenewalTask(ctx context.Context, oldCert Certificat
 	renewName := oldCert.Names[0]
 
 	// queue up this renewal job (is a no-op if already active or queued)
-	jobmanager.Submit("renew_"+renewName, func() error {
+	jobmanager.Submit(cfg.renewJobName(renewName), func() error {
 		timeLeft := oldCert.Leaf.NotAfter.Sub(time.Now().UTC())
 		log.Printf("[INFO] %v Maintenance routine: attempting renewal with %v remaining", oldCert.Names, timeLeft)
 
@@ -273,7 +278,7 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 		// to replace it with a new one. If that fails, oh well.
 		if cert.managed && ocspResp.Status == ocsp.Revoked && len(cert.Names) > 0 {
 			renewQueue = append(renewQueue, cert)
-			configs[cert.Names[0]] = cfg
+			configs[cert.hash] = cfg
 		}
 	}
 
@@ -294,7 +299,7 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 			oldCert.Names, oldCert.Leaf.NotAfter)
 
 		renewName := oldCert.Names[0]
-		cfg := configs[renewName]
+		cfg := configs[oldCert.hash]
 
 		// TODO: consider using a new key in this situation, but we don't know if key storage has been compromised...
 		err := cfg.RenewCert(ctx, renewName, false)
@@ -319,6 +324,8 @@ type CleanStorageOptions struct {
 	OCSPStaples            bool
 	ExpiredCerts           bool
 	ExpiredCertGracePeriod time.Duration
+	VerifyCerts            bool
+	VerifyOptions          VerifyStorageOptions
 }
 
 // CleanStorage removes assets which are no longer useful,
@@ -336,6 +343,12 @@ func CleanStorage(storage Storage, opts CleanStorageOptions) {
 			log.Printf("[ERROR] Deleting expired certificates: %v", err)
 		}
 	}
+	if opts.VerifyCerts {
+		_, err := VerifyStorage(context.Background(), storage, opts.VerifyOptions)
+		if err != nil {
+			log.Printf("[ERROR] Verifying certificates: %v", err)
+		}
+	}
 	// TODO: delete stale locks?
 }
 
@@ -413,6 +426,7 @@ func deleteExpiredCerts(storage Storage, gracePeriod time.Duration) error {
 				if expiredTime := time.Since(cert.NotAfter); expiredTime >= gracePeriod {
 					log.Printf("[INFO] Certificate %s expired %s ago; cleaning up", assetKey, expiredTime)
 					baseName := strings.TrimSuffix(assetKey, ".crt")
+					keyPEM, _ := storage.Load(baseName + ".key")
 					for _, relatedAsset := range []string{
 						assetKey,
 						baseName + ".key",
@@ -425,6 +439,7 @@ func deleteExpiredCerts(storage Storage, gracePeriod time.Duration) error {
 								baseName, relatedAsset, err)
 						}
 					}
+					deleteRemoteKey(keyPEM)
 				}
 			}
 
@@ -460,4 +475,245 @@ const (
 
 	// DefaultOCSPCheckInterval is how often to check if OCSP stapling needs updating.
 	DefaultOCSPCheckInterval = 1 * time.Hour
+
+	// DefaultFileCheckInterval is how often to check the files
+	// of unmanaged certificates for changes. Only the files are
+	// read and hashed, so this can be frequent.
+	DefaultFileCheckInterval = 30 * time.Second
 )
+
+// watchedCertFiles is an unmanaged certificate in the
+// cache that was loaded from files, which are checked
+// for changes.
+type watchedCertFiles struct {
+	cfg               *Config
+	certFile, keyFile string
+	cert              Certificate // currently in the cache
+	hash              string      // of the files last read
+}
+
+// watchCertificateFiles begins checking the files from which
+// cert was loaded for changes; filesHash is the hash of their
+// contents. Loading the same files again replaces the previous
+// certificate as the one to check.
+func (certCache *Cache) watchCertificateFiles(cfg *Config, cert Certificate, certFile, keyFile, filesHash string) {
+	certCache.certFilesMu.Lock()
+	defer certCache.certFilesMu.Unlock()
+	watched := &watchedCertFiles{cfg: cfg, certFile: certFile, keyFile: keyFile, cert: cert, hash: filesHash}
+	for i, w := range certCache.certFiles {
+		if w.certFile == certFile && w.keyFile == keyFile {
+			certCache.certFiles[i] = watched
+			return
+		}
+	}
+	certCache.certFiles = append(certCache.certFiles, watched)
+}
+
+// reloadCertificateFiles checks the files of unmanaged
+// certificates for changes, and replaces the certificates
+// of files that changed in the cache with new ones loaded
+// from them. The new certificate and key must be valid and
+// match; otherwise, the current certificate is kept until
+// the files change again. Files whose certificate is no
+// longer in the cache are no longer checked.
+func (certCache *Cache) reloadCertificateFiles() {
+	// take a snapshot, so that files are read and OCSP
+	// responses fetched without holding the lock
+	certCache.certFilesMu.Lock()
+	var watched []*watchedCertFiles
+	var snapshot []watchedCertFiles
+	for _, w := range certCache.certFiles {
+		if !certCache.hasCertificate(w.cert) {
+			log.Printf("[INFO] Certificate for %v from %s and %s is no longer cached; no longer checking files for changes",
+				w.cert.Names, w.certFile, w.keyFile)
+			continue
+		}
+		watched = append(watched, w)
+		snapshot = append(snapshot, *w)
+	}
+	certCache.certFiles = watched
+	certCache.certFilesMu.Unlock()
+
+	type reloadedCertFiles struct {
+		w       *watchedCertFiles
+		oldHash string
+		newHash string
+		newCert Certificate
+		err     error
+	}
+	var reloaded []reloadedCertFiles
+	for i, w := range snapshot {
+		certPEM, keyPEM, filesHash, err := readCertificateFiles(w.certFile, w.keyFile)
+		if err != nil {
+			log.Printf("[ERROR] Checking certificate files %s and %s for changes: %v", w.certFile, w.keyFile, err)
+			continue
+		}
+		if filesHash == w.hash {
+			continue
+		}
+		newCert, err := makeCertificateWithOCSP(w.cfg.Storage, certPEM, keyPEM)
+		reloaded = append(reloaded, reloadedCertFiles{
+			w:       watched[i],
+			oldHash: w.hash,
+			newHash: filesHash,
+			newCert: newCert,
+			err:     err,
+		})
+	}
+	if len(reloaded) == 0 {
+		return
+	}
+
+	// swap in the new certificates, unless their files were
+	// loaded again or stopped being checked in the meantime
+	type reloadEvent struct {
+		cfg   *Config
+		names []string
+	}
+	var events []reloadEvent
+	certCache.certFilesMu.Lock()
+	for _, r := range reloaded {
+		if r.w.hash != r.oldHash || !certCache.isWatchingCertificateFiles(r.w) || !certCache.hasCertificate(r.w.cert) {
+			continue
+		}
+		r.w.hash = r.newHash
+		if r.err != nil {
+			log.Printf("[ERROR] Reloading changed certificate files %s and %s: %v; keeping current certificate for %v",
+				r.w.certFile, r.w.keyFile, r.err, r.w.cert.Names)
+			continue
+		}
+		r.newCert.Tags = r.w.cert.Tags
+		certCache.replaceCertificate(r.w.cert, r.newCert)
+		r.w.cert = r.newCert
+		events = append(events, reloadEvent{cfg: r.w.cfg, names: r.newCert.Names})
+	}
+	certCache.certFilesMu.Unlock()
+
+	for _, e := range events {
+		e.cfg.emit("reloaded_unmanaged_cert", e.names)
+	}
+}
+
+// isWatchingCertificateFiles returns true if w is among
+// the files being checked for changes. certCache.certFilesMu
+// must be locked.
+func (certCache *Cache) isWatchingCertificateFiles(w *watchedCertFiles) bool {
+	for _, other := range certCache.certFiles {
+		if other == w {
+			return true
+		}
+	}
+	return false
+}
+
+// watchStorage begins watching storage for changes to managed
+// certificates, if it is a WatchableStorage and not already
+// being watched, so that certificates renewed by other instances
+// sharing the storage are reloaded without waiting for the next
+// renewal check. Watching stops when the cache is stopped. Storage
+// is only watched if the cache's WatchStorage option is set.
+func (certCache *Cache) watchStorage(storage Storage) {
+	ws, ok := storage.(WatchableStorage)
+	if !ok || !certCache.options.WatchStorage || certCache.stopChan == nil {
+		return
+	}
+
+	certCache.watchMu.Lock()
+	if _, ok := certCache.watching[ws]; ok {
+		certCache.watchMu.Unlock()
+		return
+	}
+	if certCache.watching == nil {
+		certCache.watching = make(map[WatchableStorage]struct{})
+	}
+	certCache.watching[ws] = struct{}{}
+	certCache.watchMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err := ws.Watch(ctx, prefixCerts)
+	if err != nil {
+		cancel()
+		if err != errStorageNotWatchable {
+			log.Printf("[ERROR][cache:%p] Watching %v for changes: %v", certCache, ws, err)
+		}
+		certCache.watchMu.Lock()
+		delete(certCache.watching, ws)
+		certCache.watchMu.Unlock()
+		return
+	}
+	go func() {
+		<-certCache.stopChan
+		cancel()
+	}()
+	go certCache.reloadOnChange(changes)
+}
+
+// reloadOnChange reloads the managed certificates whose keys are
+// received on changes, until changes is closed. Since a certificate
+// and its key are often not stored at once, changes are collected
+// until none have been received for storageWatchDelay.
+func (certCache *Cache) reloadOnChange(changes <-chan string) {
+	sites := make(map[string]struct{})
+	var settled <-chan time.Time
+	for {
+		select {
+		case key, ok := <-changes:
+			if !ok {
+				return
+			}
+			// keys are certificates/<issuer>/<site>/<file>
+			parts := strings.Split(key, "/")
+			if len(parts) < 4 || parts[0] != prefixCerts {
+				continue
+			}
+			sites[parts[2]] = struct{}{}
+			settled = time.After(storageWatchDelay)
+		case <-settled:
+			certCache.reloadChangedCertificates(sites)
+			sites = make(map[string]struct{})
+			settled = nil
+		}
+	}
+}
+
+// reloadChangedCertificates reloads the managed certificates
+// in the cache for sites, which are names as they appear in
+// storage keys, if the certificate in storage is different.
+func (certCache *Cache) reloadChangedCertificates(sites map[string]struct{}) {
+	var changed []Certificate
+	certCache.mu.RLock()
+	for _, cert := range certCache.cache {
+		if !cert.managed || len(cert.Names) == 0 {
+			continue
+		}
+		if _, ok := sites[StorageKeys.Safe(cert.Names[0])]; ok {
+			changed = append(changed, cert)
+		}
+	}
+	certCache.mu.RUnlock()
+
+	// crucially, this happens OUTSIDE a lock on the certCache
+	for _, oldCert := range changed {
+		cfg, err := certCache.getConfig(oldCert)
+		if err != nil {
+			log.Printf("[ERROR] Getting configuration to reload certificate for names %v: %v", oldCert.Names, err)
+			continue
+		}
+		newCert, err := cfg.loadManagedCertificate(oldCert.Names[0])
+		if err != nil {
+			// it may be in the middle of being stored; the next
+			// change or renewal check will pick it up
+			log.Printf("[NOTICE] %v Certificate changed in storage but could not be loaded: %v", oldCert.Names, err)
+			continue
+		}
+		if newCert.hash == oldCert.hash {
+			continue
+		}
+		log.Printf("[INFO] %v Certificate changed in storage; reloading", oldCert.Names)
+		certCache.replaceCertificate(oldCert, newCert)
+	}
+}
+
+// storageWatchDelay is how long to wait after the last change
+// to a certificate in storage before reloading it.
+var storageWatchDelay = time.Second
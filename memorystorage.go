@@ -0,0 +1,402 @@
+package otomatik
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is a Storage that keeps everything in memory,
+// for tests and for short-lived deployments that do not need
+// certificates to persist across restarts. Its contents can be
+// saved to and loaded from a file with SaveSnapshot and
+// LoadSnapshot. Locks are only effective within the process.
+//
+// Keys form a hierarchy like paths in a file system: a key
+// that is a prefix of other keys (up to a slash) exists as a
+// non-terminal key for as long as it contains any keys.
+//
+// The zero value is ready to use.
+type MemoryStorage struct {
+	mu       sync.RWMutex
+	entries  map[string]memoryEntry
+	locks    map[string]chan struct{}
+	tokens   map[string]uint64
+	watchers map[*memoryWatcher]struct{}
+}
+
+type memoryEntry struct {
+	value    []byte
+	modified time.Time
+}
+
+// Store saves value at key.
+func (ms *MemoryStorage) Store(key string, value []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.store(key, value)
+	return nil
+}
+
+// Load retrieves the value at key.
+func (ms *MemoryStorage) Load(key string) ([]byte, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	entry, ok := ms.entries[cleanKey(key)]
+	if !ok {
+		return nil, memoryNotExist(key)
+	}
+	return append([]byte(nil), entry.value...), nil
+}
+
+// Delete deletes key. If key is non-terminal,
+// all the keys it contains are deleted.
+func (ms *MemoryStorage) Delete(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if !ms.exists(key) {
+		return memoryNotExist(key)
+	}
+	ms.delete(key)
+	return nil
+}
+
+// Exists returns true if key exists.
+func (ms *MemoryStorage) Exists(key string) bool {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.exists(key)
+}
+
+// List returns all keys that match prefix.
+func (ms *MemoryStorage) List(prefix string, recursive bool) ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	prefix = cleanKey(prefix)
+	if prefix != "" && !ms.exists(prefix) {
+		return nil, memoryNotExist(prefix)
+	}
+
+	all := make([]string, 0, len(ms.entries))
+	for key := range ms.entries {
+		all = append(all, key)
+	}
+	return listKeys(all, prefix, recursive), nil
+}
+
+// Stat returns information about key.
+func (ms *MemoryStorage) Stat(key string) (KeyInfo, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	key = cleanKey(key)
+	if entry, ok := ms.entries[key]; ok {
+		return KeyInfo{
+			Key:        key,
+			Modified:   entry.modified,
+			Size:       int64(len(entry.value)),
+			IsTerminal: true,
+		}, nil
+	}
+
+	// non-terminal keys were last modified
+	// when the keys they contain were
+	info := KeyInfo{Key: key}
+	var found bool
+	for k, entry := range ms.entries {
+		if _, ok := keyWithin(key, k); ok {
+			found = true
+			if entry.modified.After(info.Modified) {
+				info.Modified = entry.modified
+			}
+		}
+	}
+	if !found {
+		return KeyInfo{}, memoryNotExist(key)
+	}
+	return info, nil
+}
+
+// Lock obtains the lock for key, blocking
+// until it can be obtained.
+func (ms *MemoryStorage) Lock(key string) error {
+	_, err := ms.LockLease(context.Background(), key, DefaultLockTTL)
+	return err
+}
+
+// Unlock releases the lock for key.
+func (ms *MemoryStorage) Unlock(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ch, ok := ms.locks[key]
+	if !ok {
+		return fmt.Errorf("lock for %s is not held", key)
+	}
+	close(ch)
+	delete(ms.locks, key)
+	return nil
+}
+
+// LockLease obtains a lease on the lock for key, blocking
+// until it can be obtained or ctx is done. Since the lock
+// only exists in memory, the lease cannot be lost and ttl
+// is ignored.
+func (ms *MemoryStorage) LockLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	for {
+		ms.mu.Lock()
+		held, ok := ms.locks[key]
+		if !ok {
+			if ms.locks == nil {
+				ms.locks = make(map[string]chan struct{})
+				ms.tokens = make(map[string]uint64)
+			}
+			ms.locks[key] = make(chan struct{})
+			ms.tokens[key]++
+			lease := &memoryLease{storage: ms, key: key, token: ms.tokens[key], lost: make(chan struct{})}
+			ms.mu.Unlock()
+			return lease, nil
+		}
+		ms.mu.Unlock()
+
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// StoreFenced saves value at key, unless a newer
+// lease has been granted for the lock of lease.
+func (ms *MemoryStorage) StoreFenced(lease Lease, key string, value []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.superseded(lease) {
+		return ErrLeaseLost
+	}
+	ms.store(key, value)
+	return nil
+}
+
+// Commit applies ops atomically.
+func (ms *MemoryStorage) Commit(lease Lease, ops []StorageOp) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if lease != nil && ms.superseded(lease) {
+		return ErrLeaseLost
+	}
+	for _, op := range ops {
+		if op.Delete {
+			ms.delete(op.Key)
+		} else {
+			ms.store(op.Key, op.Value)
+		}
+	}
+	return nil
+}
+
+// SaveSnapshot writes the contents of ms to the file
+// named filename, replacing it atomically. Locks are
+// not included.
+func (ms *MemoryStorage) SaveSnapshot(filename string) error {
+	ms.mu.RLock()
+	snapshot := make(map[string]memorySnapshotEntry, len(ms.entries))
+	for key, entry := range ms.entries {
+		snapshot[key] = memorySnapshotEntry{Value: entry.value, Modified: entry.modified}
+	}
+	ms.mu.RUnlock()
+
+	snapshotBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("encoding snapshot: %v", err)
+	}
+	err = writeFileSync(filename+".tmp", snapshotBytes, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// LoadSnapshot replaces the contents of ms with the
+// snapshot in the file named filename, which must
+// have been written by SaveSnapshot.
+func (ms *MemoryStorage) LoadSnapshot(filename string) error {
+	snapshotBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var snapshot map[string]memorySnapshotEntry
+	err = json.Unmarshal(snapshotBytes, &snapshot)
+	if err != nil {
+		return fmt.Errorf("decoding snapshot: %v", err)
+	}
+
+	entries := make(map[string]memoryEntry, len(snapshot))
+	for key, entry := range snapshot {
+		entries[cleanKey(key)] = memoryEntry{value: entry.Value, modified: entry.Modified}
+	}
+	ms.mu.Lock()
+	ms.entries = entries
+	ms.mu.Unlock()
+	return nil
+}
+
+// Watch sends the keys within prefix that are
+// stored or deleted until ctx is done.
+func (ms *MemoryStorage) Watch(ctx context.Context, prefix string) (<-chan string, error) {
+	w := &memoryWatcher{
+		prefix: cleanKey(prefix),
+		wake:   make(chan struct{}, 1),
+	}
+	ms.mu.Lock()
+	if ms.watchers == nil {
+		ms.watchers = make(map[*memoryWatcher]struct{})
+	}
+	ms.watchers[w] = struct{}{}
+	ms.mu.Unlock()
+
+	changes := make(chan string)
+	go func() {
+		defer close(changes)
+		defer func() {
+			ms.mu.Lock()
+			delete(ms.watchers, w)
+			ms.mu.Unlock()
+		}()
+		for {
+			select {
+			case <-w.wake:
+			case <-ctx.Done():
+				return
+			}
+			ms.mu.Lock()
+			pending := w.pending
+			w.pending = nil
+			ms.mu.Unlock()
+			for _, key := range pending {
+				select {
+				case changes <- key:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func (ms *MemoryStorage) String() string {
+	return fmt.Sprintf("MemoryStorage:%p", ms)
+}
+
+// store saves value at key. ms.mu must be locked.
+func (ms *MemoryStorage) store(key string, value []byte) {
+	if ms.entries == nil {
+		ms.entries = make(map[string]memoryEntry)
+	}
+	key = cleanKey(key)
+	ms.entries[key] = memoryEntry{
+		value:    append([]byte(nil), value...),
+		modified: time.Now(),
+	}
+	ms.notify(key)
+}
+
+// delete deletes key and all the keys it
+// contains. ms.mu must be locked.
+func (ms *MemoryStorage) delete(key string) {
+	key = cleanKey(key)
+	for k := range ms.entries {
+		if _, ok := keyWithin(key, k); ok || k == key {
+			delete(ms.entries, k)
+			ms.notify(k)
+		}
+	}
+}
+
+// notify queues key for the watchers of the keys
+// that contain it. ms.mu must be locked.
+func (ms *MemoryStorage) notify(key string) {
+	for w := range ms.watchers {
+		if _, ok := keyWithin(w.prefix, key); ok {
+			w.pending = append(w.pending, key)
+			select {
+			case w.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// exists returns true if key exists, as a terminal
+// or non-terminal key. ms.mu must be locked.
+func (ms *MemoryStorage) exists(key string) bool {
+	key = cleanKey(key)
+	if _, ok := ms.entries[key]; ok {
+		return true
+	}
+	for k := range ms.entries {
+		if _, ok := keyWithin(key, k); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// superseded returns true if a newer lease than lease
+// has been granted for its lock. ms.mu must be locked.
+func (ms *MemoryStorage) superseded(lease Lease) bool {
+	if leaseIsLost(lease) {
+		return true
+	}
+	if _, ok := lease.(*memoryLease); !ok {
+		return false
+	}
+	return ms.tokens[lease.Key()] > lease.Token()
+}
+
+// memoryLease is a lease on a lock in a MemoryStorage.
+type memoryLease struct {
+	storage *MemoryStorage
+	key     string
+	token   uint64
+	lost    chan struct{}
+}
+
+func (l *memoryLease) Key() string           { return l.key }
+func (l *memoryLease) Token() uint64         { return l.token }
+func (l *memoryLease) Lost() <-chan struct{} { return l.lost }
+func (l *memoryLease) Release() error        { return l.storage.Unlock(l.key) }
+
+// memoryWatcher is a watch on the keys within prefix.
+// Its pending keys are guarded by the storage's mutex.
+type memoryWatcher struct {
+	prefix  string
+	pending []string
+	wake    chan struct{}
+}
+
+// memorySnapshotEntry is an entry in a snapshot file.
+type memorySnapshotEntry struct {
+	Value    []byte    `json:"value"`
+	Modified time.Time `json:"modified"`
+}
+
+// memoryNotExist returns an ErrNotExist for key.
+func memoryNotExist(key string) error {
+	return ErrNotExist(fmt.Errorf("%s: %w", key, os.ErrNotExist))
+}
+
+// Interface guards
+var (
+	_ Storage              = (*MemoryStorage)(nil)
+	_ TransactionalStorage = (*MemoryStorage)(nil)
+	_ LeaseLocker          = (*MemoryStorage)(nil)
+	_ FencedStorage        = (*MemoryStorage)(nil)
+	_ WatchableStorage     = (*MemoryStorage)(nil)
+)
@@ -0,0 +1,128 @@
+package otomatik
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	ms := new(MemoryStorage)
+
+	for _, key := range []string{"a/b/c", "a/b/d", "a/e", "f"} {
+		if err := ms.Store(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if value, err := ms.Load("/a/b/c"); err != nil || string(value) != "a/b/c" {
+		t.Errorf("Expected to load value with equivalent key, got '%s' (error: %v)", value, err)
+	}
+	if _, err := ms.Load("nope"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected not-exist error loading missing key, got: %v", err)
+	}
+	if !ms.Exists("a/b") || ms.Exists("a/b/x") || ms.Exists("a/bc") {
+		t.Errorf("Expected non-terminal keys to exist and others not")
+	}
+
+	for i, test := range []struct {
+		prefix    string
+		recursive bool
+		expect    []string
+	}{
+		{prefix: "", recursive: false, expect: []string{"a", "f"}},
+		{prefix: "a", recursive: false, expect: []string{"a/b", "a/e"}},
+		{prefix: "a", recursive: true, expect: []string{"a/b", "a/b/c", "a/b/d", "a/e"}},
+		{prefix: "a/b/c", recursive: true, expect: []string{}},
+	} {
+		keys, err := ms.List(test.prefix, test.recursive)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error listing, got: %v", i, err)
+		}
+		if !reflect.DeepEqual(keys, test.expect) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expect, keys)
+		}
+	}
+	if _, err := ms.List("nope", false); err == nil {
+		t.Errorf("Expected error listing missing prefix")
+	}
+
+	if info, err := ms.Stat("a/b/c"); err != nil || !info.IsTerminal || info.Size != 5 {
+		t.Errorf("Expected terminal key info, got %+v (error: %v)", info, err)
+	}
+	if info, err := ms.Stat("a/b"); err != nil || info.IsTerminal || info.Modified.IsZero() {
+		t.Errorf("Expected non-terminal key info, got %+v (error: %v)", info, err)
+	}
+
+	if err := ms.Delete("a/b"); err != nil {
+		t.Errorf("Expected no error deleting non-terminal key, got: %v", err)
+	}
+	if ms.Exists("a/b/c") || !ms.Exists("a/e") {
+		t.Errorf("Expected only keys within deleted key to be gone")
+	}
+	if err := ms.Delete("a/b"); err == nil {
+		t.Errorf("Expected error deleting missing key")
+	}
+}
+
+func TestMemoryStorageLocking(t *testing.T) {
+	ms := new(MemoryStorage)
+
+	ctx := context.Background()
+	lease1, err := ms.LockLease(ctx, "foo", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := ms.LockLease(waitCtx, "foo", time.Minute); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded while lock is held, got: %v", err)
+	}
+
+	acquired := make(chan Lease)
+	go func() {
+		lease, _ := ms.LockLease(ctx, "foo", time.Minute)
+		acquired <- lease
+	}()
+	lease1.Release()
+	var lease2 Lease
+	select {
+	case lease2 = <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected waiting caller to acquire released lock")
+	}
+	defer lease2.Release()
+
+	if err := ms.StoreFenced(lease2, "fenced", []byte("new")); err != nil {
+		t.Errorf("Expected no error storing with current lease, got: %v", err)
+	}
+	if err := ms.Commit(lease1, []StorageOp{{Key: "fenced", Value: []byte("stale")}}); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost committing with old lease, got: %v", err)
+	}
+}
+
+func TestMemoryStorageSnapshot(t *testing.T) {
+	const filename = "./_testdata_tmp_snapshot.json"
+	defer os.Remove(filename)
+
+	ms := new(MemoryStorage)
+	ms.Store("certificates/example.com/example.com.crt", []byte("cert"))
+	if err := ms.SaveSnapshot(filename); err != nil {
+		t.Fatalf("Expected no error saving snapshot, got: %v", err)
+	}
+
+	restored := new(MemoryStorage)
+	restored.Store("leftover", []byte("gone after restore"))
+	if err := restored.LoadSnapshot(filename); err != nil {
+		t.Fatalf("Expected no error loading snapshot, got: %v", err)
+	}
+	if value, err := restored.Load("certificates/example.com/example.com.crt"); err != nil || string(value) != "cert" {
+		t.Errorf("Expected restored value, got '%s' (error: %v)", value, err)
+	}
+	if restored.Exists("leftover") {
+		t.Errorf("Expected snapshot to replace previous contents")
+	}
+}
@@ -0,0 +1,286 @@
+package otomatik
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge/tlsalpn01"
+)
+
+// ClientAuthPolicy configures how servers using the TLS
+// configurations of a Config authenticate clients with
+// certificates (mutual TLS). Client certificates are verified
+// against the CAs of Config.TrustedCAKeys.
+type ClientAuthPolicy struct {
+	// Whether client certificates are requested or required,
+	// and whether they are verified; see tls.ClientAuthType.
+	// The zero value, tls.NoClientCert, is taken to mean
+	// tls.RequireAndVerifyClientCert.
+	Mode tls.ClientAuthType
+
+	// If not empty, a client certificate must have one of these
+	// identities among its names; for example, SPIFFE IDs like
+	// "spiffe://example.org/api". An identity ending in "/*"
+	// allows all identities with that prefix, and DNS names may
+	// have a wildcard as their left-most label. Certificates
+	// with allowed identities are verified against the trusted
+	// CAs even if Mode does not verify them, so that identities
+	// cannot be claimed with self-signed certificates.
+	AllowedIdentities []string
+}
+
+// allows returns true if cert has an allowed identity.
+func (policy *ClientAuthPolicy) allows(cert *x509.Certificate) bool {
+	if len(policy.AllowedIdentities) == 0 {
+		return true
+	}
+	for _, name := range namesFromLeaf(cert) {
+		for _, allowed := range policy.AllowedIdentities {
+			if identityMatches(name, allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyIdentity returns a tls.Config.VerifyPeerCertificate
+// callback that enforces policy.AllowedIdentities. If the chain
+// was not verified during the handshake, because the mode only
+// requests a certificate, it is verified against the CAs of pool,
+// or the system's roots if pool is nil.
+func (policy *ClientAuthPolicy) verifyIdentity(pool *trustPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return nil // no certificate is allowed by the mode
+		}
+		var leaf *x509.Certificate
+		if len(verifiedChains) > 0 {
+			leaf = verifiedChains[0][0]
+		} else {
+			certs := make([]*x509.Certificate, len(rawCerts))
+			for i, rawCert := range rawCerts {
+				cert, err := x509.ParseCertificate(rawCert)
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			var roots *x509.CertPool
+			if pool != nil {
+				var err error
+				roots, err = pool.get()
+				if err != nil {
+					return fmt.Errorf("loading trusted CAs for client certificates: %v", err)
+				}
+			}
+			if err := verifyPeerChain(certs, roots, "", x509.ExtKeyUsageClientAuth); err != nil {
+				return fmt.Errorf("verifying client certificate: %v", err)
+			}
+			leaf = certs[0]
+		}
+		if !policy.allows(leaf) {
+			return fmt.Errorf("client certificate for %v is not allowed", namesFromLeaf(leaf))
+		}
+		return nil
+	}
+}
+
+// applyTo configures tlsConfig to authenticate clients
+// according to policy, with CAs loaded from cfg.Storage.
+func (policy *ClientAuthPolicy) applyTo(tlsConfig *tls.Config, cfg *Config) {
+	tlsConfig.ClientAuth = policy.Mode
+	if tlsConfig.ClientAuth == tls.NoClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	var pool *trustPool
+	if len(cfg.TrustedCAKeys) > 0 {
+		pool = &trustPool{storage: cfg.Storage, keys: cfg.TrustedCAKeys}
+	}
+	if len(policy.AllowedIdentities) > 0 {
+		tlsConfig.VerifyPeerCertificate = policy.verifyIdentity(pool)
+	}
+
+	// the ACME validator's TLS-ALPN challenge handshake never
+	// presents a client certificate, so it is never asked for one
+	base := tlsConfig.Clone()
+	acmeConfig := base.Clone()
+	acmeConfig.ClientAuth = tls.NoClientCert
+	acmeConfig.VerifyPeerCertificate = nil
+
+	// the trusted CAs may change in storage, so serve each
+	// other handshake with a config that has the latest pool
+	var mu sync.Mutex
+	var current *tls.Config
+	var currentPool *x509.CertPool
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == tlsalpn01.ACMETLS1Protocol {
+			return acmeConfig, nil
+		}
+		if pool == nil {
+			return nil, nil // system roots
+		}
+		certPool, err := pool.get()
+		if err != nil {
+			return nil, fmt.Errorf("loading trusted CAs for client certificates: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if certPool != currentPool {
+			current = base.Clone()
+			current.ClientCAs = certPool
+			currentPool = certPool
+		}
+		return current, nil
+	}
+}
+
+// ClientTLSConfig returns a TLS configuration for connecting to
+// servers that require client certificates. It presents the
+// certificate for identity in the cache, which should be managed
+// by cfg (for example, with ManageSync and a LocalIssuer) so that
+// it is renewed. Servers are verified against the CAs of
+// cfg.TrustedCAKeys, which are reloaded from storage periodically
+// like those that verify clients, or against the system's roots if
+// there are none.
+func (cfg *Config) ClientTLSConfig(identity string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetClientCertificate: func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cfg.getClientCertificate(cri, identity)
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(cfg.TrustedCAKeys) == 0 {
+		return tlsConfig, nil // system roots
+	}
+
+	pool := &trustPool{storage: cfg.Storage, keys: cfg.TrustedCAKeys}
+	if _, err := pool.get(); err != nil {
+		return nil, fmt.Errorf("loading trusted CAs: %v", err)
+	}
+
+	// RootCAs cannot change once the config is in use, so the
+	// server is verified here instead, with the latest pool
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if cs.ServerName == "" {
+			return fmt.Errorf("no server name to verify the server's certificate with")
+		}
+		roots, err := pool.get()
+		if err != nil {
+			return fmt.Errorf("loading trusted CAs: %v", err)
+		}
+		return verifyPeerChain(cs.PeerCertificates, roots, cs.ServerName, x509.ExtKeyUsageServerAuth)
+	}
+	return tlsConfig, nil
+}
+
+// verifyPeerChain verifies the chain of certs, the leaf first,
+// against roots, or the system's roots if roots is nil, for
+// usage, and for dnsName if it is not empty.
+func verifyPeerChain(certs []*x509.Certificate, roots *x509.CertPool, dnsName string, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       dnsName,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+// getClientCertificate returns the first unexpired certificate
+// for identity in the cache that the server supports. If there is
+// none, no certificate is sent, and the server decides whether
+// to continue without one.
+func (cfg *Config) getClientCertificate(cri *tls.CertificateRequestInfo, identity string) (*tls.Certificate, error) {
+	now := time.Now()
+	for _, cert := range cfg.certCache.getAllMatchingCerts(identity) {
+		if now.Before(cert.Leaf.NotBefore) || now.After(cert.Leaf.NotAfter) {
+			continue
+		}
+		if err := cri.SupportsCertificate(&cert.Certificate); err != nil {
+			continue
+		}
+		tlsCert := cert.Certificate
+		return &tlsCert, nil
+	}
+	log.Printf("[WARNING] No usable client certificate for %s", identity)
+	return new(tls.Certificate), nil
+}
+
+// identityMatches returns true if identity
+// matches the allowed identity pattern.
+func identityMatches(identity, pattern string) bool {
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(identity, strings.TrimSuffix(pattern, "*"))
+	}
+	return MatchWildcard(identity, pattern)
+}
+
+// trustPool is a pool of trusted CA certificates loaded from
+// storage, which is reloaded periodically so that changes to
+// the CAs, such as a new root, are picked up.
+type trustPool struct {
+	storage Storage
+	keys    []string
+
+	mu     sync.Mutex
+	pool   *x509.CertPool
+	loaded time.Time
+}
+
+// get returns the pool, reloading it if it is out of date.
+// If reloading fails, the previous pool is used if there is one.
+func (tp *trustPool) get() (*x509.CertPool, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.pool != nil && time.Since(tp.loaded) < trustPoolReloadInterval {
+		return tp.pool, nil
+	}
+	pool, err := loadTrustPool(tp.storage, tp.keys)
+	if err != nil {
+		if tp.pool == nil {
+			return nil, err
+		}
+		log.Printf("[ERROR] Reloading trusted CAs: %v; using previously loaded CAs", err)
+		pool = tp.pool
+	}
+	tp.pool, tp.loaded = pool, time.Now()
+	return pool, nil
+}
+
+// loadTrustPool returns a pool of the PEM-encoded
+// certificates stored at keys in storage.
+func loadTrustPool(storage Storage, keys []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, key := range keys {
+		bundle, err := storage.Load(key)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parseCertsFromPEMBundle(bundle)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+	}
+	return pool, nil
+}
+
+// trustPoolReloadInterval is how often trusted
+// CAs are reloaded from storage.
+var trustPoolReloadInterval = time.Minute
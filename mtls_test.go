@@ -0,0 +1,348 @@
+package otomatik
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge/tlsalpn01"
+)
+
+func TestMutualTLS(t *testing.T) {
+	storage := new(MemoryStorage)
+	issuer := &LocalIssuer{Storage: storage}
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuer:        issuer,
+		Storage:       storage,
+		TrustedCAKeys: []string{issuer.RootCertificateKey()},
+		ClientAuth: &ClientAuthPolicy{
+			AllowedIdentities: []string{"spiffe://example.org/prod/*"},
+		},
+	})
+
+	// one library manages both the server's and the clients' certificates
+	err := cfg.ManageSync([]string{
+		"localhost",
+		"spiffe://example.org/prod/billing",
+		"spiffe://example.org/dev/billing",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].URIs[0].String()))
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	request := func(identity string) (string, error) {
+		tlsConfig, err := cfg.ClientTLSConfig(identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig.ServerName = "localhost"
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get("https://" + ln.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if identity, err := request("spiffe://example.org/prod/billing"); err != nil || identity != "spiffe://example.org/prod/billing" {
+		t.Errorf("Expected client to be authenticated with its identity, got '%s' (error: %v)", identity, err)
+	}
+	if _, err := request("spiffe://example.org/dev/billing"); err == nil {
+		t.Errorf("Expected client with identity that is not allowed to be rejected")
+	}
+	if _, err := request("spiffe://example.org/prod/unmanaged"); err == nil {
+		t.Errorf("Expected client without certificate to be rejected")
+	}
+
+	// a client that does not trust the local CA rejects the server
+	tlsConfig, err := New(cache, Config{Storage: storage}).ClientTLSConfig("spiffe://example.org/prod/billing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig.ServerName = "localhost"
+	conn, err := tls.Dial("tcp", ln.Addr().String(), tlsConfig)
+	if err == nil {
+		conn.Close()
+		t.Errorf("Expected server to be verified against trusted CAs")
+	}
+}
+
+func TestMutualTLSUnverifiedMode(t *testing.T) {
+	storage := new(MemoryStorage)
+	issuer := &LocalIssuer{Storage: storage}
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuer:        issuer,
+		Storage:       storage,
+		TrustedCAKeys: []string{issuer.RootCertificateKey()},
+		ClientAuth: &ClientAuthPolicy{
+			Mode:              tls.RequireAnyClientCert,
+			AllowedIdentities: []string{"spiffe://example.org/prod/*"},
+		},
+	})
+	if err := cfg.ManageSync([]string{"localhost", "spiffe://example.org/prod/billing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	handshake := func(clientConfig *tls.Config) error {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// with TLS 1.3, the server's verdict on the client's
+		// certificate arrives after the client's handshake; the
+		// server closes the connection once it has accepted it
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+			return err
+		}
+		return nil
+	}
+
+	clientConfig, err := cfg.ClientTLSConfig("spiffe://example.org/prod/billing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.ServerName = "localhost"
+	if err := handshake(clientConfig); err != nil {
+		t.Errorf("Expected client with certificate from trusted CA to be allowed, got: %v", err)
+	}
+
+	// a self-signed certificate cannot claim an allowed identity
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, _ := url.Parse("spiffe://example.org/prod/billing")
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "impostor"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{identity},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "impostor"}}, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostorConfig := clientConfig.Clone()
+	impostorConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+	}
+	if err := handshake(impostorConfig); err == nil || !strings.Contains(err.Error(), "bad certificate") {
+		t.Errorf("Expected self-signed client certificate to be rejected, got: %v", err)
+	}
+}
+
+func TestMutualTLSServesTLSALPNChallenge(t *testing.T) {
+	storage := new(MemoryStorage)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{
+		Issuer:     &LocalIssuer{Storage: storage},
+		Storage:    storage,
+		ClientAuth: &ClientAuthPolicy{},
+	})
+	if err := cfg.ManageSync([]string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// as presented by the TLS-ALPN solver
+	challengeCert, err := tlsalpn01.ChallengeCert("example.com", "keyauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.mu.Lock()
+	cache.cache[tlsALPNCertKeyName("example.com")] = Certificate{
+		Certificate: *challengeCert,
+		Names:       []string{"example.com"},
+		hash:        hashCertificateChain(challengeCert.Certificate),
+	}
+	cache.mu.Unlock()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	handshake := func(clientConfig *tls.Config) (string, error) {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+			return "", err
+		}
+		return conn.ConnectionState().NegotiatedProtocol, nil
+	}
+
+	// the ACME validator does not present a client certificate
+	proto, err := handshake(&tls.Config{
+		ServerName:         "example.com",
+		NextProtos:         []string{tlsalpn01.ACMETLS1Protocol},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("Expected TLS-ALPN challenge handshake to succeed, got: %v", err)
+	}
+	if proto != tlsalpn01.ACMETLS1Protocol {
+		t.Errorf("Expected protocol %s to be negotiated, got '%s'", tlsalpn01.ACMETLS1Protocol, proto)
+	}
+
+	// but other clients still have to
+	if _, err := handshake(&tls.Config{ServerName: "localhost", InsecureSkipVerify: true}); err == nil {
+		t.Errorf("Expected client without certificate to be rejected")
+	}
+}
+
+func TestClientTLSConfigReloadsTrustedCAs(t *testing.T) {
+	storage := new(MemoryStorage)
+	issuer := &LocalIssuer{Storage: storage}
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+	})
+	defer cache.Stop()
+	cfg = New(cache, Config{Issuer: issuer, Storage: storage})
+	if err := cfg.ManageSync([]string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	oldInterval := trustPoolReloadInterval
+	trustPoolReloadInterval = 0
+	defer func() { trustPoolReloadInterval = oldInterval }()
+
+	// the client trusts another CA at first
+	other, _ := signTestCertificate(t, "Other CA", true, nil, nil)
+	if err := storage.Store("trusted.pem", encodeTestCertificate(other)); err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := New(cache, Config{Storage: storage, TrustedCAKeys: []string{"trusted.pem"}}).ClientTLSConfig("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.ServerName = "localhost"
+	if conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig); err == nil {
+		conn.Close()
+		t.Errorf("Expected server with certificate from untrusted CA to be rejected")
+	}
+
+	// until the trusted CAs change in storage
+	root, err := issuer.RootCertificate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store("trusted.pem", encodeTestCertificate(root)); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("Expected server to be trusted after CAs were reloaded, got: %v", err)
+	}
+	conn.Close()
+
+	clientConfig.ServerName = "example.com"
+	if conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig); err == nil {
+		conn.Close()
+		t.Errorf("Expected server to be verified for the server name")
+	}
+}
+
+func TestIdentityMatches(t *testing.T) {
+	for i, test := range []struct {
+		identity string
+		pattern  string
+		expect   bool
+	}{
+		{identity: "spiffe://example.org/api", pattern: "spiffe://example.org/api", expect: true},
+		{identity: "spiffe://example.org/api", pattern: "spiffe://example.org/*", expect: true},
+		{identity: "spiffe://example.org/prod/api", pattern: "spiffe://example.org/*", expect: true},
+		{identity: "spiffe://example.org.evil/api", pattern: "spiffe://example.org/*", expect: false},
+		{identity: "spiffe://example.org/api", pattern: "spiffe://example.org/ap", expect: false},
+		{identity: "api.example.com", pattern: "*.example.com", expect: true},
+		{identity: "example.com", pattern: "*.example.com", expect: false},
+	} {
+		if actual := identityMatches(test.identity, test.pattern); actual != test.expect {
+			t.Errorf("Test %d: Expected %t for %s matching %s, got %t", i, test.expect, test.identity, test.pattern, actual)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package otomatik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"time"
+)
+
+// NamespacedStorage is a view of a Storage in which all keys
+// are kept within a namespace, so that several independent
+// applications or tenants can share one storage without their
+// keys colliding: each namespace has its own certificates,
+// accounts, and locks, and cannot list, load or lock the keys
+// of another. Keys are stored under "tenants/<Namespace>/" in
+// the underlying storage.
+//
+// Configs with a Tenant set use a NamespacedStorage of their
+// Storage automatically. If the namespace is not valid (see
+// ValidateTenantID), every operation fails with an error.
+type NamespacedStorage struct {
+	Storage
+
+	// The namespace; may only contain lowercase
+	// letters, digits, '-' and '_'. Required.
+	Namespace string
+}
+
+// Store saves value at key.
+func (ns NamespacedStorage) Store(key string, value []byte) error {
+	if err := ns.validate(); err != nil {
+		return err
+	}
+	return ns.Storage.Store(ns.key(key), value)
+}
+
+// Load retrieves the value at key.
+func (ns NamespacedStorage) Load(key string) ([]byte, error) {
+	if err := ns.validate(); err != nil {
+		return nil, err
+	}
+	return ns.Storage.Load(ns.key(key))
+}
+
+// Delete deletes key.
+func (ns NamespacedStorage) Delete(key string) error {
+	if err := ns.validate(); err != nil {
+		return err
+	}
+	return ns.Storage.Delete(ns.key(key))
+}
+
+// Exists returns true if key exists.
+func (ns NamespacedStorage) Exists(key string) bool {
+	return ns.validate() == nil && ns.Storage.Exists(ns.key(key))
+}
+
+// List returns all keys that match prefix.
+func (ns NamespacedStorage) List(prefix string, recursive bool) ([]string, error) {
+	if err := ns.validate(); err != nil {
+		return nil, err
+	}
+	keys, err := ns.Storage.List(ns.key(prefix), recursive)
+	if err != nil {
+		if cleanKey(prefix) == "" && errors.Is(err, os.ErrNotExist) {
+			return nil, nil // nothing stored in the namespace yet
+		}
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = ns.unprefixed(key)
+	}
+	return keys, nil
+}
+
+// Stat returns information about key.
+func (ns NamespacedStorage) Stat(key string) (KeyInfo, error) {
+	if err := ns.validate(); err != nil {
+		return KeyInfo{}, err
+	}
+	info, err := ns.Storage.Stat(ns.key(key))
+	if err != nil {
+		return info, err
+	}
+	info.Key = ns.unprefixed(info.Key)
+	return info, nil
+}
+
+// Lock obtains the lock for key in the namespace.
+func (ns NamespacedStorage) Lock(key string) error {
+	if err := ns.validate(); err != nil {
+		return err
+	}
+	return ns.Storage.Lock(ns.lockKey(key))
+}
+
+// Unlock releases the lock for key in the namespace.
+func (ns NamespacedStorage) Unlock(key string) error {
+	if err := ns.validate(); err != nil {
+		return err
+	}
+	return ns.Storage.Unlock(ns.lockKey(key))
+}
+
+// LockLease obtains a lease on the lock for key in the namespace.
+func (ns NamespacedStorage) LockLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	if err := ns.validate(); err != nil {
+		return nil, err
+	}
+	lease, err := NewLeaseLocker(ns.Storage).LockLease(ctx, ns.lockKey(key), ttl)
+	if err != nil {
+		return nil, err
+	}
+	return namespacedLease{Lease: lease, key: key}, nil
+}
+
+// Commit applies ops within the namespace.
+func (ns NamespacedStorage) Commit(lease Lease, ops []StorageOp) error {
+	if err := ns.validate(); err != nil {
+		return err
+	}
+	nsOps := make([]StorageOp, len(ops))
+	for i, op := range ops {
+		nsOps[i] = StorageOp{Key: ns.key(op.Key), Value: op.Value, Delete: op.Delete}
+	}
+	return commitOps(ns.Storage, unwrapLease(lease), nsOps)
+}
+
+// StoreFenced saves value at key as long as lease is current.
+func (ns NamespacedStorage) StoreFenced(lease Lease, key string, value []byte) error {
+	if err := ns.validate(); err != nil {
+		return err
+	}
+	return storeFenced(ns.Storage, unwrapLease(lease), ns.key(key), value)
+}
+
+// Watch sends the keys within prefix in the
+// namespace that change, until ctx is done.
+func (ns NamespacedStorage) Watch(ctx context.Context, prefix string) (<-chan string, error) {
+	if err := ns.validate(); err != nil {
+		return nil, err
+	}
+	upstream, err := watchWrapped(ctx, ns.Storage, ns.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+	changes := make(chan string)
+	go func() {
+		defer close(changes)
+		for key := range upstream {
+			select {
+			case changes <- ns.unprefixed(key):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func (ns NamespacedStorage) String() string {
+	return fmt.Sprintf("%s@%v", ns.root(), ns.Storage)
+}
+
+// validate returns an error if the namespace is not valid,
+// so that keys cannot escape it.
+func (ns NamespacedStorage) validate() error {
+	if err := ValidateTenantID(ns.Namespace); err != nil {
+		return fmt.Errorf("namespaced storage: %v", err)
+	}
+	return nil
+}
+
+// key returns the key in the underlying storage for key.
+func (ns NamespacedStorage) key(key string) string {
+	if key = cleanKey(key); key == "" {
+		return ns.root()
+	}
+	return ns.root() + "/" + key
+}
+
+// unprefixed returns the key in the namespace
+// for key in the underlying storage.
+func (ns NamespacedStorage) unprefixed(key string) string {
+	rel, _ := keyWithin(ns.root(), cleanKey(key))
+	return rel
+}
+
+// lockKey returns the name of the lock in the underlying
+// storage for key. Since some storages do not allow slashes
+// in lock names, the namespace is separated with a dot,
+// which namespaces cannot contain.
+func (ns NamespacedStorage) lockKey(key string) string {
+	return ns.Namespace + "." + key
+}
+
+func (ns NamespacedStorage) root() string {
+	return path.Join(prefixTenants, ns.Namespace)
+}
+
+// namespacedLease is a lease on a lock in a namespace,
+// whose key is the key in the namespace.
+type namespacedLease struct {
+	Lease
+	key string
+}
+
+func (l namespacedLease) Key() string { return l.key }
+
+// unwrapLease returns the lease from the underlying
+// storage of a lease obtained from a NamespacedStorage.
+func unwrapLease(lease Lease) Lease {
+	for {
+		nl, ok := lease.(namespacedLease)
+		if !ok {
+			return lease
+		}
+		lease = nl.Lease
+	}
+}
+
+// ValidateTenantID returns an error if id cannot be used as
+// a tenant ID (see Config.Tenant) or as the namespace of a
+// NamespacedStorage.
+func ValidateTenantID(id string) error {
+	if !tenantIDRE.MatchString(id) {
+		return fmt.Errorf("invalid tenant ID %q: may only contain lowercase letters, digits, '-' and '_'", id)
+	}
+	return nil
+}
+
+var tenantIDRE = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// Interface guards
+var (
+	_ TransactionalStorage = NamespacedStorage{}
+	_ LeaseLocker          = NamespacedStorage{}
+	_ FencedStorage        = NamespacedStorage{}
+	_ WatchableStorage     = NamespacedStorage{}
+)
@@ -0,0 +1,162 @@
+package otomatik
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNamespacedStorageIsolation(t *testing.T) {
+	shared := new(MemoryStorage)
+	teamA := NamespacedStorage{Storage: shared, Namespace: "team-a"}
+	teamB := NamespacedStorage{Storage: shared, Namespace: "team-b"}
+
+	if keys, err := teamA.List("", true); err != nil || len(keys) != 0 {
+		t.Errorf("Expected empty namespace to list nothing, got %v (error: %v)", keys, err)
+	}
+
+	if err := teamA.Store("certificates/ca/example.com/example.com.key", []byte("a's key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := teamB.Store("certificates/ca/example.com/example.com.key", []byte("b's key")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := teamA.Load("certificates/ca/example.com/example.com.key"); string(value) != "a's key" {
+		t.Errorf("Expected each tenant to load its own value, got '%s'", value)
+	}
+	if !shared.Exists("tenants/team-b/certificates/ca/example.com/example.com.key") {
+		t.Errorf("Expected keys to be stored under the namespace in the underlying storage")
+	}
+
+	if err := teamA.Store("acme/ca/users/a@example.com/a.json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if teamB.Exists("acme/ca/users/a@example.com/a.json") || teamB.Exists("acme") {
+		t.Errorf("Expected tenant not to see keys of another tenant")
+	}
+	keys, err := teamB.List("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"certificates",
+		"certificates/ca",
+		"certificates/ca/example.com",
+		"certificates/ca/example.com/example.com.key",
+	}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Errorf("Expected tenant to list only its own keys %v, got %v", expect, keys)
+	}
+	if _, err := teamB.List("acme", true); err == nil {
+		t.Errorf("Expected error listing prefix that only exists for another tenant")
+	}
+	if info, err := teamA.Stat("acme/ca"); err != nil || info.Key != "acme/ca" {
+		t.Errorf("Expected stat of key in namespace, got %+v (error: %v)", info, err)
+	}
+
+	if err := teamB.Delete("certificates"); err != nil {
+		t.Fatal(err)
+	}
+	if !teamA.Exists("certificates/ca/example.com/example.com.key") {
+		t.Errorf("Expected deleting in one namespace not to affect another")
+	}
+}
+
+func TestNamespacedStorageLocks(t *testing.T) {
+	shared := new(MemoryStorage)
+	teamA := NamespacedStorage{Storage: shared, Namespace: "team-a"}
+	teamB := NamespacedStorage{Storage: shared, Namespace: "team-b"}
+
+	ctx := context.Background()
+	leaseA, err := teamA.LockLease(ctx, "issue_cert_example.com", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaseA.Key() != "issue_cert_example.com" {
+		t.Errorf("Expected lease key within namespace, got %s", leaseA.Key())
+	}
+
+	// another tenant's lock with the same name is a different lock
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	leaseB, err := teamB.LockLease(timeoutCtx, "issue_cert_example.com", time.Minute)
+	if err != nil {
+		t.Fatalf("Expected tenant not to be blocked by another tenant's lock, got: %v", err)
+	}
+	defer leaseB.Release()
+
+	// but the same tenant's is the same lock
+	timeoutCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := teamA.LockLease(timeoutCtx, "issue_cert_example.com", time.Minute); err != context.DeadlineExceeded {
+		t.Errorf("Expected lock to be held within namespace, got: %v", err)
+	}
+
+	// leases from the namespace fence writes in the underlying storage
+	if err := teamA.StoreFenced(leaseA, "foo", []byte("bar")); err != nil {
+		t.Errorf("Expected no error storing with current lease, got: %v", err)
+	}
+	if err := leaseA.Release(); err != nil {
+		t.Fatal(err)
+	}
+	leaseA2, err := teamA.LockLease(ctx, "issue_cert_example.com", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leaseA2.Release()
+	if err := teamA.Commit(leaseA, []StorageOp{{Key: "foo", Value: []byte("stale")}}); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost committing with superseded lease, got: %v", err)
+	}
+}
+
+func TestConfigTenant(t *testing.T) {
+	shared := new(MemoryStorage)
+	issuer := &testIssuer{key: "tenants"}
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+	})
+	defer cache.Stop()
+
+	cfgA := New(cache, Config{Issuer: issuer, Storage: shared, Tenant: "team-a"})
+	cfgB := New(cache, Config{Issuer: issuer, Storage: shared, Tenant: "team-b"})
+
+	ctx := context.Background()
+	if err := cfgA.ObtainCert(ctx, "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfgB.loadCertResource("example.com"); err == nil {
+		t.Errorf("Expected tenant not to load another tenant's certificate")
+	}
+	if _, err := cfgA.loadCertResource("example.com"); err != nil {
+		t.Errorf("Expected tenant to load its own certificate, got: %v", err)
+	}
+	if !shared.Exists("tenants/team-a/" + StorageKeys.SiteCert("tenants", "example.com")) {
+		t.Errorf("Expected certificate to be stored in tenant's namespace")
+	}
+
+	// configs made from a tenant's config are not namespaced twice
+	cfgA2 := New(cache, *cfgA)
+	if ns, ok := cfgA2.Storage.(NamespacedStorage); !ok || ns.Storage != shared {
+		t.Errorf("Expected storage to be namespaced once, got %v", cfgA2.Storage)
+	}
+
+	// an invalid tenant ID cannot escape its namespace
+	if err := ValidateTenantID("Team A/../b"); err == nil {
+		t.Errorf("Expected invalid tenant ID to be rejected")
+	}
+	cfgBad := New(cache, Config{Issuer: issuer, Storage: shared, Tenant: "Team A/../b"})
+	if err := cfgBad.ObtainCert(ctx, "example.net", true); err == nil {
+		t.Errorf("Expected error obtaining certificate for invalid tenant")
+	}
+	if err := cfgBad.Storage.Store("key", []byte("value")); err == nil {
+		t.Errorf("Expected error storing for invalid tenant")
+	}
+	keys, _ := shared.List("", true)
+	for _, key := range keys {
+		if key != "tenants" && !strings.HasPrefix(key, "tenants/team-a") {
+			t.Errorf("Expected nothing stored for invalid tenant, got %s", key)
+		}
+	}
+}
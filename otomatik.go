@@ -12,7 +12,6 @@ import (
 	"sort"
 	"strings"
 	"sync"
-	"time"
 )
 
 // HTTPS serves mux for all domainNames using the HTTP and HTTPS ports, redirecting all HTTP requests to HTTPS.
@@ -22,7 +21,8 @@ import (
 // To allow very long-lived connections, you should make your own http.Server values and use this package's Listen(),
 // TLS(), or Config.TLSConfig() functions to customize to your needs.
 // For example, servers which need to support large uploads or downloads with slow clients may need
-// to use longer timeouts, thus this function is not suitable.
+// to use longer timeouts, thus this function is not suitable; neither can it be stopped. For those
+// needs, use a Server instead.
 // Calling this function signifies your acceptance to the CA's Subscriber Agreement and/or Terms of Service.
 func HTTPS(domainNames []string, mux http.Handler) error {
 	if mux == nil {
@@ -43,19 +43,21 @@ func HTTPS(domainNames []string, mux http.Handler) error {
 	// if we haven't made listeners yet, do so now, and clean them up when all servers are done
 	lnMu.Lock()
 	if httpLn == nil && httpsLn == nil {
-		httpLn, err = net.Listen("tcp", fmt.Sprintf(":%d", HTTPPort))
+		httpLn, err = listenTCP(fmt.Sprintf(":%d", HTTPPort), DefaultProxyProtocol)
 		if err != nil {
 			lnMu.Unlock()
 			return err
 		}
 
-		httpsLn, err = tls.Listen("tcp", fmt.Sprintf(":%d", HTTPSPort), cfg.TLSConfig())
+		var tcpLn net.Listener
+		tcpLn, err = listenTCP(fmt.Sprintf(":%d", HTTPSPort), DefaultProxyProtocol)
 		if err != nil {
 			httpLn.Close()
 			httpLn = nil
 			lnMu.Unlock()
 			return err
 		}
+		httpsLn = tls.NewListener(tcpLn, cfg.TLSConfig())
 
 		go func() {
 			httpWg.Wait()
@@ -71,22 +73,13 @@ func HTTPS(domainNames []string, mux http.Handler) error {
 	// create HTTP/S servers that are configured with sane default timeouts
 	// and appropriate handlers (the HTTP server solves the HTTP challenge
 	// and issues redirects to HTTPS, while the HTTPS server simply serves the user's handler)
-	httpServer := &http.Server{
-		ReadHeaderTimeout: 5 * time.Second,
-		ReadTimeout:       5 * time.Second,
-		WriteTimeout:      5 * time.Second,
-		IdleTimeout:       5 * time.Second,
-	}
+	httpServer := new(http.Server)
+	defaultHTTPTimeouts.applyTo(httpServer)
 	if am, ok := cfg.Issuer.(*ACMEManager); ok {
 		httpServer.Handler = am.HTTPChallengeHandler(http.HandlerFunc(httpRedirectHandler))
 	}
-	httpsServer := &http.Server{
-		ReadHeaderTimeout: 10 * time.Second,
-		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      2 * time.Minute,
-		IdleTimeout:       5 * time.Minute,
-		Handler:           mux,
-	}
+	httpsServer := &http.Server{Handler: mux}
+	defaultHTTPSTimeouts.applyTo(httpsServer)
 
 	log.Printf("%v Serving HTTP->HTTPS on %s and %s",
 		domainNames, hln.Addr(), hsln.Addr())
@@ -96,18 +89,7 @@ func HTTPS(domainNames []string, mux http.Handler) error {
 }
 
 func httpRedirectHandler(w http.ResponseWriter, r *http.Request) {
-	toURL := "https://"
-
-	// since we redirect to the standard HTTPS port, we do not need to include it in the redirect URL
-	requestHost := hostOnly(r.Host)
-
-	toURL += requestHost
-	toURL += r.URL.RequestURI()
-
-	// get rid of this disgusting unencrypted HTTP connection 🤢
-	w.Header().Set("Connection", "close")
-
-	http.Redirect(w, r, toURL, http.StatusMovedPermanently)
+	RedirectHandler{}.ServeHTTP(w, r)
 }
 
 // TLS enables management of certificates for domainNames and returns a valid tls.Config.
@@ -138,7 +120,11 @@ func Listen(domainNames []string) (net.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	return tls.Listen("tcp", fmt.Sprintf(":%d", HTTPSPort), cfg.TLSConfig())
+	ln, err := listenTCP(fmt.Sprintf(":%d", HTTPSPort), DefaultProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, cfg.TLSConfig()), nil
 }
 
 // ManageSync obtains certificates for domainNames and keeps them renewed using the Default config.
@@ -348,6 +334,11 @@ var (
 	HTTPSPort = 443
 )
 
+// DefaultProxyProtocol, if set, makes the listeners created by
+// HTTPS and Listen read PROXY protocol headers, for when they
+// are behind a load balancer that forwards TCP connections.
+var DefaultProxyProtocol *ProxyProtocol
+
 // Variables for conveniently serving HTTPS.
 var (
 	httpLn, httpsLn net.Listener
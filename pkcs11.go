@@ -0,0 +1,148 @@
+package otomatik
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// PKCS11Token is a session with a PKCS#11 token, such as a
+// hardware security module or SoftHSM, as provided by a PKCS#11
+// binding; for example, a crypto11.Context is easily adapted to
+// it, as Crypto11Token does when built with the pkcs11 build
+// tag. Implementations must be safe for concurrent use.
+type PKCS11Token interface {
+	// GenerateKeyPair creates a key pair of keyType in the
+	// token with label, whose private key must be sensitive
+	// and not extractable, and returns a signer for it.
+	GenerateKeyPair(label string, keyType KeyType) (crypto.Signer, error)
+
+	// FindKeyPair returns a signer for the key pair with
+	// label in the token.
+	FindKeyPair(label string) (crypto.Signer, error)
+
+	// DeleteKeyPair deletes the key pair with label from
+	// the token. Deleting a key pair that does not exist
+	// is not an error.
+	DeleteKeyPair(label string) error
+}
+
+// PKCS11Signer is a RemoteSigner that holds keys in a PKCS#11
+// token. The keys are referred to by their labels in storage,
+// so certificates can be managed with keys that never leave
+// the token by using it in a RemoteKeyGenerator:
+//
+//	signer := &otomatik.PKCS11Signer{TokenName: "hsm1", Token: token}
+//	otomatik.RegisterRemoteSigner(signer)
+//	cfg.KeySource = otomatik.RemoteKeyGenerator{Signer: signer}
+type PKCS11Signer struct {
+	// The name of the token, which is stored in
+	// references to its keys - REQUIRED.
+	TokenName string
+
+	// The token in which keys are kept - REQUIRED.
+	Token PKCS11Token
+
+	// The prefix of the labels of created keys;
+	// default "otomatik-".
+	LabelPrefix string
+
+	mu   sync.Mutex
+	keys map[string]crypto.Signer // by label
+}
+
+// Name returns the name of the signer, which
+// is based on the name of the token.
+func (s *PKCS11Signer) Name() string {
+	return "pkcs11:" + s.TokenName
+}
+
+// CreateKey creates a key pair of keyType in the token
+// with a new random label, which is its ID.
+func (s *PKCS11Signer) CreateKey(ctx context.Context, keyType KeyType) (string, crypto.PublicKey, error) {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", nil, err
+	}
+	prefix := s.LabelPrefix
+	if prefix == "" {
+		prefix = defaultPKCS11LabelPrefix
+	}
+	label := prefix + hex.EncodeToString(random[:])
+
+	key, err := s.Token.GenerateKeyPair(label, keyType)
+	if err != nil {
+		return "", nil, fmt.Errorf("generating key pair in token %s: %v", s.TokenName, err)
+	}
+	s.mu.Lock()
+	s.cacheKey(label, key)
+	s.mu.Unlock()
+	return label, key.Public(), nil
+}
+
+// Sign signs digest with the key pair in the token with label.
+func (s *PKCS11Signer) Sign(ctx context.Context, label string, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	key, err := s.findKey(label)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return key.Sign(rand.Reader, digest, opts)
+}
+
+// DeleteKey deletes the key pair in the token with label.
+func (s *PKCS11Signer) DeleteKey(ctx context.Context, label string) error {
+	s.mu.Lock()
+	delete(s.keys, label)
+	s.mu.Unlock()
+	if err := s.Token.DeleteKeyPair(label); err != nil {
+		return fmt.Errorf("deleting key pair %s in token %s: %v", label, s.TokenName, err)
+	}
+	return nil
+}
+
+// findKey returns the key pair with label, finding
+// it in the token if it has not been used yet.
+func (s *PKCS11Signer) findKey(label string) (crypto.Signer, error) {
+	s.mu.Lock()
+	key, ok := s.keys[label]
+	s.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	// the token may be slow to search, so do not
+	// hold up signing with other keys meanwhile
+	key, err := s.Token.FindKeyPair(label)
+	if err != nil {
+		return nil, fmt.Errorf("finding key pair %s in token %s: %v", label, s.TokenName, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cached, ok := s.keys[label]; ok {
+		return cached, nil // found concurrently
+	}
+	s.cacheKey(label, key)
+	return key, nil
+}
+
+// cacheKey remembers key by label. s.mu must be locked.
+func (s *PKCS11Signer) cacheKey(label string, key crypto.Signer) {
+	if s.keys == nil {
+		s.keys = make(map[string]crypto.Signer)
+	}
+	s.keys[label] = key
+}
+
+// defaultPKCS11LabelPrefix is the prefix
+// of the labels of created keys by default.
+const defaultPKCS11LabelPrefix = "otomatik-"
+
+// Interface guard
+var _ RemoteSigner = (*PKCS11Signer)(nil)
@@ -0,0 +1,90 @@
+//go:build pkcs11
+// +build pkcs11
+
+package otomatik
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"fmt"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// Crypto11Token is a PKCS11Token that uses the crypto11 PKCS#11
+// binding, which requires cgo. It is only built with the pkcs11
+// build tag, so that programs that do not use PKCS#11 tokens
+// can be built without cgo. Key pairs are identified by their
+// labels, which are also used as their IDs in the token.
+type Crypto11Token struct {
+	Context *crypto11.Context
+}
+
+// NewCrypto11Token opens a session with the token selected by
+// config, for example:
+//
+//	token, err := otomatik.NewCrypto11Token(&crypto11.Config{
+//		Path:       "/usr/lib/softhsm/libsofthsm2.so",
+//		TokenLabel: "otomatik",
+//		Pin:        "1234",
+//	})
+//
+// The token should be closed once it is no longer used.
+func NewCrypto11Token(config *crypto11.Config) (*Crypto11Token, error) {
+	ctx, err := crypto11.Configure(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Crypto11Token{Context: ctx}, nil
+}
+
+// GenerateKeyPair creates a key pair of keyType with label in
+// the token. Ed25519 keys are not supported.
+func (t *Crypto11Token) GenerateKeyPair(label string, keyType KeyType) (crypto.Signer, error) {
+	id := []byte(label)
+	switch keyType {
+	case P256:
+		return t.Context.GenerateECDSAKeyPairWithLabel(id, id, elliptic.P256())
+	case P384:
+		return t.Context.GenerateECDSAKeyPairWithLabel(id, id, elliptic.P384())
+	case RSA2048:
+		return t.Context.GenerateRSAKeyPairWithLabel(id, id, 2048)
+	case RSA4096:
+		return t.Context.GenerateRSAKeyPairWithLabel(id, id, 4096)
+	case RSA8192:
+		return t.Context.GenerateRSAKeyPairWithLabel(id, id, 8192)
+	}
+	return nil, fmt.Errorf("key type %s is not supported in PKCS#11 tokens", keyType)
+}
+
+// FindKeyPair returns the key pair with label in the token.
+func (t *Crypto11Token) FindKeyPair(label string) (crypto.Signer, error) {
+	key, err := t.Context.FindKeyPair(nil, []byte(label))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("no key pair with label %s", label)
+	}
+	return key, nil
+}
+
+// DeleteKeyPair deletes the key pair with label from the token.
+func (t *Crypto11Token) DeleteKeyPair(label string) error {
+	key, err := t.Context.FindKeyPair(nil, []byte(label))
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return nil // already deleted
+	}
+	return key.Delete()
+}
+
+// Close closes the session with the token.
+func (t *Crypto11Token) Close() error {
+	return t.Context.Close()
+}
+
+// Interface guard
+var _ PKCS11Token = (*Crypto11Token)(nil)
@@ -0,0 +1,86 @@
+//go:build pkcs11
+// +build pkcs11
+
+package otomatik
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// TestCrypto11Token runs against SoftHSM, with a token initialized by:
+//
+//	softhsm2-util --init-token --free --label otomatik --pin 1234 --so-pin 1234
+//
+// and SOFTHSM2_MODULE set to the path of the SoftHSM PKCS#11 module,
+// such as /usr/lib/softhsm/libsofthsm2.so. The token label and PIN
+// can be changed with SOFTHSM2_TOKEN_LABEL and SOFTHSM2_PIN.
+func TestCrypto11Token(t *testing.T) {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		t.Skip("SOFTHSM2_MODULE is not set")
+	}
+	tokenLabel, pin := os.Getenv("SOFTHSM2_TOKEN_LABEL"), os.Getenv("SOFTHSM2_PIN")
+	if tokenLabel == "" {
+		tokenLabel = "otomatik"
+	}
+	if pin == "" {
+		pin = "1234"
+	}
+	token, err := NewCrypto11Token(&crypto11.Config{Path: module, TokenLabel: tokenLabel, Pin: pin})
+	if err != nil {
+		t.Fatalf("Expected no error opening token, got: %v", err)
+	}
+	defer token.Close()
+
+	signer := &PKCS11Signer{TokenName: "softhsm", Token: token}
+	RegisterRemoteSigner(signer)
+	defer unregisterRemoteSigner(signer.Name())
+
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+	})
+	defer cache.Stop()
+	for _, keyType := range []KeyType{P256, RSA2048} {
+		cfg := New(cache, Config{
+			Issuer:    &testIssuer{key: "softhsm"},
+			Storage:   new(MemoryStorage),
+			KeySource: RemoteKeyGenerator{Signer: signer, KeyType: keyType},
+		})
+		if err := cfg.ObtainCert(context.Background(), "example.com", true); err != nil {
+			t.Fatalf("%s: Expected no error obtaining certificate, got: %v", keyType, err)
+		}
+		certRes, err := cfg.loadCertResource("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := remoteKeyFromPEM(certRes.PrivateKeyPEM)
+		if key == nil {
+			t.Fatalf("%s: Expected reference to key in token, got:\n%s", keyType, certRes.PrivateKeyPEM)
+		}
+
+		// a new signer finds the key in the token by its label
+		found := &PKCS11Signer{TokenName: "softhsm", Token: token}
+		tokenKey, err := found.findKey(key.ID)
+		if err != nil {
+			t.Fatalf("%s: Expected key to be found in token, got: %v", keyType, err)
+		}
+		if _, err := cfg.generateCSR(tokenKey, []string{"example.com"}); err != nil {
+			t.Errorf("%s: Expected key in token to sign, got: %v", keyType, err)
+		}
+
+		// deleted keys are gone from the token
+		if err := signer.DeleteKey(context.Background(), key.ID); err != nil {
+			t.Fatalf("%s: Expected no error deleting key, got: %v", keyType, err)
+		}
+		if _, err := token.FindKeyPair(key.ID); err == nil {
+			t.Errorf("%s: Expected deleted key not to be found", keyType)
+		}
+		if err := signer.DeleteKey(context.Background(), key.ID); err != nil {
+			t.Errorf("%s: Expected no error deleting deleted key, got: %v", keyType, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package otomatik
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPKCS11Signer(t *testing.T) {
+	token := new(fakePKCS11Token)
+	RegisterRemoteSigner(&PKCS11Signer{TokenName: "test", Token: token})
+	defer unregisterRemoteSigner("pkcs11:test")
+
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+	})
+	defer cache.Stop()
+	cfg := New(cache, Config{
+		Issuer:    &testIssuer{key: "pkcs11"},
+		Storage:   new(MemoryStorage),
+		KeySource: RemoteKeyGenerator{Signer: &PKCS11Signer{TokenName: "test", Token: token}, KeyType: P384},
+	})
+	if err := cfg.ManageSync([]string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(token.keys) != 1 {
+		t.Fatalf("Expected one key pair in token, got %d", len(token.keys))
+	}
+
+	// only the label of the key is stored
+	keyPEM, err := cfg.Storage.Load(StorageKeys.SitePrivateKey(cfg.issuerKey(), "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var label string
+	for l := range token.keys {
+		label = l
+	}
+	if !strings.HasPrefix(label, defaultPKCS11LabelPrefix) || !bytes.Contains(keyPEM, []byte("Key-ID: "+label)) {
+		t.Errorf("Expected reference to key %s in storage, got:\n%s", label, keyPEM)
+	}
+
+	// the key is found in the token by the registered signer
+	certPEM, err := cfg.Storage.Load(StorageKeys.SiteCert(cfg.issuerKey(), "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := makeCertificate(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := cert.PrivateKey.(crypto.Signer)
+	if _, err := cfg.generateCSR(signer, []string{"example.com"}); err != nil {
+		t.Errorf("Expected key in token to sign, got: %v", err)
+	}
+	if token.finds != 1 {
+		t.Errorf("Expected key to be found in token once, got %d", token.finds)
+	}
+}
+
+func TestPKCS11SignerFindsKeysConcurrently(t *testing.T) {
+	token := &fakePKCS11Token{finding: make(chan string), release: make(chan struct{})}
+	signer := &PKCS11Signer{TokenName: "test", Token: token}
+	ctx := context.Background()
+	cached, _, err := signer.CreateKey(ctx, P256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := token.GenerateKeyPair("uncached", P256); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("hello"))
+
+	// while the token is searched for one key...
+	found := make(chan error)
+	go func() {
+		_, err := signer.Sign(ctx, "uncached", digest[:], crypto.SHA256)
+		found <- err
+	}()
+	<-token.finding
+
+	// ...keys that were already found can sign
+	signed := make(chan error)
+	go func() {
+		_, err := signer.Sign(ctx, cached, digest[:], crypto.SHA256)
+		signed <- err
+	}()
+	select {
+	case err := <-signed:
+		if err != nil {
+			t.Errorf("Expected no error signing with cached key, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected signing with cached key not to wait for token search")
+	}
+
+	close(token.release)
+	if err := <-found; err != nil {
+		t.Errorf("Expected no error signing with found key, got: %v", err)
+	}
+}
+
+// fakePKCS11Token holds key pairs in memory.
+type fakePKCS11Token struct {
+	mu    sync.Mutex
+	keys  map[string]crypto.Signer
+	finds int
+
+	// if set, FindKeyPair sends the label to finding,
+	// then waits for release before looking it up
+	finding chan string
+	release chan struct{}
+}
+
+func (tok *fakePKCS11Token) GenerateKeyPair(label string, keyType KeyType) (crypto.Signer, error) {
+	key, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	tok.mu.Lock()
+	defer tok.mu.Unlock()
+	if tok.keys == nil {
+		tok.keys = make(map[string]crypto.Signer)
+	}
+	tok.keys[label] = key.(crypto.Signer)
+	return tok.keys[label], nil
+}
+
+func (tok *fakePKCS11Token) DeleteKeyPair(label string) error {
+	tok.mu.Lock()
+	defer tok.mu.Unlock()
+	delete(tok.keys, label)
+	return nil
+}
+
+func (tok *fakePKCS11Token) FindKeyPair(label string) (crypto.Signer, error) {
+	if tok.finding != nil {
+		tok.finding <- label
+		<-tok.release
+	}
+	tok.mu.Lock()
+	defer tok.mu.Unlock()
+	tok.finds++
+	key, ok := tok.keys[label]
+	if !ok {
+		return nil, fmt.Errorf("no key pair %s", label)
+	}
+	return key, nil
+}
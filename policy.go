@@ -0,0 +1,127 @@
+package otomatik
+
+import (
+	"strings"
+
+	"github.com/go-acme/lego/v3/challenge"
+)
+
+// DomainPolicy overrides how certificates are managed for the
+// names it matches, so that a single Config can, for example,
+// use the DNS challenge for wildcard names and the HTTP
+// challenge for everything else. Zero-value fields do not
+// override the Config's settings.
+type DomainPolicy struct {
+	// The names to which this policy applies; a name
+	// matches if it is equal to one of these or matches
+	// it as a wildcard (see MatchWildcard).
+	Subjects []string
+
+	// If set, names for which this returns true also
+	// match, regardless of Subjects.
+	Match func(name string) bool
+
+	// The issuer to use for matching names. If it
+	// is also a Revoker, it is used as the revoker.
+	Issuer Issuer
+
+	// The type of private key to generate for new
+	// certificates for matching names.
+	KeyType KeyType
+
+	// The ACME challenge types that may be used for matching
+	// names; if nil, the issuer's settings are used. Only
+	// applies if the issuer is an ACMEManager.
+	Challenges []challenge.Type
+
+	// The DNS provider to use for matching names. Only
+	// applies if the issuer is an ACMEManager.
+	DNSProvider challenge.Provider
+
+	// The renewal window ratio for certificates
+	// with matching names.
+	RenewalWindowRatio float64
+}
+
+// Matches returns true if p applies to name.
+func (p DomainPolicy) Matches(name string) bool {
+	name = strings.ToLower(name)
+	for _, subj := range p.Subjects {
+		if MatchWildcard(name, strings.ToLower(subj)) {
+			return true
+		}
+	}
+	return p.Match != nil && p.Match(name)
+}
+
+// PolicyFor returns the first policy in cfg.Policies
+// that matches name, or nil if there is none.
+func (cfg *Config) PolicyFor(name string) *DomainPolicy {
+	for i := range cfg.Policies {
+		if cfg.Policies[i].Matches(name) {
+			return &cfg.Policies[i]
+		}
+	}
+	return nil
+}
+
+// forName returns the config to use when managing the certificate
+// for name: cfg itself if no policy matches name, otherwise a copy
+// of cfg with the matching policy's settings applied.
+func (cfg *Config) forName(name string) *Config {
+	policy := cfg.PolicyFor(name)
+	if policy == nil {
+		return cfg
+	}
+
+	cfgCopy := *cfg
+	cfgCopy.Policies = nil // policy is already applied
+
+	if policy.Issuer != nil {
+		cfgCopy.Issuer = policy.Issuer
+		if rev, ok := policy.Issuer.(Revoker); ok {
+			cfgCopy.Revoker = rev
+		}
+	}
+	if policy.KeyType != "" && cfgCopy.keyType == "" {
+		cfgCopy.KeySource = keyGeneratorOfType(cfgCopy.KeySource, policy.KeyType)
+	}
+	if policy.RenewalWindowRatio != 0 {
+		cfgCopy.RenewalWindowRatio = policy.RenewalWindowRatio
+	}
+	if am, ok := cfgCopy.Issuer.(*ACMEManager); ok && (policy.Challenges != nil || policy.DNSProvider != nil) {
+		am = policy.applyToACMEManager(am)
+		cfgCopy.Issuer = am
+		if _, ok := cfgCopy.Revoker.(*ACMEManager); ok {
+			cfgCopy.Revoker = am
+		}
+	}
+
+	return &cfgCopy
+}
+
+// applyToACMEManager returns a copy of am with the challenge
+// settings of p applied.
+func (p DomainPolicy) applyToACMEManager(am *ACMEManager) *ACMEManager {
+	amCopy := *am
+	if p.DNSProvider != nil {
+		amCopy.DNSProvider = p.DNSProvider
+	}
+	if p.Challenges != nil {
+		amCopy.DisableHTTPChallenge = !p.allowsChallenge(challenge.HTTP01)
+		amCopy.DisableTLSALPNChallenge = !p.allowsChallenge(challenge.TLSALPN01)
+		if !p.allowsChallenge(challenge.DNS01) {
+			amCopy.DNSProvider = nil
+		}
+	}
+	return &amCopy
+}
+
+func (p DomainPolicy) allowsChallenge(chal challenge.Type) bool {
+	for _, c := range p.Challenges {
+		if c == chal {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package otomatik
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+)
+
+// testIssuer issues certificates for CSRs by signing them
+// with its own throwaway CA, without any validation.
+type testIssuer struct {
+	key      string
+	lifetime time.Duration // default 90 days
+	err      error         // if set, returned by Issue
+
+	mu     sync.Mutex
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	issued []*x509.CertificateRequest
+}
+
+func (iss *testIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	if iss.err != nil {
+		return nil, iss.err
+	}
+	if iss.caCert == nil {
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		caTmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: iss.key},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+		if err != nil {
+			return nil, err
+		}
+		iss.caCert, _ = x509.ParseCertificate(caDER)
+		iss.caKey = caKey
+	}
+
+	iss.issued = append(iss.issued, csr)
+	lifetime := iss.lifetime
+	if lifetime == 0 {
+		lifetime = 90 * 24 * time.Hour
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(len(iss.issued) + 1)),
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, iss.caCert, csr.PublicKey, iss.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedCertificate{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Metadata:    map[string]string{"issuer": iss.key},
+	}, nil
+}
+
+func (iss *testIssuer) IssuerKey() string { return iss.key }
+
+func (iss *testIssuer) Revoke(ctx context.Context, cert CertificateResource) error { return nil }
+
+func TestDomainPolicyMatches(t *testing.T) {
+	policy := DomainPolicy{
+		Subjects: []string{"*.Example.com", "exact.example.net"},
+		Match:    func(name string) bool { return strings.HasSuffix(name, ".internal") },
+	}
+	for i, test := range []struct {
+		name   string
+		expect bool
+	}{
+		{name: "www.example.com", expect: true},
+		{name: "*.example.com", expect: true},
+		{name: "WWW.EXAMPLE.COM", expect: true},
+		{name: "example.com", expect: false},
+		{name: "a.b.example.com", expect: false},
+		{name: "exact.example.net", expect: true},
+		{name: "other.example.net", expect: false},
+		{name: "db.internal", expect: true},
+	} {
+		if actual := policy.Matches(test.name); actual != test.expect {
+			t.Errorf("Test %d (%s): Expected %t, got %t", i, test.name, test.expect, actual)
+		}
+	}
+}
+
+func TestConfigForName(t *testing.T) {
+	dnsProvider := &testTXTProvider{records: make(map[string]string)}
+	internalIssuer := &testIssuer{key: "internal"}
+
+	am := &ACMEManager{CA: "https://example.com/acme/directory"}
+	cfg := &Config{
+		Issuer:             am,
+		Revoker:            am,
+		KeySource:          DefaultKeyGenerator,
+		RenewalWindowRatio: DefaultRenewalWindowRatio,
+		Policies: []DomainPolicy{
+			{
+				Match:       func(name string) bool { return strings.HasPrefix(name, "*.") },
+				Challenges:  []challenge.Type{challenge.DNS01},
+				DNSProvider: &DelegatedDNSProvider{Provider: dnsProvider},
+				KeyType:     RSA2048,
+			},
+			{
+				Subjects:           []string{"*.internal.example"},
+				Issuer:             internalIssuer,
+				RenewalWindowRatio: 0.5,
+			},
+		},
+		certCache: new(Cache),
+	}
+	am.config = cfg
+
+	// names without a policy use the config as-is
+	if actual := cfg.forName("www.example.com"); actual != cfg {
+		t.Errorf("Expected unmatched name to use config unchanged")
+	}
+	if chal := (&acmeClient{mgr: am}).initialChallenges(); !reflect.DeepEqual(chal, []challenge.Type{challenge.HTTP01, challenge.TLSALPN01}) {
+		t.Errorf("Expected HTTP and TLS-ALPN challenges by default, got %v", chal)
+	}
+
+	wildcard := cfg.forName("*.example.com")
+	wildcardAM, ok := wildcard.Issuer.(*ACMEManager)
+	if !ok || wildcardAM == am {
+		t.Fatalf("Expected copy of ACMEManager for wildcard policy, got %#v", wildcard.Issuer)
+	}
+	if wildcard.Revoker != wildcardAM {
+		t.Errorf("Expected revoker to be the policy's ACMEManager")
+	}
+	if chal := (&acmeClient{mgr: wildcardAM}).initialChallenges(); !reflect.DeepEqual(chal, []challenge.Type{challenge.DNS01}) {
+		t.Errorf("Expected only DNS challenge for wildcard, got %v", chal)
+	}
+	if wildcardAM.IssuerKey() != am.IssuerKey() {
+		t.Errorf("Expected policy's ACMEManager to keep issuer key '%s', got '%s'", am.IssuerKey(), wildcardAM.IssuerKey())
+	}
+	if kg, ok := wildcard.KeySource.(StandardKeyGenerator); !ok || kg.KeyType != RSA2048 {
+		t.Errorf("Expected RSA2048 key generator, got %#v", wildcard.KeySource)
+	}
+	if am.DNSProvider != nil || am.DisableHTTPChallenge {
+		t.Errorf("Expected original ACMEManager to be unchanged")
+	}
+
+	internal := cfg.forName("db.internal.example")
+	if internal.Issuer != internalIssuer || internal.Revoker != internalIssuer {
+		t.Errorf("Expected internal issuer and revoker, got %#v and %#v", internal.Issuer, internal.Revoker)
+	}
+	if internal.RenewalWindowRatio != 0.5 {
+		t.Errorf("Expected renewal window ratio 0.5, got %f", internal.RenewalWindowRatio)
+	}
+	if internal.certCache != cfg.certCache || internal.KeySource != cfg.KeySource {
+		t.Errorf("Expected other settings to be inherited from config")
+	}
+}
+
+func TestObtainCertWithPolicy(t *testing.T) {
+	storage := new(MemoryStorage)
+
+	defaultIssuer := &testIssuer{key: "default"}
+	rsaIssuer := &testIssuer{key: "rsa"}
+	cfg := &Config{
+		Issuer:    defaultIssuer,
+		KeySource: DefaultKeyGenerator,
+		Storage:   storage,
+		Policies: []DomainPolicy{
+			{Subjects: []string{"legacy.example.com"}, Issuer: rsaIssuer, KeyType: RSA2048},
+		},
+		certCache: &Cache{cache: make(map[string]Certificate), cacheIndex: make(map[string][]string)},
+	}
+
+	ctx := context.Background()
+	if err := cfg.ObtainCert(ctx, "example.com", true); err != nil {
+		t.Fatalf("Expected no error obtaining certificate, got: %v", err)
+	}
+	if err := cfg.ObtainCert(ctx, "legacy.example.com", true); err != nil {
+		t.Fatalf("Expected no error obtaining certificate, got: %v", err)
+	}
+
+	if len(defaultIssuer.issued) != 1 || len(rsaIssuer.issued) != 1 {
+		t.Fatalf("Expected one certificate from each issuer, got %d and %d", len(defaultIssuer.issued), len(rsaIssuer.issued))
+	}
+	if _, ok := defaultIssuer.issued[0].PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("Expected ECDSA key from default key source, got %T", defaultIssuer.issued[0].PublicKey)
+	}
+	if _, ok := rsaIssuer.issued[0].PublicKey.(*rsa.PublicKey); !ok {
+		t.Errorf("Expected RSA key for policy name, got %T", rsaIssuer.issued[0].PublicKey)
+	}
+	if !storage.Exists(StorageKeys.SiteCert("rsa", "legacy.example.com")) {
+		t.Errorf("Expected certificate to be stored under the policy issuer's key")
+	}
+
+	// loading goes through the policy too
+	cert, err := cfg.CacheManagedCertificate("legacy.example.com")
+	if err != nil {
+		t.Fatalf("Expected no error caching certificate, got: %v", err)
+	}
+	if cert.Leaf.Issuer.CommonName != "rsa" {
+		t.Errorf("Expected certificate from policy issuer, got one from '%s'", cert.Leaf.Issuer.CommonName)
+	}
+}
@@ -0,0 +1,312 @@
+package otomatik
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocol configures listeners to read PROXY protocol
+// headers (versions 1 and 2), with which load balancers that
+// forward TCP connections convey the addresses of the original
+// connections. Connections then report the client's address as
+// their RemoteAddr, which handlers see as http.Request.RemoteAddr,
+// and the address the client connected to as their LocalAddr,
+// which is used to select certificates by IP address when
+// clients do not use SNI.
+//
+// The header of a connection is read when the connection is
+// first read from or its addresses are first requested, so that
+// slow clients do not hold up accepting other connections.
+type ProxyProtocol struct {
+	// The IP ranges in CIDR notation, such as "10.0.0.0/8",
+	// from which connections must begin with a PROXY protocol
+	// header; connections from other sources are used as they
+	// are. Since the header is trusted blindly, this should only
+	// contain the addresses of load balancers. If empty, all
+	// connections must have a header.
+	TrustedSources []string
+
+	// How long to wait for the header of a connection;
+	// defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// Listener wraps ln so that connections it accepts from trusted
+// sources read PROXY protocol headers. It returns an error if
+// any of pp.TrustedSources is invalid.
+func (pp ProxyProtocol) Listener(ln net.Listener) (net.Listener, error) {
+	pln := proxyListener{Listener: ln, timeout: pp.Timeout}
+	if pln.timeout <= 0 {
+		pln.timeout = defaultProxyHeaderTimeout
+	}
+	for _, cidr := range pp.TrustedSources {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted source for PROXY protocol: %v", err)
+		}
+		pln.trusted = append(pln.trusted, network)
+	}
+	return pln, nil
+}
+
+// listenTCP listens for TCP connections on addr, reading
+// PROXY protocol headers according to pp if it is not nil.
+func listenTCP(addr string, pp *ProxyProtocol) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || pp == nil {
+		return ln, err
+	}
+	pln, err := pp.Listener(ln)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return pln, nil
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+func (ln proxyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !ln.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, timeout: ln.timeout}, nil
+}
+
+// trusts returns true if connections from addr
+// begin with a PROXY protocol header.
+func (ln proxyListener) trusts(addr net.Addr) bool {
+	if len(ln.trusted) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range ln.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection that begins with a PROXY
+// protocol header, which is read on first use.
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once     sync.Once
+	reader   *bufio.Reader
+	src, dst net.Addr // nil if the header did not convey them
+	err      error
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time // set by the user of the connection
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the address of the client
+// as conveyed by the header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected
+// to as conveyed by the header.
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readHeader reads the header within c.timeout (or the
+// read deadline, if sooner), then restores the read deadline.
+func (c *proxyConn) readHeader() {
+	c.deadlineMu.Lock()
+	deadline := time.Now().Add(c.timeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	c.Conn.SetReadDeadline(deadline)
+	c.deadlineMu.Unlock()
+
+	c.reader = bufio.NewReader(c.Conn)
+	c.src, c.dst, c.err = readProxyHeader(c.reader)
+	if c.err != nil {
+		c.err = fmt.Errorf("reading PROXY protocol header from %s: %v", c.Conn.RemoteAddr(), c.err)
+	}
+
+	c.deadlineMu.Lock()
+	c.Conn.SetReadDeadline(c.readDeadline)
+	c.deadlineMu.Unlock()
+}
+
+// readProxyHeader reads a PROXY protocol header of either
+// version from r, and returns the source and destination
+// addresses it conveys. The addresses are nil if the header
+// does not convey TCP addresses, such as for health checks
+// by the proxy itself.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(sig) == proxyV1Prefix {
+		return readProxyHeaderV1(r)
+	}
+	sig, err = r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return nil, nil, errors.New("no PROXY protocol header")
+}
+
+// readProxyHeaderV1 reads a header of the human-readable
+// format, like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, nil, errors.New("header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, nil, fmt.Errorf("malformed header: %q", line)
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil {
+		return nil, nil, fmt.Errorf("invalid address in header: %q", line)
+	}
+	switch fields[1] {
+	case "TCP4":
+		if srcIP.To4() == nil || dstIP.To4() == nil {
+			return nil, nil, fmt.Errorf("address in header is not IPv4: %q", line)
+		}
+	case "TCP6":
+		if srcIP.To4() != nil || dstIP.To4() != nil {
+			return nil, nil, fmt.Errorf("address in header is not IPv6: %q", line)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported protocol in header: %s", fields[1])
+	}
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid port in header: %v", err)
+	}
+	dstPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid port in header: %v", err)
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyHeaderV2 reads a header of the binary format.
+func readProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	if version := versionCommand >> 4; version != 2 {
+		return nil, nil, fmt.Errorf("unsupported version: %d", version)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch command := versionCommand & 0x0F; command {
+	case 0x0: // LOCAL: connection made by the proxy itself
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported command: %d", command)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default: // unspecified, UDP, or UNIX sockets
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("header too short for addresses")
+	}
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : 2*ipLen])
+	ports := payload[2*ipLen:]
+	return &net.TCPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(ports[0:2]))},
+		&net.TCPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(ports[2:4]))}, nil
+}
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// defaultProxyHeaderTimeout is how long to wait for the
+// PROXY protocol header of a connection by default.
+const defaultProxyHeaderTimeout = 5 * time.Second
@@ -0,0 +1,164 @@
+package otomatik
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, payload ...byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family, byte(len(payload)>>8), byte(len(payload)))
+		return string(append(header, payload...))
+	}
+
+	for i, test := range []struct {
+		input     string
+		expectSrc string
+		expectDst string
+		expectErr bool
+	}{
+		{input: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET", expectSrc: "192.0.2.1:56324", expectDst: "192.0.2.2:443"},
+		{input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET", expectSrc: "[2001:db8::1]:56324", expectDst: "[2001:db8::2]:443"},
+		{input: "PROXY UNKNOWN\r\nGET"},
+		{input: "PROXY TCP4 192.0.2.1 2001:db8::2 56324 443\r\nGET", expectErr: true},
+		{input: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 99999\r\nGET", expectErr: true},
+		{input: "PROXY TCP4 192.0.2.1\r\nGET", expectErr: true},
+		{input: "PROXY " + strings.Repeat("x", 200) + "\r\n", expectErr: true},
+		{input: "GET / HTTP/1.1\r\n\r\n", expectErr: true},
+		{
+			input:     v2(0x1, 0x11, 192, 0, 2, 1, 192, 0, 2, 2, 0xDC, 0x04, 0x01, 0xBB) + "GET",
+			expectSrc: "192.0.2.1:56324",
+			expectDst: "192.0.2.2:443",
+		},
+		{
+			// addresses followed by TLVs
+			input: v2(0x1, 0x21,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+				0xDC, 0x04, 0x01, 0xBB,
+				0x04, 0x00, 0x01, 0x00) + "GET",
+			expectSrc: "[2001:db8::1]:56324",
+			expectDst: "[2001:db8::2]:443",
+		},
+		{input: v2(0x0, 0x00) + "GET"},
+		{input: v2(0x1, 0x11, 192, 0, 2, 1) + "GET", expectErr: true},
+		{input: v2(0x2, 0x11) + "GET", expectErr: true},
+	} {
+		r := bufio.NewReader(strings.NewReader(test.input))
+		src, dst, err := readProxyHeader(r)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if addrString(src) != test.expectSrc || addrString(dst) != test.expectDst {
+			t.Errorf("Test %d: Expected %s -> %s, got %s -> %s",
+				i, test.expectSrc, test.expectDst, addrString(src), addrString(dst))
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "GET" {
+			t.Errorf("Test %d: Expected data after header to remain, got '%s'", i, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	if _, err := (ProxyProtocol{TrustedSources: []string{"10.0.0.1"}}).Listener(nil); err == nil {
+		t.Errorf("Expected error for invalid CIDR")
+	}
+
+	serve := func(pp ProxyProtocol) net.Addr {
+		ln, err := listenTCP("127.0.0.1:0", &pp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.RemoteAddr))
+		})}
+		go srv.Serve(ln)
+		t.Cleanup(func() { srv.Close() })
+		return ln.Addr()
+	}
+	request := func(addr net.Addr, header string) string {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(header + "GET / HTTP/1.0\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	trusted := serve(ProxyProtocol{TrustedSources: []string{"127.0.0.0/8"}})
+	if remote := request(trusted, "PROXY TCP4 192.0.2.1 127.0.0.1 56324 443\r\n"); remote != "192.0.2.1:56324" {
+		t.Errorf("Expected client address from header, got %s", remote)
+	}
+	if remote := request(trusted, ""); strings.HasPrefix(remote, "127.0.0.1:") {
+		t.Errorf("Expected trusted source without header not to be served")
+	}
+
+	untrusted := serve(ProxyProtocol{TrustedSources: []string{"10.0.0.0/8"}})
+	if remote := request(untrusted, ""); !strings.HasPrefix(remote, "127.0.0.1:") {
+		t.Errorf("Expected actual address of untrusted source, got %s", remote)
+	}
+}
+
+func TestProxyProtocolCertificateByIP(t *testing.T) {
+	ln, err := listenTCP("127.0.0.1:0", &ProxyProtocol{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var cfg Config
+	names := make(chan string, 1)
+	tlsLn := tls.NewListener(ln, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			names <- cfg.getNameFromClientHello(hello)
+			return nil, errors.New("no certificate")
+		},
+	})
+	go func() {
+		conn, err := tlsLn.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.7 56324 443\r\n"))
+	tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+
+	if name := <-names; name != "198.51.100.7" {
+		t.Errorf("Expected certificate to be selected by destination address from header, got %s", name)
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,148 @@
+package otomatik
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedirectHandler is an HTTP handler that redirects requests
+// to HTTPS. The zero value redirects all requests permanently
+// to HTTPSPort, and closes the connection afterward.
+type RedirectHandler struct {
+	// The status code of redirects; defaults to
+	// 301 (http.StatusMovedPermanently). 308 preserves
+	// the method and body of requests.
+	StatusCode int
+
+	// The port to redirect to; defaults to HTTPSPort.
+	// Unless it is 443, the port is included in the
+	// redirect URL.
+	Port int
+
+	// If not empty, only requests for these hosts are
+	// redirected, so that the handler cannot be used as an
+	// open redirect; requests for other hosts are answered
+	// with 404 Not Found. Hosts may have a wildcard as their
+	// left-most label, like "*.example.com".
+	AllowedHosts []string
+
+	// Requests whose paths begin with any of these prefixes
+	// are not redirected, but are served by Exempt instead,
+	// or answered with 404 Not Found if Exempt is nil.
+	ExemptPaths []string
+	Exempt      http.Handler
+
+	// If true, connections are kept open after redirecting;
+	// by default they are closed, since clients are expected
+	// to continue over HTTPS.
+	KeepAlive bool
+}
+
+func (h RedirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, prefix := range h.ExemptPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			if h.Exempt == nil {
+				http.NotFound(w, r)
+				return
+			}
+			h.Exempt.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	host := strings.ToLower(strings.Trim(hostOnly(r.Host), "[]"))
+	if !h.hostAllowed(host) {
+		http.NotFound(w, r)
+		return
+	}
+
+	port := h.Port
+	if port == 0 {
+		port = HTTPSPort
+	}
+	toHost := host
+	if port != 443 {
+		toHost = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if strings.Contains(host, ":") {
+		toHost = "[" + host + "]" // IPv6 literal
+	}
+	toURL := "https://" + toHost + r.URL.RequestURI()
+
+	if !h.KeepAlive {
+		// get rid of this disgusting unencrypted HTTP connection 🤢
+		w.Header().Set("Connection", "close")
+	}
+
+	statusCode := h.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, toURL, statusCode)
+}
+
+// hostAllowed returns true if requests for
+// host may be redirected.
+func (h RedirectHandler) hostAllowed(host string) bool {
+	if len(h.AllowedHosts) == 0 {
+		return true
+	}
+	for _, allowed := range h.AllowedHosts {
+		if MatchWildcard(host, strings.ToLower(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// HSTS configures HTTP Strict Transport Security (RFC 6797),
+// which tells browsers to only ever connect to a site over
+// HTTPS.
+type HSTS struct {
+	// How long browsers should remember to use HTTPS;
+	// defaults to 1 year.
+	MaxAge time.Duration
+
+	// Whether the policy also applies to all subdomains.
+	IncludeSubDomains bool
+
+	// Whether to consent to being included in browsers'
+	// built-in lists of HTTPS-only sites; those lists
+	// require IncludeSubDomains and a MaxAge of at least
+	// 1 year.
+	Preload bool
+}
+
+// Handler wraps next so that responses to requests
+// made over TLS have a Strict-Transport-Security header.
+// As the RFC requires, the header is not added to responses
+// over plain HTTP.
+func (hsts HSTS) Handler(next http.Handler) http.Handler {
+	value := hsts.String()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// String returns the value of the
+// Strict-Transport-Security header.
+func (hsts HSTS) String() string {
+	maxAge := hsts.MaxAge
+	if maxAge <= 0 {
+		maxAge = 365 * 24 * time.Hour
+	}
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	if hsts.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if hsts.Preload {
+		value += "; preload"
+	}
+	return value
+}
@@ -0,0 +1,110 @@
+package otomatik
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	exempt := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("exempt"))
+	})
+
+	for i, test := range []struct {
+		handler        RedirectHandler
+		url            string
+		expectStatus   int
+		expectLocation string
+		expectClose    bool
+	}{
+		{
+			handler:        RedirectHandler{},
+			url:            "http://example.com/foo?bar=baz",
+			expectStatus:   http.StatusMovedPermanently,
+			expectLocation: "https://example.com/foo?bar=baz",
+			expectClose:    true,
+		},
+		{
+			handler:        RedirectHandler{Port: 8443, StatusCode: http.StatusPermanentRedirect, KeepAlive: true},
+			url:            "http://example.com:8080/foo",
+			expectStatus:   http.StatusPermanentRedirect,
+			expectLocation: "https://example.com:8443/foo",
+		},
+		{
+			handler:        RedirectHandler{Port: 443},
+			url:            "http://[::1]:8080/",
+			expectStatus:   http.StatusMovedPermanently,
+			expectLocation: "https://[::1]/",
+			expectClose:    true,
+		},
+		{
+			handler:        RedirectHandler{Port: 8443},
+			url:            "http://[::1]/",
+			expectStatus:   http.StatusMovedPermanently,
+			expectLocation: "https://[::1]:8443/",
+			expectClose:    true,
+		},
+		{
+			handler:        RedirectHandler{AllowedHosts: []string{"example.com", "*.example.net"}},
+			url:            "http://sub.EXAMPLE.net/",
+			expectStatus:   http.StatusMovedPermanently,
+			expectLocation: "https://sub.example.net/",
+			expectClose:    true,
+		},
+		{
+			handler:      RedirectHandler{AllowedHosts: []string{"example.com"}},
+			url:          "http://evil.com/",
+			expectStatus: http.StatusNotFound,
+		},
+		{
+			handler:      RedirectHandler{ExemptPaths: []string{"/healthz"}, Exempt: exempt},
+			url:          "http://example.com/healthz",
+			expectStatus: http.StatusOK,
+		},
+		{
+			handler:      RedirectHandler{ExemptPaths: []string{"/healthz"}},
+			url:          "http://example.com/healthz",
+			expectStatus: http.StatusNotFound,
+		},
+	} {
+		w := httptest.NewRecorder()
+		test.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+		if w.Code != test.expectStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectStatus, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.expectLocation {
+			t.Errorf("Test %d: Expected location '%s', got '%s'", i, test.expectLocation, location)
+		}
+		if closed := w.Header().Get("Connection") == "close"; closed != test.expectClose {
+			t.Errorf("Test %d: Expected connection closed to be %t", i, test.expectClose)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for i, test := range []struct {
+		hsts   HSTS
+		expect string
+	}{
+		{hsts: HSTS{}, expect: "max-age=31536000"},
+		{hsts: HSTS{MaxAge: time.Hour, IncludeSubDomains: true}, expect: "max-age=3600; includeSubDomains"},
+		{hsts: HSTS{MaxAge: 2 * 365 * 24 * time.Hour, IncludeSubDomains: true, Preload: true}, expect: "max-age=63072000; includeSubDomains; preload"},
+	} {
+		w := httptest.NewRecorder()
+		test.hsts.Handler(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+		if actual := w.Header().Get("Strict-Transport-Security"); actual != test.expect {
+			t.Errorf("Test %d: Expected '%s', got '%s'", i, test.expect, actual)
+		}
+	}
+
+	// never over plain HTTP
+	w := httptest.NewRecorder()
+	HSTS{}.Handler(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if actual := w.Header().Get("Strict-Transport-Security"); actual != "" {
+		t.Errorf("Expected no header over plain HTTP, got '%s'", actual)
+	}
+}
@@ -0,0 +1,433 @@
+package otomatik
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteSigner is an external signer that holds private keys
+// which never leave it, such as a signing service or a local
+// agent. Certificates can be managed with its keys by using a
+// RemoteKeyGenerator as Config.KeySource: only references to
+// the keys are kept in storage, and CSRs and TLS handshakes are
+// signed by the signer. Signers must be registered with
+// RegisterRemoteSigner before their keys are loaded.
+type RemoteSigner interface {
+	// Name uniquely identifies the signer among registered
+	// signers. It is stored in references to its keys, so it
+	// must not change while they are in use.
+	Name() string
+
+	// CreateKey creates a new key of keyType in the signer, and
+	// returns its ID, which is stored in references to the key,
+	// and its public key.
+	CreateKey(ctx context.Context, keyType KeyType) (id string, pub crypto.PublicKey, err error)
+
+	// Sign signs digest with the key with id, as described
+	// by crypto.Signer. For RSA keys used in TLS 1.3, opts
+	// are *rsa.PSSOptions.
+	Sign(ctx context.Context, id string, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+
+	// DeleteKey deletes the key with id from the signer. It is
+	// called once no stored certificate uses the key any more.
+	// Deleting a key that does not exist is not an error.
+	DeleteKey(ctx context.Context, id string) error
+}
+
+// RegisterRemoteSigner makes signer available to load the keys
+// it holds from their references in storage. Registering a
+// signer with the same name as another replaces it.
+func RegisterRemoteSigner(signer RemoteSigner) {
+	remoteSignersMu.Lock()
+	remoteSigners[signer.Name()] = signer
+	remoteSignersMu.Unlock()
+}
+
+// RemoteKey is a private key held by a RemoteSigner. It is a
+// crypto.Signer that signs by sending digests to the signer.
+type RemoteKey struct {
+	// The signer that holds the key; nil if the signer
+	// of a loaded key is not registered.
+	Signer RemoteSigner
+
+	// The ID of the key within the signer.
+	ID string
+
+	// The public key.
+	PublicKey crypto.PublicKey
+
+	signerName string
+}
+
+// Public returns the public key.
+func (k *RemoteKey) Public() crypto.PublicKey {
+	return k.PublicKey
+}
+
+// Sign signs digest with the key in the signer, giving up
+// after RemoteSignTimeout. The rand argument is not used.
+func (k *RemoteKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if k.Signer == nil {
+		return nil, fmt.Errorf("remote signer %q is not registered", k.signerName)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RemoteSignTimeout)
+	defer cancel()
+	return k.Signer.Sign(ctx, k.ID, digest, opts)
+}
+
+// RemoteKeyGenerator is a KeyGenerator that creates
+// keys in a RemoteSigner.
+type RemoteKeyGenerator struct {
+	// The signer in which to create keys - REQUIRED.
+	Signer RemoteSigner
+
+	// The type of keys to create; default P256.
+	KeyType KeyType
+}
+
+// GenerateKey creates a new key in kg.Signer
+// and returns it as a *RemoteKey.
+func (kg RemoteKeyGenerator) GenerateKey() (crypto.PrivateKey, error) {
+	keyType := kg.KeyType
+	if keyType == "" {
+		keyType = P256
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RemoteSignTimeout)
+	defer cancel()
+	id, pub, err := kg.Signer.CreateKey(ctx, keyType)
+	if err != nil {
+		return nil, fmt.Errorf("creating key in remote signer %s: %v", kg.Signer.Name(), err)
+	}
+	return &RemoteKey{Signer: kg.Signer, ID: id, PublicKey: pub, signerName: kg.Signer.Name()}, nil
+}
+
+// keyGeneratorOfType returns a key generator for keys of keyType
+// that keeps the keys in the same remote signer as kg, if any.
+func keyGeneratorOfType(kg KeyGenerator, keyType KeyType) KeyGenerator {
+	if remote, ok := kg.(RemoteKeyGenerator); ok {
+		remote.KeyType = keyType
+		return remote
+	}
+	return StandardKeyGenerator{KeyType: keyType}
+}
+
+// encodeRemoteKeyReference encodes a reference to key, which
+// contains the name of its signer, its ID and its public key,
+// but no private key material.
+func encodeRemoteKeyReference(key *RemoteKey) ([]byte, error) {
+	pubDER, err := x509.MarshalPKIXPublicKey(key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	signerName := key.signerName
+	if key.Signer != nil {
+		signerName = key.Signer.Name()
+	}
+	block := &pem.Block{
+		Type: remoteKeyPEMType,
+		Headers: map[string]string{
+			"Signer": signerName,
+			"Key-ID": key.ID,
+		},
+		Bytes: pubDER,
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// decodeRemoteKeyReference decodes the reference in block to a
+// key, whose Signer is nil if its signer is not registered.
+func decodeRemoteKeyReference(block *pem.Block) (*RemoteKey, error) {
+	signerName, id := block.Headers["Signer"], block.Headers["Key-ID"]
+	if signerName == "" || id == "" {
+		return nil, fmt.Errorf("remote key reference is missing signer or key ID")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("remote key reference has invalid public key: %v", err)
+	}
+	remoteSignersMu.RLock()
+	signer := remoteSigners[signerName]
+	remoteSignersMu.RUnlock()
+	return &RemoteKey{Signer: signer, ID: id, PublicKey: pub, signerName: signerName}, nil
+}
+
+// remoteKeyFromPEM returns the remote key that keyPEM refers
+// to, or nil if keyPEM is not a valid reference to a remote key.
+func remoteKeyFromPEM(keyPEM []byte) *RemoteKey {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != remoteKeyPEMType {
+		return nil
+	}
+	key, err := decodeRemoteKeyReference(block)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// deleteRemoteKey deletes the key that keyPEM refers to from
+// its signer, if keyPEM is a reference to a remote key. Errors
+// are logged, since the key is no longer needed either way.
+func deleteRemoteKey(keyPEM []byte) {
+	key := remoteKeyFromPEM(keyPEM)
+	if key == nil {
+		return
+	}
+	if key.Signer == nil {
+		log.Printf("[WARNING] Cannot delete unused key %s: remote signer %s is not registered", key.ID, key.signerName)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RemoteSignTimeout)
+	defer cancel()
+	if err := key.Signer.DeleteKey(ctx, key.ID); err != nil {
+		log.Printf("[ERROR] Deleting unused key %s from remote signer %s: %v", key.ID, key.signerName, err)
+		return
+	}
+	log.Printf("[INFO] Deleted unused key %s from remote signer %s", key.ID, key.signerName)
+}
+
+// x509KeyPair is like tls.X509KeyPair, except that
+// keyPEMBlock may also be a reference to a remote key.
+func x509KeyPair(certPEMBlock, keyPEMBlock []byte) (tls.Certificate, error) {
+	block, _ := pem.Decode(keyPEMBlock)
+	if block == nil || block.Type != remoteKeyPEMType {
+		return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	}
+	key, err := decodeRemoteKeyReference(block)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	chain, err := parseCertsFromPEMBundle(certPEMBlock)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leafPub, err := x509.MarshalPKIXPublicKey(chain[0].PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if !bytes.Equal(leafPub, block.Bytes) {
+		return tls.Certificate{}, fmt.Errorf("remote key does not match certificate")
+	}
+	var tlsCert tls.Certificate
+	for _, cert := range chain {
+		tlsCert.Certificate = append(tlsCert.Certificate, cert.Raw)
+	}
+	tlsCert.PrivateKey = key
+	return tlsCert, nil
+}
+
+// HTTPSigner is a RemoteSigner that uses a signing service over
+// HTTP, either on the network or from a local agent listening on
+// a Unix socket. It sends JSON requests, with binary values in
+// standard base64:
+//
+//	POST <URL>/keys {"key_type": "p256"}
+//	  -> {"id": "...", "public_key": "<PKIX DER>"}
+//	POST <URL>/keys/<id>/sign {"digest": "...", "hash": "SHA-256", "pss_salt_length": 32}
+//	  -> {"signature": "..."}
+//	DELETE <URL>/keys/<id>
+//
+// The hash is empty when signing Ed25519 messages, and
+// pss_salt_length is only set for RSA-PSS signatures.
+// Any response status other than 2xx is an error, except
+// that 404 Not Found is accepted when deleting a key.
+type HTTPSigner struct {
+	// The name of the signer, which is stored in
+	// references to its keys - REQUIRED.
+	SignerName string
+
+	// The base URL of the service. If SocketPath is set,
+	// only its path is used; by default it is empty.
+	URL string
+
+	// If set, the path of the Unix socket
+	// on which the service listens.
+	SocketPath string
+
+	// Headers to add to each request, for
+	// example to authenticate to the service.
+	Headers http.Header
+
+	// The HTTP client to use if SocketPath is not
+	// set; if nil, the default client is used.
+	HTTPClient *http.Client
+
+	socketClientOnce sync.Once
+	socketClient     *http.Client
+}
+
+// Name returns s.SignerName.
+func (s *HTTPSigner) Name() string { return s.SignerName }
+
+// CreateKey asks the service to create a key.
+func (s *HTTPSigner) CreateKey(ctx context.Context, keyType KeyType) (string, crypto.PublicKey, error) {
+	var resp struct {
+		ID        string `json:"id"`
+		PublicKey []byte `json:"public_key"`
+	}
+	err := s.do(ctx, http.MethodPost, "/keys", map[string]interface{}{"key_type": keyType}, &resp)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.ID == "" {
+		return "", nil, fmt.Errorf("signer returned no key ID")
+	}
+	pub, err := x509.ParsePKIXPublicKey(resp.PublicKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("signer returned invalid public key: %v", err)
+	}
+	return resp.ID, pub, nil
+}
+
+// Sign asks the service to sign digest with the key with id.
+func (s *HTTPSigner) Sign(ctx context.Context, id string, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := map[string]interface{}{
+		"digest": digest,
+		"hash":   hashName(opts.HashFunc()),
+	}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		saltLength := pss.SaltLength
+		if saltLength == rsa.PSSSaltLengthEqualsHash {
+			saltLength = opts.HashFunc().Size()
+		}
+		req["pss_salt_length"] = saltLength
+	}
+	var resp struct {
+		Signature []byte `json:"signature"`
+	}
+	err := s.do(ctx, http.MethodPost, "/keys/"+url.PathEscape(id)+"/sign", req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+// DeleteKey asks the service to delete the key with id.
+func (s *HTTPSigner) DeleteKey(ctx context.Context, id string) error {
+	return s.do(ctx, http.MethodDelete, "/keys/"+url.PathEscape(id), nil, nil)
+}
+
+// do sends a request with the JSON encoding of reqBody, if
+// not nil, and decodes the response into respBody, if not nil.
+func (s *HTTPSigner) do(ctx context.Context, method, path string, reqBody, respBody interface{}) error {
+	var body io.Reader
+	if reqBody != nil {
+		encoded, err := json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	client, baseURL := s.HTTPClient, s.URL
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if s.SocketPath != "" {
+		client = s.unixSocketClient()
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			return err
+		}
+		baseURL = "http://unix" + u.Path // the host is not used
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(baseURL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for field, values := range s.Headers {
+		req.Header[field] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", buildUAString())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if method == http.MethodDelete && resp.StatusCode == http.StatusNotFound {
+		return nil // already deleted
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("signer responded HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if respBody == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(respBody)
+}
+
+// unixSocketClient returns a client that
+// connects to s.SocketPath.
+func (s *HTTPSigner) unixSocketClient() *http.Client {
+	s.socketClientOnce.Do(func() {
+		s.socketClient = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", s.SocketPath)
+				},
+			},
+		}
+	})
+	return s.socketClient
+}
+
+// hashName returns the name of h as used by HTTPSigner,
+// or an empty string if no hash function is used.
+func hashName(h crypto.Hash) string {
+	switch h {
+	case crypto.SHA1:
+		return "SHA-1"
+	case crypto.SHA256:
+		return "SHA-256"
+	case crypto.SHA384:
+		return "SHA-384"
+	case crypto.SHA512:
+		return "SHA-512"
+	case 0:
+		return ""
+	}
+	return fmt.Sprintf("unknown-%d", h)
+}
+
+// RemoteSignTimeout is how long remote
+// signers may take to create keys and sign.
+var RemoteSignTimeout = 10 * time.Second
+
+// remoteKeyPEMType is the PEM block type of references
+// to remote keys, which are stored in place of keys.
+const remoteKeyPEMType = "REMOTE KEY REFERENCE"
+
+var (
+	remoteSigners   = make(map[string]RemoteSigner)
+	remoteSignersMu sync.RWMutex
+)
+
+// Interface guards
+var (
+	_ crypto.Signer = (*RemoteKey)(nil)
+	_ KeyGenerator  = RemoteKeyGenerator{}
+	_ RemoteSigner  = (*HTTPSigner)(nil)
+)
@@ -0,0 +1,348 @@
+package otomatik
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRemoteKey(t *testing.T) {
+	signer := &fakeRemoteSigner{name: "fake"}
+	RegisterRemoteSigner(signer)
+	defer unregisterRemoteSigner(signer.name)
+
+	iss := &testIssuer{key: "remote"}
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+	})
+	defer cache.Stop()
+	cfg := New(cache, Config{
+		Issuer:    iss,
+		Storage:   new(MemoryStorage),
+		KeySource: RemoteKeyGenerator{Signer: signer},
+	})
+	if err := cfg.ManageSync([]string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// only a reference to the key is stored
+	keyKey := StorageKeys.SitePrivateKey(cfg.issuerKey(), "example.com")
+	keyPEM, err := cfg.Storage.Load(keyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(keyPEM, []byte(remoteKeyPEMType)) || bytes.Contains(keyPEM, []byte("PRIVATE KEY")) {
+		t.Errorf("Expected reference to remote key in storage, got:\n%s", keyPEM)
+	}
+	if len(signer.keys) != 1 || signer.signatures() == 0 {
+		t.Errorf("Expected CSR to be signed by remote key, got %d keys and %d signatures",
+			len(signer.keys), signer.signatures())
+	}
+
+	// the remote key signs TLS handshakes
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+	before := signer.signatures()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Expected handshake with remote key to succeed, got: %v", err)
+	}
+	conn.Close()
+	if signer.signatures() == before {
+		t.Errorf("Expected handshake to be signed by remote key")
+	}
+
+	// renewal keeps the key in the signer
+	if err := cfg.RenewCert(context.Background(), "example.com", false); err != nil {
+		t.Fatal(err)
+	}
+	renewedKeyPEM, err := cfg.Storage.Load(keyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(renewedKeyPEM, keyPEM) || len(signer.keys) != 1 {
+		t.Errorf("Expected renewal to reuse remote key")
+	}
+
+	// keys of signers that are not registered cannot be used
+	certPEM, err := cfg.Storage.Load(StorageKeys.SiteCert(cfg.issuerKey(), "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unregisterRemoteSigner(signer.name)
+	if _, err := makeCertificate(certPEM, keyPEM); err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("Expected error for unregistered signer, got: %v", err)
+	}
+}
+
+func TestRemoteKeyDeletedWhenUnused(t *testing.T) {
+	signer := &fakeRemoteSigner{name: "fake-unused"}
+	RegisterRemoteSigner(signer)
+	defer unregisterRemoteSigner(signer.name)
+
+	iss := &testIssuer{key: "remote"}
+	cfg := &Config{
+		Issuer:             iss,
+		KeySource:          RemoteKeyGenerator{Signer: signer},
+		Storage:            new(MemoryStorage),
+		RenewalWindowRatio: 1, // always due for renewal
+		CertHistory:        1,
+		certCache:          &Cache{cache: make(map[string]Certificate), cacheIndex: make(map[string][]string)},
+	}
+	ctx := context.Background()
+
+	// pruned versions that use the active key keep it
+	if err := cfg.ObtainCert(ctx, "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := cfg.RenewCert(ctx, "example.com", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids := signer.keyIDs(); len(ids) != 1 || ids[0] != "key-1" {
+		t.Fatalf("Expected key to be kept while in use, got %v", ids)
+	}
+
+	// once the active certificate has a new key, pruning
+	// the last version with the old key deletes it
+	issuerKey := cfg.issuerKey()
+	for _, key := range []string{
+		StorageKeys.SiteCert(issuerKey, "example.com"),
+		StorageKeys.SitePrivateKey(issuerKey, "example.com"),
+		StorageKeys.SiteMeta(issuerKey, "example.com"),
+	} {
+		if err := cfg.Storage.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cfg.ObtainCert(ctx, "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if ids := signer.keyIDs(); len(ids) != 2 {
+		t.Fatalf("Expected old key to be kept by prior version, got %v", ids)
+	}
+	if err := cfg.RenewCert(ctx, "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if ids := signer.keyIDs(); len(ids) != 1 || ids[0] != "key-2" {
+		t.Errorf("Expected only key-2 to be left after pruning, got %v", ids)
+	}
+
+	// keys created for certificates that fail to be obtained are deleted
+	iss.err = fmt.Errorf("issuance failed")
+	if err := cfg.ObtainCert(ctx, "other.example.com", true); err == nil {
+		t.Fatal("Expected error obtaining certificate")
+	}
+	if ids := signer.keyIDs(); len(ids) != 1 || ids[0] != "key-2" {
+		t.Errorf("Expected key of failed obtain to be deleted, got %v", ids)
+	}
+}
+
+func TestHTTPSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otomatik-signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "signer.sock")
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skipf("Unix sockets not available: %v", err)
+	}
+	backend := &fakeRemoteSigner{name: "backend"}
+	srv := &http.Server{Handler: fakeSigningService(t, backend)}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	signer := &HTTPSigner{
+		SignerName: "agent",
+		URL:        "/v1",
+		SocketPath: socketPath,
+		Headers:    http.Header{"Authorization": []string{"Bearer secret"}},
+	}
+	for _, keyType := range []KeyType{P256, RSA2048, ED25519} {
+		key, err := RemoteKeyGenerator{Signer: signer, KeyType: keyType}.GenerateKey()
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		csr, err := new(Config).generateCSR(key, []string{"example.com"})
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			t.Errorf("%s: Expected valid signature from signing service, got: %v", keyType, err)
+		}
+	}
+
+	// keys are deleted, and deleting them again is not an error
+	for _, id := range backend.keyIDs() {
+		if err := signer.DeleteKey(context.Background(), id); err != nil {
+			t.Errorf("Expected no error deleting key %s, got: %v", id, err)
+		}
+		if err := signer.DeleteKey(context.Background(), id); err != nil {
+			t.Errorf("Expected no error deleting deleted key %s, got: %v", id, err)
+		}
+	}
+	if ids := backend.keyIDs(); len(ids) != 0 {
+		t.Errorf("Expected all keys to be deleted from signing service, got %v", ids)
+	}
+
+	signer.Headers = nil
+	if _, err := (RemoteKeyGenerator{Signer: signer}).GenerateKey(); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected error from signing service, got: %v", err)
+	}
+}
+
+// fakeSigningService serves the HTTPSigner
+// protocol with keys held by signer.
+func fakeSigningService(t *testing.T, signer *fakeRemoteSigner) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/keys", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			KeyType KeyType `json:"key_type"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		id, pub, err := signer.CreateKey(r.Context(), req.KeyType)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "public_key": pubDER})
+	})
+	mux.HandleFunc("/v1/keys/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			id := strings.TrimPrefix(r.URL.Path, "/v1/keys/")
+			if !signer.hasKey(id) {
+				http.NotFound(w, r)
+				return
+			}
+			signer.DeleteKey(r.Context(), id)
+			return
+		}
+		var req struct {
+			Digest []byte `json:"digest"`
+			Hash   string `json:"hash"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		hashes := map[string]crypto.Hash{"": 0, "SHA-256": crypto.SHA256, "SHA-384": crypto.SHA384, "SHA-512": crypto.SHA512}
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/keys/"), "/sign")
+		sig, err := signer.Sign(r.Context(), id, req.Digest, hashes[req.Hash])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"signature": sig})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// fakeRemoteSigner holds keys in memory.
+type fakeRemoteSigner struct {
+	name string
+
+	mu      sync.Mutex
+	keys    map[string]crypto.Signer
+	created int
+	signs   int
+}
+
+func (s *fakeRemoteSigner) Name() string { return s.name }
+
+func (s *fakeRemoteSigner) CreateKey(ctx context.Context, keyType KeyType) (string, crypto.PublicKey, error) {
+	key, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+	if err != nil {
+		return "", nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[string]crypto.Signer)
+	}
+	s.created++
+	id := fmt.Sprintf("key-%d", s.created)
+	s.keys[id] = key.(crypto.Signer)
+	return id, s.keys[id].Public(), nil
+}
+
+func (s *fakeRemoteSigner) Sign(ctx context.Context, id string, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.mu.Lock()
+	key, ok := s.keys[id]
+	if ok {
+		s.signs++
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no key %s", id)
+	}
+	return key.Sign(rand.Reader, digest, opts)
+}
+
+func (s *fakeRemoteSigner) DeleteKey(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *fakeRemoteSigner) hasKey(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.keys[id]
+	return ok
+}
+
+func (s *fakeRemoteSigner) keyIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range s.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *fakeRemoteSigner) signatures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signs
+}
+
+func unregisterRemoteSigner(name string) {
+	remoteSignersMu.Lock()
+	delete(remoteSigners, name)
+	remoteSignersMu.Unlock()
+}
@@ -0,0 +1,291 @@
+package otomatik
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/miekg/dns"
+)
+
+// RFC2136Provider solves the DNS-01 challenge by publishing and
+// removing TXT records with dynamic DNS updates (RFC 2136),
+// authenticated with TSIG (RFC 8945). This works with BIND and
+// other authoritative servers that accept dynamic updates. After
+// each update, it waits until all authoritative servers of the
+// zone serve the change.
+//
+// RFC2136Provider is also a TXTRecordProvider, so it can be used
+// with DelegatedDNSProvider to update only a validation zone.
+type RFC2136Provider struct {
+	// The server (host:port) to send updates to,
+	// usually the zone's primary - REQUIRED.
+	Nameserver string
+
+	// The name of the TSIG key; if empty,
+	// updates are not authenticated.
+	TSIGKey string
+
+	// The base64-encoded TSIG secret.
+	TSIGSecret string
+
+	// The TSIG algorithm, such as "hmac-sha256"
+	// (the default) or "hmac-sha512".
+	TSIGAlgorithm string
+
+	// The zone to update; if empty, the zone of each
+	// record is found by looking up its SOA record.
+	Zone string
+
+	// The TTL of the TXT records, in seconds;
+	// the default is 60.
+	TTL uint32
+
+	// The network to send updates over, "udp" (the default) or "tcp".
+	Network string
+
+	// The authoritative servers (host:port) which must serve the
+	// updated records before the change is considered propagated;
+	// if empty, the zone's NS records are looked up.
+	AuthoritativeServers []string
+
+	// The recursive DNS resolvers (host:port) to use when looking up
+	// zones and their name servers; if empty, the system's are used.
+	Resolvers []string
+
+	// How long to wait for each DNS response; the default is 10s.
+	DNSTimeout time.Duration
+
+	// How long to wait for updates to propagate, and how
+	// often to check; if unset, lego's defaults are used.
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+}
+
+// Present publishes the challenge record for domain.
+func (p *RFC2136Provider) Present(domain, token, keyAuth string) error {
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+	return p.PresentTXT(fqdn, value)
+}
+
+// CleanUp removes the challenge record for domain.
+func (p *RFC2136Provider) CleanUp(domain, token, keyAuth string) error {
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+	return p.CleanUpTXT(fqdn, value)
+}
+
+// Timeout returns the propagation timeout and polling interval.
+func (p *RFC2136Provider) Timeout() (timeout, interval time.Duration) {
+	return propagationTimeout(p.PropagationTimeout, p.PollingInterval)
+}
+
+// PresentTXT adds a TXT record with value at fqdn, then
+// waits for the authoritative servers to serve it.
+func (p *RFC2136Provider) PresentTXT(fqdn, value string) error {
+	zone, err := p.zoneFor(fqdn)
+	if err != nil {
+		return err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Insert([]dns.RR{p.txtRecord(fqdn, value)})
+	if err := p.sendUpdate(m); err != nil {
+		return fmt.Errorf("adding TXT record %s: %v", fqdn, err)
+	}
+	return p.waitForPropagation(zone, fqdn, value)
+}
+
+// CleanUpTXT removes the TXT record with value at fqdn.
+// Propagation of removals is not waited for.
+func (p *RFC2136Provider) CleanUpTXT(fqdn, value string) error {
+	zone, err := p.zoneFor(fqdn)
+	if err != nil {
+		return err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Remove([]dns.RR{p.txtRecord(fqdn, value)})
+	if err := p.sendUpdate(m); err != nil {
+		return fmt.Errorf("removing TXT record %s: %v", fqdn, err)
+	}
+	return nil
+}
+
+func (p *RFC2136Provider) txtRecord(fqdn, value string) *dns.TXT {
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = 60
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(fqdn), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+		Txt: []string{value},
+	}
+}
+
+// sendUpdate signs m, if a TSIG key is configured, and sends it
+// to the nameserver, returning an error if it is not accepted.
+func (p *RFC2136Provider) sendUpdate(m *dns.Msg) error {
+	network := p.Network
+	if network == "" {
+		network = "udp"
+	}
+	timeout := p.DNSTimeout
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+	client := &dns.Client{Net: network, Timeout: timeout}
+
+	if p.TSIGKey != "" {
+		alg, err := tsigAlgorithm(p.TSIGAlgorithm)
+		if err != nil {
+			return err
+		}
+		keyName := strings.ToLower(dns.Fqdn(p.TSIGKey))
+		client.TsigSecret = map[string]string{keyName: p.TSIGSecret}
+		m.SetTsig(keyName, alg, 300, time.Now().Unix())
+	}
+
+	resp, _, err := client.Exchange(m, p.Nameserver)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("server %s responded %s", p.Nameserver, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// zoneFor returns the zone that contains fqdn.
+func (p *RFC2136Provider) zoneFor(fqdn string) (string, error) {
+	if p.Zone != "" {
+		return dns.Fqdn(p.Zone), nil
+	}
+	resolvers := p.Resolvers
+	if len(resolvers) == 0 {
+		resolvers = systemResolvers()
+	}
+	labels := dns.SplitDomainName(fqdn)
+	for i := range labels {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		resp, err := dnsExchange(candidate, dns.TypeSOA, resolvers, true, p.DNSTimeout)
+		if err != nil {
+			return "", fmt.Errorf("finding zone of %s: %v", fqdn, err)
+		}
+		for _, rr := range resp.Answer {
+			if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, candidate) {
+				return candidate, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("could not find zone of %s", fqdn)
+}
+
+// authoritativeServers returns the addresses of the
+// name servers that are authoritative for zone.
+func (p *RFC2136Provider) authoritativeServers(zone string) ([]string, error) {
+	if len(p.AuthoritativeServers) > 0 {
+		return p.AuthoritativeServers, nil
+	}
+	resolvers := p.Resolvers
+	if len(resolvers) == 0 {
+		resolvers = systemResolvers()
+	}
+	resp, err := dnsExchange(zone, dns.TypeNS, resolvers, true, p.DNSTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("looking up name servers of %s: %v", zone, err)
+	}
+	var servers []string
+	for _, rr := range resp.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			addrResp, err := dnsExchange(ns.Ns, qtype, resolvers, true, p.DNSTimeout)
+			if err != nil {
+				continue
+			}
+			for _, addrRR := range addrResp.Answer {
+				switch addr := addrRR.(type) {
+				case *dns.A:
+					servers = append(servers, net.JoinHostPort(addr.A.String(), "53"))
+				case *dns.AAAA:
+					servers = append(servers, net.JoinHostPort(addr.AAAA.String(), "53"))
+				}
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no authoritative servers found for %s", zone)
+	}
+	return servers, nil
+}
+
+// waitForPropagation polls every authoritative server of zone until
+// each of them serves the TXT record with value at fqdn, or until
+// the propagation timeout.
+func (p *RFC2136Provider) waitForPropagation(zone, fqdn, value string) error {
+	servers, err := p.authoritativeServers(zone)
+	if err != nil {
+		return err
+	}
+	timeout, interval := p.Timeout()
+	deadline := time.Now().Add(timeout)
+	for {
+		var pending []string
+		for _, server := range servers {
+			found, err := txtRecordServed(server, fqdn, value, p.DNSTimeout)
+			if err != nil || !found {
+				pending = append(pending, server)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("TXT record %s did not propagate to %v within %s", fqdn, pending, timeout)
+		}
+		log.Printf("[INFO] Waiting for TXT record %s to propagate to %v", fqdn, pending)
+		time.Sleep(interval)
+	}
+}
+
+// txtRecordServed returns true if server answers authoritatively
+// with a TXT record for fqdn that has the given value.
+func txtRecordServed(server, fqdn, value string, timeout time.Duration) (bool, error) {
+	resp, err := dnsExchange(fqdn, dns.TypeTXT, []string{server}, false, timeout)
+	if err != nil {
+		return false, err
+	}
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// tsigAlgorithm returns the canonical name of the TSIG algorithm alg.
+func tsigAlgorithm(alg string) (string, error) {
+	switch strings.TrimSuffix(strings.ToLower(alg), ".") {
+	case "", "hmac-sha256":
+		return dns.HmacSHA256, nil
+	case "hmac-sha512":
+		return dns.HmacSHA512, nil
+	case "hmac-sha1":
+		return dns.HmacSHA1, nil
+	case "hmac-md5", "hmac-md5.sig-alg.reg.int":
+		return dns.HmacMD5, nil
+	}
+	return "", fmt.Errorf("unsupported TSIG algorithm: %s", alg)
+}
+
+// Interface guards
+var (
+	_ challenge.ProviderTimeout = (*RFC2136Provider)(nil)
+	_ TXTRecordProvider         = (*RFC2136Provider)(nil)
+)
@@ -0,0 +1,174 @@
+package otomatik
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/miekg/dns"
+)
+
+// testUpdateServer is a minimal authoritative server for example.com.
+// which applies dynamic updates signed with its TSIG key.
+type testUpdateServer struct {
+	mu  sync.Mutex
+	txt map[string][]string // values keyed by lowercase name
+}
+
+func (s *testUpdateServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	defer func() {
+		if r.IsTsig() != nil {
+			m.SetTsig(testTSIGKey, dns.HmacSHA256, 300, int64(r.IsTsig().TimeSigned))
+		}
+		w.WriteMsg(m)
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := r.Question[0]
+	if r.Opcode == dns.OpcodeUpdate {
+		if r.IsTsig() == nil || w.TsigStatus() != nil {
+			m.Rcode = dns.RcodeRefused
+			return
+		}
+		if !strings.EqualFold(q.Name, "example.com.") {
+			m.Rcode = dns.RcodeNotZone
+			return
+		}
+		for _, rr := range r.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				m.Rcode = dns.RcodeFormatError
+				return
+			}
+			name, value := strings.ToLower(txt.Hdr.Name), strings.Join(txt.Txt, "")
+			switch txt.Hdr.Class {
+			case dns.ClassINET:
+				s.txt[name] = append(s.txt[name], value)
+			case dns.ClassNONE:
+				var kept []string
+				for _, v := range s.txt[name] {
+					if v != value {
+						kept = append(kept, v)
+					}
+				}
+				s.txt[name] = kept
+			}
+		}
+		return
+	}
+
+	m.Authoritative = true
+	switch q.Qtype {
+	case dns.TypeSOA:
+		if strings.EqualFold(q.Name, "example.com.") {
+			rr, _ := dns.NewRR("example.com. 300 IN SOA ns1.example.com. admin.example.com. 1 3600 600 86400 60")
+			m.Answer = append(m.Answer, rr)
+		}
+	case dns.TypeTXT:
+		for _, v := range s.txt[strings.ToLower(q.Name)] {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{v},
+			})
+		}
+	}
+}
+
+const (
+	testTSIGKey    = "update-key."
+	testTSIGSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0"
+)
+
+func TestRFC2136Provider(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening for test DNS server: %v", err)
+	}
+	handler := &testUpdateServer{txt: make(map[string][]string)}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           handler,
+		TsigSecret:        map[string]string{testTSIGKey: testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// the default accept func rejects updates as not implemented
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+	addr := pc.LocalAddr().String()
+
+	provider := &RFC2136Provider{
+		Nameserver:           addr,
+		TSIGKey:              "update-key",
+		TSIGSecret:           testTSIGSecret,
+		Resolvers:            []string{addr},
+		AuthoritativeServers: []string{addr},
+	}
+
+	if zone, err := provider.zoneFor("_acme-challenge.www.example.com."); err != nil || zone != "example.com." {
+		t.Errorf("Expected zone 'example.com.', got '%s' (error: %v)", zone, err)
+	}
+
+	err = provider.Present("www.example.com", "token", "keyauth")
+	if err != nil {
+		t.Fatalf("Expected no error presenting, got: %v", err)
+	}
+	fqdn, value := dns01.GetRecord("www.example.com", "keyauth")
+	found, err := txtRecordServed(addr, fqdn, value, 0)
+	if err != nil || !found {
+		t.Errorf("Expected TXT record to be served after presenting (error: %v)", err)
+	}
+
+	err = provider.CleanUp("www.example.com", "token", "keyauth")
+	if err != nil {
+		t.Fatalf("Expected no error cleaning up, got: %v", err)
+	}
+	found, err = txtRecordServed(addr, fqdn, value, 0)
+	if err != nil || found {
+		t.Errorf("Expected TXT record to be removed after cleaning up (error: %v)", err)
+	}
+
+	// updates signed with the wrong secret must be rejected
+	bad := *provider
+	bad.TSIGSecret = "d3Jvbmctc2VjcmV0"
+	if err := bad.Present("www.example.com", "token", "keyauth"); err == nil {
+		t.Error("Expected error presenting with wrong TSIG secret, but got none")
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.txt[strings.ToLower(fqdn)]) != 0 {
+		t.Errorf("Expected no records from rejected update, got: %v", handler.txt)
+	}
+}
+
+func TestTSIGAlgorithm(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		expect    string
+		expectErr bool
+	}{
+		{input: "", expect: dns.HmacSHA256},
+		{input: "HMAC-SHA512", expect: dns.HmacSHA512},
+		{input: "hmac-md5.sig-alg.reg.int.", expect: dns.HmacMD5},
+		{input: "hmac-sha3", expectErr: true},
+	} {
+		actual, err := tsigAlgorithm(test.input)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but got none", i)
+			}
+			continue
+		}
+		if err != nil || actual != test.expect {
+			t.Errorf("Test %d: Expected '%s', got '%s' (error: %v)", i, test.expect, actual, err)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package otomatik
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Server serves HTTPS for the names managed by a Config, along
+// with an HTTP server that solves HTTP challenges and redirects
+// all other requests to HTTPS. Unlike the HTTPS function, it
+// owns its listeners, can be configured, and can be shut down
+// gracefully, which makes it suitable for embedding in a process
+// that needs to stop cleanly:
+//
+//	srv := &otomatik.Server{Config: cfg, Domains: names, Handler: mux}
+//	if err := srv.Start(); err != nil {
+//	    return err
+//	}
+//	<-sigterm
+//	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+//	defer cancel()
+//	return srv.Shutdown(ctx)
+//
+// A Server may only be started once.
+type Server struct {
+	// The config with which to manage certificates;
+	// if nil, NewDefault() is used.
+	Config *Config
+
+	// The names to manage certificates for when starting.
+	// May be empty if the config obtains certificates on
+	// demand, or they are managed elsewhere.
+	Domains []string
+
+	// The handler to serve over HTTPS;
+	// if nil, http.DefaultServeMux is used.
+	Handler http.Handler
+
+	// The addresses to listen on; if empty, the HTTPPort
+	// and HTTPSPort on all interfaces are used.
+	HTTPAddr  string
+	HTTPSAddr string
+
+	// Timeouts for the HTTP and HTTPS servers. Zero values
+	// are replaced with the defaults used by HTTPS.
+	HTTPTimeouts  ServerTimeouts
+	HTTPSTimeouts ServerTimeouts
+
+	// How the HTTP server redirects requests to HTTPS; by
+	// default, all requests are redirected permanently to the
+	// port the HTTPS server listens on. If Redirect.Port is 0,
+	// that port is used.
+	Redirect *RedirectHandler
+
+	// If set, responses over HTTPS have a
+	// Strict-Transport-Security header.
+	HSTS *HSTS
+
+	// If set, HTTP/3 is also served over QUIC, on the UDP
+	// port of the same number as the HTTPS port, by the server
+	// HTTP3 returns for the given TLS configuration (from
+	// Config.HTTP3TLSConfig) and handler; responses over HTTPS
+	// then advertise HTTP/3 with an Alt-Svc header. This package
+	// does not implement QUIC itself, so that it does not depend
+	// on a QUIC implementation; NewServer in the http3 module
+	// (github.com/wondenge/otomatik/http3) serves HTTP/3 with
+	// quic-go:
+	//
+	//	HTTP3: http3.NewServer,
+	HTTP3 func(tlsConfig *tls.Config, handler http.Handler) HTTP3Server
+
+	// If set, the HTTP and HTTPS listeners read PROXY protocol
+	// headers, so that handlers and certificate selection see
+	// the addresses of clients behind a TCP load balancer.
+	ProxyProtocol *ProxyProtocol
+
+	// If true, Shutdown also stops the certificate
+	// cache of Config once the servers are shut down.
+	StopCache bool
+
+	mu          sync.Mutex
+	started     bool
+	httpServer  *http.Server
+	httpsServer *http.Server
+	http3Server HTTP3Server
+	httpLn      net.Listener
+	httpsLn     net.Listener
+	http3Conn   net.PacketConn
+	cfg         *Config
+	done        chan struct{} // closed when both servers have stopped
+	serveErr    error         // the first error from a server
+}
+
+// HTTP3Server is a server that serves HTTP/3 over QUIC on a
+// packet connection, such as http3.Server from quic-go. If it
+// also has a Shutdown(context.Context) error method, it is
+// used to shut it down gracefully; otherwise it is closed.
+type HTTP3Server interface {
+	Serve(conn net.PacketConn) error
+	Close() error
+}
+
+// ServerTimeouts are the timeouts of an HTTP server;
+// see the fields of the same names in http.Server.
+type ServerTimeouts struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+}
+
+// Start obtains or loads certificates for s.Domains, then
+// begins serving HTTP and HTTPS in the background. It returns
+// once both servers are listening; errors that stop a server
+// after that are returned by Wait.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("server already started")
+	}
+
+	cfg := s.Config
+	if cfg == nil {
+		DefaultACME.Agreed = true
+		cfg = NewDefault()
+	}
+	if len(s.Domains) > 0 {
+		if err := cfg.ManageSync(s.Domains); err != nil {
+			return err
+		}
+	}
+
+	httpAddr, httpsAddr := s.HTTPAddr, s.HTTPSAddr
+	if httpAddr == "" {
+		httpAddr = fmt.Sprintf(":%d", HTTPPort)
+	}
+	if httpsAddr == "" {
+		httpsAddr = fmt.Sprintf(":%d", HTTPSPort)
+	}
+	httpLn, err := listenTCP(httpAddr, s.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+	httpsTCPLn, err := listenTCP(httpsAddr, s.ProxyProtocol)
+	if err != nil {
+		httpLn.Close()
+		return err
+	}
+	httpsLn := tls.NewListener(httpsTCPLn, cfg.TLSConfig())
+
+	var redirect RedirectHandler
+	if s.Redirect != nil {
+		redirect = *s.Redirect
+	}
+	if redirect.Port == 0 {
+		redirect.Port = httpsLn.Addr().(*net.TCPAddr).Port
+	}
+	var httpHandler http.Handler = redirect
+	if am, ok := cfg.Issuer.(*ACMEManager); ok {
+		httpHandler = am.HTTPChallengeHandler(httpHandler)
+	}
+	handler := s.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	if s.HSTS != nil {
+		handler = s.HSTS.Handler(handler)
+	}
+
+	// HTTP/3 is served on the UDP port of the same number
+	var http3Conn net.PacketConn
+	if s.HTTP3 != nil {
+		http3Conn, err = net.ListenPacket("udp", httpsLn.Addr().String())
+		if err != nil {
+			httpLn.Close()
+			httpsLn.Close()
+			return fmt.Errorf("listening for HTTP/3: %v", err)
+		}
+		s.http3Server = s.HTTP3(cfg.HTTP3TLSConfig(), handler)
+		handler = altSvcHandler(handler, http3Conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+
+	s.httpServer = &http.Server{Handler: httpHandler}
+	s.HTTPTimeouts.withDefaults(defaultHTTPTimeouts).applyTo(s.httpServer)
+	s.httpsServer = &http.Server{Handler: handler}
+	s.HTTPSTimeouts.withDefaults(defaultHTTPSTimeouts).applyTo(s.httpsServer)
+
+	s.cfg, s.httpLn, s.httpsLn, s.http3Conn = cfg, httpLn, httpsLn, http3Conn
+	s.done = make(chan struct{})
+	s.started = true
+
+	log.Printf("%v Serving HTTP->HTTPS on %s and %s", s.Domains, httpLn.Addr(), httpsLn.Addr())
+
+	serves := []func() error{
+		func() error { return s.httpServer.Serve(httpLn) },
+		func() error { return s.httpsServer.Serve(httpsLn) },
+	}
+	if s.http3Server != nil {
+		log.Printf("%v Serving HTTP/3 on %s", s.Domains, http3Conn.LocalAddr())
+		serves = append(serves, func() error { return s.http3Server.Serve(http3Conn) })
+	}
+	serveErrs := make(chan error, len(serves))
+	for _, serve := range serves {
+		go func(serve func() error) {
+			err := serve()
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+			serveErrs <- err
+		}(serve)
+	}
+	go func() {
+		for range serves {
+			if err := <-serveErrs; err != nil && s.serveErr == nil {
+				s.serveErr = err
+			}
+		}
+		close(s.done)
+	}()
+
+	return nil
+}
+
+// Wait blocks until both servers have stopped, and returns
+// the first error that stopped a server other than being
+// shut down. It returns immediately if s was not started.
+func (s *Server) Wait() error {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	<-done
+	return s.serveErr
+}
+
+// Shutdown gracefully shuts down the servers: they stop
+// accepting connections, and Shutdown waits for active
+// requests to finish before closing their connections, until
+// ctx is done. Then, if s.StopCache is true, it stops the
+// config's certificate cache. It returns ctx's error if not
+// all connections finished in time.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+
+	shutdowns := []func() error{
+		func() error { return s.httpServer.Shutdown(ctx) },
+		func() error { return s.httpsServer.Shutdown(ctx) },
+	}
+	if s.http3Server != nil {
+		shutdowns = append(shutdowns, func() error {
+			if graceful, ok := s.http3Server.(interface{ Shutdown(context.Context) error }); ok {
+				return graceful.Shutdown(ctx)
+			}
+			return s.http3Server.Close()
+		})
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(shutdowns))
+	for _, shutdown := range shutdowns {
+		wg.Add(1)
+		go func(shutdown func() error) {
+			defer wg.Done()
+			errs <- shutdown()
+		}(shutdown)
+	}
+	wg.Wait()
+	close(errs)
+	if s.http3Conn != nil {
+		s.http3Conn.Close()
+	}
+
+	if s.StopCache && s.cfg.certCache != nil {
+		s.cfg.certCache.Stop()
+	}
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Addrs returns the addresses that the HTTP and HTTPS
+// servers are listening on, or nil if s is not started.
+func (s *Server) Addrs() (httpAddr, httpsAddr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		return nil, nil
+	}
+	return s.httpLn.Addr(), s.httpsLn.Addr()
+}
+
+// altSvcHandler wraps h so that its responses advertise
+// HTTP/3 on port, as RFC 7838 describes.
+func altSvcHandler(h http.Handler, port int) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=%d`, port, int(altSvcMaxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// altSvcMaxAge is how long clients may remember that
+// HTTP/3 is available.
+const altSvcMaxAge = 24 * time.Hour
+
+// withDefaults returns t with its zero
+// values replaced by those of defaults.
+func (t ServerTimeouts) withDefaults(defaults ServerTimeouts) ServerTimeouts {
+	if t.ReadHeaderTimeout == 0 {
+		t.ReadHeaderTimeout = defaults.ReadHeaderTimeout
+	}
+	if t.ReadTimeout == 0 {
+		t.ReadTimeout = defaults.ReadTimeout
+	}
+	if t.WriteTimeout == 0 {
+		t.WriteTimeout = defaults.WriteTimeout
+	}
+	if t.IdleTimeout == 0 {
+		t.IdleTimeout = defaults.IdleTimeout
+	}
+	return t
+}
+
+func (t ServerTimeouts) applyTo(srv *http.Server) {
+	srv.ReadHeaderTimeout = t.ReadHeaderTimeout
+	srv.ReadTimeout = t.ReadTimeout
+	srv.WriteTimeout = t.WriteTimeout
+	srv.IdleTimeout = t.IdleTimeout
+}
+
+// The default timeouts of the HTTP server, which only solves
+// challenges and redirects, and of the HTTPS server.
+var (
+	defaultHTTPTimeouts = ServerTimeouts{
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       5 * time.Second,
+		WriteTimeout:      5 * time.Second,
+		IdleTimeout:       5 * time.Second,
+	}
+	defaultHTTPSTimeouts = ServerTimeouts{
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      2 * time.Minute,
+		IdleTimeout:       5 * time.Minute,
+	}
+)
@@ -0,0 +1,237 @@
+package otomatik
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServerShutdown(t *testing.T) {
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+	})
+	cfg = New(cache, Config{
+		Issuer:  &testIssuer{key: "server"},
+		Storage: new(MemoryStorage),
+	})
+
+	requestStarted := make(chan struct{})
+	finishRequest := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(requestStarted)
+		<-finishRequest
+		w.Write([]byte("done"))
+	})
+
+	srv := &Server{
+		Config:       cfg,
+		Domains:      []string{"example.com"},
+		Handler:      mux,
+		HTTPAddr:     "127.0.0.1:0",
+		HTTPSAddr:    "127.0.0.1:0",
+		HTTPTimeouts: ServerTimeouts{IdleTimeout: time.Second},
+		StopCache:    true,
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Expected no error starting server, got: %v", err)
+	}
+	if err := srv.Start(); err == nil {
+		t.Errorf("Expected error starting server twice")
+	}
+	if srv.httpServer.IdleTimeout != time.Second || srv.httpServer.ReadTimeout != defaultHTTPTimeouts.ReadTimeout {
+		t.Errorf("Expected configured timeouts with defaults for the rest, got %+v", srv.httpServer)
+	}
+	httpAddr, httpsAddr := srv.Addrs()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: "example.com", InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := client.Get("http://" + httpAddr.String() + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if expect := "https://" + httpsAddr.String() + "/foo"; resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != expect {
+		t.Errorf("Expected redirect to %s, got %d to %s", expect, resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, err = client.Get("https://" + httpsAddr.String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("Expected handler to be served over HTTPS, got '%s'", body)
+	}
+	if resp.TLS == nil || resp.TLS.PeerCertificates[0].DNSNames[0] != "example.com" {
+		t.Errorf("Expected managed certificate to be served")
+	}
+
+	// shutting down waits for active requests
+	slowBody := make(chan string)
+	go func() {
+		resp, err := client.Get("https://" + httpsAddr.String() + "/slow")
+		if err != nil {
+			slowBody <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		slowBody <- string(body)
+	}()
+	<-requestStarted
+
+	shutdownDone := make(chan error)
+	go func() { shutdownDone <- srv.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("Expected shutdown to wait for active request, but it returned: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(finishRequest)
+	if body := <-slowBody; body != "done" {
+		t.Errorf("Expected active request to complete, got '%s'", body)
+	}
+	if err := <-shutdownDone; err != nil {
+		t.Errorf("Expected no error shutting down, got: %v", err)
+	}
+	if err := srv.Wait(); err != nil {
+		t.Errorf("Expected no error from stopped servers, got: %v", err)
+	}
+
+	if _, err := client.Get("https://" + httpsAddr.String() + "/"); err == nil {
+		t.Errorf("Expected no new connections after shutdown")
+	}
+	select {
+	case <-cache.doneChan:
+	default:
+		t.Errorf("Expected cache to be stopped")
+	}
+	cache.Stop() // stopping again has no effect
+}
+
+func TestServerHTTP3(t *testing.T) {
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+	})
+	defer cache.Stop()
+	cfg := New(cache, Config{
+		Issuer:  &testIssuer{key: "http3"},
+		Storage: new(MemoryStorage),
+	})
+
+	h3 := &fakeHTTP3Server{received: make(chan string, 1), closed: make(chan struct{})}
+	srv := &Server{
+		Config:    cfg,
+		Domains:   []string{"example.com"},
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		HTTPAddr:  "127.0.0.1:0",
+		HTTPSAddr: "127.0.0.1:0",
+		HTTP3: func(tlsConfig *tls.Config, handler http.Handler) HTTP3Server {
+			h3.tlsConfig = tlsConfig
+			return h3
+		},
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_, httpsAddr := srv.Addrs()
+
+	// the HTTP/3 server serves the managed certificates over QUIC
+	if h3.tlsConfig.MinVersion != tls.VersionTLS13 || h3.tlsConfig.NextProtos[0] != "h3" {
+		t.Errorf("Expected TLS 1.3 config for h3, got %+v", h3.tlsConfig)
+	}
+	cert, err := h3.tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil || cert.Leaf.DNSNames[0] != "example.com" {
+		t.Errorf("Expected managed certificate for HTTP/3, got error: %v", err)
+	}
+
+	// on the UDP port of the same number
+	conn, err := net.Dial("udp", httpsAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("quic"))
+	conn.Close()
+	select {
+	case packet := <-h3.received:
+		if packet != "quic" {
+			t.Errorf("Expected packet to be received by HTTP/3 server, got '%s'", packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for HTTP/3 server to receive packet")
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: "example.com", InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get("https://" + httpsAddr.String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	port := httpsAddr.(*net.TCPAddr).Port
+	if expect := fmt.Sprintf(`h3=":%d"; ma=86400`, port); resp.Header.Get("Alt-Svc") != expect {
+		t.Errorf("Expected Alt-Svc header %s, got %s", expect, resp.Header.Get("Alt-Svc"))
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Wait(); err != nil {
+		t.Errorf("Expected no error from stopped servers, got: %v", err)
+	}
+	if !h3.shutdown {
+		t.Errorf("Expected HTTP/3 server to be shut down")
+	}
+}
+
+// fakeHTTP3Server receives packets
+// instead of speaking QUIC.
+type fakeHTTP3Server struct {
+	tlsConfig *tls.Config
+	received  chan string
+	closed    chan struct{}
+	shutdown  bool
+}
+
+func (s *fakeHTTP3Server) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return nil
+			default:
+				return err
+			}
+		}
+		s.received <- string(buf[:n])
+	}
+}
+
+func (s *fakeHTTP3Server) Shutdown(ctx context.Context) error {
+	s.shutdown = true
+	close(s.closed)
+	return nil
+}
+
+func (s *fakeHTTP3Server) Close() error { return s.Shutdown(context.Background()) }
@@ -1,9 +1,11 @@
 package otomatik
 
 import (
+	"context"
 	"log"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -96,10 +98,70 @@ type KeyInfo struct {
 	IsTerminal bool // false for keys that only contain other keys (like directories)
 }
 
-// storeTx stores all the values or none at all.
-func storeTx(s Storage, all []keyValue) error {
+// TransactionalStorage is a Storage that can apply a batch
+// of changes atomically: even if the process crashes or the
+// machine loses power, either all of the changes are made or
+// none of them are. This keeps related keys, such as a
+// certificate and its private key, consistent with each other.
+type TransactionalStorage interface {
+	Storage
+
+	// Commit applies all of ops atomically. If lease is not nil
+	// and the storage supports fencing (see FencedStorage), it
+	// returns ErrLeaseLost without applying anything if lease has
+	// been lost or superseded. Deleting a key that does not exist
+	// is not an error.
+	Commit(lease Lease, ops []StorageOp) error
+}
+
+// WatchableStorage is a Storage that can notify of changes to
+// its keys, so that instances sharing the storage can pick up
+// certificates renewed by another instance within seconds
+// instead of waiting for their next maintenance. Caches only
+// watch storage if their WatchStorage option is set.
+type WatchableStorage interface {
+	Storage
+
+	// Watch returns a channel on which it sends the keys within
+	// prefix (terminal keys, not the prefix itself) that are
+	// stored or deleted, until ctx is done, after which the
+	// channel is closed. Notifications may be delayed, coalesced
+	// or spurious: a key being sent only means it may have changed.
+	Watch(ctx context.Context, prefix string) (<-chan string, error)
+}
+
+// StorageOp is a single change in a storage transaction.
+type StorageOp struct {
+	// The key to change.
+	Key string
+
+	// The value to store at Key.
+	Value []byte
+
+	// If true, Key is deleted and Value is ignored.
+	Delete bool
+}
+
+// storeTx stores all the values or none at all. If lease
+// is not nil and s is a FencedStorage, the values are only
+// stored as long as lease is current. If s is a
+// TransactionalStorage, the values are stored atomically.
+func storeTx(s Storage, lease Lease, all []keyValue) error {
+	if txs, ok := s.(TransactionalStorage); ok {
+		ops := make([]StorageOp, len(all))
+		for i, kv := range all {
+			ops[i] = StorageOp{Key: kv.key, Value: kv.value}
+		}
+		return txs.Commit(lease, ops)
+	}
+	fenced, _ := s.(FencedStorage)
 	for i, kv := range all {
-		err := s.Store(kv.key, kv.value)
+		var err error
+		if lease != nil && fenced != nil {
+			err = fenced.StoreFenced(lease, kv.key, kv.value)
+		} else {
+			err = s.Store(kv.key, kv.value)
+		}
 		if err != nil {
 			for j := i - 1; j >= 0; j-- {
 				s.Delete(all[j].key)
@@ -110,6 +172,53 @@ func storeTx(s Storage, all []keyValue) error {
 	return nil
 }
 
+// listKeys returns the keys within prefix, like Storage.List,
+// given all the terminal keys of a storage whose keys form a
+// hierarchy separated by slashes. Non-terminal keys are
+// included as they are encountered.
+func listKeys(all []string, prefix string, recursive bool) []string {
+	found := make(map[string]struct{})
+	for _, key := range all {
+		rel, ok := keyWithin(prefix, key)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(rel, "/")
+		if !recursive {
+			parts = parts[:1]
+		}
+		for i := range parts {
+			found[path.Join(prefix, strings.Join(parts[:i+1], "/"))] = struct{}{}
+		}
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cleanKey normalizes key, so that equivalent
+// keys are stored in the same place.
+func cleanKey(key string) string {
+	return strings.Trim(path.Clean("/"+key), "/")
+}
+
+// keyWithin returns the part of key below prefix,
+// and true if key is strictly within prefix. The empty
+// prefix contains all keys.
+func keyWithin(prefix, key string) (string, bool) {
+	if prefix == "" {
+		return key, key != ""
+	}
+	if !strings.HasPrefix(key, prefix+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(key, prefix+"/"), true
+}
+
 // keyValue pairs a key and a value.
 type keyValue struct {
 	key   string
@@ -156,6 +265,41 @@ func (keys KeyBuilder) SiteMeta(issuerKey, domain string) string {
 	return path.Join(keys.CertsSitePrefix(issuerKey, domain), safeDomain+".json")
 }
 
+// CertHistoryPrefix returns the key prefix for the prior
+// versions of the certificate for domain that is associated
+// with the issuer with the given issuerKey.
+func (keys KeyBuilder) CertHistoryPrefix(issuerKey, domain string) string {
+	return path.Join(prefixHistory, keys.Safe(issuerKey), keys.Safe(domain))
+}
+
+// CertHistoryVersion returns the key prefix for the
+// prior version of the certificate for domain with
+// the given version ID.
+func (keys KeyBuilder) CertHistoryVersion(issuerKey, domain, versionID string) string {
+	return path.Join(keys.CertHistoryPrefix(issuerKey, domain), keys.Safe(versionID))
+}
+
+// CertHistoryCert returns the path to the certificate file
+// of the prior version of the certificate for domain with
+// the given version ID.
+func (keys KeyBuilder) CertHistoryCert(issuerKey, domain, versionID string) string {
+	return path.Join(keys.CertHistoryVersion(issuerKey, domain, versionID), keys.Safe(domain)+".crt")
+}
+
+// CertHistoryPrivateKey returns the path to the private key
+// file of the prior version of the certificate for domain
+// with the given version ID.
+func (keys KeyBuilder) CertHistoryPrivateKey(issuerKey, domain, versionID string) string {
+	return path.Join(keys.CertHistoryVersion(issuerKey, domain, versionID), keys.Safe(domain)+".key")
+}
+
+// CertHistoryMeta returns the path to the metadata file of
+// the prior version of the certificate for domain with the
+// given version ID.
+func (keys KeyBuilder) CertHistoryMeta(issuerKey, domain, versionID string) string {
+	return path.Join(keys.CertHistoryVersion(issuerKey, domain, versionID), keys.Safe(domain)+".json")
+}
+
 // OCSPStaple returns a key for the OCSP staple associated
 // with the given certificate. If you have the PEM bundle
 // handy, pass that in to save an extra encoding step.
@@ -169,6 +313,24 @@ func (keys KeyBuilder) OCSPStaple(cert *Certificate, pemBundle []byte) string {
 	return path.Join(prefixOCSP, ocspFileName)
 }
 
+// CAPrefix returns the key prefix for the assets of
+// the local certificate authority named caName.
+func (keys KeyBuilder) CAPrefix(caName string) string {
+	return path.Join(prefixCA, keys.Safe(caName))
+}
+
+// CARootCert returns the path to the root certificate
+// of the local certificate authority named caName.
+func (keys KeyBuilder) CARootCert(caName string) string {
+	return path.Join(keys.CAPrefix(caName), "root.crt")
+}
+
+// CARootPrivateKey returns the path to the private key of
+// the root of the local certificate authority named caName.
+func (keys KeyBuilder) CARootPrivateKey(caName string) string {
+	return path.Join(keys.CAPrefix(caName), "root.key")
+}
+
 // Safe standardizes and sanitizes str for use as
 // a single component of a storage key. This method
 // is idempotent.
@@ -198,32 +360,35 @@ func (keys KeyBuilder) Safe(str string) string {
 func CleanUpOwnLocks() {
 	locksMu.Lock()
 	defer locksMu.Unlock()
-	for lockKey, storage := range locks {
-		err := storage.Unlock(lockKey)
+	for lockKey, lease := range locks {
+		err := lease.Release()
 		if err == nil {
 			delete(locks, lockKey)
 		} else {
-			log.Printf("[ERROR] Unable to clean up lock: %v (lock=%s storage=%s)",
-				err, lockKey, storage)
+			log.Printf("[ERROR] Unable to clean up lock: %v (lock=%s token=%d)",
+				err, lockKey, lease.Token())
 		}
 	}
 }
 
-func obtainLock(storage Storage, lockKey string) error {
-	err := storage.Lock(lockKey)
+// obtainLock acquires a lease on the lock for lockKey in storage,
+// adapting storage's Locker if it is not also a LeaseLocker. It
+// gives up when ctx is done.
+func obtainLock(ctx context.Context, storage Storage, lockKey string) (Lease, error) {
+	lease, err := NewLeaseLocker(storage).LockLease(ctx, lockKey, DefaultLockTTL)
 	if err == nil {
 		locksMu.Lock()
-		locks[lockKey] = storage
+		locks[lockKey] = lease
 		locksMu.Unlock()
 	}
-	return err
+	return lease, err
 }
 
-func releaseLock(storage Storage, lockKey string) error {
-	err := storage.Unlock(lockKey)
+func releaseLock(lease Lease) error {
+	err := lease.Release()
 	if err == nil {
 		locksMu.Lock()
-		delete(locks, lockKey)
+		delete(locks, lease.Key())
 		locksMu.Unlock()
 	}
 	return err
@@ -231,7 +396,7 @@ func releaseLock(storage Storage, lockKey string) error {
 
 // locks stores a reference to all the current
 // locks obtained by this process.
-var locks = make(map[string]Storage)
+var locks = make(map[string]Lease)
 var locksMu sync.Mutex
 
 // StorageKeys provides methods for accessing
@@ -243,8 +408,12 @@ var locksMu sync.Mutex
 var StorageKeys KeyBuilder
 
 const (
-	prefixCerts = "certificates"
-	prefixOCSP  = "ocsp"
+	prefixCerts      = "certificates"
+	prefixOCSP       = "ocsp"
+	prefixHistory    = "history"
+	prefixQuarantine = "quarantine"
+	prefixTenants    = "tenants"
+	prefixCA         = "ca"
 )
 
 // safeKeyRE matches any undesirable characters in storage keys.
@@ -1,8 +1,14 @@
 package otomatik
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestPrefixAndKeyBuilders(t *testing.T) {
@@ -61,4 +67,222 @@ func TestPrefixAndKeyBuilders(t *testing.T) {
 			t.Errorf("Test %d: site meta file: Expected '%s' but got '%s'", i, testcase.metaFile, actual)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestFileStorageCommit(t *testing.T) {
+	fs := &FileStorage{Path: "./_testdata_tmp"}
+	defer os.RemoveAll(fs.Path)
+
+	if err := fs.Store("old", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	err := fs.Commit(nil, []StorageOp{
+		{Key: "site/cert", Value: []byte("cert")},
+		{Key: "site/key", Value: []byte("key")},
+		{Key: "old", Delete: true},
+		{Key: "never-existed", Delete: true},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error committing, got: %v", err)
+	}
+	for key, expect := range map[string]string{"site/cert": "cert", "site/key": "key"} {
+		if value, err := fs.Load(key); err != nil || string(value) != expect {
+			t.Errorf("Expected '%s' at %s, got '%s' (error: %v)", expect, key, value, err)
+		}
+	}
+	if fs.Exists("old") {
+		t.Errorf("Expected deleted key to be gone")
+	}
+	if dirs, _ := ioutil.ReadDir(fs.txDir()); len(dirs) != 0 {
+		t.Errorf("Expected staging directory to be cleaned up, got %d entries", len(dirs))
+	}
+
+	// transactions under a superseded lease are rejected entirely
+	lease1, err := fs.LockLease(context.Background(), "site", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease1.Release()
+	lease2, err := fs.LockLease(context.Background(), "site", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease2.Release()
+	err = fs.Commit(lease1, []StorageOp{
+		{Key: "site/cert", Value: []byte("stale cert")},
+		{Key: "site/key", Value: []byte("stale key")},
+	})
+	if err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost committing with old lease, got: %v", err)
+	}
+	if value, _ := fs.Load("site/cert"); string(value) != "cert" {
+		t.Errorf("Expected stale transaction to be rejected, but value is '%s'", value)
+	}
+}
+
+func TestFileStorageRecoverTransactions(t *testing.T) {
+	fs := &FileStorage{Path: "./_testdata_tmp"}
+	defer os.RemoveAll(fs.Path)
+
+	if err := fs.Store("site/meta", []byte("old meta")); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash after committing a transaction but
+	// before all of its changes were applied
+	committed := filepath.Join(fs.txDir(), "tx-committed")
+	if err := os.MkdirAll(committed, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileSync(filepath.Join(committed, "1"), []byte("new key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Store("site/cert", []byte("new cert")); err != nil { // already applied
+		t.Fatal(err)
+	}
+	err := writeTxJournal(committed, []txJournalEntry{
+		{Key: "site/cert"},
+		{Key: "site/key"},
+		{Key: "site/meta", Delete: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and a transaction abandoned before it was committed
+	abandoned := filepath.Join(fs.txDir(), "tx-abandoned")
+	if err := os.MkdirAll(abandoned, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileSync(filepath.Join(abandoned, "0"), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleTxAge)
+	if err := os.Chtimes(abandoned, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// recovery happens when the storage is next opened
+	txRecovered.Delete(fs.Path)
+
+	if value, err := fs.Load("site/key"); err != nil || string(value) != "new key" {
+		t.Errorf("Expected interrupted transaction to be completed, got '%s' (error: %v)", value, err)
+	}
+	if value, _ := fs.Load("site/cert"); string(value) != "new cert" {
+		t.Errorf("Expected applied change to be kept, got '%s'", value)
+	}
+	if fs.Exists("site/meta") {
+		t.Errorf("Expected deletion in interrupted transaction to be completed")
+	}
+	if dirs, _ := ioutil.ReadDir(fs.txDir()); len(dirs) != 0 {
+		t.Errorf("Expected recovered and abandoned transactions to be cleaned up, got %d entries", len(dirs))
+	}
+}
+
+func TestFileStorageRetryRecoverTransactions(t *testing.T) {
+	fs := &FileStorage{Path: "./_testdata_tmp"}
+	defer os.RemoveAll(fs.Path)
+
+	// a file where a directory should be makes applying fail
+	if err := fs.Store("blocked", []byte("in the way")); err != nil {
+		t.Fatal(err)
+	}
+	committed := filepath.Join(fs.txDir(), "tx-committed")
+	if err := os.MkdirAll(committed, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileSync(filepath.Join(committed, "0"), []byte("value"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTxJournal(committed, []txJournalEntry{{Key: "blocked/key"}}); err != nil {
+		t.Fatal(err)
+	}
+	txRecovered.Delete(fs.Path)
+
+	keys, err := fs.List("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if key == "transactions" || strings.HasPrefix(key, "transactions/") {
+			t.Errorf("Expected staged transactions not to be listed, got %s", key)
+		}
+	}
+	if value, _ := fs.Load("blocked/key"); value != nil {
+		t.Fatalf("Expected transaction to fail to apply")
+	}
+
+	// once the obstacle is gone, recovery is tried again
+	if err := os.Remove(fs.Filename("blocked")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := fs.Load("blocked/key"); err != nil || string(value) != "value" {
+		t.Errorf("Expected transaction to be completed on retry, got '%s' (error: %v)", value, err)
+	}
+	if _, ok := txRecovered.Load(fs.Path); !ok {
+		t.Errorf("Expected storage to be marked recovered after retry")
+	}
+}
+
+func TestFileStorageWatch(t *testing.T) {
+	fs := &FileStorage{Path: "./_testdata_tmp", WatchInterval: 10 * time.Millisecond}
+	defer os.RemoveAll(fs.Path)
+
+	if err := fs.Store("certificates/ca/example.com/example.com.crt", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err := fs.Watch(ctx, "certificates")
+	if err != nil {
+		t.Fatalf("Expected no error watching, got: %v", err)
+	}
+
+	// neither locks nor keys outside the prefix are changes
+	lease, err := fs.LockLease(ctx, "example.com", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release()
+	if err := fs.Store("acme/ca/users/me/me.json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Store("certificates/ca/example.com/example.com.crt", []byte("renewed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Store("certificates/ca/example.net/example.net.crt", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(received) < 2 {
+		select {
+		case key := <-changes:
+			received[key] = true
+		case <-timeout:
+			t.Fatalf("Timed out waiting for changes; got %v", received)
+		}
+	}
+	for _, key := range []string{"certificates/ca/example.com/example.com.crt", "certificates/ca/example.net/example.net.crt"} {
+		if !received[key] {
+			t.Errorf("Expected change to %s, got %v", key, received)
+		}
+	}
+
+	if err := fs.Delete("certificates/ca/example.net/example.net.crt"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case key := <-changes:
+		if key != "certificates/ca/example.net/example.net.crt" {
+			t.Errorf("Expected deleted key to be sent, got %s", key)
+		}
+	case <-timeout:
+		t.Fatal("Timed out waiting for deletion")
+	}
+
+	cancel()
+	for range changes {
+	}
+}
@@ -0,0 +1,564 @@
+package otomatik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The storage wrappers in this file add behavior to another
+// Storage, and can be stacked; for example, a remote storage
+// may be wrapped with retries, then instrumented, then cached:
+//
+//     storage := &CachingStorage{
+//         Storage: &InstrumentedStorage{
+//             Storage: &RetryingStorage{Storage: remote},
+//         },
+//     }
+//
+// Wrappers pass transactions, lease locks, fenced writes and
+// watches through to the storage they wrap. If it does not
+// support them, transactions are applied one change at a time,
+// fenced writes only check whether the lease is lost, locks are
+// adapted with NewLeaseLocker, and watching fails.
+
+// CachingStorage is a Storage that caches the values it loads
+// from the storage it wraps, including the absence of values,
+// so that certificates, keys and OCSP staples are not loaded
+// from a remote storage on every use. Cached values are
+// invalidated when they are stored or deleted through the
+// CachingStorage, when the wrapped storage being watched
+// reports that they changed, and after TTL.
+//
+// Changes made to the wrapped storage by other instances are
+// not seen until the cached values expire, unless the cache is
+// watching the wrapped storage (which a certificate Cache does
+// for the storage of the certificates it manages).
+type CachingStorage struct {
+	Storage
+
+	// How long loaded values are cached;
+	// defaults to 1 minute.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedLoad
+	version uint64 // incremented on every invalidation
+}
+
+type cachedLoad struct {
+	value   []byte
+	err     error
+	expires time.Time
+}
+
+// Load returns the value at key, loading it from the
+// wrapped storage only if it is not cached.
+func (s *CachingStorage) Load(key string) ([]byte, error) {
+	key = cleanKey(key)
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(s.entries, key)
+		ok = false
+	}
+	version := s.version
+	s.mu.Unlock()
+	if ok {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return append([]byte(nil), entry.value...), nil
+	}
+
+	value, err := s.Storage.Load(key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err // do not cache errors that may be transient
+	}
+
+	s.mu.Lock()
+	// if anything was invalidated while loading, the
+	// loaded value may already be outdated
+	if s.version == version {
+		if s.entries == nil {
+			s.entries = make(map[string]cachedLoad)
+		}
+		s.entries[key] = cachedLoad{
+			value:   append([]byte(nil), value...),
+			err:     err,
+			expires: time.Now().Add(s.ttl()),
+		}
+	}
+	s.mu.Unlock()
+	return value, err
+}
+
+// Store saves value at key and invalidates its cached value.
+func (s *CachingStorage) Store(key string, value []byte) error {
+	defer s.invalidate(key)
+	return s.Storage.Store(key, value)
+}
+
+// Delete deletes key and invalidates the cached
+// values of it and the keys it contains.
+func (s *CachingStorage) Delete(key string) error {
+	defer s.invalidate(key)
+	return s.Storage.Delete(key)
+}
+
+// Commit applies ops to the wrapped storage and
+// invalidates the cached values of the keys changed.
+func (s *CachingStorage) Commit(lease Lease, ops []StorageOp) error {
+	defer func() {
+		for _, op := range ops {
+			s.invalidate(op.Key)
+		}
+	}()
+	return commitOps(s.Storage, lease, ops)
+}
+
+// StoreFenced saves value at key as long as lease is
+// current, and invalidates the cached value of key.
+func (s *CachingStorage) StoreFenced(lease Lease, key string, value []byte) error {
+	defer s.invalidate(key)
+	return storeFenced(s.Storage, lease, key, value)
+}
+
+// LockLease obtains a lease on the lock for key
+// from the wrapped storage.
+func (s *CachingStorage) LockLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	return NewLeaseLocker(s.Storage).LockLease(ctx, key, ttl)
+}
+
+// Watch watches the wrapped storage, invalidating the
+// cached values of the keys that change before they
+// are sent on the returned channel.
+func (s *CachingStorage) Watch(ctx context.Context, prefix string) (<-chan string, error) {
+	upstream, err := watchWrapped(ctx, s.Storage, prefix)
+	if err != nil {
+		return nil, err
+	}
+	changes := make(chan string)
+	go func() {
+		defer close(changes)
+		for key := range upstream {
+			s.invalidate(key)
+			select {
+			case changes <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func (s *CachingStorage) String() string {
+	return fmt.Sprint(s.Storage)
+}
+
+// invalidate removes the cached values of key
+// and of all the keys within it.
+func (s *CachingStorage) invalidate(key string) {
+	key = cleanKey(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	delete(s.entries, key)
+	for k := range s.entries {
+		if _, ok := keyWithin(key, k); ok {
+			delete(s.entries, k)
+		}
+	}
+}
+
+func (s *CachingStorage) ttl() time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return time.Minute
+}
+
+// InstrumentedStorage is a Storage that measures the latency
+// and errors of the operations on the storage it wraps. A
+// key not existing is not counted as an error.
+type InstrumentedStorage struct {
+	Storage
+
+	// If set, OnOperation is called after every operation
+	// with the name of the method called (such as "Load"),
+	// its key or prefix, how long it took, and its error.
+	OnOperation func(op, key string, took time.Duration, err error)
+
+	mu    sync.Mutex
+	stats map[string]StorageOpStats
+}
+
+// StorageOpStats are the statistics of
+// one kind of storage operation.
+type StorageOpStats struct {
+	Count        int
+	Errors       int
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+// Stats returns the statistics of the operations
+// performed so far, keyed by method name.
+func (s *InstrumentedStorage) Stats() map[string]StorageOpStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[string]StorageOpStats, len(s.stats))
+	for op, opStats := range s.stats {
+		stats[op] = opStats
+	}
+	return stats
+}
+
+// Store saves value at key.
+func (s *InstrumentedStorage) Store(key string, value []byte) error {
+	start := time.Now()
+	err := s.Storage.Store(key, value)
+	s.observe("Store", key, start, err)
+	return err
+}
+
+// Load retrieves the value at key.
+func (s *InstrumentedStorage) Load(key string) ([]byte, error) {
+	start := time.Now()
+	value, err := s.Storage.Load(key)
+	s.observe("Load", key, start, err)
+	return value, err
+}
+
+// Delete deletes key.
+func (s *InstrumentedStorage) Delete(key string) error {
+	start := time.Now()
+	err := s.Storage.Delete(key)
+	s.observe("Delete", key, start, err)
+	return err
+}
+
+// Exists returns true if key exists.
+func (s *InstrumentedStorage) Exists(key string) bool {
+	start := time.Now()
+	exists := s.Storage.Exists(key)
+	s.observe("Exists", key, start, nil)
+	return exists
+}
+
+// List returns all keys that match prefix.
+func (s *InstrumentedStorage) List(prefix string, recursive bool) ([]string, error) {
+	start := time.Now()
+	keys, err := s.Storage.List(prefix, recursive)
+	s.observe("List", prefix, start, err)
+	return keys, err
+}
+
+// Stat returns information about key.
+func (s *InstrumentedStorage) Stat(key string) (KeyInfo, error) {
+	start := time.Now()
+	info, err := s.Storage.Stat(key)
+	s.observe("Stat", key, start, err)
+	return info, err
+}
+
+// Lock obtains the lock for key.
+func (s *InstrumentedStorage) Lock(key string) error {
+	start := time.Now()
+	err := s.Storage.Lock(key)
+	s.observe("Lock", key, start, err)
+	return err
+}
+
+// Unlock releases the lock for key.
+func (s *InstrumentedStorage) Unlock(key string) error {
+	start := time.Now()
+	err := s.Storage.Unlock(key)
+	s.observe("Unlock", key, start, err)
+	return err
+}
+
+// Commit applies ops to the wrapped storage.
+// The key observed is the first one changed.
+func (s *InstrumentedStorage) Commit(lease Lease, ops []StorageOp) error {
+	start := time.Now()
+	err := commitOps(s.Storage, lease, ops)
+	var key string
+	if len(ops) > 0 {
+		key = ops[0].Key
+	}
+	s.observe("Commit", key, start, err)
+	return err
+}
+
+// StoreFenced saves value at key as long as lease is current.
+func (s *InstrumentedStorage) StoreFenced(lease Lease, key string, value []byte) error {
+	start := time.Now()
+	err := storeFenced(s.Storage, lease, key, value)
+	s.observe("StoreFenced", key, start, err)
+	return err
+}
+
+// LockLease obtains a lease on the lock for key
+// from the wrapped storage.
+func (s *InstrumentedStorage) LockLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	start := time.Now()
+	lease, err := NewLeaseLocker(s.Storage).LockLease(ctx, key, ttl)
+	s.observe("LockLease", key, start, err)
+	return lease, err
+}
+
+// Watch watches the wrapped storage.
+func (s *InstrumentedStorage) Watch(ctx context.Context, prefix string) (<-chan string, error) {
+	return watchWrapped(ctx, s.Storage, prefix)
+}
+
+func (s *InstrumentedStorage) String() string {
+	return fmt.Sprint(s.Storage)
+}
+
+// observe records an operation op on key
+// that started at start and returned err.
+func (s *InstrumentedStorage) observe(op, key string, start time.Time, err error) {
+	took := time.Since(start)
+	failed := err != nil && !errors.Is(err, os.ErrNotExist)
+
+	s.mu.Lock()
+	if s.stats == nil {
+		s.stats = make(map[string]StorageOpStats)
+	}
+	stats := s.stats[op]
+	stats.Count++
+	if failed {
+		stats.Errors++
+	}
+	stats.TotalLatency += took
+	if took > stats.MaxLatency {
+		stats.MaxLatency = took
+	}
+	s.stats[op] = stats
+	s.mu.Unlock()
+
+	if s.OnOperation != nil {
+		s.OnOperation(op, key, took, err)
+	}
+}
+
+// RetryingStorage is a Storage that retries operations on the
+// storage it wraps that fail with transient errors, waiting
+// longer after each failed attempt. Locks are not retried,
+// since obtaining them already waits as long as necessary.
+type RetryingStorage struct {
+	Storage
+
+	// How many times to attempt an operation;
+	// defaults to 3.
+	Attempts int
+
+	// How long to wait before the first retry; the wait
+	// doubles after each attempt. Defaults to 250ms.
+	Backoff time.Duration
+
+	// Reports whether an operation that failed with err
+	// should be retried. By default, all errors are
+	// retried except for keys not existing and lost
+	// leases, which will not go away by retrying.
+	Retryable func(err error) bool
+}
+
+// Store saves value at key.
+func (s *RetryingStorage) Store(key string, value []byte) error {
+	return s.retry("Store", key, func() error {
+		return s.Storage.Store(key, value)
+	})
+}
+
+// Load retrieves the value at key.
+func (s *RetryingStorage) Load(key string) ([]byte, error) {
+	var value []byte
+	err := s.retry("Load", key, func() error {
+		var err error
+		value, err = s.Storage.Load(key)
+		return err
+	})
+	return value, err
+}
+
+// Delete deletes key. If a retry finds that key no longer
+// exists, an earlier attempt must have deleted it, so it
+// is not an error.
+func (s *RetryingStorage) Delete(key string) error {
+	var attempted bool
+	return s.retry("Delete", key, func() error {
+		err := s.Storage.Delete(key)
+		if attempted && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		attempted = true
+		return err
+	})
+}
+
+// List returns all keys that match prefix.
+func (s *RetryingStorage) List(prefix string, recursive bool) ([]string, error) {
+	var keys []string
+	err := s.retry("List", prefix, func() error {
+		var err error
+		keys, err = s.Storage.List(prefix, recursive)
+		return err
+	})
+	return keys, err
+}
+
+// Stat returns information about key.
+func (s *RetryingStorage) Stat(key string) (KeyInfo, error) {
+	var info KeyInfo
+	err := s.retry("Stat", key, func() error {
+		var err error
+		info, err = s.Storage.Stat(key)
+		return err
+	})
+	return info, err
+}
+
+// Commit applies ops to the wrapped storage.
+func (s *RetryingStorage) Commit(lease Lease, ops []StorageOp) error {
+	var key string
+	if len(ops) > 0 {
+		key = ops[0].Key
+	}
+	return s.retry("Commit", key, func() error {
+		return commitOps(s.Storage, lease, ops)
+	})
+}
+
+// StoreFenced saves value at key as long as lease is current.
+func (s *RetryingStorage) StoreFenced(lease Lease, key string, value []byte) error {
+	return s.retry("StoreFenced", key, func() error {
+		return storeFenced(s.Storage, lease, key, value)
+	})
+}
+
+// LockLease obtains a lease on the lock for key
+// from the wrapped storage.
+func (s *RetryingStorage) LockLease(ctx context.Context, key string, ttl time.Duration) (Lease, error) {
+	return NewLeaseLocker(s.Storage).LockLease(ctx, key, ttl)
+}
+
+// Watch watches the wrapped storage.
+func (s *RetryingStorage) Watch(ctx context.Context, prefix string) (<-chan string, error) {
+	return watchWrapped(ctx, s.Storage, prefix)
+}
+
+func (s *RetryingStorage) String() string {
+	return fmt.Sprint(s.Storage)
+}
+
+// retry calls do until it succeeds, fails with an error
+// that is not retryable, or has been attempted enough.
+func (s *RetryingStorage) retry(op, key string, do func() error) error {
+	attempts := s.Attempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	backoff := s.Backoff
+	if backoff <= 0 {
+		backoff = 250 * time.Millisecond
+	}
+	retryable := s.Retryable
+	if retryable == nil {
+		retryable = func(err error) bool {
+			return !errors.Is(err, os.ErrNotExist) && err != ErrLeaseLost
+		}
+	}
+
+	var err error
+	for i := 1; i <= attempts; i++ {
+		err = do()
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if i < attempts {
+			log.Printf("[WARNING][%s] %s %s (attempt %d/%d): %v - retrying in %s",
+				s, op, key, i, attempts, err, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// commitOps applies ops to s atomically if s is a
+// TransactionalStorage, otherwise one at a time.
+func commitOps(s Storage, lease Lease, ops []StorageOp) error {
+	if txs, ok := s.(TransactionalStorage); ok {
+		return txs.Commit(lease, ops)
+	}
+	for _, op := range ops {
+		var err error
+		switch {
+		case op.Delete:
+			err = s.Delete(op.Key)
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		case lease != nil:
+			err = storeFenced(s, lease, op.Key, op.Value)
+		default:
+			err = s.Store(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeFenced stores value at key in s as long as lease is
+// current, which is only checked thoroughly if s is a
+// FencedStorage.
+func storeFenced(s Storage, lease Lease, key string, value []byte) error {
+	if fs, ok := s.(FencedStorage); ok {
+		return fs.StoreFenced(lease, key, value)
+	}
+	if leaseIsLost(lease) {
+		return ErrLeaseLost
+	}
+	return s.Store(key, value)
+}
+
+// watchWrapped watches prefix in s, if s is a WatchableStorage.
+func watchWrapped(ctx context.Context, s Storage, prefix string) (<-chan string, error) {
+	ws, ok := s.(WatchableStorage)
+	if !ok {
+		return nil, errStorageNotWatchable
+	}
+	return ws.Watch(ctx, prefix)
+}
+
+// errStorageNotWatchable is returned when watching a
+// wrapper whose wrapped storage cannot be watched.
+var errStorageNotWatchable = errors.New("storage cannot be watched")
+
+// Interface guards
+var (
+	_ TransactionalStorage = (*CachingStorage)(nil)
+	_ LeaseLocker          = (*CachingStorage)(nil)
+	_ FencedStorage        = (*CachingStorage)(nil)
+	_ WatchableStorage     = (*CachingStorage)(nil)
+
+	_ TransactionalStorage = (*InstrumentedStorage)(nil)
+	_ LeaseLocker          = (*InstrumentedStorage)(nil)
+	_ FencedStorage        = (*InstrumentedStorage)(nil)
+	_ WatchableStorage     = (*InstrumentedStorage)(nil)
+
+	_ TransactionalStorage = (*RetryingStorage)(nil)
+	_ LeaseLocker          = (*RetryingStorage)(nil)
+	_ FencedStorage        = (*RetryingStorage)(nil)
+	_ WatchableStorage     = (*RetryingStorage)(nil)
+)
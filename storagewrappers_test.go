@@ -0,0 +1,194 @@
+package otomatik
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCachingStorage(t *testing.T) {
+	backend := &InstrumentedStorage{Storage: new(MemoryStorage)}
+	s := &CachingStorage{Storage: backend, TTL: time.Hour}
+
+	loads := func() int { return backend.Stats()["Load"].Count }
+
+	if err := s.Store("site/cert", []byte("cert")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if value, err := s.Load("site/cert"); err != nil || string(value) != "cert" {
+			t.Fatalf("Expected to load stored value, got '%s' (error: %v)", value, err)
+		}
+	}
+	if loads() != 1 {
+		t.Errorf("Expected 1 load from backend, got %d", loads())
+	}
+
+	// values that do not exist are cached as such
+	for i := 0; i < 2; i++ {
+		if _, err := s.Load("site/ocsp"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Expected not-exist error, got: %v", err)
+		}
+	}
+	if loads() != 2 {
+		t.Errorf("Expected 2 loads from backend, got %d", loads())
+	}
+
+	// changes through the cache invalidate it
+	if err := s.Store("site/ocsp", []byte("staple")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := s.Load("site/ocsp"); err != nil || string(value) != "staple" {
+		t.Errorf("Expected stored value after invalidation, got '%s' (error: %v)", value, err)
+	}
+	err := s.Commit(nil, []StorageOp{{Key: "site/cert", Value: []byte("renewed")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := s.Load("site/cert"); string(value) != "renewed" {
+		t.Errorf("Expected committed value, got '%s'", value)
+	}
+	if err := s.Delete("site"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load("site/cert"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected deleted value to be gone, got: %v", err)
+	}
+
+	// cached values expire
+	s.TTL = time.Millisecond
+	s.Store("foo", []byte("bar"))
+	s.Load("foo")
+	before := loads()
+	time.Sleep(5 * time.Millisecond)
+	s.Load("foo")
+	if loads() != before+1 {
+		t.Errorf("Expected expired value to be loaded again")
+	}
+}
+
+func TestCachingStorageWatch(t *testing.T) {
+	backend := new(MemoryStorage)
+	s := &CachingStorage{Storage: backend, TTL: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := s.Watch(ctx, "certificates")
+	if err != nil {
+		t.Fatalf("Expected no error watching, got: %v", err)
+	}
+
+	backend.Store("certificates/ca/example.com/example.com.crt", []byte("old"))
+	<-changes
+	s.Load("certificates/ca/example.com/example.com.crt")
+
+	// changed by another instance directly in the backend
+	backend.Store("certificates/ca/example.com/example.com.crt", []byte("new"))
+	<-changes
+	if value, _ := s.Load("certificates/ca/example.com/example.com.crt"); string(value) != "new" {
+		t.Errorf("Expected watched change to invalidate cache, got '%s'", value)
+	}
+
+	if _, err := (&CachingStorage{Storage: &KubernetesStorage{}}).Watch(ctx, ""); err != errStorageNotWatchable {
+		t.Errorf("Expected error watching storage that cannot be watched, got: %v", err)
+	}
+}
+
+func TestInstrumentedStorage(t *testing.T) {
+	var observed []string
+	s := &InstrumentedStorage{
+		Storage: new(MemoryStorage),
+		OnOperation: func(op, key string, took time.Duration, err error) {
+			observed = append(observed, op+" "+key)
+		},
+	}
+
+	s.Store("foo", []byte("bar"))
+	s.Load("foo")
+	s.Load("nope")
+	s.Delete("nope")
+	lease, err := s.LockLease(context.Background(), "foo", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreFenced(lease, "foo", []byte("baz")); err != nil {
+		t.Errorf("Expected no error storing with lease, got: %v", err)
+	}
+	lease.Release()
+
+	stats := s.Stats()
+	if stats["Load"].Count != 2 || stats["Load"].Errors != 0 {
+		t.Errorf("Expected 2 loads without errors (not existing is not an error), got %+v", stats["Load"])
+	}
+	if stats["Delete"].Count != 1 || stats["Store"].Count != 1 || stats["LockLease"].Count != 1 || stats["StoreFenced"].Count != 1 {
+		t.Errorf("Expected every operation to be counted, got %+v", stats)
+	}
+	if len(observed) != 6 || observed[0] != "Store foo" {
+		t.Errorf("Expected every operation to be observed, got %v", observed)
+	}
+}
+
+func TestRetryingStorage(t *testing.T) {
+	flaky := &flakyStorage{MemoryStorage: new(MemoryStorage), failures: 2}
+	s := &RetryingStorage{Storage: flaky, Backoff: time.Millisecond}
+
+	if err := s.Store("foo", []byte("bar")); err != nil {
+		t.Fatalf("Expected store to succeed on third attempt, got: %v", err)
+	}
+	if flaky.calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", flaky.calls)
+	}
+
+	flaky.calls, flaky.failures = 0, 5
+	if err := s.Store("foo", []byte("bar")); err != errFlaky {
+		t.Errorf("Expected error after all attempts failed, got: %v", err)
+	}
+	if flaky.calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", flaky.calls)
+	}
+
+	// keys not existing are not transient
+	flaky.calls, flaky.failures = 0, 0
+	if _, err := s.Load("nope"); !errors.Is(err, os.ErrNotExist) || flaky.calls != 1 {
+		t.Errorf("Expected not-exist error without retrying, got %v after %d attempts", err, flaky.calls)
+	}
+
+	// transactions pass through to transactional storage
+	err := s.Commit(nil, []StorageOp{{Key: "a", Value: []byte("a")}, {Key: "foo", Delete: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !flaky.Exists("a") || flaky.Exists("foo") {
+		t.Errorf("Expected commit to be applied")
+	}
+}
+
+// flakyStorage is a storage whose Store and Load
+// fail the next few times they are called.
+type flakyStorage struct {
+	*MemoryStorage
+	failures int
+	calls    int
+}
+
+var errFlaky = errors.New("flaky")
+
+func (s *flakyStorage) Store(key string, value []byte) error {
+	s.calls++
+	if s.failures > 0 {
+		s.failures--
+		return errFlaky
+	}
+	return s.MemoryStorage.Store(key, value)
+}
+
+func (s *flakyStorage) Load(key string) ([]byte, error) {
+	s.calls++
+	if s.failures > 0 {
+		s.failures--
+		return nil, errFlaky
+	}
+	return s.MemoryStorage.Load(key)
+}
@@ -194,7 +194,7 @@ func (manager *ACMEManager) saveUser(ca string, user *user) error {
 			value: keyBytes,
 		},
 	}
-	return storeTx(manager.config.Storage, all)
+	return storeTx(manager.config.Storage, nil, all)
 }
 
 // promptUserAgreement simply outputs the standard user
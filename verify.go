@@ -0,0 +1,287 @@
+package otomatik
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// VerifyStorageOptions specifies how to verify the
+// certificates in a storage unit.
+type VerifyStorageOptions struct {
+	// If true, corrupt entries are moved out of the way,
+	// under the "quarantine" prefix, so that they are no
+	// longer loaded or renewed.
+	Quarantine bool
+
+	// If set, the certificates of quarantined entries
+	// are obtained again using this config. Entries
+	// stored for a different issuer are not re-obtained.
+	Reobtain *Config
+
+	// If set, certificate chains must verify up to one
+	// of these roots; otherwise, each certificate in a
+	// chain only needs to be signed by the next one.
+	Roots *x509.CertPool
+}
+
+// StorageProblem describes a corrupt certificate
+// entry found by VerifyStorage.
+type StorageProblem struct {
+	// The key prefix of the entry's site.
+	SiteKey string
+
+	// The name the certificate is for, if known.
+	Name string
+
+	// What is wrong with the entry.
+	Err error
+
+	// Whether the entry was quarantined and, if so,
+	// whether its certificate was obtained again.
+	Quarantined bool
+	Reobtained  bool
+}
+
+func (p StorageProblem) Error() string {
+	return fmt.Sprintf("%s: %v", p.SiteKey, p.Err)
+}
+
+// VerifyStorage checks every certificate entry under the
+// certificates prefix of storage: the certificate, private
+// key and metadata must all be present and decode, the key
+// must match the certificate, and the certificate chain must
+// verify. Corrupt entries, for example ones half-written when
+// the machine lost power, are returned and logged, and are
+// handled according to opts.
+//
+// Entries modified within the last minute are reported but
+// never quarantined, since they may still be being written;
+// still, it is best to run this when certificates are not
+// being obtained or renewed, such as at startup. It can also
+// be run periodically as part of CleanStorage.
+func VerifyStorage(ctx context.Context, storage Storage, opts VerifyStorageOptions) ([]StorageProblem, error) {
+	issuerKeys, err := storage.List(prefixCerts, false)
+	if err != nil {
+		// maybe just hasn't been created yet; no big deal
+		return nil, nil
+	}
+
+	var problems []StorageProblem
+	for _, issuerKey := range issuerKeys {
+		siteKeys, err := storage.List(issuerKey, false)
+		if err != nil {
+			log.Printf("[ERROR] Listing contents of %s: %v", issuerKey, err)
+			continue
+		}
+
+		for _, siteKey := range siteKeys {
+			if err := ctx.Err(); err != nil {
+				return problems, err
+			}
+
+			name, err := verifySite(storage, siteKey, opts.Roots)
+			if err == nil {
+				continue
+			}
+			problem := StorageProblem{SiteKey: siteKey, Name: name, Err: err}
+			log.Printf("[ERROR] Corrupt certificate entry %s: %v", siteKey, err)
+
+			if opts.Quarantine && !siteRecentlyModified(storage, siteKey) {
+				problem.Quarantined, problem.Reobtained = quarantineSite(ctx, storage, siteKey, name, opts.Reobtain)
+			}
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems, nil
+}
+
+// verifySite checks the certificate entry at siteKey. It returns
+// the name the certificate is for, if known, and what is wrong
+// with the entry, if anything.
+func verifySite(storage Storage, siteKey string, roots *x509.CertPool) (string, error) {
+	base := path.Join(siteKey, path.Base(siteKey))
+	name := nameFromSafeKey(path.Base(siteKey))
+
+	metaBytes, err := storage.Load(base + ".json")
+	if err != nil {
+		return name, fmt.Errorf("loading metadata: %v", err)
+	}
+	var certRes CertificateResource
+	if err := json.Unmarshal(metaBytes, &certRes); err != nil {
+		return name, fmt.Errorf("decoding metadata: %v", err)
+	}
+	if len(certRes.SANs) == 1 {
+		name = certRes.SANs[0]
+	}
+
+	certPEM, err := storage.Load(base + ".crt")
+	if err != nil {
+		return name, fmt.Errorf("loading certificate: %v", err)
+	}
+	chain, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil {
+		return name, fmt.Errorf("decoding certificate: %v", err)
+	}
+
+	keyPEM, err := storage.Load(base + ".key")
+	if err != nil {
+		return name, fmt.Errorf("loading private key: %v", err)
+	}
+	if _, err := decodePrivateKey(keyPEM); err != nil {
+		return name, fmt.Errorf("decoding private key: %v", err)
+	}
+	if _, err := x509KeyPair(certPEM, keyPEM); err != nil {
+		return name, fmt.Errorf("private key does not match certificate: %v", err)
+	}
+
+	if err := verifyChain(chain, roots); err != nil {
+		return name, fmt.Errorf("verifying certificate chain: %v", err)
+	}
+
+	return name, nil
+}
+
+// verifyChain checks that each certificate in chain is signed by
+// the next one and, if roots is not nil, that the chain verifies
+// up to one of roots. Expiration is not considered.
+func verifyChain(chain []*x509.Certificate, roots *x509.CertPool) error {
+	for i := 0; i < len(chain)-1; i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return fmt.Errorf("certificate %d is not signed by the next one: %v", i, err)
+		}
+	}
+	if roots == nil {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   chain[0].NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// quarantineSite moves all the assets at siteKey under the
+// quarantine prefix, then, if reobtain is not nil, obtains the
+// certificate for name again. It returns whether each step
+// succeeded; errors are logged.
+func quarantineSite(ctx context.Context, storage Storage, siteKey, name string, reobtain *Config) (bool, bool) {
+	assets, err := storage.List(siteKey, false)
+	if err != nil {
+		log.Printf("[ERROR] Quarantining %s: listing assets: %v", siteKey, err)
+		return false, false
+	}
+
+	dest := path.Join(prefixQuarantine,
+		strings.TrimPrefix(siteKey, prefixCerts+"/"),
+		time.Now().UTC().Format(certVersionIDFormat))
+	var moved []keyValue
+	for _, asset := range assets {
+		value, err := storage.Load(asset)
+		if err != nil {
+			continue // missing or not a file
+		}
+		moved = append(moved, keyValue{key: path.Join(dest, path.Base(asset)), value: value})
+	}
+	if err := storeTx(storage, nil, moved); err != nil {
+		log.Printf("[ERROR] Quarantining %s: %v", siteKey, err)
+		return false, false
+	}
+	if txs, ok := storage.(TransactionalStorage); ok {
+		ops := make([]StorageOp, len(assets))
+		for i, asset := range assets {
+			ops[i] = StorageOp{Key: asset, Delete: true}
+		}
+		err = txs.Commit(nil, ops)
+	} else {
+		for _, asset := range assets {
+			if err = storage.Delete(asset); err != nil && storage.Exists(asset) {
+				break
+			}
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Printf("[ERROR] Quarantining %s: copied to %s, but unable to remove: %v", siteKey, dest, err)
+		return false, false
+	}
+	_ = storage.Delete(siteKey)
+	log.Printf("[INFO] Quarantined corrupt certificate entry %s to %s", siteKey, dest)
+
+	if reobtain == nil {
+		return true, false
+	}
+	cfg := reobtain.forIssuerDir(name, path.Base(path.Dir(siteKey)))
+	if cfg == nil {
+		log.Printf("[NOTICE] Not obtaining certificate for %s again: entry %s is for a different issuer", name, siteKey)
+		return true, false
+	}
+	if err := cfg.ObtainCert(ctx, name, false); err != nil {
+		log.Printf("[ERROR] Obtaining certificate for %s again: %v", name, err)
+		return true, false
+	}
+
+	// the new certificate has a new key, so a remote key of
+	// the quarantined one is no longer needed
+	for _, kv := range moved {
+		if strings.HasSuffix(kv.key, ".key") {
+			cfg.deleteUnusedRemoteKey(name, kv.value)
+		}
+	}
+	return true, true
+}
+
+// forIssuerDir returns the config that manages the certificate
+// for name in the issuer directory issuerDir of storage, which
+// may be that of the primary certificate or of one of the
+// additional key types, or nil if cfg does not manage it.
+func (cfg *Config) forIssuerDir(name, issuerDir string) *Config {
+	configs := []*Config{cfg}
+	for _, keyType := range cfg.additionalKeyTypes(name) {
+		configs = append(configs, cfg.forKeyType(keyType))
+	}
+	for _, c := range configs {
+		c = c.forName(name)
+		if issuerDir == StorageKeys.Safe(c.issuerKey()) {
+			return c
+		}
+	}
+	return nil
+}
+
+// siteRecentlyModified returns true if any of the
+// assets at siteKey were modified in the last minute.
+func siteRecentlyModified(storage Storage, siteKey string) bool {
+	assets, err := storage.List(siteKey, false)
+	if err != nil {
+		return false
+	}
+	for _, asset := range assets {
+		info, err := storage.Stat(asset)
+		if err == nil && time.Since(info.Modified) < time.Minute {
+			return true
+		}
+	}
+	return false
+}
+
+// nameFromSafeKey makes a best-effort attempt to
+// reverse KeyBuilder.Safe for a domain name.
+func nameFromSafeKey(safe string) string {
+	if strings.HasPrefix(safe, "wildcard_") {
+		return "*" + strings.TrimPrefix(safe, "wildcard_")
+	}
+	return safe
+}
@@ -0,0 +1,92 @@
+package otomatik
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyStorage(t *testing.T) {
+	storage := &FileStorage{Path: "./_testdata_tmp"}
+	defer os.RemoveAll(storage.Path)
+
+	issuer := &testIssuer{key: "verify"}
+	cfg := &Config{
+		Issuer:    issuer,
+		KeySource: DefaultKeyGenerator,
+		Storage:   storage,
+		certCache: &Cache{cache: make(map[string]Certificate), cacheIndex: make(map[string][]string)},
+	}
+
+	ctx := context.Background()
+	for _, name := range []string{"good.example.com", "mismatch.example.com", "*.example.com"} {
+		if err := cfg.ObtainCert(ctx, name, true); err != nil {
+			t.Fatalf("Expected no error obtaining certificate for %s, got: %v", name, err)
+		}
+	}
+
+	// the key of one entry belongs to another certificate,
+	// and another entry was only partially written
+	goodKey, err := storage.Load(StorageKeys.SitePrivateKey("verify", "good.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(StorageKeys.SitePrivateKey("verify", "mismatch.example.com"), goodKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store(StorageKeys.SiteCert("verify", "*.example.com"), []byte("-----BEGIN CERT")); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries modified recently are never quarantined
+	problems, err := VerifyStorage(ctx, storage, VerifyStorageOptions{Quarantine: true})
+	if err != nil {
+		t.Fatalf("Expected no error verifying storage, got: %v", err)
+	}
+	if len(problems) != 2 || problems[0].Quarantined || problems[1].Quarantined {
+		t.Fatalf("Expected 2 problems reported without quarantine, got %+v", problems)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	filepath.Walk(storage.Path, func(fpath string, info os.FileInfo, err error) error {
+		if err == nil {
+			os.Chtimes(fpath, old, old)
+		}
+		return nil
+	})
+
+	problems, err = VerifyStorage(ctx, storage, VerifyStorageOptions{Quarantine: true, Reobtain: cfg})
+	if err != nil {
+		t.Fatalf("Expected no error verifying storage, got: %v", err)
+	}
+	if len(problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %+v", problems)
+	}
+	found := make(map[string]StorageProblem)
+	for _, p := range problems {
+		found[p.Name] = p
+	}
+	for _, name := range []string{"mismatch.example.com", "*.example.com"} {
+		p, ok := found[name]
+		if !ok {
+			t.Errorf("Expected problem with %s, got %+v", name, problems)
+			continue
+		}
+		if !p.Quarantined || !p.Reobtained {
+			t.Errorf("Expected %s to be quarantined and obtained again, got %+v", name, p)
+		}
+	}
+
+	quarantined, err := storage.List(prefixQuarantine, true)
+	if err != nil || len(quarantined) == 0 {
+		t.Errorf("Expected quarantined entries in storage, got %v (error: %v)", quarantined, err)
+	}
+	if problems, _ := VerifyStorage(ctx, storage, VerifyStorageOptions{}); len(problems) != 0 {
+		t.Errorf("Expected no problems after repair, got %+v", problems)
+	}
+	if len(issuer.issued) != 5 {
+		t.Errorf("Expected 2 certificates to be obtained again, got %d in total", len(issuer.issued))
+	}
+}